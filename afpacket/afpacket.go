@@ -23,6 +23,8 @@ import (
 	"unsafe"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/bpf"
+	"github.com/google/gopacket/layers"
 )
 
 /*
@@ -33,6 +35,8 @@ import (
 #include <arpa/inet.h>  // htons()
 #include <sys/mman.h>  // mmap(), munmap()
 #include <poll.h>  // poll()
+#include <stdlib.h>  // malloc(), free()
+#include <linux/filter.h>  // struct sock_fprog
 */
 import "C"
 
@@ -425,6 +429,46 @@ func (h *TPacket) SetFanout(t FanoutType, id uint16) error {
 	return err
 }
 
+// SetBPF attaches a BPF program to the socket, so the kernel only passes
+// packets accepted by it to the ring.
+func (h *TPacket) SetBPF(prog []bpf.Instruction) error {
+	if err := bpf.Validate(prog); err != nil {
+		return err
+	}
+	// The program is copied to C memory, since the sock_fprog passed to the
+	// kernel must not point to Go memory.
+	size := C.size_t(len(prog)) * C.size_t(unsafe.Sizeof(C.struct_sock_filter{}))
+	filter := (*[bpf.MaxInstructions]C.struct_sock_filter)(C.malloc(size))
+	defer C.free(unsafe.Pointer(filter))
+	for i, ins := range prog {
+		filter[i] = C.struct_sock_filter{
+			code: C.__u16(ins.Code),
+			jt:   C.__u8(ins.Jt),
+			jf:   C.__u8(ins.Jf),
+			k:    C.__u32(ins.K),
+		}
+	}
+	fprog := C.struct_sock_fprog{
+		len:    C.ushort(len(prog)),
+		filter: &filter[0],
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := C.setsockopt(h.fd, C.SOL_SOCKET, C.SO_ATTACH_FILTER, unsafe.Pointer(&fprog), C.socklen_t(unsafe.Sizeof(fprog)))
+	return err
+}
+
+// SetBPFFilter compiles a filter expression in the tcpdump syntax with
+// bpf.Compile and attaches it to the socket.  Packets are assumed to be
+// ethernet frames.
+func (h *TPacket) SetBPFFilter(expr string) error {
+	prog, err := bpf.Compile(expr, layers.LinkTypeEthernet, h.opts.frameSize)
+	if err != nil {
+		return err
+	}
+	return h.SetBPF(prog)
+}
+
 // WritePacketData transmits a raw packet.
 func (h *TPacket) WritePacketData(pkt []byte) error {
 	_, err := C.write(h.fd, unsafe.Pointer(&pkt[0]), C.size_t(len(pkt)))
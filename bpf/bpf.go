@@ -0,0 +1,235 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package bpf provides a pure Go implementation of the classic BSD packet
+// filter virtual machine, so packets can be filtered without cgo or libpcap.
+//
+// Programs are slices of Instruction, which has the same layout as
+// pcap.BPFInstruction and struct bpf_insn, so the output of
+// pcap.Handle.CompileBPFFilter or 'tcpdump -dd' can be used directly:
+//
+//	vm, err := bpf.NewVM([]bpf.Instruction{
+//		{0x28, 0, 0, 0x0000000c},
+//		{0x15, 0, 1, 0x00000800},
+//		{0x6, 0, 0, 0x0000ffff},
+//		{0x6, 0, 0, 0x00000000},
+//	})
+//	if vm.Matches(ci, data) {
+//		...
+//	}
+//
+// Any gopacket.PacketDataSource can be wrapped in a FilteredSource, which
+// only returns packets accepted by a VM.
+//
+// Compile turns filter expressions in the tcpdump syntax into programs,
+// so the same filters can be used everywhere, for example when reading a
+// file with pcapgo:
+//
+//	r, err := pcapgo.NewReader(f)
+//	...
+//	vm, err := bpf.NewVMFromExpression("tcp and dst port 80", r.LinkType(), 0)
+//	...
+//	source := gopacket.NewPacketSource(bpf.NewFilteredSource(r, vm), r.LinkType())
+package bpf
+
+import (
+	"fmt"
+)
+
+// Instruction is a single BPF instruction, laid out exactly like the C
+// struct bpf_insn.
+type Instruction struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+// Instruction classes, the lowest 3 bits of Code.
+const (
+	ClassLd   = 0x00
+	ClassLdx  = 0x01
+	ClassSt   = 0x02
+	ClassStx  = 0x03
+	ClassAlu  = 0x04
+	ClassJmp  = 0x05
+	ClassRet  = 0x06
+	ClassMisc = 0x07
+)
+
+// Load sizes.
+const (
+	SizeW = 0x00
+	SizeH = 0x08
+	SizeB = 0x10
+)
+
+// Load addressing modes.
+const (
+	ModeImm = 0x00
+	ModeAbs = 0x20
+	ModeInd = 0x40
+	ModeMem = 0x60
+	ModeLen = 0x80
+	ModeMsh = 0xa0
+)
+
+// ALU operations.
+const (
+	AluAdd = 0x00
+	AluSub = 0x10
+	AluMul = 0x20
+	AluDiv = 0x30
+	AluOr  = 0x40
+	AluAnd = 0x50
+	AluLsh = 0x60
+	AluRsh = 0x70
+	AluNeg = 0x80
+	AluMod = 0x90
+	AluXor = 0xa0
+)
+
+// Jump operations.
+const (
+	JmpJa   = 0x00
+	JmpJeq  = 0x10
+	JmpJgt  = 0x20
+	JmpJge  = 0x30
+	JmpJset = 0x40
+)
+
+// Operand sources for ALU and jump instructions.
+const (
+	SrcK = 0x00
+	SrcX = 0x08
+)
+
+// Return value sources.
+const (
+	RetK = 0x00
+	RetX = 0x08
+	RetA = 0x10
+)
+
+// Miscellaneous operations.
+const (
+	MiscTax = 0x00
+	MiscTxa = 0x80
+)
+
+// MemWords is the number of words of scratch memory available to a
+// program.
+const MemWords = 16
+
+// MaxInstructions is the maximum length of a program (BPF_MAXINSNS).
+const MaxInstructions = 4096
+
+// Class returns the instruction class.
+func (i Instruction) Class() uint16 { return i.Code & 0x07 }
+
+// Size returns the load size of ld and ldx instructions.
+func (i Instruction) Size() uint16 { return i.Code & 0x18 }
+
+// Mode returns the addressing mode of ld, ldx, st and stx instructions.
+func (i Instruction) Mode() uint16 { return i.Code & 0xe0 }
+
+// Op returns the operation of alu and jmp instructions.
+func (i Instruction) Op() uint16 { return i.Code & 0xf0 }
+
+// Src returns the operand source of alu and jmp instructions.
+func (i Instruction) Src() uint16 { return i.Code & 0x08 }
+
+// RetSrc returns the source of the return value of ret instructions.
+func (i Instruction) RetSrc() uint16 { return i.Code & 0x18 }
+
+// MiscOp returns the operation of misc instructions.
+func (i Instruction) MiscOp() uint16 { return i.Code & 0xf8 }
+
+// Stmt returns a non-jump instruction, like the BPF_STMT C macro.
+func Stmt(code uint16, k uint32) Instruction {
+	return Instruction{Code: code, K: k}
+}
+
+// Jump returns a jump instruction, like the BPF_JUMP C macro.
+func Jump(code uint16, k uint32, jt, jf uint8) Instruction {
+	return Instruction{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+var sizeSuffix = map[uint16]string{SizeW: "", SizeH: "h", SizeB: "b"}
+
+var aluNames = map[uint16]string{
+	AluAdd: "add", AluSub: "sub", AluMul: "mul", AluDiv: "div", AluOr: "or",
+	AluAnd: "and", AluLsh: "lsh", AluRsh: "rsh", AluMod: "mod", AluXor: "xor",
+}
+
+var jmpNames = map[uint16]string{JmpJeq: "jeq", JmpJgt: "jgt", JmpJge: "jge", JmpJset: "jset"}
+
+// String returns the instruction in the syntax used by 'tcpdump -d', with
+// jump targets relative to the next instruction.
+func (i Instruction) String() string {
+	switch i.Class() {
+	case ClassLd, ClassLdx:
+		op := "ld"
+		if i.Class() == ClassLdx {
+			op = "ldx"
+		}
+		switch i.Mode() {
+		case ModeImm:
+			return fmt.Sprintf("%s #%#x", op, i.K)
+		case ModeAbs:
+			return fmt.Sprintf("%s%s [%d]", op, sizeSuffix[i.Size()], i.K)
+		case ModeInd:
+			return fmt.Sprintf("%s%s [x + %d]", op, sizeSuffix[i.Size()], i.K)
+		case ModeMem:
+			return fmt.Sprintf("%s M[%d]", op, i.K)
+		case ModeLen:
+			return fmt.Sprintf("%s #pktlen", op)
+		case ModeMsh:
+			return fmt.Sprintf("%sb 4*([%d]&0xf)", op, i.K)
+		}
+	case ClassSt:
+		return fmt.Sprintf("st M[%d]", i.K)
+	case ClassStx:
+		return fmt.Sprintf("stx M[%d]", i.K)
+	case ClassAlu:
+		if i.Op() == AluNeg {
+			return "neg"
+		}
+		if name, ok := aluNames[i.Op()]; ok {
+			if i.Src() == SrcX {
+				return name + " x"
+			}
+			return fmt.Sprintf("%s #%#x", name, i.K)
+		}
+	case ClassJmp:
+		if i.Op() == JmpJa {
+			return fmt.Sprintf("ja +%d", i.K)
+		}
+		if name, ok := jmpNames[i.Op()]; ok {
+			if i.Src() == SrcX {
+				return fmt.Sprintf("%s x jt +%d jf +%d", name, i.Jt, i.Jf)
+			}
+			return fmt.Sprintf("%s #%#x jt +%d jf +%d", name, i.K, i.Jt, i.Jf)
+		}
+	case ClassRet:
+		switch i.RetSrc() {
+		case RetK:
+			return fmt.Sprintf("ret #%d", i.K)
+		case RetX:
+			return "ret x"
+		case RetA:
+			return "ret a"
+		}
+	case ClassMisc:
+		switch i.MiscOp() {
+		case MiscTax:
+			return "tax"
+		case MiscTxa:
+			return "txa"
+		}
+	}
+	return fmt.Sprintf("unknown %#x %d %d %#x", i.Code, i.Jt, i.Jf, i.K)
+}
@@ -0,0 +1,199 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package bpf
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+)
+
+// DefaultSnapLen is the number of bytes accepted by compiled programs when
+// Compile is given a snaplen <= 0.
+const DefaultSnapLen = 262144
+
+// Compile compiles a filter expression in the pcap-filter(7) language, as
+// used by tcpdump, into a BPF program for packets of the given link type.
+// Matching packets are accepted with up to snaplen bytes.
+//
+// Supported primitives are host, net (with /len or mask), port and
+// portrange with their src/dst and protocol qualifiers, the ether, ip,
+// ip6, arp, rarp, tcp, udp, sctp, icmp, icmp6 and igmp protocols, ether/ip/
+// ip6 proto, broadcast and multicast, vlan, less and greater, and
+// arithmetic relations on packet data such as 'tcp[13] & 2 != 0'.  Host
+// and port names are not resolved, except for the IANA service names
+// known to the layers package.  As in libpcap, proto[x] loads of transport
+// protocols only match IPv4 packets.
+//
+// Supported link types are Ethernet, Linux SLL, Null, Loop and the raw IP
+// link types.
+func Compile(expr string, linkType layers.LinkType, snaplen int) ([]Instruction, error) {
+	link, err := newLinkInfo(linkType)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newParser(expr, link)
+	if err != nil {
+		return nil, err
+	}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	if snaplen <= 0 {
+		snaplen = DefaultSnapLen
+	}
+	prog := generate(root, uint32(snaplen))
+	if len(prog) > MaxInstructions {
+		return nil, fmt.Errorf("filter %q compiles to %d instructions, maximum is %d", expr, len(prog), MaxInstructions)
+	}
+	if err := Validate(prog); err != nil {
+		// This is a bug in the compiler.
+		return nil, fmt.Errorf("filter %q compiled to invalid program: %v", expr, err)
+	}
+	return prog, nil
+}
+
+// NewVMFromExpression compiles expr with Compile and returns a VM running
+// the result.
+func NewVMFromExpression(expr string, linkType layers.LinkType, snaplen int) (*VM, error) {
+	prog, err := Compile(expr, linkType, snaplen)
+	if err != nil {
+		return nil, err
+	}
+	return NewVM(prog)
+}
+
+// node is an element of the boolean expression tree built by the parser.
+type node interface{}
+
+type andNode struct{ a, b node }
+type orNode struct{ a, b node }
+type notNode struct{ a node }
+
+// constNode is a test whose result is known at compile time, like "arp" on
+// a raw IP link.
+type constNode bool
+
+// testNode is a straight-line piece of code computing A (and possibly
+// using X and scratch memory), followed by a conditional jump comparing A
+// to K or X.
+type testNode struct {
+	code []Instruction
+	op   uint16
+	src  uint16
+	k    uint32
+}
+
+func and(nodes ...node) node {
+	var ret node
+	for _, n := range nodes {
+		if ret == nil {
+			ret = n
+		} else {
+			ret = andNode{ret, n}
+		}
+	}
+	return ret
+}
+
+func or(nodes ...node) node {
+	var ret node
+	for _, n := range nodes {
+		if ret == nil {
+			ret = n
+		} else {
+			ret = orNode{ret, n}
+		}
+	}
+	if ret == nil {
+		return constNode(false)
+	}
+	return ret
+}
+
+// test returns a node comparing A, as computed by code, to k.
+func test(op uint16, k uint32, code ...Instruction) node {
+	return testNode{code: code, op: op, src: SrcK, k: k}
+}
+
+func ld(size uint16, off int) Instruction {
+	return Stmt(ClassLd|size|ModeAbs, uint32(off))
+}
+
+// codegen generates a program backwards, so that jump targets are always
+// known when a jump is emitted.  rev[0] is the last instruction of the
+// program, and positions are indexes into rev.
+type codegen struct {
+	rev []Instruction
+}
+
+func generate(root node, snaplen uint32) []Instruction {
+	g := &codegen{}
+	reject := g.emit(Stmt(ClassRet|RetK, 0))
+	accept := g.emit(Stmt(ClassRet|RetK, snaplen))
+	start := accept
+	if root != nil {
+		start = g.gen(root, accept, reject)
+	}
+	if start != len(g.rev)-1 {
+		g.emit(Stmt(ClassJmp|JmpJa, uint32(len(g.rev)-start-1)))
+	}
+	prog := make([]Instruction, len(g.rev))
+	for i, ins := range g.rev {
+		prog[len(prog)-1-i] = ins
+	}
+	return prog
+}
+
+func (g *codegen) emit(ins Instruction) int {
+	g.rev = append(g.rev, ins)
+	return len(g.rev) - 1
+}
+
+// trampoline emits an unconditional jump to t and returns its position.
+// It is used when t is too far away for a conditional jump.
+func (g *codegen) trampoline(t int) int {
+	return g.emit(Stmt(ClassJmp|JmpJa, uint32(len(g.rev)-t-1)))
+}
+
+// gen generates code for n, jumping to t if n is true and f otherwise.
+// It returns the position of the first instruction.
+func (g *codegen) gen(n node, t, f int) int {
+	switch n := n.(type) {
+	case andNode:
+		return g.gen(n.a, g.gen(n.b, t, f), f)
+	case orNode:
+		return g.gen(n.a, t, g.gen(n.b, t, f))
+	case notNode:
+		return g.gen(n.a, f, t)
+	case constNode:
+		if n {
+			return t
+		}
+		return f
+	case testNode:
+		// Inserting a trampoline for one target moves the other one
+		// further away, so loop until both are reachable.
+		for {
+			if len(g.rev)-f-1 > 0xff {
+				f = g.trampoline(f)
+			} else if len(g.rev)-t-1 > 0xff {
+				t = g.trampoline(t)
+			} else {
+				break
+			}
+		}
+		jt, jf := uint8(len(g.rev)-t-1), uint8(len(g.rev)-f-1)
+		pos := g.emit(Jump(ClassJmp|n.op|n.src, n.k, jt, jf))
+		for i := len(n.code) - 1; i >= 0; i-- {
+			pos = g.emit(n.code[i])
+		}
+		return pos
+	}
+	panic(fmt.Sprintf("unknown node type %T", n))
+}
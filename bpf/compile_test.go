@@ -0,0 +1,279 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package bpf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var (
+	macA = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	macB = net.HardwareAddr{0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb}
+)
+
+func eth(t layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{SrcMAC: macA, DstMAC: macB, EthernetType: t}
+}
+
+func ip4(proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: proto,
+		SrcIP:    net.IP{192, 168, 1, 10},
+		DstIP:    net.IP{10, 1, 2, 3},
+	}
+}
+
+func ip6(next layers.IPProtocol) *layers.IPv6 {
+	return &layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: next,
+		SrcIP:      net.ParseIP("2001:db8::1"),
+		DstIP:      net.ParseIP("fe80::2"),
+	}
+}
+
+func compileTestPackets(t *testing.T) map[string][]byte {
+	pkts := map[string][]byte{}
+
+	ip := ip4(layers.IPProtocolTCP)
+	tcp := &layers.TCP{SrcPort: 1234, DstPort: 80, SYN: true}
+	tcp.SetNetworkLayerForChecksum(ip)
+	pkts["tcp4"] = serialize(t, eth(layers.EthernetTypeIPv4), ip, tcp, gopacket.Payload("GET /"))
+
+	ip = ip4(layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	pkts["udp4"] = serialize(t, eth(layers.EthernetTypeIPv4), ip, udp, gopacket.Payload("x"))
+
+	ip6 := ip6(layers.IPProtocolTCP)
+	tcp = &layers.TCP{SrcPort: 443, DstPort: 50000, ACK: true}
+	tcp.SetNetworkLayerForChecksum(ip6)
+	pkts["tcp6"] = serialize(t, eth(layers.EthernetTypeIPv6), ip6, tcp)
+
+	pkts["icmp4"] = serialize(t, eth(layers.EthernetTypeIPv4), ip4(layers.IPProtocolICMPv4),
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0)})
+
+	pkts["arp"] = serialize(t, &layers.Ethernet{SrcMAC: macA, DstMAC: etherBroadcast, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPRequest,
+			SourceHwAddress:   macA,
+			SourceProtAddress: []byte{192, 168, 1, 10},
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    []byte{192, 168, 1, 1},
+		})
+
+	ip = ip4(layers.IPProtocolUDP)
+	udp = &layers.UDP{SrcPort: 67, DstPort: 68}
+	udp.SetNetworkLayerForChecksum(ip)
+	pkts["vlan"] = serialize(t, eth(layers.EthernetTypeDot1Q),
+		&layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeIPv4}, ip, udp)
+	return pkts
+}
+
+func TestCompile(t *testing.T) {
+	pkts := compileTestPackets(t)
+	for _, test := range []struct {
+		expr  string
+		match string // space separated names of matching packets
+	}{
+		{"", "tcp4 udp4 tcp6 icmp4 arp vlan"},
+		{"ip", "tcp4 udp4 icmp4"},
+		{"ip6", "tcp6"},
+		{"arp", "arp"},
+		{"tcp", "tcp4 tcp6"},
+		{"udp or icmp", "udp4 icmp4"},
+		{"not ip and not ip6", "arp vlan"},
+		{"ip proto 17", "udp4"},
+		{"proto \\tcp", "tcp4 tcp6"},
+		{"ether proto 0x806", "arp"},
+		{"host 192.168.1.10", "tcp4 udp4 icmp4 arp"},
+		{"src host 10.1.2.3", ""},
+		{"dst host 10.1.2.3", "tcp4 udp4 icmp4"},
+		{"ip host 192.168.1.10", "tcp4 udp4 icmp4"},
+		{"arp dst host 192.168.1.1", "arp"},
+		{"net 10.0.0.0/8", "tcp4 udp4 icmp4"},
+		{"src net 192.168", "tcp4 udp4 icmp4 arp"},
+		{"net 10.1.0.0 mask 255.255.0.0", "tcp4 udp4 icmp4"},
+		{"host 2001:db8::1", "tcp6"},
+		{"src net 2001:db8::/32 and dst net fe80::/10", "tcp6"},
+		{"port 80", "tcp4"},
+		{"tcp port http", "tcp4"},
+		{"udp port 80", ""},
+		{"port 53 or 443", "udp4 tcp6"},
+		{"src port 5353", "udp4"},
+		{"src or dst port 80", "tcp4"},
+		{"src and dst port 80", ""},
+		{"portrange 400-500", "tcp6"},
+		{"dst portrange 1-100", "tcp4 udp4"},
+		{"ether host 00:11:22:33:44:55", "tcp4 udp4 tcp6 icmp4 arp vlan"},
+		{"ether dst 66:77:88:99:aa:bb", "tcp4 udp4 tcp6 icmp4 vlan"},
+		{"broadcast", "arp"},
+		{"ether multicast", "arp"},
+		{"vlan", "vlan"},
+		{"vlan 100 and udp port 68", "vlan"},
+		{"vlan 101", ""},
+		{"vlan and not multicast", "vlan"},
+		{"vlan and ether multicast", ""},
+		{"tcp[13] & 2 != 0", "tcp4"},
+		{"tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn", "tcp4"},
+		{"icmp[icmptype] = icmp-echo", "icmp4"},
+		{"ip[9] == 6 and ip[2:2] > 40", "tcp4"},
+		{"ip6[6] = 6", "tcp6"},
+		{"ether[12:2] = 0x0806", "arp"},
+		{"len > 70", "tcp6"},
+		{"greater 70", "tcp6"},
+		{"less 60", "tcp4 udp4 icmp4 arp vlan"}, // padded to 60 bytes
+		{"len - 14 >= 60", "tcp6"},
+		{"tcp[(ip[0] & 0) + 2:2] = 80", "tcp4"},
+		{"ip[2:2] - ip[0] * 0 + 14 = len - 1", "tcp4"},
+		{"(tcp or udp) and not (port 80 or port 53)", "tcp6"},
+		{"!tcp && !udp || arp", "icmp4 arp vlan"},
+	} {
+		vm, err := NewVMFromExpression(test.expr, layers.LinkTypeEthernet, 0)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		want := map[string]bool{}
+		for _, name := range strings.Fields(test.match) {
+			want[name] = true
+		}
+		for name, data := range pkts {
+			ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+			if got := vm.Matches(ci, data); got != want[name] {
+				t.Errorf("%q on %s: got %v, want %v\n%v", test.expr, name, got, want[name], vm.prog)
+			}
+		}
+	}
+}
+
+func TestCompileLinkTypes(t *testing.T) {
+	ip := ip4(layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 1000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	raw := serialize(t, ip, udp)
+	for _, test := range []struct {
+		linkType layers.LinkType
+		data     []byte
+	}{
+		{layers.LinkTypeRaw, raw},
+		{layers.LinkTypeIPv4, raw},
+		{layers.LinkTypeNull, append([]byte{2, 0, 0, 0}, raw...)},
+		{layers.LinkTypeLoop, append([]byte{0, 0, 0, 2}, raw...)},
+		{layers.LinkTypeLinuxSLL, append(make([]byte, 14), append([]byte{8, 0}, raw...)...)},
+	} {
+		ci := gopacket.CaptureInfo{CaptureLength: len(test.data), Length: len(test.data)}
+		for expr, want := range map[string]bool{
+			"udp dst port 53":     true,
+			"host 10.1.2.3":       true,
+			"ip6 or tcp":          false,
+			"udp[2:2] = 53":       true,
+			"ip[0] & 0xf0 = 0x40": true,
+		} {
+			vm, err := NewVMFromExpression(expr, test.linkType, 100)
+			if err != nil {
+				t.Errorf("%v %q: %v", test.linkType, expr, err)
+				continue
+			}
+			if got := vm.Run(ci, test.data); (got == 100) != want {
+				t.Errorf("%v %q: got %d, want match %v", test.linkType, expr, got, want)
+			}
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{
+		"foo",
+		"host",
+		"tcp and",
+		"(tcp",
+		"tcp)",
+		"port nosuchservice",
+		"net 10.0.0.1/8",
+		"net 10.0.0.0/33",
+		"ip host 2001:db8::1",
+		"tcp[0:3] = 1",
+		"tcp[0] / 0 = 1",
+		"len ~ 3",
+		"icmp port 80",
+		"vlan 5000",
+		"ip proto 300",
+	} {
+		if _, err := Compile(expr, layers.LinkTypeEthernet, 0); err == nil {
+			t.Errorf("%q should not compile", expr)
+		}
+	}
+	if _, err := Compile("ether host 00:11:22:33:44:55", layers.LinkTypeRaw, 0); err == nil {
+		t.Error("ether host should not compile for raw IP")
+	}
+	if _, err := Compile("tcp", layers.LinkTypePPP, 0); err == nil {
+		t.Error("PPP should not be supported")
+	}
+}
+
+func TestCompileLongProgram(t *testing.T) {
+	// Enough hosts that jumps need trampolines.
+	var hosts []string
+	for i := 0; i < 150; i++ {
+		hosts = append(hosts, fmt.Sprintf("ip src host 10.0.%d.%d", i/100, i%100))
+	}
+	pkts := compileTestPackets(t)
+	for _, test := range []struct {
+		last string
+		want bool
+	}{
+		{"10.0.2.0", false},
+		{"192.168.1.10", true},
+	} {
+		expr := "(" + strings.Join(hosts, " or ") + " or ip src host " + test.last + ") and tcp"
+		prog, err := Compile(expr, layers.LinkTypeEthernet, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jumps := 0
+		for _, ins := range prog {
+			if ins.Class() == ClassJmp && ins.Op() == JmpJa {
+				jumps++
+			}
+		}
+		if jumps == 0 {
+			t.Errorf("expected trampolines in %d instruction program", len(prog))
+		}
+		vm, err := NewVM(prog)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := pkts["tcp4"]
+		ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+		if got := vm.Matches(ci, data); got != test.want {
+			t.Errorf("host %s: got %v, want %v", test.last, got, test.want)
+		}
+	}
+}
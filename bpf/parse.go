@@ -0,0 +1,1155 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package bpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket/layers"
+)
+
+const ethernetTypeRARP = 0x8035
+
+// linkInfo describes where the interesting fields of a link type are.
+type linkInfo struct {
+	linkType layers.LinkType
+	// typeOff is the offset of the 2-byte ethernet type, or -1 if the link
+	// type has none.
+	typeOff int
+	// netOff is the offset of the network layer header.
+	netOff int
+}
+
+func newLinkInfo(linkType layers.LinkType) (linkInfo, error) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return linkInfo{linkType, 12, 14}, nil
+	case layers.LinkTypeLinuxSLL:
+		return linkInfo{linkType, 14, 16}, nil
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return linkInfo{linkType, -1, 4}, nil
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		return linkInfo{linkType, -1, 0}, nil
+	}
+	return linkInfo{}, fmt.Errorf("link type %v not supported by the BPF compiler", linkType)
+}
+
+// Address families used by the Null and Loop link types for IPv6, which
+// differ between operating systems.
+var nullFamiliesIPv6 = []uint32{10, 24, 28, 30}
+
+// netProto returns a node testing that the network protocol is the given
+// ethernet type.
+func (l linkInfo) netProto(t layers.EthernetType) node {
+	switch l.linkType {
+	case layers.LinkTypeRaw:
+		switch t {
+		case layers.EthernetTypeIPv4:
+			return test(JmpJeq, 0x40, ld(SizeB, 0), Stmt(ClassAlu|AluAnd|SrcK, 0xf0))
+		case layers.EthernetTypeIPv6:
+			return test(JmpJeq, 0x60, ld(SizeB, 0), Stmt(ClassAlu|AluAnd|SrcK, 0xf0))
+		}
+		return constNode(false)
+	case layers.LinkTypeIPv4:
+		return constNode(t == layers.EthernetTypeIPv4)
+	case layers.LinkTypeIPv6:
+		return constNode(t == layers.EthernetTypeIPv6)
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		var families []uint32
+		switch t {
+		case layers.EthernetTypeIPv4:
+			families = []uint32{2}
+		case layers.EthernetTypeIPv6:
+			families = nullFamiliesIPv6
+		default:
+			return constNode(false)
+		}
+		var tests []node
+		for _, f := range families {
+			tests = append(tests, test(JmpJeq, f, ld(SizeW, 0)))
+			if l.linkType == layers.LinkTypeNull {
+				// Null uses host byte order of the capturing machine.
+				var b [4]byte
+				binary.LittleEndian.PutUint32(b[:], f)
+				tests = append(tests, test(JmpJeq, binary.BigEndian.Uint32(b[:]), ld(SizeW, 0)))
+			}
+		}
+		return or(tests...)
+	}
+	return test(JmpJeq, uint32(t), ld(SizeH, l.typeOff))
+}
+
+// token kinds
+const (
+	tokEOF = iota
+	tokID
+	tokOp
+)
+
+type token struct {
+	kind int
+	text string
+	// escaped is set for identifiers preceded by a backslash, which are
+	// never keywords.
+	escaped bool
+	pos     int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+var operators = []string{
+	"&&", "||", "<<", ">>", "<=", ">=", "==", "!=",
+	"(", ")", "[", "]", ":", "!", "&", "|", "^", "+", "-", "*", "/", "%", "<", ">", "=",
+}
+
+func isIDStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+func isIDChar(c byte) bool {
+	return isIDStart(c) || c == '-' || c == '.'
+}
+
+func isAddrChar(c byte) bool {
+	return c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F' || c >= '0' && c <= '9' || c == ':' || c == '.'
+}
+
+// lex splits expr into tokens.  Like in libpcap, identifiers may contain
+// '-' and '.', so "len-14" is a single (invalid) token and arithmetic needs
+// spaces around '-'.  MAC and IPv6 addresses are recognized before ':' is
+// treated as an operator.
+func lex(expr string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case isAddrChar(c):
+			j := i
+			for j < len(expr) && isAddrChar(expr[j]) {
+				j++
+			}
+			if s := expr[i:j]; strings.Contains(s, ":") && (j == len(expr) || !isIDChar(expr[j])) {
+				if _, err := net.ParseMAC(s); err == nil || net.ParseIP(s) != nil {
+					toks = append(toks, token{kind: tokID, text: s, pos: i})
+					i = j
+					continue
+				}
+			}
+		}
+		escaped := false
+		start := i
+		if c == '\\' && i+1 < len(expr) && isIDStart(expr[i+1]) {
+			escaped = true
+			i++
+			c = expr[i]
+		}
+		if isIDStart(c) {
+			j := i + 1
+			for j < len(expr) && isIDChar(expr[j]) {
+				j++
+			}
+			// identifiers may not end in '-'
+			for expr[j-1] == '-' {
+				j--
+			}
+			toks = append(toks, token{kind: tokID, text: expr[i:j], escaped: escaped, pos: start})
+			i = j
+			continue
+		}
+		found := false
+		for _, op := range operators {
+			if strings.HasPrefix(expr[i:], op) {
+				toks = append(toks, token{kind: tokOp, text: op, pos: i})
+				i += len(op)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(expr)}), nil
+}
+
+// Keywords that can't be used as bare values.
+var keywords = map[string]bool{
+	"and": true, "or": true, "not": true,
+	"host": true, "net": true, "port": true, "portrange": true, "gateway": true,
+	"src": true, "dst": true, "proto": true, "mask": true,
+	"ether": true, "link": true, "ip": true, "ip6": true, "arp": true, "rarp": true,
+	"tcp": true, "udp": true, "sctp": true, "icmp": true, "icmp6": true, "igmp": true,
+	"vlan": true, "less": true, "greater": true, "broadcast": true, "multicast": true,
+	"len": true,
+}
+
+var protoQualifiers = map[string]bool{
+	"ether": true, "link": true, "ip": true, "ip6": true, "arp": true, "rarp": true,
+	"tcp": true, "udp": true, "sctp": true, "icmp": true, "icmp6": true, "igmp": true,
+}
+
+var typeQualifiers = map[string]bool{
+	"host": true, "net": true, "port": true, "portrange": true, "gateway": true,
+}
+
+// qualifiers hold the protocol, direction and type qualifiers of a
+// primitive.  Empty strings mean the qualifier was not given.
+type qualifiers struct {
+	proto, dir, typ string
+}
+
+type parser struct {
+	toks []token
+	pos  int
+	link linkInfo
+	// last holds the qualifiers of the previous primitive, which are
+	// applied to bare values like in "port ftp or ftp-data".
+	last *qualifiers
+	// scratch is the next free scratch memory word.
+	scratch int
+}
+
+func newParser(expr string, link linkInfo) (*parser, error) {
+	toks, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{toks: toks, link: link}, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) peekN(n int) token {
+	if p.pos+n >= len(p.toks) {
+		return p.toks[len(p.toks)-1]
+	}
+	return p.toks[p.pos+n]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// is returns true if the next token is a (non-escaped) token with the
+// given text.
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return t.kind != tokEOF && !t.escaped && t.text == text
+}
+
+func (p *parser) accept(texts ...string) bool {
+	for _, text := range texts {
+		if p.is(text) {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("expected %q, got %v", text, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at offset %d: %s", p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+// parse parses the whole expression, returning nil for an empty
+// expression.
+func (p *parser) parse() (node, error) {
+	if p.peek().kind == tokEOF {
+		return nil, nil
+	}
+	n, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected %v", p.peek())
+	}
+	return n, nil
+}
+
+// expr parses a list of terms joined by and/or, which have the same
+// precedence and associate to the left.
+func (p *parser) expr() (node, error) {
+	n, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var isAnd bool
+		switch {
+		case p.accept("and", "&&"):
+			isAnd = true
+		case p.accept("or", "||"):
+		default:
+			return n, nil
+		}
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if isAnd {
+			n = andNode{n, m}
+		} else {
+			n = orNode{n, m}
+		}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if p.accept("not", "!") {
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	// Relations like "len > 100" or "(tcp[0] + 1) = 2" can't be told
+	// apart from primitives and groups by a single token, so try them
+	// first and backtrack if they fail.
+	save := p.pos
+	if n, err := p.relation(); err == nil {
+		return n, nil
+	}
+	p.pos = save
+
+	if p.accept("(") {
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	switch {
+	case p.accept("less"):
+		n, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{test(JmpJgt, n, Stmt(ClassLd|ModeLen, 0))}, nil
+	case p.accept("greater"):
+		n, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		return test(JmpJge, n, Stmt(ClassLd|ModeLen, 0)), nil
+	case p.accept("vlan"):
+		return p.vlan()
+	case p.accept("broadcast"):
+		return p.broadcast("")
+	case p.accept("multicast"):
+		return p.multicast("")
+	}
+
+	var q qualifiers
+	if t := p.peek(); t.kind == tokID && !t.escaped && protoQualifiers[t.text] {
+		q.proto = p.next().text
+		if q.proto == "link" {
+			q.proto = "ether"
+		}
+		switch {
+		case p.accept("proto"):
+			return p.protoValue(q.proto)
+		case p.accept("broadcast"):
+			return p.broadcast(q.proto)
+		case p.accept("multicast"):
+			return p.multicast(q.proto)
+		}
+	}
+	if p.is("src") || p.is("dst") {
+		q.dir = p.next().text
+		if (p.is("or") || p.is("and")) && (p.peekN(1).text == "src" || p.peekN(1).text == "dst") && !p.peekN(1).escaped {
+			op := p.next().text
+			p.next()
+			q.dir = "src " + op + " dst"
+		}
+	}
+	if t := p.peek(); t.kind == tokID && !t.escaped && typeQualifiers[t.text] {
+		q.typ = p.next().text
+	} else if q.proto == "" && q.dir == "" && p.accept("proto") {
+		return p.protoValue("")
+	}
+	if q == (qualifiers{}) {
+		// A bare value inherits the qualifiers of the previous primitive.
+		if t := p.peek(); t.kind != tokID || (keywords[t.text] && !t.escaped) {
+			return nil, p.errorf("unexpected %v", t)
+		}
+		if p.last != nil {
+			q = *p.last
+		}
+	}
+	if t := p.peek(); t.kind == tokID && (!keywords[t.text] || t.escaped) {
+		if q.typ == "" {
+			q.typ = "host"
+		}
+		last := q
+		p.last = &last
+		return p.primitive(q)
+	}
+	if q.dir == "" && q.typ == "" && q.proto != "" {
+		return p.protoAbbrev(q.proto)
+	}
+	return nil, p.errorf("expected value, got %v", p.peek())
+}
+
+func (p *parser) number() (uint32, error) {
+	t := p.next()
+	n, err := strconv.ParseUint(t.text, 0, 32)
+	if t.kind != tokID || err != nil {
+		return 0, fmt.Errorf("syntax error at offset %d: expected number, got %v", t.pos, t)
+	}
+	return uint32(n), nil
+}
+
+// vlan parses the optional vlan id and shifts the offsets of all following
+// primitives by the size of a vlan tag.
+func (p *parser) vlan() (node, error) {
+	if p.link.typeOff < 0 {
+		return nil, fmt.Errorf("vlan not supported on link type %v", p.link.linkType)
+	}
+	tags := or(
+		test(JmpJeq, uint32(layers.EthernetTypeDot1Q), ld(SizeH, p.link.typeOff)),
+		test(JmpJeq, uint32(layers.EthernetTypeQinQ), ld(SizeH, p.link.typeOff)),
+		test(JmpJeq, 0x9100, ld(SizeH, p.link.typeOff)),
+	)
+	if t := p.peek(); t.kind == tokID && !keywords[t.text] {
+		id, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		if id > 0xfff {
+			return nil, fmt.Errorf("vlan id %d out of range", id)
+		}
+		tags = and(tags, test(JmpJeq, id, ld(SizeH, p.link.typeOff+2), Stmt(ClassAlu|AluAnd|SrcK, 0xfff)))
+	}
+	p.link.typeOff += 4
+	p.link.netOff += 4
+	return tags, nil
+}
+
+var etherBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func (p *parser) broadcast(proto string) (node, error) {
+	switch proto {
+	case "", "ether":
+		return p.etherAddr("dst", etherBroadcast)
+	}
+	return nil, fmt.Errorf("%s broadcast not supported", proto)
+}
+
+func (p *parser) multicast(proto string) (node, error) {
+	switch proto {
+	case "", "ether":
+		if p.link.linkType != layers.LinkTypeEthernet {
+			return nil, fmt.Errorf("ether multicast not supported on link type %v", p.link.linkType)
+		}
+		return test(JmpJset, 1, ld(SizeB, 0)), nil
+	case "ip":
+		return and(p.link.netProto(layers.EthernetTypeIPv4), test(JmpJge, 224, ld(SizeB, p.link.netOff+16))), nil
+	case "ip6":
+		return and(p.link.netProto(layers.EthernetTypeIPv6), test(JmpJeq, 0xff, ld(SizeB, p.link.netOff+24))), nil
+	}
+	return nil, fmt.Errorf("%s multicast not supported", proto)
+}
+
+var etherProtoNames = map[string]layers.EthernetType{
+	"ip":   layers.EthernetTypeIPv4,
+	"ip6":  layers.EthernetTypeIPv6,
+	"arp":  layers.EthernetTypeARP,
+	"rarp": ethernetTypeRARP,
+}
+
+var ipProtoNames = map[string]layers.IPProtocol{
+	"icmp":  layers.IPProtocolICMPv4,
+	"igmp":  layers.IPProtocolIGMP,
+	"tcp":   layers.IPProtocolTCP,
+	"udp":   layers.IPProtocolUDP,
+	"gre":   layers.IPProtocolGRE,
+	"esp":   layers.IPProtocolESP,
+	"ah":    layers.IPProtocolAH,
+	"icmp6": layers.IPProtocolICMPv6,
+	"sctp":  layers.IPProtocolSCTP,
+	"pim":   103,
+	"vrrp":  112,
+}
+
+// protoValue parses the value of "[ether|ip|ip6] proto X".
+func (p *parser) protoValue(proto string) (node, error) {
+	t := p.next()
+	if t.kind != tokID {
+		return nil, fmt.Errorf("syntax error at offset %d: expected protocol, got %v", t.pos, t)
+	}
+	n, err := strconv.ParseUint(t.text, 0, 16)
+	switch proto {
+	case "ether":
+		if err != nil {
+			et, ok := etherProtoNames[t.text]
+			if !ok {
+				return nil, fmt.Errorf("unknown ether proto %q", t.text)
+			}
+			n = uint64(et)
+		}
+		return p.link.netProto(layers.EthernetType(n)), nil
+	case "", "ip", "ip6":
+		if err != nil {
+			ipp, ok := ipProtoNames[t.text]
+			if !ok {
+				return nil, fmt.Errorf("unknown ip proto %q", t.text)
+			}
+			n = uint64(ipp)
+		} else if n > 0xff {
+			return nil, fmt.Errorf("ip proto %d out of range", n)
+		}
+		var tests []node
+		if proto != "ip6" {
+			tests = append(tests, p.ipProto(layers.IPProtocol(n)))
+		}
+		if proto != "ip" {
+			tests = append(tests, p.ip6Proto(layers.IPProtocol(n)))
+		}
+		return or(tests...), nil
+	}
+	return nil, fmt.Errorf("%s proto not supported", proto)
+}
+
+func (p *parser) ipProto(proto layers.IPProtocol) node {
+	return and(p.link.netProto(layers.EthernetTypeIPv4), test(JmpJeq, uint32(proto), ld(SizeB, p.link.netOff+9)))
+}
+
+func (p *parser) ip6Proto(proto layers.IPProtocol) node {
+	return and(p.link.netProto(layers.EthernetTypeIPv6), test(JmpJeq, uint32(proto), ld(SizeB, p.link.netOff+6)))
+}
+
+// protoAbbrev returns the node for a protocol name used on its own, like
+// "tcp".
+func (p *parser) protoAbbrev(proto string) (node, error) {
+	if et, ok := etherProtoNames[proto]; ok {
+		return p.link.netProto(et), nil
+	}
+	switch proto {
+	case "tcp", "udp", "sctp":
+		ipp := ipProtoNames[proto]
+		return or(p.ipProto(ipp), p.ip6Proto(ipp)), nil
+	case "icmp", "igmp":
+		return p.ipProto(ipProtoNames[proto]), nil
+	case "icmp6":
+		return p.ip6Proto(layers.IPProtocolICMPv6), nil
+	}
+	return nil, fmt.Errorf("%q can't be used on its own", proto)
+}
+
+// dirNode combines the tests for source and destination according to the
+// direction qualifier.
+func dirNode(dir string, src, dst node) node {
+	switch dir {
+	case "src":
+		return src
+	case "dst":
+		return dst
+	case "src and dst":
+		return and(src, dst)
+	}
+	return or(src, dst)
+}
+
+// primitive parses the value of a qualified primitive like "src host X".
+func (p *parser) primitive(q qualifiers) (node, error) {
+	t := p.next()
+	switch q.typ {
+	case "host":
+		return p.host(q, t.text)
+	case "net":
+		return p.net(q, t.text)
+	case "port":
+		return p.port(q, t.text, t.text)
+	case "portrange":
+		i := strings.Index(t.text, "-")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid port range %q", t.text)
+		}
+		return p.port(q, t.text[:i], t.text[i+1:])
+	}
+	return nil, fmt.Errorf("%s not supported", q.typ)
+}
+
+func (p *parser) host(q qualifiers, value string) (node, error) {
+	if mac, err := net.ParseMAC(value); err == nil && len(mac) == 6 {
+		if q.proto != "" && q.proto != "ether" {
+			return nil, fmt.Errorf("illegal qualifier %q for ethernet address", q.proto)
+		}
+		return p.etherAddr(q.dir, mac)
+	}
+	if q.proto == "ether" {
+		return nil, fmt.Errorf("invalid ethernet address %q", value)
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("unknown host %q", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil && !strings.Contains(value, ":") {
+		return p.ip4Net(q, binary.BigEndian.Uint32(ip4), 0xffffffff)
+	}
+	return p.ip6Net(q, ip, 128)
+}
+
+func (p *parser) net(q qualifiers, value string) (node, error) {
+	var bits = -1
+	if p.accept("/") {
+		n, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		bits = int(n)
+	}
+	if strings.Contains(value, ":") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv6 network %q", value)
+		}
+		if bits < 0 {
+			bits = 128
+		} else if bits > 128 {
+			return nil, fmt.Errorf("invalid IPv6 prefix length %d", bits)
+		}
+		return p.ip6Net(q, ip, bits)
+	}
+	// IPv4 networks may be abbreviated, "10" means 10.0.0.0/8.
+	parts := strings.Split(value, ".")
+	if len(parts) > 4 {
+		return nil, fmt.Errorf("invalid network %q", value)
+	}
+	var addr uint32
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", value)
+		}
+		addr |= uint32(n) << uint(24-8*i)
+	}
+	mask := uint32(0xffffffff) << uint(32-8*len(parts))
+	if bits >= 0 {
+		if bits > 32 {
+			return nil, fmt.Errorf("invalid IPv4 prefix length %d", bits)
+		}
+		mask = uint32(0xffffffff << uint(32-bits))
+		if bits == 0 {
+			mask = 0
+		}
+	} else if p.accept("mask") {
+		t := p.next()
+		m := net.ParseIP(t.text).To4()
+		if m == nil {
+			return nil, fmt.Errorf("invalid netmask %v", t)
+		}
+		mask = binary.BigEndian.Uint32(m)
+	}
+	if addr&^mask != 0 {
+		return nil, fmt.Errorf("non-network bits set in %q", value)
+	}
+	return p.ip4Net(q, addr, mask)
+}
+
+func ipTest(off int, addr, mask uint32) node {
+	if mask == 0xffffffff {
+		return test(JmpJeq, addr, ld(SizeW, off))
+	}
+	return test(JmpJeq, addr, ld(SizeW, off), Stmt(ClassAlu|AluAnd|SrcK, mask))
+}
+
+// ip4Net returns a node matching the IPv4 network addr/mask, for IP and,
+// unless restricted by a protocol qualifier, ARP and RARP.
+func (p *parser) ip4Net(q qualifiers, addr, mask uint32) (node, error) {
+	off := p.link.netOff
+	ip := and(p.link.netProto(layers.EthernetTypeIPv4), dirNode(q.dir, ipTest(off+12, addr, mask), ipTest(off+16, addr, mask)))
+	arp := func(t layers.EthernetType) node {
+		return and(p.link.netProto(t), dirNode(q.dir, ipTest(off+14, addr, mask), ipTest(off+24, addr, mask)))
+	}
+	switch q.proto {
+	case "":
+		return or(ip, arp(layers.EthernetTypeARP), arp(ethernetTypeRARP)), nil
+	case "ip":
+		return ip, nil
+	case "arp":
+		return arp(layers.EthernetTypeARP), nil
+	case "rarp":
+		return arp(ethernetTypeRARP), nil
+	}
+	return nil, fmt.Errorf("illegal qualifier %q for IPv4 address", q.proto)
+}
+
+// ip6Net returns a node matching the IPv6 network ip/bits.
+func (p *parser) ip6Net(q qualifiers, ip net.IP, bits int) (node, error) {
+	if q.proto != "" && q.proto != "ip6" {
+		return nil, fmt.Errorf("illegal qualifier %q for IPv6 address", q.proto)
+	}
+	mask := net.CIDRMask(bits, 128)
+	addrTest := func(off int) node {
+		var tests []node
+		for i := 0; i < 16; i += 4 {
+			m := binary.BigEndian.Uint32(mask[i:])
+			if m == 0 {
+				break
+			}
+			tests = append(tests, ipTest(off+i, binary.BigEndian.Uint32(ip[i:])&m, m))
+		}
+		if len(tests) == 0 {
+			return constNode(true)
+		}
+		return and(tests...)
+	}
+	off := p.link.netOff
+	return and(p.link.netProto(layers.EthernetTypeIPv6), dirNode(q.dir, addrTest(off+8), addrTest(off+24))), nil
+}
+
+// etherAddr returns a node matching the given ethernet address.
+func (p *parser) etherAddr(dir string, mac net.HardwareAddr) (node, error) {
+	if p.link.linkType != layers.LinkTypeEthernet {
+		return nil, fmt.Errorf("ethernet addresses not supported on link type %v", p.link.linkType)
+	}
+	addrTest := func(off int) node {
+		return and(
+			test(JmpJeq, binary.BigEndian.Uint32(mac[2:]), ld(SizeW, off+2)),
+			test(JmpJeq, uint32(binary.BigEndian.Uint16(mac)), ld(SizeH, off)),
+		)
+	}
+	return dirNode(dir, addrTest(6), addrTest(0)), nil
+}
+
+var (
+	portNamesOnce sync.Once
+	portNames     map[string]map[string]uint16
+)
+
+// lookupPort resolves a port number or IANA service name for the given
+// transport protocol.
+func lookupPort(proto, name string) (uint16, bool) {
+	if n, err := strconv.ParseUint(name, 0, 16); err == nil {
+		return uint16(n), true
+	}
+	portNamesOnce.Do(func() {
+		portNames = map[string]map[string]uint16{"tcp": {}, "udp": {}, "sctp": {}}
+		add := func(m map[string]uint16, port uint16, name string) {
+			if old, ok := m[name]; !ok || port < old {
+				m[name] = port
+			}
+		}
+		for port, name := range layers.TCPPortNames {
+			add(portNames["tcp"], uint16(port), name)
+		}
+		for port, name := range layers.UDPPortNames {
+			add(portNames["udp"], uint16(port), name)
+		}
+		for port, name := range layers.SCTPPortNames {
+			add(portNames["sctp"], uint16(port), name)
+		}
+	})
+	n, ok := portNames[proto][name]
+	return n, ok
+}
+
+func (p *parser) port(q qualifiers, from, to string) (node, error) {
+	protos := []string{"tcp", "udp", "sctp"}
+	switch q.proto {
+	case "":
+	case "tcp", "udp", "sctp":
+		protos = []string{q.proto}
+	default:
+		return nil, fmt.Errorf("illegal qualifier %q for port", q.proto)
+	}
+	var tests []node
+	for _, proto := range protos {
+		lo, ok1 := lookupPort(proto, from)
+		hi, ok2 := lookupPort(proto, to)
+		if !ok1 || !ok2 {
+			continue
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		tests = append(tests, p.portTest(q.dir, ipProtoNames[proto], lo, hi))
+	}
+	if len(tests) == 0 {
+		return nil, fmt.Errorf("unknown port %q", from)
+	}
+	return or(tests...), nil
+}
+
+// portTest matches transport ports in [lo, hi] of the given IP protocol,
+// for IPv4 (non-fragments or first fragments only) and IPv6 without
+// extension headers.
+func (p *parser) portTest(dir string, proto layers.IPProtocol, lo, hi uint16) node {
+	off := p.link.netOff
+	rangeTest := func(code ...Instruction) node {
+		if lo == hi {
+			return test(JmpJeq, uint32(lo), code...)
+		}
+		return and(test(JmpJge, uint32(lo), code...), notNode{test(JmpJgt, uint32(hi), code...)})
+	}
+	ip4Port := func(portOff int) node {
+		return rangeTest(Stmt(ClassLdx|SizeB|ModeMsh, uint32(off)), Stmt(ClassLd|SizeH|ModeInd, uint32(off+portOff)))
+	}
+	ip6Port := func(portOff int) node {
+		return rangeTest(ld(SizeH, off+40+portOff))
+	}
+	return or(
+		and(p.ipProto(proto), p.notFragment(), dirNode(dir, ip4Port(0), ip4Port(2))),
+		and(p.ip6Proto(proto), dirNode(dir, ip6Port(0), ip6Port(2))),
+	)
+}
+
+// notFragment matches IPv4 packets with a fragment offset of 0.
+func (p *parser) notFragment() node {
+	return notNode{test(JmpJset, 0x1fff, ld(SizeH, p.link.netOff+6))}
+}
+
+// Arithmetic expressions.
+
+// arith is a compiled arithmetic expression: straight-line code leaving
+// the value in A, plus the protocol tests its loads depend on.
+type arith struct {
+	code  []Instruction
+	conds []node
+	// isConst is set for constant values, which are kept in k.
+	isConst bool
+	k       uint32
+}
+
+func (a arith) load() []Instruction {
+	if a.isConst {
+		return []Instruction{Stmt(ClassLd|ModeImm, a.k)}
+	}
+	return a.code
+}
+
+var relOps = map[string]bool{">": true, "<": true, ">=": true, "<=": true, "=": true, "==": true, "!=": true}
+
+// relation parses "arith relop arith".
+func (p *parser) relation() (node, error) {
+	// Relations are independent, so each starts with all scratch memory
+	// free again.  Within a relation, words are never reused, so the code
+	// of an operand never clobbers a value stored by its parent.
+	p.scratch = 0
+	lhs, err := p.arith(0)
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	if t.kind != tokOp || !relOps[t.text] {
+		return nil, p.errorf("expected relational operator, got %v", t)
+	}
+	p.next()
+	rhs, err := p.arith(0)
+	if err != nil {
+		return nil, err
+	}
+	var op uint16
+	negate := false
+	switch t.text {
+	case "=", "==":
+		op = JmpJeq
+	case "!=":
+		op, negate = JmpJeq, true
+	case ">":
+		op = JmpJgt
+	case ">=":
+		op = JmpJge
+	case "<":
+		op, negate = JmpJge, true
+	case "<=":
+		op, negate = JmpJgt, true
+	}
+	var n node
+	if rhs.isConst {
+		n = testNode{code: lhs.load(), op: op, src: SrcK, k: rhs.k}
+	} else {
+		s, err := p.allocScratch()
+		if err != nil {
+			return nil, err
+		}
+		code := append(append([]Instruction{}, rhs.load()...), Stmt(ClassSt, s))
+		code = append(code, lhs.load()...)
+		code = append(code, Stmt(ClassLdx|ModeMem, s))
+		n = testNode{code: code, op: op, src: SrcX}
+	}
+	if negate {
+		n = notNode{n}
+	}
+	conds := append(append([]node{}, lhs.conds...), rhs.conds...)
+	return and(append(conds, n)...), nil
+}
+
+func (p *parser) allocScratch() (uint32, error) {
+	if p.scratch >= MemWords {
+		return 0, errors.New("expression too complex")
+	}
+	p.scratch++
+	return uint32(p.scratch - 1), nil
+}
+
+// Binary operators by precedence, lowest first.
+var arithLevels = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+var arithOps = map[string]uint16{
+	"|": AluOr, "^": AluXor, "&": AluAnd, "<<": AluLsh, ">>": AluRsh,
+	"+": AluAdd, "-": AluSub, "*": AluMul, "/": AluDiv, "%": AluMod,
+}
+
+func (p *parser) arith(level int) (arith, error) {
+	if level == len(arithLevels) {
+		return p.arithUnary()
+	}
+	a, err := p.arith(level + 1)
+	if err != nil {
+		return a, err
+	}
+	for {
+		t := p.peek()
+		found := false
+		for _, op := range arithLevels[level] {
+			if t.kind == tokOp && t.text == op {
+				found = true
+			}
+		}
+		if !found {
+			return a, nil
+		}
+		p.next()
+		b, err := p.arith(level + 1)
+		if err != nil {
+			return a, err
+		}
+		if a, err = p.binary(arithOps[t.text], a, b); err != nil {
+			return a, err
+		}
+	}
+}
+
+func (p *parser) binary(op uint16, a, b arith) (arith, error) {
+	if (op == AluDiv || op == AluMod) && b.isConst && b.k == 0 {
+		return a, errors.New("division by zero")
+	}
+	ret := arith{conds: append(append([]node{}, a.conds...), b.conds...)}
+	if a.isConst && b.isConst {
+		ret.isConst, ret.k = true, fold(op, a.k, b.k)
+		return ret, nil
+	}
+	if b.isConst {
+		ret.code = append(append([]Instruction{}, a.load()...), Stmt(ClassAlu|op|SrcK, b.k))
+		return ret, nil
+	}
+	s, err := p.allocScratch()
+	if err != nil {
+		return a, err
+	}
+	ret.code = append(append([]Instruction{}, b.load()...), Stmt(ClassSt, s))
+	ret.code = append(ret.code, a.load()...)
+	ret.code = append(ret.code, Stmt(ClassLdx|ModeMem, s), Stmt(ClassAlu|op|SrcX, 0))
+	return ret, nil
+}
+
+// fold computes the result of an ALU operation on constants.
+func fold(op uint16, a, b uint32) uint32 {
+	switch op {
+	case AluAdd:
+		return a + b
+	case AluSub:
+		return a - b
+	case AluMul:
+		return a * b
+	case AluDiv:
+		return a / b
+	case AluMod:
+		return a % b
+	case AluOr:
+		return a | b
+	case AluAnd:
+		return a & b
+	case AluXor:
+		return a ^ b
+	case AluLsh:
+		return a << b
+	}
+	return a >> b
+}
+
+// Named constants usable in arithmetic expressions.
+var arithConstants = map[string]uint32{
+	"tcpflags": 13, "tcp-fin": 0x01, "tcp-syn": 0x02, "tcp-rst": 0x04, "tcp-push": 0x08,
+	"tcp-ack": 0x10, "tcp-urg": 0x20, "tcp-ece": 0x40, "tcp-cwr": 0x80,
+	"icmptype": 0, "icmpcode": 1,
+	"icmp-echoreply": 0, "icmp-unreach": 3, "icmp-sourcequench": 4, "icmp-redirect": 5,
+	"icmp-echo": 8, "icmp-routeradvert": 9, "icmp-routersolicit": 10, "icmp-timxceed": 11,
+	"icmp-paramprob": 12, "icmp-tstamp": 13, "icmp-tstampreply": 14, "icmp-ireq": 15,
+	"icmp-ireqreply": 16, "icmp-maskreq": 17, "icmp-maskreply": 18,
+	"icmp6type": 0, "icmp6code": 1,
+	"icmp6-destinationunreach": 1, "icmp6-packettoobig": 2, "icmp6-timeexceeded": 3,
+	"icmp6-parameterproblem": 4, "icmp6-echo": 128, "icmp6-echoreply": 129,
+	"icmp6-multicastlistenerquery": 130, "icmp6-multicastlistenerreportv1": 131,
+	"icmp6-multicastlistenerdone": 132, "icmp6-routersolicit": 133,
+	"icmp6-routeradvert": 134, "icmp6-neighborsolicit": 135,
+	"icmp6-neighboradvert": 136, "icmp6-redirect": 137,
+}
+
+func (p *parser) arithUnary() (arith, error) {
+	if p.accept("-") {
+		a, err := p.arithUnary()
+		if err != nil {
+			return a, err
+		}
+		if a.isConst {
+			a.k = -a.k
+			return a, nil
+		}
+		a.code = append(a.code, Stmt(ClassAlu|AluNeg, 0))
+		return a, nil
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokOp && t.text == "(":
+		p.next()
+		a, err := p.arith(0)
+		if err != nil {
+			return a, err
+		}
+		return a, p.expect(")")
+	case t.kind != tokID:
+		return arith{}, p.errorf("unexpected %v", t)
+	case t.text == "len" && !t.escaped:
+		p.next()
+		return arith{code: []Instruction{Stmt(ClassLd|ModeLen, 0)}}, nil
+	case protoQualifiers[t.text] && !t.escaped && p.peekN(1).text == "[":
+		p.next()
+		p.next()
+		return p.load(t.text)
+	}
+	if k, ok := arithConstants[t.text]; ok {
+		p.next()
+		return arith{isConst: true, k: k}, nil
+	}
+	n, err := strconv.ParseUint(t.text, 0, 32)
+	if err != nil {
+		return arith{}, p.errorf("expected number, got %v", t)
+	}
+	p.next()
+	return arith{isConst: true, k: uint32(n)}, nil
+}
+
+// load parses "proto[expr:size]" after the opening bracket.
+func (p *parser) load(proto string) (arith, error) {
+	idx, err := p.arith(0)
+	if err != nil {
+		return idx, err
+	}
+	size := uint16(SizeB)
+	if p.accept(":") {
+		n, err := p.number()
+		if err != nil {
+			return idx, err
+		}
+		switch n {
+		case 1:
+		case 2:
+			size = SizeH
+		case 4:
+			size = SizeW
+		default:
+			return idx, fmt.Errorf("invalid load size %d", n)
+		}
+	}
+	if err := p.expect("]"); err != nil {
+		return idx, err
+	}
+	var cond node
+	base := p.link.netOff
+	msh := false
+	switch proto {
+	case "link", "ether":
+		base = 0
+	case "ip":
+		cond = p.link.netProto(layers.EthernetTypeIPv4)
+	case "ip6":
+		cond = p.link.netProto(layers.EthernetTypeIPv6)
+	case "arp", "rarp":
+		cond = p.link.netProto(etherProtoNames[proto])
+	case "icmp6":
+		cond = p.ip6Proto(layers.IPProtocolICMPv6)
+		base += 40
+	default:
+		// Transport protocols, IPv4 only.
+		cond = and(p.ipProto(ipProtoNames[proto]), p.notFragment())
+		msh = true
+	}
+	ret := arith{conds: idx.conds}
+	if cond != nil {
+		ret.conds = append(ret.conds, cond)
+	}
+	switch {
+	case idx.isConst && !msh:
+		ret.code = []Instruction{ld(size, base+int(idx.k))}
+	case idx.isConst:
+		ret.code = []Instruction{
+			Stmt(ClassLdx|SizeB|ModeMsh, uint32(base)),
+			Stmt(ClassLd|size|ModeInd, uint32(base)+idx.k),
+		}
+	case !msh:
+		ret.code = append(append([]Instruction{}, idx.code...),
+			Stmt(ClassMisc|MiscTax, 0),
+			Stmt(ClassLd|size|ModeInd, uint32(base)))
+	default:
+		s, err := p.allocScratch()
+		if err != nil {
+			return idx, err
+		}
+		ret.code = append(append([]Instruction{}, idx.code...),
+			Stmt(ClassSt, s),
+			Stmt(ClassLdx|SizeB|ModeMsh, uint32(base)),
+			Stmt(ClassLd|ModeMem, s),
+			Stmt(ClassAlu|AluAdd|SrcX, 0),
+			Stmt(ClassMisc|MiscTax, 0),
+			Stmt(ClassLd|size|ModeInd, uint32(base)))
+	}
+	return ret, nil
+}
@@ -0,0 +1,314 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package bpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/gopacket"
+)
+
+// VM executes a validated BPF program against packet data.  A VM has no
+// mutable state, so it may be used concurrently by multiple goroutines.
+type VM struct {
+	prog []Instruction
+}
+
+// NewVM validates the given program and returns a VM executing it.  Like
+// the kernel's bpf_validate, it rejects unknown opcodes, jumps out of the
+// program, scratch memory accesses out of range, constant divisions by zero
+// and programs that don't end in a return instruction.
+func NewVM(prog []Instruction) (*VM, error) {
+	if err := Validate(prog); err != nil {
+		return nil, err
+	}
+	vm := &VM{prog: make([]Instruction, len(prog))}
+	copy(vm.prog, prog)
+	return vm, nil
+}
+
+// Validate checks that prog is a valid BPF program, see NewVM.
+func Validate(prog []Instruction) error {
+	if len(prog) == 0 {
+		return errors.New("empty BPF program")
+	}
+	if len(prog) > MaxInstructions {
+		return fmt.Errorf("BPF program has %d instructions, maximum is %d", len(prog), MaxInstructions)
+	}
+	for pc, ins := range prog {
+		if err := validateInstruction(pc, ins, len(prog)); err != nil {
+			return fmt.Errorf("BPF instruction %d (%v): %v", pc, ins, err)
+		}
+	}
+	if prog[len(prog)-1].Class() != ClassRet {
+		return errors.New("BPF program does not end with a return")
+	}
+	return nil
+}
+
+func validateInstruction(pc int, ins Instruction, n int) error {
+	switch ins.Class() {
+	case ClassLd, ClassLdx:
+		switch ins.Mode() {
+		case ModeImm, ModeLen:
+		case ModeAbs, ModeInd:
+			if ins.Class() == ClassLdx {
+				return errors.New("invalid addressing mode for ldx")
+			}
+			if ins.Size() == 0x18 {
+				return errors.New("invalid load size")
+			}
+		case ModeMsh:
+			if ins.Class() == ClassLd {
+				return errors.New("invalid addressing mode for ld")
+			}
+		case ModeMem:
+			if ins.K >= MemWords {
+				return errors.New("scratch memory index out of range")
+			}
+		default:
+			return errors.New("invalid addressing mode")
+		}
+	case ClassSt, ClassStx:
+		if ins.K >= MemWords {
+			return errors.New("scratch memory index out of range")
+		}
+	case ClassAlu:
+		switch ins.Op() {
+		case AluAdd, AluSub, AluMul, AluOr, AluAnd, AluLsh, AluRsh, AluXor, AluNeg:
+		case AluDiv, AluMod:
+			if ins.Src() == SrcK && ins.K == 0 {
+				return errors.New("division by zero")
+			}
+		default:
+			return errors.New("invalid alu operation")
+		}
+	case ClassJmp:
+		switch ins.Op() {
+		case JmpJa:
+			if uint64(ins.K) >= uint64(n-pc-1) {
+				return errors.New("jump out of program")
+			}
+		case JmpJeq, JmpJgt, JmpJge, JmpJset:
+			if int(ins.Jt) >= n-pc-1 || int(ins.Jf) >= n-pc-1 {
+				return errors.New("jump out of program")
+			}
+		default:
+			return errors.New("invalid jump operation")
+		}
+	case ClassRet:
+		switch ins.RetSrc() {
+		case RetK, RetX, RetA:
+		default:
+			return errors.New("invalid return source")
+		}
+	case ClassMisc:
+		switch ins.MiscOp() {
+		case MiscTax, MiscTxa:
+		default:
+			return errors.New("invalid misc operation")
+		}
+	}
+	return nil
+}
+
+// load reads size bytes at offset off of data, returning false if it is out
+// of bounds.
+func load(data []byte, off uint64, size uint16) (uint32, bool) {
+	switch size {
+	case SizeW:
+		if off+4 > uint64(len(data)) {
+			return 0, false
+		}
+		return binary.BigEndian.Uint32(data[off:]), true
+	case SizeH:
+		if off+2 > uint64(len(data)) {
+			return 0, false
+		}
+		return uint32(binary.BigEndian.Uint16(data[off:])), true
+	default:
+		if off >= uint64(len(data)) {
+			return 0, false
+		}
+		return uint32(data[off]), true
+	}
+}
+
+// Run executes the program against the given packet and returns the
+// program's return value, which is the number of bytes of the packet to
+// keep; 0 means the packet is rejected.  Loads beyond the captured data and
+// divisions by zero reject the packet, like in the kernel.  Length loads
+// return ci.Length, the packet's length on the wire.
+func (vm *VM) Run(ci gopacket.CaptureInfo, data []byte) uint32 {
+	var a, x uint32
+	var mem [MemWords]uint32
+	wireLen := uint32(ci.Length)
+	if ci.Length == 0 {
+		wireLen = uint32(len(data))
+	}
+	prog := vm.prog
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		switch ins.Class() {
+		case ClassLd:
+			switch ins.Mode() {
+			case ModeImm:
+				a = ins.K
+			case ModeLen:
+				a = wireLen
+			case ModeMem:
+				a = mem[ins.K]
+			case ModeAbs, ModeInd:
+				off := uint64(ins.K)
+				if ins.Mode() == ModeInd {
+					off += uint64(x)
+				}
+				v, ok := load(data, off, ins.Size())
+				if !ok {
+					return 0
+				}
+				a = v
+			}
+		case ClassLdx:
+			switch ins.Mode() {
+			case ModeImm:
+				x = ins.K
+			case ModeLen:
+				x = wireLen
+			case ModeMem:
+				x = mem[ins.K]
+			case ModeMsh:
+				v, ok := load(data, uint64(ins.K), SizeB)
+				if !ok {
+					return 0
+				}
+				x = (v & 0xf) << 2
+			}
+		case ClassSt:
+			mem[ins.K] = a
+		case ClassStx:
+			mem[ins.K] = x
+		case ClassAlu:
+			v := ins.K
+			if ins.Src() == SrcX {
+				v = x
+			}
+			switch ins.Op() {
+			case AluAdd:
+				a += v
+			case AluSub:
+				a -= v
+			case AluMul:
+				a *= v
+			case AluDiv:
+				if v == 0 {
+					return 0
+				}
+				a /= v
+			case AluMod:
+				if v == 0 {
+					return 0
+				}
+				a %= v
+			case AluOr:
+				a |= v
+			case AluAnd:
+				a &= v
+			case AluXor:
+				a ^= v
+			case AluLsh:
+				a <<= v
+			case AluRsh:
+				a >>= v
+			case AluNeg:
+				a = -a
+			}
+		case ClassJmp:
+			if ins.Op() == JmpJa {
+				pc += int(ins.K)
+				continue
+			}
+			v := ins.K
+			if ins.Src() == SrcX {
+				v = x
+			}
+			var cond bool
+			switch ins.Op() {
+			case JmpJeq:
+				cond = a == v
+			case JmpJgt:
+				cond = a > v
+			case JmpJge:
+				cond = a >= v
+			case JmpJset:
+				cond = a&v != 0
+			}
+			if cond {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case ClassRet:
+			switch ins.RetSrc() {
+			case RetK:
+				return ins.K
+			case RetX:
+				return x
+			default:
+				return a
+			}
+		case ClassMisc:
+			if ins.MiscOp() == MiscTax {
+				x = a
+			} else {
+				a = x
+			}
+		}
+	}
+	// Validated programs always end with a return.
+	return 0
+}
+
+// Matches returns true if the program accepts the given packet.
+func (vm *VM) Matches(ci gopacket.CaptureInfo, data []byte) bool {
+	return vm.Run(ci, data) != 0
+}
+
+// FilteredSource is a gopacket.PacketDataSource which only returns those
+// packets of an underlying source accepted by a VM.  Like a kernel socket
+// filter, packets are truncated to the length returned by the program.
+type FilteredSource struct {
+	source gopacket.PacketDataSource
+	vm     *VM
+}
+
+// NewFilteredSource returns a FilteredSource reading from source, only
+// returning packets accepted by vm.
+func NewFilteredSource(source gopacket.PacketDataSource, vm *VM) *FilteredSource {
+	return &FilteredSource{source: source, vm: vm}
+}
+
+// ReadPacketData returns the next packet of the underlying source accepted
+// by the filter.  Errors of the underlying source are returned immediately.
+func (s *FilteredSource) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		if data, ci, err = s.source.ReadPacketData(); err != nil {
+			return
+		}
+		n := s.vm.Run(ci, data)
+		if n == 0 {
+			continue
+		}
+		if uint64(n) < uint64(len(data)) {
+			data = data[:n]
+			ci.CaptureLength = int(n)
+		}
+		return
+	}
+}
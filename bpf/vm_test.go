@@ -0,0 +1,205 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package bpf
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tcpdump -dd 'tcp[13] & 0x12 == 0x12', minus the IPv6 part.
+var synAckProgram = []Instruction{
+	{0x28, 0, 0, 0x0000000c},
+	{0x15, 0, 9, 0x00000800},
+	{0x30, 0, 0, 0x00000017},
+	{0x15, 0, 7, 0x00000006},
+	{0x28, 0, 0, 0x00000014},
+	{0x45, 5, 0, 0x00001fff},
+	{0xb1, 0, 0, 0x0000000e},
+	{0x50, 0, 0, 0x0000001b},
+	{0x54, 0, 0, 0x00000012},
+	{0x15, 0, 1, 0x00000012},
+	{0x6, 0, 0, 0x0000ffff},
+	{0x6, 0, 0, 0x00000000},
+}
+
+func tcpPacket(t *testing.T, tcp *layers.TCP) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{1, 2, 3, 4, 5, 6},
+		DstMAC:       net.HardwareAddr{6, 5, 4, 3, 2, 1},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{10, 0, 0, 2},
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload("hello")); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVMSynAck(t *testing.T) {
+	vm, err := NewVM(synAckProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		tcp  *layers.TCP
+		want bool
+	}{
+		{&layers.TCP{SrcPort: 80, DstPort: 1234, SYN: true, ACK: true}, true},
+		{&layers.TCP{SrcPort: 80, DstPort: 1234, SYN: true}, false},
+		{&layers.TCP{SrcPort: 80, DstPort: 1234, ACK: true}, false},
+	} {
+		data := tcpPacket(t, test.tcp)
+		ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}
+		if got := vm.Matches(ci, data); got != test.want {
+			t.Errorf("SYN=%v ACK=%v: got %v, want %v", test.tcp.SYN, test.tcp.ACK, got, test.want)
+		}
+		// Truncated packets are rejected once a load is out of bounds.
+		if vm.Matches(ci, data[:30]) {
+			t.Error("truncated packet should not match")
+		}
+	}
+}
+
+func TestVMOperations(t *testing.T) {
+	data := []byte{0x41, 0x01, 0x02, 0x03, 0x04, 0x05}
+	ci := gopacket.CaptureInfo{CaptureLength: len(data), Length: 100}
+	for _, test := range []struct {
+		name string
+		prog []Instruction
+		want uint32
+	}{
+		{"len", []Instruction{
+			Stmt(ClassLd|SizeW|ModeLen, 0),
+			Stmt(ClassRet|RetA, 0),
+		}, 100},
+		{"word", []Instruction{
+			Stmt(ClassLd|SizeW|ModeAbs, 1),
+			Stmt(ClassRet|RetA, 0),
+		}, 0x01020304},
+		{"msh", []Instruction{
+			Stmt(ClassLdx|SizeB|ModeMsh, 0),
+			Stmt(ClassLd|SizeB|ModeInd, 1),
+			Stmt(ClassRet|RetA, 0),
+		}, 0x05},
+		{"scratch", []Instruction{
+			Stmt(ClassLd|ModeImm, 7),
+			Stmt(ClassSt, 3),
+			Stmt(ClassLdx|ModeMem, 3),
+			Stmt(ClassAlu|AluMul|SrcX, 0),
+			Stmt(ClassAlu|AluSub|SrcK, 4),
+			Stmt(ClassAlu|AluMod|SrcK, 10),
+			Stmt(ClassRet|RetA, 0),
+		}, 5},
+		{"tax txa neg", []Instruction{
+			Stmt(ClassLd|ModeImm, 1),
+			Stmt(ClassAlu|AluNeg, 0),
+			Stmt(ClassMisc|MiscTax, 0),
+			Stmt(ClassLd|ModeImm, 0),
+			Stmt(ClassMisc|MiscTxa, 0),
+			Stmt(ClassAlu|AluRsh|SrcK, 28),
+			Stmt(ClassRet|RetA, 0),
+		}, 0xf},
+		{"div by zero x", []Instruction{
+			Stmt(ClassLd|ModeImm, 1),
+			Stmt(ClassAlu|AluDiv|SrcX, 0),
+			Stmt(ClassRet|RetK, 1),
+		}, 0},
+		{"out of bounds", []Instruction{
+			Stmt(ClassLd|SizeH|ModeAbs, 5),
+			Stmt(ClassRet|RetK, 1),
+		}, 0},
+		{"jumps", []Instruction{
+			Stmt(ClassLd|SizeB|ModeAbs, 0),
+			Jump(ClassJmp|JmpJset|SrcK, 0x40, 0, 2),
+			Jump(ClassJmp|JmpJgt|SrcK, 0x40, 0, 1),
+			Stmt(ClassJmp|JmpJa, 1),
+			Stmt(ClassRet|RetK, 1),
+			Stmt(ClassLdx|ModeImm, 42),
+			Stmt(ClassRet|RetX, 0),
+		}, 42},
+	} {
+		vm, err := NewVM(test.prog)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := vm.Run(ci, data); got != test.want {
+			t.Errorf("%s: got %#x, want %#x", test.name, got, test.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, prog := range [][]Instruction{
+		nil,
+		{Stmt(ClassLd|ModeImm, 0)},
+		{Jump(ClassJmp|JmpJeq|SrcK, 0, 1, 0), Stmt(ClassRet|RetK, 0)},
+		{Stmt(ClassJmp|JmpJa, 1), Stmt(ClassRet|RetK, 0)},
+		{Stmt(ClassAlu|AluDiv|SrcK, 0), Stmt(ClassRet|RetK, 0)},
+		{Stmt(ClassSt, MemWords), Stmt(ClassRet|RetK, 0)},
+		{Stmt(ClassLd|ModeMsh, 0), Stmt(ClassRet|RetK, 0)},
+		{Stmt(ClassAlu|0xf0, 0), Stmt(ClassRet|RetK, 0)},
+		make([]Instruction, MaxInstructions+1),
+	} {
+		if err := Validate(prog); err == nil {
+			t.Errorf("program %v should be invalid", prog)
+		}
+	}
+}
+
+type sliceSource struct {
+	packets [][]byte
+}
+
+func (s *sliceSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(s.packets) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := s.packets[0]
+	s.packets = s.packets[1:]
+	return data, gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}, nil
+}
+
+func TestFilteredSource(t *testing.T) {
+	// Accept packets starting with 1, truncated to 2 bytes.
+	vm, err := NewVM([]Instruction{
+		Stmt(ClassLd|SizeB|ModeAbs, 0),
+		Jump(ClassJmp|JmpJeq|SrcK, 1, 0, 1),
+		Stmt(ClassRet|RetK, 2),
+		Stmt(ClassRet|RetK, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := NewFilteredSource(&sliceSource{[][]byte{{0, 1}, {1, 2, 3}, {2}, {1}}}, vm)
+	for _, want := range [][]byte{{1, 2}, {1}} {
+		data, ci, err := src.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(want) || ci.CaptureLength != len(want) {
+			t.Errorf("got %v (%+v), want %v", data, ci, want)
+		}
+	}
+	if _, _, err := src.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
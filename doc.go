@@ -18,6 +18,10 @@ useful, including:
  * pfring: C bindings to use PF_RING to read packets off the wire.
  * afpacket: C bindings for Linux's AF_PACKET to read packets off the wire.
  * tcpassembly: TCP stream reassembly
+ * udpassembly: UDP conversation tracking
+ * flowtable: bidirectional flow accounting
+ * flowexport: IPFIX and NetFlow v9 export of flow records
+ * sflowagent: sFlow sampling agent
 
 Also, if you're looking to dive right into code, see the examples subdirectory
 for numerous simple binaries built using gopacket libraries.
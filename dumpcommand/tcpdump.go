@@ -13,7 +13,10 @@ import (
 	"flag"
 	"fmt"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/bpf"
+	"github.com/google/gopacket/filter"
 	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/ip6defrag"
 	"github.com/google/gopacket/layers" // pulls in all layers decoders
 	"log"
 	"os"
@@ -25,12 +28,25 @@ var (
 	maxcount    = flag.Int("c", -1, "Only grab this many packets, then exit")
 	decoder     = flag.String("decoder", "Ethernet", "Name of the decoder to use")
 	dump        = flag.Bool("X", false, "If true, dump very verbose info on each packet")
+	jsonout     = flag.Bool("json", false, "If true, print packets as JSON, one per line")
 	statsevery  = flag.Int("stats", 1000, "Output statistics every N packets")
 	printErrors = flag.Bool("errors", false, "Print out packet dumps of decode errors, useful for checking decoders against live traffic")
 	lazy        = flag.Bool("lazy", false, "If true, do lazy decoding")
-	defrag      = flag.Bool("defrag", false, "If true, do IPv4 defrag")
+	defrag      = flag.Bool("defrag", false, "If true, do IPv4 and IPv6 defrag")
+	gofilter    = flag.String("gofilter", "", "BPF filter expression, compiled and run in Go without libpcap")
+	dfilter     = flag.String("dfilter", "", "Wireshark style display filter on decoded packets")
 )
 
+// filterLinkTypes maps decoder names to the link types used to compile
+// -gofilter expressions.
+var filterLinkTypes = map[string]layers.LinkType{
+	"Ethernet": layers.LinkTypeEthernet,
+	"LinuxSLL": layers.LinkTypeLinuxSLL,
+	"Loopback": layers.LinkTypeNull,
+	"IPv4":     layers.LinkTypeIPv4,
+	"IPv6":     layers.LinkTypeIPv6,
+}
+
 func Run(src gopacket.PacketDataSource) {
 	if !flag.Parsed() {
 		log.Fatalln("Run called without flags.Parse() being called")
@@ -40,9 +56,33 @@ func Run(src gopacket.PacketDataSource) {
 	if dec, ok = gopacket.DecodersByLayerName[*decoder]; !ok {
 		log.Fatalln("No decoder named", *decoder)
 	}
+	if *gofilter != "" {
+		linkType, ok := filterLinkTypes[*decoder]
+		if !ok {
+			log.Fatalln("-gofilter not supported with decoder", *decoder)
+		}
+		vm, err := bpf.NewVMFromExpression(*gofilter, linkType, 0)
+		if err != nil {
+			log.Fatalln("Error compiling filter:", err)
+		}
+		src = bpf.NewFilteredSource(src, vm)
+	}
+	var display *filter.Filter
+	if *dfilter != "" {
+		var err error
+		if display, err = filter.Compile(*dfilter); err != nil {
+			log.Fatalln("Error compiling display filter:", err)
+		}
+	}
 	source := gopacket.NewPacketSource(src, dec)
 	source.Lazy = *lazy
 	source.NoCopy = true
+	if *defrag {
+		source.Defragmenter = gopacket.Defragmenters{
+			ip4defrag.NewIPv4Defragmenter(),
+			ip6defrag.NewIPv6Defragmenter(),
+		}
+	}
 	fmt.Fprintln(os.Stderr, "Starting to read packets")
 	count := 0
 	bytes := int64(0)
@@ -50,44 +90,26 @@ func Run(src gopacket.PacketDataSource) {
 	errors := 0
 	truncated := 0
 	layertypes := map[gopacket.LayerType]int{}
-	defragger := ip4defrag.NewIPv4Defragmenter()
 
 	for packet := range source.Packets() {
+		if display != nil && !display.Match(packet) {
+			continue
+		}
 		count++
 		bytes += int64(len(packet.Data()))
 
-		// defrag the IPv4 packet if required
-		if *defrag {
-			ip4Layer := packet.Layer(layers.LayerTypeIPv4)
-			if ip4Layer == nil {
-				continue
-			}
-			ip4 := ip4Layer.(*layers.IPv4)
-			l := ip4.Length
-
-			newip4, err := defragger.DefragIPv4(ip4)
+		if *jsonout {
+			data, err := layers.MarshalPacketJSON(packet)
 			if err != nil {
-				log.Fatalln("Error while de-fragmenting", err)
-			} else if newip4 == nil {
-				continue // packet fragment, we don't have whole packet yet.
+				log.Fatalln("Error encoding packet as JSON:", err)
 			}
-			if newip4.Length != l {
-				fmt.Printf("Decoding re-assembled packet: %s\n", newip4.NextLayerType())
-				pb, ok := packet.(gopacket.PacketBuilder)
-				if !ok {
-					panic("Not a PacketBuilder")
-				}
-				nextDecoder := newip4.NextLayerType()
-				nextDecoder.Decode(newip4.Payload, pb)
-			}
-		}
-
-		if *dump {
+			fmt.Println(string(data))
+		} else if *dump {
 			fmt.Println(packet.Dump())
 		} else if *print {
 			fmt.Println(packet)
 		}
-		if !*lazy || *print || *dump { // if we've already decoded all layers...
+		if !*lazy || *print || *dump || *jsonout { // if we've already decoded all layers...
 			for _, layer := range packet.Layers() {
 				layertypes[layer.LayerType()]++
 			}
@@ -31,42 +31,30 @@ var snaplen = flag.Int("s", 1600, "SnapLen for pcap packet capture")
 var filter = flag.String("f", "tcp and dst port 80", "BPF filter for pcap")
 var logAllPackets = flag.Bool("v", false, "Logs every packet in great detail")
 
-// Build a simple HTTP request parser using tcpassembly.StreamFactory and tcpassembly.Stream interfaces
-
-// httpStreamFactory implements tcpassembly.StreamFactory
-type httpStreamFactory struct{}
-
-// httpStream will handle the actual decoding of http requests.
-type httpStream struct {
-	net, transport gopacket.Flow
-	r              tcpreader.ReaderStream
-}
-
-func (h *httpStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
-	hstream := &httpStream{
-		net:       net,
-		transport: transport,
-		r:         tcpreader.NewReaderStream(),
-	}
-	go hstream.run() // Important... we must guarantee that data from the reader stream is read.
-
-	// ReaderStream implements tcpassembly.Stream, so we can return a pointer to it.
-	return &hstream.r
+// Build a simple HTTP request parser, dispatched to by a tcpreader.StreamDispatcher
+
+func init() {
+	tcpreader.Register(&tcpreader.Protocol{
+		Name:  "http",
+		Ports: []layers.TCPPort{80},
+		Parse: parseHTTP,
+	})
 }
 
-func (h *httpStream) run() {
-	buf := bufio.NewReader(&h.r)
+// parseHTTP handles the actual decoding of http requests.
+func parseHTTP(net, transport gopacket.Flow, r *tcpreader.ReaderStream) {
+	buf := bufio.NewReader(r)
 	for {
 		req, err := http.ReadRequest(buf)
 		if err == io.EOF {
 			// We must read until we see an EOF... very important!
 			return
 		} else if err != nil {
-			log.Println("Error reading stream", h.net, h.transport, ":", err)
+			log.Println("Error reading stream", net, transport, ":", err)
 		} else {
 			bodyBytes := tcpreader.DiscardBytesToEOF(req.Body)
 			req.Body.Close()
-			log.Println("Received request from stream", h.net, h.transport, ":", req, "with", bodyBytes, "bytes in request body")
+			log.Println("Received request from stream", net, transport, ":", req, "with", bodyBytes, "bytes in request body")
 		}
 	}
 }
@@ -93,7 +81,7 @@ func main() {
 	}
 
 	// Set up assembly
-	streamFactory := &httpStreamFactory{}
+	streamFactory := &tcpreader.StreamDispatcher{}
 	streamPool := tcpassembly.NewStreamPool(streamFactory)
 	assembler := tcpassembly.NewAssembler(streamPool)
 
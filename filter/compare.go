@@ -0,0 +1,208 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package filter
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// predicate tests a single value of a field.
+type predicate func(v reflect.Value) bool
+
+// truth returns the predicate used for a field without comparison, which
+// is true for non-zero values.
+func truth(f *field) (predicate, error) {
+	switch f.typ.Kind() {
+	case reflect.Struct:
+		return func(reflect.Value) bool { return true }, nil
+	case reflect.Bool:
+		return func(v reflect.Value) bool { return v.Bool() }, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(v reflect.Value) bool { return v.Int() != 0 }, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func(v reflect.Value) bool { return v.Uint() != 0 }, nil
+	case reflect.Float32, reflect.Float64:
+		return func(v reflect.Value) bool { return v.Float() != 0 }, nil
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return func(v reflect.Value) bool { return v.Len() != 0 }, nil
+	}
+	return nil, fmt.Errorf("field %q of type %v can't be used as a condition", f.name, f.typ)
+}
+
+// compilePredicate returns the predicate comparing a field to value with
+// op, which is one of ==, <, <=, >, >=, &, contains and matches.  value is
+// parsed according to the type of the field.
+func compilePredicate(f *field, op string, value token) (predicate, error) {
+	t := f.typ
+	invalid := func() (predicate, error) {
+		return nil, fmt.Errorf("invalid value %v for field %q of type %v", value, f.name, t)
+	}
+	unsupported := func() (predicate, error) {
+		return nil, fmt.Errorf("operator %q not supported for field %q of type %v", op, f.name, t)
+	}
+	switch {
+	case t == ipType:
+		if op != "==" {
+			return unsupported()
+		}
+		if strings.Contains(value.text, "/") {
+			_, ipnet, err := net.ParseCIDR(value.text)
+			if err != nil {
+				return invalid()
+			}
+			return func(v reflect.Value) bool { return ipnet.Contains(net.IP(v.Bytes())) }, nil
+		}
+		ip := net.ParseIP(value.text)
+		if ip == nil {
+			return invalid()
+		}
+		return func(v reflect.Value) bool { return ip.Equal(net.IP(v.Bytes())) }, nil
+	case t == macType:
+		if op != "==" {
+			return unsupported()
+		}
+		mac, err := net.ParseMAC(value.text)
+		if err != nil {
+			return invalid()
+		}
+		return func(v reflect.Value) bool { return bytes.Equal(mac, v.Bytes()) }, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value.text)
+		if err != nil {
+			return invalid()
+		}
+		if op != "==" {
+			return unsupported()
+		}
+		return func(v reflect.Value) bool { return v.Bool() == b }, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value.text, 0, 64)
+		if err != nil {
+			return stringerPredicate(f, op, value, invalid)
+		}
+		cmp := intComparisons[op]
+		if cmp == nil {
+			return unsupported()
+		}
+		return func(v reflect.Value) bool { return cmp(v.Int(), n) }, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(value.text, 0, 64)
+		if err != nil {
+			return stringerPredicate(f, op, value, invalid)
+		}
+		cmp := uintComparisons[op]
+		if cmp == nil {
+			return unsupported()
+		}
+		return func(v reflect.Value) bool { return cmp(v.Uint(), n) }, nil
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(value.text, 64)
+		if err != nil {
+			return invalid()
+		}
+		cmp := floatComparisons[op]
+		if cmp == nil {
+			return unsupported()
+		}
+		return func(v reflect.Value) bool { return cmp(v.Float(), x) }, nil
+	case reflect.String:
+		return stringPredicate(op, value.text, func(v reflect.Value) string { return v.String() }, unsupported)
+	case reflect.Slice:
+		if t.Elem().Kind() != reflect.Uint8 {
+			break
+		}
+		b := []byte(value.text)
+		if value.kind == tokWord {
+			// Unquoted values are hex bytes, like 47:45:54 or 474554.
+			var err error
+			if b, err = hex.DecodeString(strings.Replace(value.text, ":", "", -1)); err != nil {
+				return invalid()
+			}
+		}
+		switch op {
+		case "==":
+			return func(v reflect.Value) bool { return bytes.Equal(v.Bytes(), b) }, nil
+		case "contains":
+			return func(v reflect.Value) bool { return bytes.Contains(v.Bytes(), b) }, nil
+		case "matches":
+			re, err := regexp.Compile(value.text)
+			if err != nil {
+				return nil, err
+			}
+			return func(v reflect.Value) bool { return re.Match(v.Bytes()) }, nil
+		}
+		return unsupported()
+	}
+	return stringerPredicate(f, op, value, unsupported)
+}
+
+// stringerPredicate compares the String method of fields, used for
+// enumerations like layers.IPProtocol.  Equality is case insensitive.
+func stringerPredicate(f *field, op string, value token, fail func() (predicate, error)) (predicate, error) {
+	if !f.typ.Implements(stringerType) {
+		return fail()
+	}
+	str := func(v reflect.Value) string {
+		if !v.CanInterface() {
+			return ""
+		}
+		return v.Interface().(fmt.Stringer).String()
+	}
+	return stringPredicate(op, value.text, str, fail)
+}
+
+func stringPredicate(op, s string, str func(reflect.Value) string, fail func() (predicate, error)) (predicate, error) {
+	switch op {
+	case "==":
+		return func(v reflect.Value) bool { return strings.EqualFold(str(v), s) }, nil
+	case "contains":
+		return func(v reflect.Value) bool { return strings.Contains(str(v), s) }, nil
+	case "matches":
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		return func(v reflect.Value) bool { return re.MatchString(str(v)) }, nil
+	}
+	return fail()
+}
+
+var intComparisons = map[string]func(a, b int64) bool{
+	"==": func(a, b int64) bool { return a == b },
+	"<":  func(a, b int64) bool { return a < b },
+	"<=": func(a, b int64) bool { return a <= b },
+	">":  func(a, b int64) bool { return a > b },
+	">=": func(a, b int64) bool { return a >= b },
+	"&":  func(a, b int64) bool { return a&b != 0 },
+}
+
+var uintComparisons = map[string]func(a, b uint64) bool{
+	"==": func(a, b uint64) bool { return a == b },
+	"<":  func(a, b uint64) bool { return a < b },
+	"<=": func(a, b uint64) bool { return a <= b },
+	">":  func(a, b uint64) bool { return a > b },
+	">=": func(a, b uint64) bool { return a >= b },
+	"&":  func(a, b uint64) bool { return a&b != 0 },
+}
+
+var floatComparisons = map[string]func(a, b float64) bool{
+	"==": func(a, b float64) bool { return a == b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+}
@@ -0,0 +1,362 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package filter
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// layerInfo describes a layer type whose fields can be used in filters.
+type layerInfo struct {
+	layerType gopacket.LayerType
+	// typ is the struct type implementing the layer.
+	typ reflect.Type
+}
+
+var layersByName = map[string]*layerInfo{}
+
+// RegisterLayer makes the fields of the layer implemented by prototype
+// available to filters.  prototype must be a pointer to a struct, like
+// &layers.TCP{}.  The layer is named by its lower case LayerType name, and
+// by any additional names given.  RegisterLayer is not safe for concurrent
+// use, and should be called from an init function.
+func RegisterLayer(prototype gopacket.Layer, names ...string) {
+	t := reflect.TypeOf(prototype)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("filter: layer prototype %T is not a pointer to a struct", prototype))
+	}
+	info := &layerInfo{layerType: prototype.LayerType(), typ: t.Elem()}
+	layersByName[strings.ToLower(info.layerType.String())] = info
+	for _, name := range names {
+		layersByName[strings.ToLower(name)] = info
+	}
+}
+
+func init() {
+	for _, l := range []gopacket.Layer{
+		&layers.ARP{},
+		&layers.CiscoDiscovery{},
+		&layers.CiscoDiscoveryInfo{},
+		&layers.DNS{},
+		&layers.Dot11InformationElement{},
+		&layers.Dot11MgmtBeacon{},
+		&layers.Dot11MgmtProbeReq{},
+		&layers.Dot11MgmtProbeResp{},
+		&layers.EAP{},
+		&layers.EAPOL{},
+		&layers.EtherIP{},
+		&layers.GRE{},
+		&layers.ICMPv6MLDDone{},
+		&layers.ICMPv6MLDQuery{},
+		&layers.ICMPv6MLDReport{},
+		&layers.ICMPv6MLDv2Report{},
+		&layers.ICMPv6NeighborAdvertisement{},
+		&layers.ICMPv6NeighborSolicitation{},
+		&layers.ICMPv6Redirect{},
+		&layers.ICMPv6RouterAdvertisement{},
+		&layers.ICMPv6RouterSolicitation{},
+		&layers.IGMP{},
+		&layers.IPFIX{},
+		&layers.IPSecAH{},
+		&layers.IPSecESP{},
+		&layers.IPv6Destination{},
+		&layers.IPv6Fragment{},
+		&layers.IPv6HopByHop{},
+		&layers.IPv6Routing{},
+		&layers.LinkLayerDiscoveryInfo{},
+		&layers.LinuxSLL{},
+		&layers.Loopback{},
+		&layers.MPLS{},
+		&layers.NetFlowV5{},
+		&layers.NetFlowV9{},
+		&layers.PPP{},
+		&layers.PPPoE{},
+		&layers.RadioTap{},
+		&layers.SCTP{},
+		&layers.SNAP{},
+		&layers.UDPLite{},
+		&layers.VXLAN{},
+	} {
+		RegisterLayer(l)
+	}
+	RegisterLayer(&layers.DHCPv4{}, "dhcp", "bootp")
+	RegisterLayer(&layers.DHCPv6{})
+	RegisterLayer(&layers.Dot11{}, "wlan")
+	RegisterLayer(&layers.Dot1Q{}, "vlan")
+	RegisterLayer(&layers.Ethernet{}, "eth")
+	RegisterLayer(&layers.ICMPv4{}, "icmp")
+	RegisterLayer(&layers.ICMPv6{})
+	RegisterLayer(&layers.IPv4{}, "ip")
+	RegisterLayer(&layers.IPv6{})
+	RegisterLayer(&layers.LinkLayerDiscovery{}, "lldp")
+	RegisterLayer(&layers.LLC{})
+	RegisterLayer(&layers.TCP{})
+	RegisterLayer(&layers.UDP{})
+}
+
+// fieldAliases maps Wireshark style field names to one or more paths of
+// struct fields.  A field with multiple paths matches if any of them does.
+var fieldAliases = map[gopacket.LayerType]map[string][]string{
+	layers.LayerTypeEthernet: {
+		"src":  {"SrcMAC"},
+		"dst":  {"DstMAC"},
+		"addr": {"SrcMAC", "DstMAC"},
+		"type": {"EthernetType"},
+	},
+	layers.LayerTypeDot1Q: {
+		"id":    {"VLANIdentifier"},
+		"etype": {"Type"},
+	},
+	layers.LayerTypeIPv4: {
+		"src":     {"SrcIP"},
+		"dst":     {"DstIP"},
+		"addr":    {"SrcIP", "DstIP"},
+		"proto":   {"Protocol"},
+		"len":     {"Length"},
+		"hdr_len": {"IHL"},
+		"id":      {"Id"},
+		"ttl":     {"TTL"},
+	},
+	layers.LayerTypeIPv6: {
+		"src":  {"SrcIP"},
+		"dst":  {"DstIP"},
+		"addr": {"SrcIP", "DstIP"},
+		"nxt":  {"NextHeader"},
+		"hlim": {"HopLimit"},
+		"plen": {"Length"},
+		"flow": {"FlowLabel"},
+	},
+	layers.LayerTypeTCP: {
+		"srcport":     {"SrcPort"},
+		"dstport":     {"DstPort"},
+		"port":        {"SrcPort", "DstPort"},
+		"ack":         {"Ack"},
+		"window_size": {"Window"},
+		"flags.fin":   {"FIN"},
+		"flags.syn":   {"SYN"},
+		"flags.reset": {"RST"},
+		"flags.rst":   {"RST"},
+		"flags.push":  {"PSH"},
+		"flags.ack":   {"ACK"},
+		"flags.urg":   {"URG"},
+		"flags.ece":   {"ECE"},
+		"flags.cwr":   {"CWR"},
+		"flags.ns":    {"NS"},
+	},
+	layers.LayerTypeUDP: {
+		"srcport": {"SrcPort"},
+		"dstport": {"DstPort"},
+		"port":    {"SrcPort", "DstPort"},
+	},
+	layers.LayerTypeDNS: {
+		"qry.name":       {"Questions.Name"},
+		"qry.type":       {"Questions.Type"},
+		"resp.name":      {"Answers.Name"},
+		"resp.type":      {"Answers.Type"},
+		"a":              {"Answers.IP"},
+		"aaaa":           {"Answers.IP"},
+		"flags.response": {"QR"},
+		"flags.rcode":    {"ResponseCode"},
+	},
+	layers.LayerTypeDot11: {
+		"sa":    {"Address2"},
+		"da":    {"Address1"},
+		"addr":  {"Address1", "Address2", "Address3", "Address4"},
+		"bssid": {"Address3"},
+	},
+}
+
+// field is a resolved field name.
+type field struct {
+	name  string
+	layer *layerInfo
+	// paths are the alternative sequences of struct field indexes leading
+	// to the field.  An empty path selects the layer itself.
+	paths [][][]int
+	// typ is the type of the field, after following pointers and
+	// flattening slices.
+	typ reflect.Type
+}
+
+var (
+	ipType       = reflect.TypeOf(net.IP(nil))
+	macType      = reflect.TypeOf(net.HardwareAddr(nil))
+	stringerType = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+// isList returns true for types whose elements are matched individually.
+// Byte slices, including net.IP and net.HardwareAddr, are single values.
+func isList(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8
+}
+
+// elem follows pointers and list elements of t.
+func elem(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || isList(t) {
+		t = t.Elem()
+	}
+	return t
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
+
+// lookupField finds the exported field named name in the struct type t,
+// including fields promoted from embedded structs.  An exact match of the
+// Go name wins, otherwise the name is matched case insensitively and
+// ignoring underscores, which must be unambiguous.
+func lookupField(t reflect.Type, name string) ([]int, error) {
+	type candidate struct {
+		t     reflect.Type
+		index []int
+	}
+	level := []candidate{{t, nil}}
+	for len(level) > 0 {
+		var next []candidate
+		var matches [][]int
+		for _, c := range level {
+			for i := 0; i < c.t.NumField(); i++ {
+				f := c.t.Field(i)
+				index := append(append([]int{}, c.index...), i)
+				if f.Anonymous {
+					if ft := f.Type; ft.Kind() == reflect.Struct {
+						next = append(next, candidate{ft, index})
+					}
+				}
+				if f.PkgPath != "" {
+					continue
+				}
+				if f.Name == name {
+					return index, nil
+				}
+				if normalize(f.Name) == normalize(name) {
+					matches = append(matches, index)
+				}
+			}
+		}
+		switch len(matches) {
+		case 0:
+		case 1:
+			return matches[0], nil
+		default:
+			return nil, fmt.Errorf("ambiguous field %q in %v", name, t)
+		}
+		level = next
+	}
+	return nil, fmt.Errorf("%v has no field %q", t, name)
+}
+
+// resolvePath resolves a dot separated path of struct fields in t.
+func resolvePath(t reflect.Type, path string) ([][]int, reflect.Type, error) {
+	var indexes [][]int
+	if path == "" {
+		return nil, t, nil
+	}
+	for _, name := range strings.Split(path, ".") {
+		t = elem(t)
+		if t.Kind() != reflect.Struct {
+			return nil, nil, fmt.Errorf("%v has no field %q", t, name)
+		}
+		index, err := lookupField(t, name)
+		if err != nil {
+			return nil, nil, err
+		}
+		indexes = append(indexes, index)
+		t = t.FieldByIndex(index).Type
+	}
+	return indexes, elem(t), nil
+}
+
+// resolveField resolves a field name like "tcp.flags.syn" against the
+// registered layers.
+func resolveField(name string) (*field, error) {
+	parts := strings.SplitN(name, ".", 2)
+	info, ok := layersByName[strings.ToLower(parts[0])]
+	if !ok {
+		return nil, fmt.Errorf("unknown layer %q", parts[0])
+	}
+	f := &field{name: name, layer: info}
+	if len(parts) == 1 {
+		f.paths = [][][]int{nil}
+		f.typ = info.typ
+		return f, nil
+	}
+	paths, ok := fieldAliases[info.layerType][strings.ToLower(parts[1])]
+	if !ok {
+		paths = []string{parts[1]}
+	}
+	for _, path := range paths {
+		indexes, t, err := resolvePath(info.typ, path)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %v", name, err)
+		}
+		if f.typ != nil && f.typ != t {
+			// Can't happen for the built in aliases.
+			return nil, fmt.Errorf("field %q has multiple types", name)
+		}
+		f.typ = t
+		f.paths = append(f.paths, indexes)
+	}
+	return f, nil
+}
+
+// visit calls fn with every value of the field in the packet, until fn
+// returns true.
+func (f *field) visit(p gopacket.Packet, fn func(reflect.Value) bool) {
+	for _, l := range p.Layers() {
+		if l.LayerType() != f.layer.layerType {
+			continue
+		}
+		v := reflect.ValueOf(l)
+		if v.Kind() != reflect.Ptr || v.Type().Elem() != f.layer.typ || v.IsNil() {
+			continue
+		}
+		for _, path := range f.paths {
+			if walk(v.Elem(), path, fn) {
+				return
+			}
+		}
+	}
+}
+
+// walk calls fn with all values reachable from v by following path,
+// pointers and list elements.  It returns true if fn did.
+func walk(v reflect.Value, path [][]int, fn func(reflect.Value) bool) bool {
+	switch {
+	case v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			return false
+		}
+		return walk(v.Elem(), path, fn)
+	case isList(v.Type()):
+		for i := 0; i < v.Len(); i++ {
+			if walk(v.Index(i), path, fn) {
+				return true
+			}
+		}
+		return false
+	case len(path) == 0:
+		return fn(v)
+	}
+	for _, i := range path[0] {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return walk(v, path[1:], fn)
+}
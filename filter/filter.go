@@ -0,0 +1,134 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package filter implements Wireshark style display filters, which match
+// packets on the fields of their decoded layers, like:
+//
+//	f, err := filter.Compile(`tcp.flags.syn && !tcp.flags.ack && ip.ttl < 5`)
+//	...
+//	for packet := range source.Packets() {
+//		if f.Match(packet) {
+//			...
+//		}
+//	}
+//
+// Fields are named by a layer name and a path of struct fields of the
+// layer's Go type, separated by dots.  Layer names are the lower case
+// names of the layer types, like "ipv4" or "dns", plus common Wireshark
+// abbreviations like "ip", "eth" or "wlan".  Struct fields are matched case
+// insensitively, ignoring underscores, so "dns.questions.name" refers to the
+// Name field of the elements of DNS.Questions.  Common Wireshark field names
+// like "ip.src", "tcp.port" or "tcp.flags.syn" are also supported.  Field
+// names are checked when the filter is compiled.  Layers implemented
+// outside of the layers package can be made available with RegisterLayer.
+//
+// A field on its own tests that it is present and not zero, a layer name on
+// its own that the layer is present.  Fields can be compared to values
+// with ==, !=, <, <=, >, >= (or eq, ne, lt, le, gt, ge), tested for bits
+// with &, and strings and byte slices can be searched with contains and
+// matched against regular expressions with matches.  Values are numbers,
+// quoted strings, IP addresses and networks like 10.0.0.0/8, MAC addresses,
+// hex bytes like 47:45:54, true and false, and the names returned by the
+// String method of enumerations like layers.IPProtocol:
+//
+//	ip.src == 10.0.0.0/8 and ip.proto == UDP
+//	dns.questions.name contains "corp" || eth.src == 00:11:22:33:44:55
+//
+// Fields which occur multiple times, because the layer is repeated or the
+// field is part of a slice, match if any occurrence does.  The exception is
+// !=, which matches if the field is present and no occurrence is equal to
+// the value, so "ip.addr != 10.0.0.1" excludes all packets from and to
+// 10.0.0.1.  Tests of missing fields are always false.
+//
+// Expressions are combined with && (and), || (or), ! (not) and parentheses,
+// where && binds more tightly than ||.
+package filter
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/google/gopacket"
+)
+
+// Filter is a compiled display filter.  It may be used concurrently by
+// multiple goroutines.
+type Filter struct {
+	expr string
+	root node
+}
+
+// Compile parses a display filter expression, checking that all fields
+// exist.  An empty expression matches all packets.
+func Compile(expr string) (*Filter, error) {
+	p, err := newParser(expr)
+	if err != nil {
+		return nil, err
+	}
+	root, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// MustCompile is like Compile but panics if the expression can't be
+// compiled.
+func MustCompile(expr string) *Filter {
+	f, err := Compile(expr)
+	if err != nil {
+		panic(fmt.Sprintf("filter: Compile(%q): %v", expr, err))
+	}
+	return f
+}
+
+// Match returns true if the packet matches the filter.
+func (f *Filter) Match(p gopacket.Packet) bool {
+	if f.root == nil {
+		return true
+	}
+	return f.root.eval(p)
+}
+
+// String returns the expression the filter was compiled from.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+type node interface {
+	eval(p gopacket.Packet) bool
+}
+
+type andNode struct{ a, b node }
+
+func (n andNode) eval(p gopacket.Packet) bool { return n.a.eval(p) && n.b.eval(p) }
+
+type orNode struct{ a, b node }
+
+func (n orNode) eval(p gopacket.Packet) bool { return n.a.eval(p) || n.b.eval(p) }
+
+type notNode struct{ a node }
+
+func (n notNode) eval(p gopacket.Packet) bool { return !n.a.eval(p) }
+
+// testNode tests the values of a field with a predicate.  If all is false,
+// the test matches if the predicate is true for any value, otherwise if
+// the field is present and the predicate is true for all values.
+type testNode struct {
+	f    *field
+	pred predicate
+	all  bool
+}
+
+func (n testNode) eval(p gopacket.Packet) bool {
+	found, ret := false, false
+	n.f.visit(p, func(v reflect.Value) bool {
+		found = true
+		ret = n.pred(v)
+		return ret != n.all
+	})
+	return found && ret
+}
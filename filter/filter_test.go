@@ -0,0 +1,189 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package filter
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) gopacket.Packet {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		t.Fatal(err)
+	}
+	p := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	if err := p.ErrorLayer(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return p
+}
+
+func testPackets(t *testing.T) (syn, dns gopacket.Packet) {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0x11, 0x22, 0x33, 0x44, 0x55},
+		DstMAC:       net.HardwareAddr{0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      3,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IP{10, 0, 0, 1},
+		DstIP:    net.IP{192, 168, 0, 1},
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, SYN: true, Seq: 1000, Window: 1024}
+	tcp.SetNetworkLayerForChecksum(ip)
+	syn = serialize(t, eth, ip, tcp, gopacket.Payload("GET / HTTP/1.0"))
+
+	ip = &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IP{192, 168, 0, 1},
+		DstIP:    net.IP{8, 8, 8, 8},
+	}
+	udp := &layers.UDP{SrcPort: 5000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	// DNS can't be serialized, so the query is built by hand: ID 42, RD set,
+	// questions www.example.com A and mail.corp.example.com AAAA.
+	query := []byte{0, 42, 1, 0, 0, 2, 0, 0, 0, 0, 0, 0}
+	for _, q := range []struct {
+		name  string
+		qtype byte
+	}{{"www.example.com", 1}, {"mail.corp.example.com", 28}} {
+		for _, label := range strings.Split(q.name, ".") {
+			query = append(query, byte(len(label)))
+			query = append(query, label...)
+		}
+		query = append(query, 0, 0, q.qtype, 0, 1)
+	}
+	dns = serialize(t, eth, ip, udp, gopacket.Payload(query))
+	return
+}
+
+func TestFilter(t *testing.T) {
+	syn, dns := testPackets(t)
+	for _, test := range []struct {
+		expr     string
+		syn, dns bool
+	}{
+		{"", true, true},
+		{"tcp", true, false},
+		{"ip && udp", false, true},
+		{"!tcp", false, true},
+		{"not tcp and not udp", false, false},
+		{"tcp.flags.syn && !tcp.flags.ack && ip.ttl < 5", true, false},
+		{"tcp.SYN == true", true, false},
+		{"tcp.flags.ack == 0", true, false},
+		{"ip.ttl >= 64", false, true},
+		{"ip.ttl gt 3 or tcp.seq le 1000", true, true},
+		{"ip.flags & 2", false, false},
+		{"tcp.dstport == 80", true, false},
+		{"tcp.port == 40000", true, false},
+		{"udp.port == 53 && udp.srcport == 5000", false, true},
+		{"ip.src == 10.0.0.1", true, false},
+		{"ip.addr == 192.168.0.0/16", true, true},
+		{"ip.addr != 192.168.0.1", false, false},
+		{"ip.addr != 8.8.8.8", true, false},
+		{"ip.proto == UDP", false, true},
+		{"ip.proto == 6", true, false},
+		{"ipv4.protocol eq tcp", true, false},
+		{"eth.src == 00:11:22:33:44:55", true, true},
+		{"eth.dst != 00:11:22:33:44:55", true, true},
+		{"eth.type == IPv4", true, true},
+		{`dns.questions.name contains "corp"`, false, true},
+		{`dns.qry.name == "www.example.com"`, false, true},
+		{`dns.questions.name matches "^mail\\."`, false, true},
+		{`dns.questions.name == 77:77:77:2e`, false, false},
+		{"dns.questions.type == 28", false, true},
+		{"dns.questions.type == 15", false, false},
+		{"dns.id == 42 && dns.rd", false, true},
+		{"dns.answers", false, false},
+		{"dns.questions", false, true},
+		{`tcp.payload contains "HTTP"`, true, false},
+		{"tcp.payload contains 47:45:54", true, false},
+		{"(tcp || udp) && !(ip.ttl < 5)", false, true},
+		{"tcp.window_size > 1000", true, false},
+		{"netflowv9.sourceid == 3 || ipfix || netflowv5", false, false},
+	} {
+		f, err := Compile(test.expr)
+		if err != nil {
+			t.Errorf("%q: %v", test.expr, err)
+			continue
+		}
+		if got := f.Match(syn); got != test.syn {
+			t.Errorf("%q on syn: got %v, want %v", test.expr, got, test.syn)
+		}
+		if got := f.Match(dns); got != test.dns {
+			t.Errorf("%q on dns: got %v, want %v", test.expr, got, test.dns)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		"foo",
+		"tcp.nosuchfield",
+		"ip.src == notanip",
+		"ip.src > 10.0.0.1",
+		"ip.ttl == abc",
+		"tcp.flags.syn == maybe",
+		"tcp &&",
+		"(tcp",
+		"tcp)",
+		`dns.questions.name contains`,
+		`"tcp"`,
+		"tcp.srcport contains 80",
+		`dns.questions.name matches "("`,
+		"tcp # udp",
+	} {
+		if _, err := Compile(expr); err == nil {
+			t.Errorf("%q should not compile", expr)
+		}
+	}
+}
+
+func TestFieldAliases(t *testing.T) {
+	for lt, aliases := range fieldAliases {
+		for alias := range aliases {
+			name := lt.String() + "." + alias
+			if _, err := resolveField(name); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+}
+
+type testLayer struct {
+	layers.BaseLayer
+	Value uint16
+}
+
+var testLayerType = gopacket.RegisterLayerType(1999, gopacket.LayerTypeMetadata{Name: "FilterTest"})
+
+func (t *testLayer) LayerType() gopacket.LayerType { return testLayerType }
+
+func TestRegisterLayer(t *testing.T) {
+	if _, err := Compile("filtertest.value == 1"); err == nil {
+		t.Fatal("unregistered layer should not compile")
+	}
+	RegisterLayer(&testLayer{}, "ft")
+	f := MustCompile("ft.value == 7 && filtertest")
+	p := gopacket.NewPacket(nil, gopacket.DecodeFunc(func(data []byte, p gopacket.PacketBuilder) error {
+		p.AddLayer(&testLayer{Value: 7})
+		return nil
+	}), gopacket.Default)
+	if !f.Match(p) {
+		t.Error("registered layer did not match")
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package filter
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// token kinds
+const (
+	tokEOF = iota
+	tokWord
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of filter"
+	case tokString:
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "&", "(", ")"}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '.' || c == ':' || c == '-' || c == '/'
+}
+
+// lex splits expr into words (field names and unquoted values), quoted
+// strings and operators.
+func lex(expr string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			s, err := strconv.Unquote(expr[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d: %v", i, err)
+			}
+			toks = append(toks, token{tokString, s, i})
+			i = j + 1
+		case isWordChar(c):
+			j := i
+			for j < len(expr) && isWordChar(expr[j]) {
+				j++
+			}
+			toks = append(toks, token{tokWord, expr[i:j], i})
+			i = j
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(expr[i:], op) {
+					toks = append(toks, token{tokOp, op, i})
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(expr)}), nil
+}
+
+// comparisons maps the comparison operators and their word forms to the
+// operator used by compilePredicate.
+var comparisons = map[string]string{
+	"==": "==", "eq": "==",
+	"!=": "!=", "ne": "!=",
+	"<": "<", "lt": "<",
+	"<=": "<=", "le": "<=",
+	">": ">", "gt": ">",
+	">=": ">=", "ge": ">=",
+	"&":        "&",
+	"contains": "contains",
+	"matches":  "matches",
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func newParser(expr string) (*parser, error) {
+	toks, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &parser{toks: toks}, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it is an operator or word with one of
+// the given texts.
+func (p *parser) accept(texts ...string) bool {
+	t := p.peek()
+	if t.kind != tokOp && t.kind != tokWord {
+		return false
+	}
+	for _, text := range texts {
+		if t.text == text {
+			p.pos++
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("syntax error at offset %d: %s", p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+// parse parses the whole filter, returning nil for an empty filter.
+func (p *parser) parse() (node, error) {
+	if p.peek().kind == tokEOF {
+		return nil, nil
+	}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected %v", p.peek())
+	}
+	return n, nil
+}
+
+func (p *parser) or() (node, error) {
+	n, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||", "or") {
+		m, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		n = orNode{n, m}
+	}
+	return n, nil
+}
+
+func (p *parser) and() (node, error) {
+	n, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&", "and") {
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		n = andNode{n, m}
+	}
+	return n, nil
+}
+
+func (p *parser) unary() (node, error) {
+	if p.accept("!", "not") {
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	}
+	if p.accept("(") {
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf("expected \")\", got %v", p.peek())
+		}
+		return n, nil
+	}
+	return p.test()
+}
+
+// test parses a field, optionally followed by a comparison.
+func (p *parser) test() (node, error) {
+	t := p.peek()
+	if t.kind != tokWord {
+		return nil, p.errorf("expected field, got %v", t)
+	}
+	p.next()
+	f, err := resolveField(t.text)
+	if err != nil {
+		return nil, err
+	}
+	op, ok := comparisons[p.peek().text]
+	if !ok || p.peek().kind == tokString || p.peek().kind == tokEOF {
+		pred, err := truth(f)
+		if err != nil {
+			return nil, err
+		}
+		return testNode{f: f, pred: pred}, nil
+	}
+	p.next()
+	value := p.next()
+	if value.kind != tokWord && value.kind != tokString {
+		return nil, fmt.Errorf("syntax error at offset %d: expected value, got %v", value.pos, value)
+	}
+	if op == "!=" {
+		pred, err := compilePredicate(f, "==", value)
+		if err != nil {
+			return nil, err
+		}
+		return testNode{f: f, pred: func(v reflect.Value) bool { return !pred(v) }, all: true}, nil
+	}
+	pred, err := compilePredicate(f, op, value)
+	if err != nil {
+		return nil, err
+	}
+	return testNode{f: f, pred: pred}, nil
+}
@@ -0,0 +1,372 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package flowexport exports flow records to collectors, with IPFIX or
+// NetFlow v9.
+//
+// An Exporter takes the records of a flowtable.Table, and packs them into
+// messages serialized with the layers.IPFIX and layers.NetFlowV9 layers.  It
+// manages the templates describing the records, resending them periodically
+// as required over UDP, and the sequence numbers of the messages.  Messages
+// are written to any io.Writer, one Write call each, so writing them to a UDP
+// connection sends one message per datagram:
+//
+//	exporter, err := flowexport.DialUDP("collector:4739", flowexport.DefaultExporterOptions)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer exporter.Close()
+//	table := flowtable.NewTable(func(r *flowtable.Record) {
+//		if err := exporter.Export(r); err != nil {
+//			log.Println(err)
+//		}
+//	}, flowtable.DefaultTableOptions)
+package flowexport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/flowtable"
+	"github.com/google/gopacket/layers"
+)
+
+// ExporterOptions controls the behavior of an Exporter.
+type ExporterOptions struct {
+	// Version is the version of the protocol exported: 9 for NetFlow v9,
+	// 10 for IPFIX.
+	Version uint16
+	// ObservationDomainID identifies the exporter to the collector, along
+	// with its address.  It is the source ID of NetFlow v9.
+	ObservationDomainID uint32
+	// MaxMessageSize is the maximum size of the messages, which should
+	// leave room for the IP and UDP headers within the path MTU.
+	MaxMessageSize int
+	// TemplateRefresh is the interval at which templates are sent again, for
+	// collectors which started after the first ones or lost them.
+	TemplateRefresh time.Duration
+}
+
+// DefaultExporterOptions provides default options for an Exporter, exporting
+// IPFIX.
+var DefaultExporterOptions = ExporterOptions{
+	Version:         10,
+	MaxMessageSize:  1400,
+	TemplateRefresh: 10 * time.Minute,
+}
+
+// Exporter exports flow records.  It is safe for concurrent use.
+type Exporter struct {
+	ExporterOptions
+	w         io.Writer
+	templates []layers.NetFlowTemplate // one per address family
+	lengths   []int                    // length of the records of each template
+	// now returns the current time, replaced by tests.
+	now func() time.Time
+
+	mu            sync.Mutex
+	start         time.Time // for the SysUptime of NetFlow v9
+	sequence      uint32
+	templatesSent time.Time
+	withTemplates bool // whether the pending message holds the templates
+	pending       [][]layers.NetFlowRecord
+	pendingSize   int
+	buf           gopacket.SerializeBuffer
+}
+
+const (
+	ipv4Template = iota
+	ipv6Template
+)
+
+// NewExporter returns a new Exporter writing its messages to w.
+func NewExporter(w io.Writer, options ExporterOptions) (*Exporter, error) {
+	if options.Version != 9 && options.Version != 10 {
+		return nil, fmt.Errorf("flowexport: invalid version %d", options.Version)
+	}
+	e := &Exporter{
+		ExporterOptions: options,
+		w:               w,
+		now:             time.Now,
+		buf:             gopacket.NewSerializeBuffer(),
+	}
+	for i, addr := range []int{net.IPv4len, net.IPv6len} {
+		t := newTemplate(uint16(256+i), addr, options.Version)
+		e.templates = append(e.templates, t)
+		length := 0
+		for _, f := range t.Fields {
+			length += int(f.Length)
+		}
+		e.lengths = append(e.lengths, length)
+	}
+	e.pending = make([][]layers.NetFlowRecord, len(e.templates))
+	if e.headerLength()+e.templatesLength()+4+e.lengths[ipv6Template]+3 > options.MaxMessageSize {
+		return nil, fmt.Errorf("flowexport: maximum message size %d too small", options.MaxMessageSize)
+	}
+	e.start = e.now()
+	return e, nil
+}
+
+// DialUDP returns a new Exporter sending its messages to the collector at the
+// given UDP address.  Closing it closes the connection.
+func DialUDP(addr string, options ExporterOptions) (*Exporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	e, err := NewExporter(conn, options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// newTemplate returns the template of the records of the flows whose
+// addresses are addr bytes long, for the given protocol version.  With IPFIX,
+// bidirectional flows are exported as one record with reverse fields (RFC
+// 5103), and records carry their end reason and absolute times.  NetFlow v9
+// only has the fields it defines: bidirectional flows are exported as two
+// records, without end reason, and with times relative to SysUptime.
+func newTemplate(id uint16, addr int, version uint16) layers.NetFlowTemplate {
+	src, dst := layers.NetFlowFieldSourceIPv4Address, layers.NetFlowFieldDestinationIPv4Address
+	if addr == net.IPv6len {
+		src, dst = layers.NetFlowFieldSourceIPv6Address, layers.NetFlowFieldDestinationIPv6Address
+	}
+	t := layers.NetFlowTemplate{ID: id, Fields: []layers.NetFlowField{
+		{Type: src, Length: uint16(addr)},
+		{Type: dst, Length: uint16(addr)},
+		{Type: layers.NetFlowFieldSourceTransportPort, Length: 2},
+		{Type: layers.NetFlowFieldDestinationTransportPort, Length: 2},
+		{Type: layers.NetFlowFieldProtocolIdentifier, Length: 1},
+	}}
+	if version == 10 {
+		t.Fields = append(t.Fields,
+			layers.NetFlowField{Type: layers.NetFlowFieldFlowEndReason, Length: 1},
+			layers.NetFlowField{Type: layers.NetFlowFieldFlowStartMilliseconds, Length: 8},
+			layers.NetFlowField{Type: layers.NetFlowFieldFlowEndMilliseconds, Length: 8})
+	} else {
+		// FIRST_SWITCHED and LAST_SWITCHED.
+		t.Fields = append(t.Fields,
+			layers.NetFlowField{Type: layers.NetFlowFieldFlowStartSysUpTime, Length: 4},
+			layers.NetFlowField{Type: layers.NetFlowFieldFlowEndSysUpTime, Length: 4})
+	}
+	t.Fields = append(t.Fields,
+		layers.NetFlowField{Type: layers.NetFlowFieldOctetDeltaCount, Length: 8},
+		layers.NetFlowField{Type: layers.NetFlowFieldPacketDeltaCount, Length: 8},
+		layers.NetFlowField{Type: layers.NetFlowFieldTCPControlBits, Length: 1})
+	if version == 10 {
+		for _, f := range t.Fields[len(t.Fields)-3:] {
+			f.EnterpriseNumber = layers.NetFlowReverseEnterpriseNumber
+			t.Fields = append(t.Fields, f)
+		}
+	}
+	return t
+}
+
+func (e *Exporter) headerLength() int {
+	if e.Version == 9 {
+		return 20
+	}
+	return 16
+}
+
+// templatesLength returns the length of the template set.
+func (e *Exporter) templatesLength() int {
+	length := 4
+	for _, t := range e.templates {
+		length += 4
+		for _, f := range t.Fields {
+			length += 4
+			if f.EnterpriseNumber != 0 {
+				length += 4
+			}
+		}
+	}
+	return length
+}
+
+// Export queues the record r of a flow for export, writing the pending
+// message first if r doesn't fit in it.  Flows of non-IP protocols can't be
+// exported.
+func (e *Exporter) Export(r *flowtable.Record) error {
+	src, dst := r.Key.Network.Endpoints()
+	template := ipv4Template
+	switch src.EndpointType() {
+	case layers.EndpointIPv4:
+	case layers.EndpointIPv6:
+		template = ipv6Template
+	default:
+		return fmt.Errorf("flowexport: can't export flow %v", r.Key)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var records []layers.NetFlowRecord
+	if e.Version == 10 {
+		records = append(records, e.record(template, src, dst, r.Key, r.Start, r.End, r.EndReason, &r.Forward, &r.Reverse))
+	} else {
+		records = append(records, e.record(template, src, dst, r.Key, r.Forward.First, r.Forward.Last, r.EndReason, &r.Forward, nil))
+		if r.Reverse.Packets > 0 {
+			records = append(records, e.record(template, dst, src, r.Key.Reverse(), r.Reverse.First, r.Reverse.Last, r.EndReason, &r.Reverse, nil))
+		}
+	}
+
+	for _, rec := range records {
+		size := e.lengths[template]
+		if len(e.pending[template]) == 0 {
+			// A new data set, with its header and padding.
+			size += 4 + 3
+		}
+		if e.pendingSize > 0 && e.pendingSize+size > e.MaxMessageSize {
+			if err := e.flush(); err != nil {
+				return err
+			}
+			size = e.lengths[template] + 4 + 3
+		}
+		if e.pendingSize == 0 {
+			e.pendingSize = e.headerLength()
+			now := e.now()
+			if e.withTemplates = e.templatesSent.IsZero() || now.Sub(e.templatesSent) >= e.TemplateRefresh; e.withTemplates {
+				e.pendingSize += e.templatesLength()
+			}
+		}
+		e.pending[template] = append(e.pending[template], rec)
+		e.pendingSize += size
+	}
+	return nil
+}
+
+// record returns a record of template for the flow from src to dst with the
+// given key, start and end times, end reason, and counters, as well as
+// reverse counters if reverse is set.  The end reason isn't exported with
+// NetFlow v9.
+func (e *Exporter) record(template int, src, dst gopacket.Endpoint, k flowtable.Key, start, end time.Time, reason flowtable.EndReason, c, reverse *flowtable.Counters) layers.NetFlowRecord {
+	t := &e.templates[template]
+	data := make([]byte, 0, e.lengths[template])
+	data = append(data, src.Raw()...)
+	data = append(data, dst.Raw()...)
+	srcPort, dstPort := k.Transport.Endpoints()
+	data = appendPort(data, srcPort)
+	data = appendPort(data, dstPort)
+	data = append(data, byte(k.Protocol))
+	if e.Version == 10 {
+		data = append(data, byte(reason))
+		data = appendUint64(data, uint64(start.UnixNano()/int64(time.Millisecond)))
+		data = appendUint64(data, uint64(end.UnixNano()/int64(time.Millisecond)))
+	} else {
+		data = appendUint32(data, e.sysUptime(start))
+		data = appendUint32(data, e.sysUptime(end))
+	}
+	for _, c := range []*flowtable.Counters{c, reverse} {
+		if c != nil {
+			data = appendUint64(data, c.Bytes)
+			data = appendUint64(data, c.Packets)
+			data = append(data, c.TCPFlags)
+		}
+	}
+	r := layers.NetFlowRecord{Fields: make([]layers.NetFlowFieldValue, len(t.Fields))}
+	for i, f := range t.Fields {
+		r.Fields[i] = layers.NetFlowFieldValue{NetFlowField: f, Value: data[:f.Length]}
+		data = data[f.Length:]
+	}
+	return r
+}
+
+func appendPort(b []byte, e gopacket.Endpoint) []byte {
+	if raw := e.Raw(); len(raw) == 2 {
+		return append(b, raw...)
+	}
+	return append(b, 0, 0)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	b = append(b, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(b[len(b)-4:], v)
+	return b
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	b = append(b, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(b[len(b)-8:], v)
+	return b
+}
+
+// sysUptime returns the SysUptime of NetFlow v9 at t, in milliseconds since
+// the exporter started, modulo 2^32.
+func (e *Exporter) sysUptime(t time.Time) uint32 {
+	return uint32(t.Sub(e.start) / time.Millisecond)
+}
+
+// Flush writes the pending message, if any.
+func (e *Exporter) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.flush()
+}
+
+func (e *Exporter) flush() error {
+	if e.pendingSize == 0 {
+		return nil
+	}
+	now := e.now()
+	var sets layers.NetFlowSets
+	if e.withTemplates {
+		sets.Templates = e.templates
+		e.templatesSent = now
+	}
+	records := 0
+	for i, rs := range e.pending {
+		if len(rs) > 0 {
+			sets.DataSets = append(sets.DataSets, layers.NetFlowDataSet{TemplateID: e.templates[i].ID, Records: rs})
+			records += len(rs)
+		}
+		e.pending[i] = nil
+	}
+	e.pendingSize = 0
+	var l gopacket.SerializableLayer
+	if e.Version == 10 {
+		l = &layers.IPFIX{
+			NetFlowSets:         sets,
+			ExportTime:          uint32(now.Unix()),
+			SequenceNumber:      e.sequence,
+			ObservationDomainID: e.ObservationDomainID,
+		}
+		// IPFIX counts the data records sent.
+		e.sequence += uint32(records)
+	} else {
+		l = &layers.NetFlowV9{
+			NetFlowSets:    sets,
+			SysUptime:      e.sysUptime(now),
+			UnixSecs:       uint32(now.Unix()),
+			SequenceNumber: e.sequence,
+			SourceID:       e.ObservationDomainID,
+		}
+		// NetFlow v9 counts the packets sent.
+		e.sequence++
+	}
+	if err := gopacket.SerializeLayers(e.buf, gopacket.SerializeOptions{FixLengths: true}, l); err != nil {
+		return err
+	}
+	_, err := e.w.Write(e.buf.Bytes())
+	return err
+}
+
+// Close writes the pending message, then closes the writer of the exporter
+// if it is an io.Closer.
+func (e *Exporter) Close() error {
+	err := e.Flush()
+	if c, ok := e.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
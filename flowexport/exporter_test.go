@@ -0,0 +1,205 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package flowexport
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/flowtable"
+	"github.com/google/gopacket/layers"
+)
+
+func testRecord(src, dst net.IP, srcPort, dstPort layers.TCPPort, start time.Time) *flowtable.Record {
+	netFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(src), layers.NewIPEndpoint(dst))
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(srcPort), layers.NewTCPPortEndpoint(dstPort))
+	return &flowtable.Record{
+		Key:       flowtable.Key{Protocol: layers.IPProtocolTCP, Network: netFlow, Transport: tcpFlow},
+		Forward:   flowtable.Counters{Packets: 3, Bytes: 300, First: start, Last: start.Add(time.Second), TCPFlags: 0x13},
+		Reverse:   flowtable.Counters{Packets: 2, Bytes: 1500, First: start.Add(time.Millisecond), Last: start.Add(time.Second), TCPFlags: 0x12},
+		Start:     start,
+		End:       start.Add(time.Second),
+		EndReason: flowtable.EndOfFlow,
+	}
+}
+
+// messages records the messages written to it.
+type messages [][]byte
+
+func (m *messages) Write(b []byte) (int, error) {
+	*m = append(*m, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func checkRecord(t *testing.T, r *layers.NetFlowRecord, src, dst string, srcPort, dstPort uint16, octets, packets uint64, flags, reason uint8) {
+	if r.SrcAddr.String() != src || r.DstAddr.String() != dst || r.SrcPort != srcPort || r.DstPort != dstPort {
+		t.Errorf("got flow %v:%d -> %v:%d, want %v:%d -> %v:%d", r.SrcAddr, r.SrcPort, r.DstAddr, r.DstPort, src, srcPort, dst, dstPort)
+	}
+	if r.Protocol != layers.IPProtocolTCP || r.Octets != octets || r.Packets != packets || r.TCPFlags != flags || r.FlowEndReason != reason {
+		t.Errorf("got protocol %v, %d octets, %d packets, flags %#x, end reason %d, want TCP, %d, %d, %#x, %d",
+			r.Protocol, r.Octets, r.Packets, r.TCPFlags, r.FlowEndReason, octets, packets, flags, reason)
+	}
+}
+
+func TestExporterIPFIX(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	options := DefaultExporterOptions
+	options.ObservationDomainID = 42
+	e, err := DialUDP(conn.LocalAddr().String(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	start := time.Unix(1500000000, 250*int64(time.Millisecond))
+	cache := layers.NewNetFlowTemplateCache(0)
+	buf := make([]byte, 65536)
+	for i, test := range []struct {
+		records   []*flowtable.Record
+		templates int
+		sequence  uint32
+	}{
+		{[]*flowtable.Record{
+			testRecord(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, 2}, 1000, 80, start),
+			testRecord(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 2000, 443, start),
+		}, 2, 0},
+		// Templates are only sent again after TemplateRefresh.
+		{[]*flowtable.Record{
+			testRecord(net.IP{10, 0, 0, 3}, net.IP{10, 0, 0, 4}, 1001, 80, start),
+		}, 0, 2},
+	} {
+		for _, r := range test.records {
+			if err := e.Export(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := e.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		x := &layers.IPFIX{}
+		x.SetTemplateCache(cache, gopacket.Endpoint{})
+		if err := x.DecodeFromBytes(buf[:n], gopacket.NilDecodeFeedback); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if len(x.Templates) != test.templates || x.SequenceNumber != test.sequence || x.ObservationDomainID != 42 {
+			t.Errorf("message %d: got %d templates, sequence %d, domain %d, want %d, %d, 42", i, len(x.Templates), x.SequenceNumber, x.ObservationDomainID, test.templates, test.sequence)
+		}
+		var records []*layers.NetFlowRecord
+		for j := range x.DataSets {
+			for k := range x.DataSets[j].Records {
+				records = append(records, &x.DataSets[j].Records[k])
+			}
+		}
+		if len(records) != len(test.records) {
+			t.Fatalf("message %d: got %d records, want %d", i, len(records), len(test.records))
+		}
+		for j, r := range records {
+			src, dst := test.records[j].Key.Network.Endpoints()
+			srcPort, dstPort := test.records[j].Key.Transport.Endpoints()
+			checkRecord(t, r, src.String(), dst.String(), binary.BigEndian.Uint16(srcPort.Raw()), binary.BigEndian.Uint16(dstPort.Raw()), 300, 3, 0x13, uint8(flowtable.EndOfFlow))
+			if r.ReverseOctets != 1500 || r.ReversePackets != 2 {
+				t.Errorf("message %d record %d: got reverse %d octets, %d packets, want 1500, 2", i, j, r.ReverseOctets, r.ReversePackets)
+			}
+			if !r.FlowStart.Equal(start) || !r.FlowEnd.Equal(start.Add(time.Second)) {
+				t.Errorf("message %d record %d: got times %v - %v, want %v - %v", i, j, r.FlowStart, r.FlowEnd, start, start.Add(time.Second))
+			}
+		}
+	}
+}
+
+func TestExporterNetFlowV9(t *testing.T) {
+	var m messages
+	options := DefaultExporterOptions
+	options.Version = 9
+	options.MaxMessageSize = 190
+	e, err := NewExporter(&m, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	e.now = func() time.Time { return now }
+	e.start = now.Add(-time.Minute)
+
+	// Each flow is exported as two unidirectional records, 38 bytes long:
+	// messages with the templates only have room for one of them, the
+	// other ones for four.  Templates are sent again after TemplateRefresh.
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			now = now.Add(options.TemplateRefresh)
+			e.start = e.start.Add(options.TemplateRefresh)
+		}
+		if err := e.Export(testRecord(net.IP{10, 0, 0, 1}, net.IP{10, 0, 0, byte(2 + i)}, 1000, 80, now)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := layers.NewNetFlowTemplateCache(0)
+	var got []int
+	forward := true
+	for i, b := range m {
+		if len(b) > options.MaxMessageSize {
+			t.Errorf("message %d: %d bytes long, want at most %d", i, len(b), options.MaxMessageSize)
+		}
+		n := &layers.NetFlowV9{}
+		n.SetTemplateCache(cache, gopacket.Endpoint{})
+		if err := n.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if n.SequenceNumber != uint32(i) || n.SysUptime != 60000 {
+			t.Errorf("message %d: got sequence %d, uptime %d, want %d, 60000", i, n.SequenceNumber, n.SysUptime, i)
+		}
+		records := 0
+		for _, s := range n.DataSets {
+			for j := range s.Records {
+				r := &s.Records[j]
+				// Times are relative to SysUptime, the flows starting when
+				// the messages are sent.
+				if forward {
+					checkRecord(t, r, "10.0.0.1", r.DstAddr.String(), 1000, 80, 300, 3, 0x13, 0)
+					if r.FirstSwitched != 60000 || r.LastSwitched != 61000 {
+						t.Errorf("message %d: got times %d - %d, want 60000 - 61000", i, r.FirstSwitched, r.LastSwitched)
+					}
+				} else {
+					checkRecord(t, r, r.SrcAddr.String(), "10.0.0.1", 80, 1000, 1500, 2, 0x12, 0)
+					if r.FirstSwitched != 60001 || r.LastSwitched != 61000 {
+						t.Errorf("message %d: got times %d - %d, want 60001 - 61000", i, r.FirstSwitched, r.LastSwitched)
+					}
+				}
+				if !r.FlowStart.IsZero() || !r.FlowEnd.IsZero() {
+					t.Errorf("message %d: got absolute times %v - %v", i, r.FlowStart, r.FlowEnd)
+				}
+				forward = !forward
+			}
+			records += len(s.Records)
+		}
+		got = append(got, len(n.Templates), records)
+	}
+	want := []int{2, 1, 0, 4, 2, 1}
+	if len(got) != len(want) {
+		t.Fatalf("got (templates, records) %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got (templates, records) %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package flowtable provides bidirectional flow accounting.
+//
+// A Table groups packets into flows by their 5-tuple (protocol, addresses and
+// ports), both directions of a flow sharing an entry, and keeps IPFIX-style
+// statistics for each direction: packet and byte counts, first and last
+// timestamps, and the union of the TCP flags seen.  Flows are expired after
+// an idle timeout, or an active timeout for long-lived ones, and their
+// statistics emitted as a Record through a callback:
+//
+//	table := flowtable.NewTable(func(r *flowtable.Record) {
+//		fmt.Println(r.Key, r.Forward.Packets, r.Reverse.Packets, r.EndReason)
+//	}, flowtable.DefaultTableOptions)
+//	for packet := range packetSource.Packets() {
+//		table.Add(packet)
+//	}
+//	table.FlushAll()
+//
+// The Table is split into shards, each with its own lock, so multiple
+// goroutines may update it at once.
+package flowtable
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Key identifies a flow by its 5-tuple.  The flows go from the initiator of
+// the flow, the host sending its first packet, to the responder.  Packets
+// without a transport layer have a zero Transport flow.
+type Key struct {
+	Protocol  layers.IPProtocol
+	Network   gopacket.Flow
+	Transport gopacket.Flow
+}
+
+// Reverse returns the key of the packets sent the other way.
+func (k Key) Reverse() Key {
+	return Key{k.Protocol, k.Network.Reverse(), k.Transport.Reverse()}
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf("%v %v:%v", k.Protocol, k.Network, k.Transport)
+}
+
+// canonical returns the key shared by both directions of a flow, and whether
+// it is the reverse of k.
+func (k Key) canonical() (Key, bool) {
+	src, dst := k.Network.Endpoints()
+	if src == dst {
+		src, dst = k.Transport.Endpoints()
+	}
+	if dst.LessThan(src) {
+		return k.Reverse(), true
+	}
+	return k, false
+}
+
+// hash returns a hash of the key, the same for both directions.
+func (k Key) hash() uint64 {
+	return (k.Network.FastHash()*1099511628211+k.Transport.FastHash())*1099511628211 + uint64(k.Protocol)
+}
+
+// EndReason tells why a flow was expired.  Its values are the ones of the
+// flowEndReason IPFIX information element.
+type EndReason uint8
+
+const (
+	// EndIdleTimeout: no packet was seen for the idle timeout.
+	EndIdleTimeout EndReason = 1
+	// EndActiveTimeout: the flow lasted for the active timeout.  It goes on
+	// in a new record.
+	EndActiveTimeout EndReason = 2
+	// EndOfFlow: the TCP connection was closed by FINs or reset.
+	EndOfFlow EndReason = 3
+	// EndForced: the flow was expired by FlushAll.
+	EndForced EndReason = 4
+)
+
+func (r EndReason) String() string {
+	switch r {
+	case EndIdleTimeout:
+		return "IdleTimeout"
+	case EndActiveTimeout:
+		return "ActiveTimeout"
+	case EndOfFlow:
+		return "EndOfFlow"
+	case EndForced:
+		return "Forced"
+	default:
+		return fmt.Sprintf("EndReason(%d)", uint8(r))
+	}
+}
+
+// Counters are the statistics of one direction of a flow.
+type Counters struct {
+	// Packets and Bytes count the packets seen, and their bytes from the
+	// start of the network layer.
+	Packets, Bytes uint64
+	// First and Last are the timestamps of the first and last packets
+	// seen, zero if none was.
+	First, Last time.Time
+	// TCPFlags is the union of the flags of the TCP packets seen, as laid
+	// out in the TCP header (FIN is 0x01, SYN 0x02...).
+	TCPFlags uint8
+}
+
+func (c *Counters) add(length int, flags uint8, ts time.Time) {
+	if c.Packets == 0 || ts.Before(c.First) {
+		c.First = ts
+	}
+	if ts.After(c.Last) {
+		c.Last = ts
+	}
+	c.Packets++
+	c.Bytes += uint64(length)
+	c.TCPFlags |= flags
+}
+
+// Record holds the statistics of an expired flow.
+type Record struct {
+	Key Key
+	// Forward counts the packets sent by the initiator, Reverse the ones
+	// sent by the responder.
+	Forward, Reverse Counters
+	// Start and End are the timestamps of the first and last packets of
+	// the flow.
+	Start, End time.Time
+	EndReason  EndReason
+}
+
+// TCPFlags returns the flags of t as laid out in the TCP header.
+func TCPFlags(t *layers.TCP) (flags uint8) {
+	for i, set := range []bool{t.FIN, t.SYN, t.RST, t.PSH, t.ACK, t.URG, t.ECE, t.CWR} {
+		if set {
+			flags |= 1 << uint(i)
+		}
+	}
+	return
+}
+
+const (
+	tcpFIN = 0x01
+	tcpRST = 0x04
+)
+
+// flow is a flow entry of a Table.
+type flow struct {
+	Record
+	// ended is set once both sides sent a FIN, or one sent a RST.
+	ended bool
+}
+
+func (f *flow) expire(reason EndReason) *Record {
+	r := f.Record
+	r.EndReason = reason
+	return &r
+}
+
+// TableOptions controls the behavior of a Table.
+type TableOptions struct {
+	// IdleTimeout is the time after which flows without packets expire.
+	IdleTimeout time.Duration
+	// ActiveTimeout is the time after which flows expire regardless of their
+	// activity, so that long-lived flows get reported periodically.  If <=
+	// 0, flows only expire when idle.
+	ActiveTimeout time.Duration
+	// Shards is the number of parts the table is split into, to avoid lock
+	// contention.  If <= 0, it is split into one shard per CPU.
+	Shards int
+}
+
+// DefaultTableOptions provides default options for a Table, following the
+// common defaults of flow exporters.
+var DefaultTableOptions = TableOptions{
+	IdleTimeout:   15 * time.Second,
+	ActiveTimeout: 30 * time.Minute,
+}
+
+type shard struct {
+	mu    sync.Mutex
+	flows map[Key]*flow
+}
+
+// Table keeps track of bidirectional flows.  It is safe for concurrent use.
+type Table struct {
+	TableOptions
+	expired func(*Record)
+	shards  []shard
+}
+
+// NewTable creates a new flow table, passing the records of its flows to
+// expired when they expire.  expired is called without any lock held, and
+// must be safe for concurrent use if the Table is used concurrently.
+func NewTable(expired func(r *Record), options TableOptions) *Table {
+	n := options.Shards
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	t := &Table{TableOptions: options, expired: expired, shards: make([]shard, n)}
+	for i := range t.shards {
+		t.shards[i].flows = make(map[Key]*flow)
+	}
+	return t
+}
+
+// Add accounts packet p to its flow.  Packets without a network layer are
+// ignored.  The timestamp of the packet is taken from its metadata.
+func (t *Table) Add(p gopacket.Packet) {
+	net := p.NetworkLayer()
+	if net == nil {
+		return
+	}
+	k := Key{Network: net.NetworkFlow()}
+	switch ip := net.(type) {
+	case *layers.IPv4:
+		k.Protocol = ip.Protocol
+	case *layers.IPv6:
+		k.Protocol = ip.NextHeader
+	}
+	var flags uint8
+	if tr := p.TransportLayer(); tr != nil {
+		k.Transport = tr.TransportFlow()
+		switch tr := tr.(type) {
+		case *layers.TCP:
+			k.Protocol = layers.IPProtocolTCP
+			flags = TCPFlags(tr)
+		case *layers.UDP:
+			k.Protocol = layers.IPProtocolUDP
+		case *layers.UDPLite:
+			k.Protocol = layers.IPProtocolUDPLite
+		case *layers.SCTP:
+			k.Protocol = layers.IPProtocolSCTP
+		}
+	}
+	t.Update(k, len(net.LayerContents())+len(net.LayerPayload()), flags, p.Metadata().Timestamp)
+}
+
+// Update accounts a packet with key k, length bytes long from the start of
+// its network layer, with the given TCP flags, and seen at ts, to its flow.
+func (t *Table) Update(k Key, length int, tcpFlags uint8, ts time.Time) {
+	ck, _ := k.canonical()
+	s := &t.shards[ck.hash()%uint64(len(t.shards))]
+	var expired *Record
+	s.mu.Lock()
+	f := s.flows[ck]
+	if f != nil && t.ActiveTimeout > 0 && ts.Sub(f.Start) >= t.ActiveTimeout {
+		// The flow goes on in a new record, in the same direction.
+		expired = f.expire(EndActiveTimeout)
+		f = &flow{Record: Record{Key: f.Key}}
+		s.flows[ck] = f
+	}
+	if f == nil {
+		f = &flow{Record: Record{Key: k}}
+		s.flows[ck] = f
+	}
+	c, peer := &f.Forward, &f.Reverse
+	if k != f.Key {
+		c, peer = peer, c
+	}
+	c.add(length, tcpFlags, ts)
+	if f.Start.IsZero() || ts.Before(f.Start) {
+		f.Start = ts
+	}
+	if ts.After(f.End) {
+		f.End = ts
+	}
+	if tcpFlags&tcpRST != 0 || c.TCPFlags&peer.TCPFlags&tcpFIN != 0 {
+		f.ended = true
+	}
+	s.mu.Unlock()
+	if expired != nil {
+		t.expired(expired)
+	}
+}
+
+// expire expires the flows of every shard for which reason returns a reason,
+// and returns the number of flows expired.
+func (t *Table) expire(reason func(f *flow) EndReason) (expired int) {
+	var records []*Record
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		for k, f := range s.flows {
+			if r := reason(f); r != 0 {
+				records = append(records, f.expire(r))
+				delete(s.flows, k)
+			}
+		}
+		s.mu.Unlock()
+		for _, r := range records {
+			t.expired(r)
+		}
+		expired += len(records)
+		records = records[:0]
+	}
+	return
+}
+
+// Expire expires the flows which timed out at now, or whose TCP connection
+// was closed, and returns the number of flows expired.  It should be called
+// periodically, with the current time for live captures, or the timestamp
+// of the last packet when reading from files.
+func (t *Table) Expire(now time.Time) int {
+	return t.expire(func(f *flow) EndReason {
+		switch {
+		case f.ended:
+			return EndOfFlow
+		case now.Sub(f.End) >= t.IdleTimeout:
+			return EndIdleTimeout
+		case t.ActiveTimeout > 0 && now.Sub(f.Start) >= t.ActiveTimeout:
+			return EndActiveTimeout
+		}
+		return 0
+	})
+}
+
+// FlushAll expires all flows, and returns the number of flows expired.
+func (t *Table) FlushAll() int {
+	return t.expire(func(f *flow) EndReason {
+		if f.ended {
+			return EndOfFlow
+		}
+		return EndForced
+	})
+}
+
+// Len returns the number of flows in the table.
+func (t *Table) Len() (n int) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.mu.Lock()
+		n += len(s.flows)
+		s.mu.Unlock()
+	}
+	return
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package flowtable
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	client = net.IP{10, 0, 0, 1}
+	server = net.IP{10, 0, 0, 2}
+)
+
+// testTCPPacket returns a decoded TCP packet between client and server.
+func testTCPPacket(t *testing.T, fromClient bool, tcp layers.TCP, payload string, ts time.Time) gopacket.Packet {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: client, DstIP: server}
+	tcp.SrcPort, tcp.DstPort = 1000, 80
+	if !fromClient {
+		ip.SrcIP, ip.DstIP = server, client
+		tcp.SrcPort, tcp.DstPort = 80, 1000
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, &tcp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	p := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+	p.Metadata().Timestamp = ts
+	return p
+}
+
+func testUDPKey(srcPort, dstPort layers.UDPPort) Key {
+	netFlow, _ := gopacket.FlowFromEndpoints(layers.NewIPEndpoint(client), layers.NewIPEndpoint(server))
+	udpFlow, _ := gopacket.FlowFromEndpoints(layers.NewUDPPortEndpoint(srcPort), layers.NewUDPPortEndpoint(dstPort))
+	return Key{layers.IPProtocolUDP, netFlow, udpFlow}
+}
+
+func TestTCPFlow(t *testing.T) {
+	var records []*Record
+	table := NewTable(func(r *Record) { records = append(records, r) }, DefaultTableOptions)
+	start := time.Unix(100, 0)
+	for i, p := range []struct {
+		fromClient bool
+		tcp        layers.TCP
+		payload    string
+	}{
+		// The handshake of the server is seen first.
+		{false, layers.TCP{SYN: true, ACK: true}, ""},
+		{true, layers.TCP{ACK: true, PSH: true}, "request"},
+		{false, layers.TCP{ACK: true, PSH: true}, "response"},
+		{true, layers.TCP{FIN: true, ACK: true}, ""},
+		{false, layers.TCP{FIN: true, ACK: true}, ""},
+	} {
+		table.Add(testTCPPacket(t, p.fromClient, p.tcp, p.payload, start.Add(time.Duration(i)*time.Second)))
+	}
+	if n := table.Len(); n != 1 {
+		t.Fatalf("got %d flows, want 1", n)
+	}
+	if n := table.Expire(start.Add(5 * time.Second)); n != 1 {
+		t.Fatalf("expired %d flows, want 1", n)
+	}
+	r := records[0]
+	if want := "TCP 10.0.0.2->10.0.0.1:80->1000"; r.Key.String() != want {
+		t.Errorf("key: got %v, want %v", r.Key, want)
+	}
+	if r.EndReason != EndOfFlow {
+		t.Errorf("end reason: got %v, want %v", r.EndReason, EndOfFlow)
+	}
+	if !r.Start.Equal(start) || !r.End.Equal(start.Add(4*time.Second)) {
+		t.Errorf("flow from %v to %v", r.Start, r.End)
+	}
+	// IPv4 and TCP headers are 40 bytes long.
+	if want := (Counters{3, 40*3 + 8, start, start.Add(4 * time.Second), 0x1a | 0x01 | 0x02}); r.Forward != want {
+		t.Errorf("forward counters: got %+v, want %+v", r.Forward, want)
+	}
+	if want := (Counters{2, 40*2 + 7, start.Add(time.Second), start.Add(3 * time.Second), 0x18 | 0x01}); r.Reverse != want {
+		t.Errorf("reverse counters: got %+v, want %+v", r.Reverse, want)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	var records []*Record
+	options := DefaultTableOptions
+	options.IdleTimeout, options.ActiveTimeout, options.Shards = 10*time.Second, time.Minute, 4
+	table := NewTable(func(r *Record) { records = append(records, r) }, options)
+	start := time.Unix(100, 0)
+	dns, syslog := testUDPKey(1000, 53), testUDPKey(1001, 514)
+	table.Update(dns, 50, 0, start)
+	table.Update(dns.Reverse(), 100, 0, start.Add(time.Second))
+	for i := 0; i < 60; i += 5 {
+		table.Update(syslog, 200, 0, start.Add(time.Duration(i)*time.Second))
+	}
+	// The packet starting a new record keeps the direction of the flow.
+	table.Update(syslog.Reverse(), 200, 0, start.Add(time.Minute))
+	if len(records) != 1 || records[0].EndReason != EndActiveTimeout || records[0].Forward.Packets != 12 {
+		t.Fatalf("got records %+v, want the first 12 syslog packets", records)
+	}
+	if n := table.Expire(start.Add(10 * time.Second)); n != 0 {
+		t.Errorf("expired %d flows before their idle timeout", n)
+	}
+	if n := table.Expire(start.Add(11 * time.Second)); n != 1 {
+		t.Fatalf("expired %d flows, want 1", n)
+	}
+	if r := records[1]; r.Key != dns || r.EndReason != EndIdleTimeout || r.Forward.Bytes != 50 || r.Reverse.Bytes != 100 {
+		t.Errorf("got record %+v, want dns flow", r)
+	}
+	if n := table.FlushAll(); n != 1 {
+		t.Fatalf("flushed %d flows, want 1", n)
+	}
+	if r := records[2]; r.Key != syslog || r.EndReason != EndForced || r.Forward.Packets != 0 || r.Reverse.Packets != 1 {
+		t.Errorf("got record %+v, want last syslog packet, in reverse", r)
+	}
+	if n := table.Len(); n != 0 {
+		t.Errorf("%d flows left", n)
+	}
+}
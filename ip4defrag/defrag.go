@@ -71,9 +71,13 @@ func (d *IPv4Defragmenter) DefragIPv4(in *layers.IPv4) (*layers.IPv4, error) {
 	if st := d.dontDefrag(in); st == true {
 		return in, nil
 	}
+	d.Lock()
+	defer d.Unlock()
+	d.stats.Fragments++
 	// perfom security checks
 	st, err := d.securityChecks(in)
 	if err != nil || st == false {
+		d.stats.Dropped++
 		return nil, err
 	}
 
@@ -81,39 +85,104 @@ func (d *IPv4Defragmenter) DefragIPv4(in *layers.IPv4) (*layers.IPv4, error) {
 	debug.Printf("defrag: got in.Id=%d in.FragOffset=%d in.Flags=%d\n",
 		in.Id, in.FragOffset*8, in.Flags)
 
-	// do we already has seen a flow between src/dst with that Id
+	// make room for the fragment within the byte budget, discarding
+	// the packets we haven't heard about for the longest time
 	ipf := newIPv4(in)
-	var fl *fragmentList
-	var exist bool
-	d.Lock()
-	fl, exist = d.ipFlows[ipf]
+	if max := d.MaxBufferedBytes; max > 0 {
+		for d.buffered+len(in.Payload) > max {
+			e := d.lru.Front()
+			if e == nil {
+				d.stats.Dropped++
+				return nil, fmt.Errorf("defrag: fragment of %d bytes "+
+					"exceeds the %d bytes budget", len(in.Payload), max)
+			}
+			old := e.Value.(*fragmentList)
+			debug.Printf("defrag: over budget, discarding flow with %d bytes\n", old.Current)
+			d.stats.Dropped += old.Received
+			d.remove(old)
+		}
+	}
+
+	// do we already has seen a flow between src/dst with that Id
+	fl, exist := d.ipFlows[ipf]
 	if !exist {
 		debug.Printf("defrag: creating a new flow\n")
-		fl = new(fragmentList)
+		fl = &fragmentList{key: ipf}
+		fl.elem = d.lru.PushBack(fl)
 		d.ipFlows[ipf] = fl
+	} else {
+		d.lru.MoveToBack(fl.elem)
 	}
-	d.Unlock()
 	// insert, and if final build it
-	out, err2 := fl.insert(in)
+	before := fl.Current
+	overlaps := fl.insert(in, d.OverlapPolicy)
+	d.buffered += fl.Current - before
+	d.stats.Overlaps += overlaps
+
+	if fl.complete() {
+		out, err := fl.build(in)
+		d.remove(fl)
+		if err != nil {
+			d.stats.Dropped += fl.Received
+			return nil, err
+		}
+		d.stats.Reassembled++
+		return out, nil
+	}
 
 	// at last, if we hit the maximum frag list len
 	// without any defrag success, we just drop everything and
 	// raise an error
-	if out == nil && fl.List.Len()+1 > IPv4MaximumFragmentListLen {
-		d.Lock()
-		fl = new(fragmentList)
-		d.ipFlows[ipf] = fl
-		d.Unlock()
+	max := d.MaxFragmentListLen
+	if max <= 0 {
+		max = IPv4MaximumFragmentListLen
+	}
+	if fl.Received >= max {
+		d.remove(fl)
+		d.stats.Dropped += fl.Received
 		return nil, fmt.Errorf("defrag: Fragment List hits its maximum"+
-			"size(%d), without sucess. Flushing the list",
-			IPv4MaximumFragmentListLen)
+			"size(%d), without sucess. Flushing the list", max)
 	}
+	return nil, nil
+}
 
-	// if we got a packet, it's a new one, and he is defragmented
-	if out != nil {
-		return out, nil
+// DefragPacket implements gopacket.Defragmenter, so that a
+// gopacket.PacketSource hands out reassembled IPv4 datagrams.  It runs
+// DefragIPv4 on the first IPv4 layer of p.  Once a datagram is complete,
+// the returned packet holds the layers of its last fragment preceding
+// IPv4, followed by the whole datagram, and carries the last fragment's
+// metadata.
+func (d *IPv4Defragmenter) DefragPacket(p gopacket.Packet, opts gopacket.DecodeOptions) (gopacket.Packet, error) {
+	in, ok := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return p, nil
+	}
+	out, err := d.DefragIPv4(in)
+	if err != nil || out == nil {
+		return nil, err
+	} else if out == in {
+		return p, nil
+	}
+	buf := gopacket.NewSerializeBuffer()
+	sopts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, sopts, out, gopacket.Payload(out.Payload)); err != nil {
+		return nil, err
 	}
-	return nil, err2
+	return gopacket.RebuildPacket(p, in, buf.Bytes(), opts)
+}
+
+// Stats returns the counters of the defragmenter.
+func (d *IPv4Defragmenter) Stats() Stats {
+	d.RLock()
+	defer d.RUnlock()
+	return d.stats
+}
+
+// remove forgets about a packet being defragmented.
+func (d *IPv4Defragmenter) remove(fl *fragmentList) {
+	delete(d.ipFlows, fl.key)
+	d.lru.Remove(fl.elem)
+	d.buffered -= fl.Current
 }
 
 // DiscardOlderThan forgets all packets without any activity since
@@ -122,12 +191,13 @@ func (d *IPv4Defragmenter) DefragIPv4(in *layers.IPv4) (*layers.IPv4, error) {
 func (d *IPv4Defragmenter) DiscardOlderThan(t time.Time) int {
 	var nb int
 	d.Lock()
-	for k, v := range d.ipFlows {
+	for _, v := range d.ipFlows {
 		if v.LastSeen.Before(t) {
 			nb = nb + 1
-			delete(d.ipFlows, k)
+			d.remove(v)
 		}
 	}
+	d.stats.Timeouts += nb
 	d.Unlock()
 	return nb
 }
@@ -164,50 +234,126 @@ func (d *IPv4Defragmenter) securityChecks(ip *layers.IPv4) (bool, error) {
 	return true, nil
 }
 
+// fragment is a part of a fragment held by a fragmentList: the data at
+// offset, cut out of the fragment at [start, end) as received.
+type fragment struct {
+	start, end int
+	offset     int
+	data       []byte
+}
+
+// cut returns the parts of f outside of [from, to).
+func (f *fragment) cut(from, to int) (left, right *fragment) {
+	if f.offset < from {
+		left = &fragment{f.start, f.end, f.offset, f.data[:from-f.offset]}
+	}
+	if f.offset+len(f.data) > to {
+		right = &fragment{f.start, f.end, to, f.data[to-f.offset:]}
+	}
+	return
+}
+
 // fragmentList holds a container/list used to contains IP
-// packets/fragments.  It stores internal counters to track the
+// fragments.  It stores internal counters to track the
 // maximum total of byte, and the current length it has received.
 // It also stores a flag to know if he has seen the last packet.
+//
+// Overlaps are resolved as fragments are inserted, so the list holds
+// the non-overlapping data that will make the final datagram, sorted by
+// offset.
 type fragmentList struct {
 	List          list.List
-	Highest       uint16
-	Current       uint16
+	Highest       int
+	Current       int
+	Received      int
 	FinalReceived bool
 	LastSeen      time.Time
+
+	key  ipv4
+	elem *list.Element
 }
 
-// insert insert an IPv4 fragment/packet into the Fragment List
-// It use the following strategy : we are inserting fragment based
-// on their offset, latest first. This is sometimes called BSD-Right.
-// See: http://www.sans.org/reading-room/whitepapers/detection/ip-fragment-reassembly-scapy-33969
-func (f *fragmentList) insert(in *layers.IPv4) (*layers.IPv4, error) {
+// insert insert an IPv4 fragment/packet into the Fragment List,
+// resolving overlaps with the fragments already there according to
+// policy.  It returns the number of fragments the new one overlapped.
+func (f *fragmentList) insert(in *layers.IPv4, policy OverlapPolicy) int {
 	// TODO: should keep a copy of *in in the list
 	// or not (ie the packet source is reliable) ?
-	fragOffset := in.FragOffset * 8
-	if fragOffset >= f.Highest {
-		f.List.PushBack(in)
-	} else {
-		for e := f.List.Front(); e != nil; e = e.Next() {
-			frag, _ := e.Value.(*layers.IPv4)
-			if in.FragOffset <= frag.FragOffset {
-				debug.Printf("defrag: inserting frag %d before existing frag %d \n",
-					fragOffset, frag.FragOffset*8)
-				f.List.InsertBefore(in, e)
-				break
+	start := int(in.FragOffset) * 8
+	end := start + len(in.Payload)
+	pieces := []*fragment{{start, end, start, in.Payload}}
+	overlaps := 0
+	for e := f.List.Front(); e != nil; {
+		next := e.Next()
+		old := e.Value.(*fragment)
+		oldEnd := old.offset + len(old.data)
+		if old.offset >= end || oldEnd <= start {
+			e = next
+			continue
+		}
+		overlaps++
+		if policy.newWins(start, end, old.start, old.end) {
+			debug.Printf("defrag: fragment %d-%d overrides %d-%d\n",
+				start, end, old.offset, oldEnd)
+			left, right := old.cut(start, end)
+			for _, p := range []*fragment{left, right} {
+				if p != nil {
+					f.List.InsertBefore(p, e)
+				}
+			}
+			f.List.Remove(e)
+			f.Current -= len(old.data)
+			if left != nil {
+				f.Current += len(left.data)
+			}
+			if right != nil {
+				f.Current += len(right.data)
+			}
+		} else {
+			debug.Printf("defrag: fragment %d-%d overridden by %d-%d\n",
+				start, end, old.offset, oldEnd)
+			var kept []*fragment
+			for _, p := range pieces {
+				if p.offset >= oldEnd || p.offset+len(p.data) <= old.offset {
+					kept = append(kept, p)
+					continue
+				}
+				left, right := p.cut(old.offset, oldEnd)
+				if left != nil {
+					kept = append(kept, left)
+				}
+				if right != nil {
+					kept = append(kept, right)
+				}
 			}
+			pieces = kept
+		}
+		e = next
+	}
+	for _, p := range pieces {
+		if len(p.data) == 0 {
+			continue
+		}
+		e := f.List.Front()
+		for e != nil && e.Value.(*fragment).offset < p.offset {
+			e = e.Next()
+		}
+		if e != nil {
+			f.List.InsertBefore(p, e)
+		} else {
+			f.List.PushBack(p)
 		}
+		f.Current += len(p.data)
 	}
 	// packet.Metadata().Timestamp should have been better, but
 	// we don't have this info there...
 	f.LastSeen = time.Now()
+	f.Received++
 
-	fragLength := in.Length - 20
 	// After inserting the Fragment, we update the counters
-	if f.Highest < fragOffset+fragLength {
-		f.Highest = fragOffset + fragLength
+	if f.Highest < end {
+		f.Highest = end
 	}
-	f.Current = f.Current + fragLength
-
 	debug.Printf("defrag: insert ListLen: %d Highest:%d Current:%d\n",
 		f.List.Len(),
 		f.Highest, f.Current)
@@ -216,44 +362,30 @@ func (f *fragmentList) insert(in *layers.IPv4) (*layers.IPv4, error) {
 	if in.Flags&layers.IPv4MoreFragments == 0 {
 		f.FinalReceived = true
 	}
-	// Ready to try defrag ?
-	if f.FinalReceived && f.Highest == f.Current {
-		return f.build(in)
-	}
-	return nil, nil
+	return overlaps
 }
 
-// Build builds the final datagram, modifying ip in place.
-// It puts priority to packet in the early position of the list.
-// See Insert for more details.
-func (f *fragmentList) build(in *layers.IPv4) (*layers.IPv4, error) {
-	var final []byte
-	var currentOffset uint16 = 0
+// complete returns whether all the data of the datagram has been
+// received.
+func (f *fragmentList) complete() bool {
+	return f.FinalReceived && f.Highest == f.Current
+}
 
+// Build builds the final datagram from the fragments, taking the header
+// fields from in.
+func (f *fragmentList) build(in *layers.IPv4) (*layers.IPv4, error) {
+	final := make([]byte, 0, f.Highest)
 	debug.Printf("defrag: building the datagram \n")
 	for e := f.List.Front(); e != nil; e = e.Next() {
-		frag, _ := e.Value.(*layers.IPv4)
-		if frag.FragOffset*8 == currentOffset {
-			debug.Printf("defrag: building - adding %d\n", frag.FragOffset*8)
-			final = append(final, frag.Payload...)
-			currentOffset = currentOffset + frag.Length - 20
-		} else if frag.FragOffset*8 < currentOffset {
-			// overlapping fragment - let's take only what we need
-			startAt := currentOffset - frag.FragOffset*8
-			debug.Printf("defrag: building - overlapping, starting at %d\n",
-				startAt)
-			if startAt > frag.Length-20 {
-				return nil, fmt.Errorf("defrag: building - invalid fragment")
-			}
-			final = append(final, frag.Payload[startAt:]...)
-			currentOffset = currentOffset + frag.FragOffset*8
-		} else {
+		frag := e.Value.(*fragment)
+		if frag.offset != len(final) {
 			// Houston - we have an hole !
 			debug.Printf("defrag: hole found while building, " +
 				"stopping the defrag process\n")
 			return nil, fmt.Errorf("defrag: building - hole found")
 		}
-		debug.Printf("defrag: building - next is %d\n", currentOffset)
+		debug.Printf("defrag: building - adding %d\n", frag.offset)
+		final = append(final, frag.data...)
 	}
 
 	// TODO recompute IP Checksum
@@ -261,7 +393,7 @@ func (f *fragmentList) build(in *layers.IPv4) (*layers.IPv4, error) {
 		Version:    in.Version,
 		IHL:        in.IHL,
 		TOS:        in.TOS,
-		Length:     f.Highest,
+		Length:     uint16(f.Highest),
 		Id:         0,
 		Flags:      0,
 		FragOffset: 0,
@@ -296,13 +428,119 @@ func newIPv4(ip *layers.IPv4) ipv4 {
 // all fragment/packet.
 type IPv4Defragmenter struct {
 	sync.RWMutex
-	ipFlows map[ipv4]*fragmentList
+	IPv4DefragmenterOptions
+	ipFlows  map[ipv4]*fragmentList
+	lru      list.List // of *fragmentList, least recently updated first
+	buffered int
+	stats    Stats
 }
 
 // NewIPv4Defragmenter returns a new IPv4Defragmenter
 // with an initialized map.
+//
+// This sets the defragmenter options to DefaultIPv4DefragmenterOptions.
 func NewIPv4Defragmenter() *IPv4Defragmenter {
 	return &IPv4Defragmenter{
-		ipFlows: make(map[ipv4]*fragmentList),
+		ipFlows:                 make(map[ipv4]*fragmentList),
+		IPv4DefragmenterOptions: DefaultIPv4DefragmenterOptions,
+	}
+}
+
+// DefaultIPv4DefragmenterOptions provides default options for a
+// defragmenter.  These options are used by default when calling
+// NewIPv4Defragmenter, so if modified before a NewIPv4Defragmenter call
+// they'll affect the resulting IPv4Defragmenter.
+var DefaultIPv4DefragmenterOptions = IPv4DefragmenterOptions{
+	OverlapPolicy:      OverlapLinux,
+	MaxFragmentListLen: IPv4MaximumFragmentListLen,
+	MaxBufferedBytes:   0, // unlimited
+}
+
+// IPv4DefragmenterOptions controls the behavior of each defragmenter.
+// Modify the options of each defragmenter you create to change their
+// behavior.
+type IPv4DefragmenterOptions struct {
+	// OverlapPolicy selects which data is kept when fragments overlap.
+	OverlapPolicy OverlapPolicy
+	// MaxFragmentListLen is the number of fragments of a single packet
+	// after which, if the packet still can't be built, its fragments
+	// are dropped.  If <= 0, IPv4MaximumFragmentListLen is used.
+	MaxFragmentListLen int
+	// MaxBufferedBytes is an upper limit on the number of fragment bytes
+	// buffered across all packets.  Once it's reached, the packets that
+	// were updated the least recently are dropped to make room for new
+	// fragments.  If <= 0, this is ignored.
+	MaxBufferedBytes int
+}
+
+// Stats holds the counters of an IPv4Defragmenter.
+type Stats struct {
+	Fragments   int // fragments received
+	Reassembled int // packets successfully defragmented
+	Dropped     int // fragments dropped: invalid, or flushed due to limits
+	Overlaps    int // times a fragment overlapped one already received
+	Timeouts    int // packets discarded by DiscardOlderThan
+}
+
+// OverlapPolicy selects which data is kept when fragments of a packet
+// overlap.  Hosts resolve overlaps differently, so to see a packet as a
+// given host will, reassemble it with the policy of that host.  The
+// policies below are described in terms of an old fragment, already
+// received, and a new one overlapping it: each says when the data of
+// the new fragment replaces the old one in the overlapping range.
+type OverlapPolicy int
+
+const (
+	// OverlapLinux: the new fragment starts at or before the old one.
+	OverlapLinux OverlapPolicy = iota
+	// OverlapFirst: never, the data received first is kept.
+	OverlapFirst
+	// OverlapLast: always, the data received last is kept.
+	OverlapLast
+	// OverlapBSD: the new fragment starts before the old one.
+	OverlapBSD
+	// OverlapWindows: the new fragment starts before the old one, and
+	// ends at or after its end.
+	OverlapWindows
+	// OverlapSolaris: the new fragment starts at or before the old
+	// one, and ends at or after its end, covering more than it.
+	OverlapSolaris
+)
+
+func (p OverlapPolicy) String() string {
+	switch p {
+	case OverlapLinux:
+		return "Linux"
+	case OverlapFirst:
+		return "First"
+	case OverlapLast:
+		return "Last"
+	case OverlapBSD:
+		return "BSD"
+	case OverlapWindows:
+		return "Windows"
+	case OverlapSolaris:
+		return "Solaris"
+	default:
+		return fmt.Sprintf("OverlapPolicy(%d)", int(p))
+	}
+}
+
+// newWins returns whether the new fragment at [start, end) takes
+// precedence over the old one at [oldStart, oldEnd).
+func (p OverlapPolicy) newWins(start, end, oldStart, oldEnd int) bool {
+	switch p {
+	case OverlapFirst:
+		return false
+	case OverlapLast:
+		return true
+	case OverlapBSD:
+		return start < oldStart
+	case OverlapWindows:
+		return start < oldStart && end >= oldEnd
+	case OverlapSolaris:
+		return start <= oldStart && end >= oldEnd && (start < oldStart || end > oldEnd)
+	default:
+		return start <= oldStart
 	}
 }
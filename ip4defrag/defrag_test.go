@@ -4,8 +4,10 @@ package ip4defrag
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/bytediff"
@@ -122,6 +124,199 @@ func TestDefragPingTooMuch(t *testing.T) {
 	}
 }
 
+func TestDefragOverlapPolicies(t *testing.T) {
+	type frag struct {
+		start, end int
+		fill       byte
+	}
+	// Fragments overlapping in all the ways the policies tell apart.
+	frags := []frag{
+		{8, 16, 'a'}, {0, 16, 'b'}, {8, 16, 'h'}, {16, 24, 'c'},
+		{16, 32, 'd'}, {40, 56, 'e'}, {32, 48, 'f'},
+	}
+	for _, test := range []struct {
+		policy OverlapPolicy
+		want   string // fill of each 8 bytes block
+	}{
+		{OverlapFirst, "bacdfee"},
+		{OverlapLast, "bhddffe"},
+		{OverlapLinux, "bbddffe"},
+		{OverlapBSD, "bbcdffe"},
+		{OverlapWindows, "bbcdfee"},
+		{OverlapSolaris, "bbddfee"},
+	} {
+		defrag := NewIPv4Defragmenter()
+		defrag.OverlapPolicy = test.policy
+		var out *layers.IPv4
+		for i, f := range frags {
+			in := testFragment(1, f.start, bytes.Repeat([]byte{f.fill}, f.end-f.start), f.end != 56)
+			var err error
+			if out, err = defrag.DefragIPv4(in); err != nil {
+				t.Fatalf("%v: %v", test.policy, err)
+			} else if (out != nil) != (i == len(frags)-1) {
+				t.Fatalf("%v: fragment %d: got packet %v", test.policy, i, out)
+			}
+		}
+		var got []byte
+		for i := 0; i < len(out.Payload); i += 8 {
+			got = append(got, out.Payload[i])
+		}
+		want := bytes.Repeat([]byte{0}, 56)
+		for i := range want {
+			want[i] = test.want[i/8]
+		}
+		if string(got) != test.want || !bytes.Equal(out.Payload, want) {
+			t.Errorf("%v: got blocks %q, want %q", test.policy, got, test.want)
+		}
+		stats := defrag.Stats()
+		if stats.Fragments != len(frags) || stats.Reassembled != 1 || stats.Dropped != 0 || stats.Overlaps == 0 {
+			t.Errorf("%v: unexpected stats %+v", test.policy, stats)
+		}
+	}
+}
+
+func TestDefragMemoryLimits(t *testing.T) {
+	defrag := NewIPv4Defragmenter()
+	defrag.MaxBufferedBytes = 24
+	if out, err := defrag.DefragIPv4(testFragment(1, 0, make([]byte, 16), true)); out != nil || err != nil {
+		t.Fatalf("defrag: unexpected result %v, %v", out, err)
+	}
+	// This one doesn't fit with the first packet's fragment, which
+	// gets dropped.
+	if out, err := defrag.DefragIPv4(testFragment(2, 0, make([]byte, 16), true)); out != nil || err != nil {
+		t.Fatalf("defrag: unexpected result %v, %v", out, err)
+	}
+	if out, err := defrag.DefragIPv4(testFragment(1, 16, make([]byte, 8), false)); out != nil || err != nil {
+		t.Fatalf("defrag: dropped packet was defragmented: %v, %v", out, err)
+	}
+	if n := defrag.DiscardOlderThan(time.Now().Add(time.Second)); n != 2 {
+		t.Errorf("defrag: discarded %d packets, want 2", n)
+	}
+	if out, err := defrag.DefragIPv4(testFragment(3, 0, make([]byte, 32), true)); out != nil || err == nil {
+		t.Fatalf("defrag: expected fragment over the budget to be dropped, got %v, %v", out, err)
+	}
+	want := Stats{Fragments: 4, Dropped: 2, Timeouts: 2}
+	if got := defrag.Stats(); got != want {
+		t.Errorf("defrag: got stats %+v, want %+v", got, want)
+	}
+	if defrag.buffered != 0 {
+		t.Errorf("defrag: %d bytes still buffered", defrag.buffered)
+	}
+}
+
+type sliceSource [][]byte
+
+func (s *sliceSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(*s) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := (*s)[0]
+	*s = (*s)[1:]
+	return data, gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}, nil
+}
+
+func TestDefragPacketSource(t *testing.T) {
+	src := &sliceSource{testPing1Frag1, testPing1Frag3, testPing1Frag2, testPing1Frag4}
+	source := gopacket.NewPacketSource(src, layers.LayerTypeEthernet)
+	source.Defragmenter = NewIPv4Defragmenter()
+	p, err := source.NextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ErrorLayer() != nil {
+		t.Fatal("Failed to decode defragmented packet:", p.ErrorLayer().Error())
+	}
+	ip, ok := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok || ip.Length != 20+4508 || ip.Flags != 0 || ip.FragOffset != 0 {
+		t.Fatalf("defrag: unexpected IPv4 layer in %v", p)
+	}
+	if _, ok := p.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); !ok {
+		t.Errorf("defrag: no ICMPv4 layer in %v", p)
+	}
+	if !bytes.Equal(p.Data()[:14], testPing1Frag4[:14]) {
+		t.Errorf("defrag: Ethernet header not kept")
+	}
+	if ci := p.Metadata().CaptureInfo; ci.Length != 14+20+4508 || ci.CaptureLength != ci.Length {
+		t.Errorf("defrag: unexpected capture info %+v", ci)
+	}
+	if p, err := source.NextPacket(); err != io.EOF {
+		t.Errorf("defrag: expected io.EOF, got %v, %v", p, err)
+	}
+}
+
+// TestDefragPacketSourcePPPoE checks that the length fields of the layers
+// enclosing the fragments are fixed to hold the whole datagram.
+func TestDefragPacketSourcePPPoE(t *testing.T) {
+	payload := make([]byte, 48)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 5678}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	datagram := append([]byte(nil), buf.Bytes()...)
+
+	var src sliceSource
+	for _, frag := range []struct {
+		offset, length int
+		more           bool
+	}{{24, 32, false}, {0, 24, true}} {
+		data := datagram[frag.offset : frag.offset+frag.length]
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+			&layers.Ethernet{
+				SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+				DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+				EthernetType: layers.EthernetTypePPPoESession,
+			},
+			&layers.PPPoE{Version: 1, Type: 1, Code: layers.PPPoECodeSession, SessionId: 7},
+			&layers.PPP{PPPType: layers.PPPTypeIPv4},
+			testFragment(1, frag.offset, data, frag.more),
+			gopacket.Payload(data)); err != nil {
+			t.Fatal(err)
+		}
+		src = append(src, buf.Bytes())
+	}
+	source := gopacket.NewPacketSource(&src, layers.LayerTypeEthernet)
+	source.Defragmenter = NewIPv4Defragmenter()
+	p, err := source.NextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ErrorLayer() != nil {
+		t.Fatal("Failed to decode defragmented packet:", p.ErrorLayer().Error())
+	}
+	if pppoe, ok := p.Layer(layers.LayerTypePPPoE).(*layers.PPPoE); !ok || pppoe.Length != uint16(2+20+len(datagram)) || pppoe.SessionId != 7 {
+		t.Errorf("defrag: unexpected PPPoE layer in %v", p)
+	}
+	if udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || !bytes.Equal(udp.Payload, payload) {
+		t.Errorf("defrag: payload is not correctly defragmented in %v", p)
+	}
+}
+
+// testFragment returns an IPv4 fragment of packet id, holding data at
+// offset.
+func testFragment(id uint16, offset int, data []byte, more bool) *layers.IPv4 {
+	ip := &layers.IPv4{
+		Version:    4,
+		IHL:        5,
+		Length:     uint16(20 + len(data)),
+		Id:         id,
+		FragOffset: uint16(offset / 8),
+		TTL:        64,
+		Protocol:   layers.IPProtocolUDP,
+		SrcIP:      net.IPv4(1, 1, 1, 1),
+		DstIP:      net.IPv4(2, 2, 2, 2),
+	}
+	if more {
+		ip.Flags = layers.IPv4MoreFragments
+	}
+	ip.Payload = data
+	return ip
+}
+
 func gentestDefrag(t *testing.T, defrag *IPv4Defragmenter, buf []byte, expect bool, label string) *layers.IPv4 {
 	p := gopacket.NewPacket(buf, layers.LinkTypeEthernet, gopacket.Default)
 	if p.ErrorLayer() != nil {
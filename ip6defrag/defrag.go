@@ -0,0 +1,412 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Package ip6defrag implements a IPv6 defragmenter
+package ip6defrag
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Quick and Easy to use debug code to trace
+// how defrag works.
+var debug debugging = false // or flip to true
+type debugging bool
+
+func (d debugging) Printf(format string, args ...interface{}) {
+	if d {
+		log.Printf(format, args...)
+	}
+}
+
+const (
+	IPv6MaximumSize            = 65535
+	IPv6MaximumFragmentListLen = 16
+)
+
+// DefragIPv6 takes in an IPv6 packet, which may carry a fragment header in
+// its extension header chain.
+//
+// It does not modify the IPv6 layer in place, 'in' remains untouched.
+// It returns a ready-to be used IPv6 layer.
+//
+// If the passed-in IPv6 layer is NOT a fragment, it will
+// immediately return it without modifying the layer.
+//
+// If the IPv6 layer is a fragment and we don't have all
+// fragments, it will return nil and store whatever internal
+// information it needs to eventually defrag the packet.
+//
+// If the IPv6 layer is the last fragment needed to reconstruct
+// the packet, a new IPv6 layer will be returned, and will be set to
+// the entire defragmented packet.  Its payload starts with the
+// unfragmentable extension headers of the first fragment, with the
+// fragment header removed from the chain.
+//
+// Following RFC 5722, a fragment overlapping another one of the same
+// packet makes the whole packet be discarded, including its fragments
+// received later on, until DiscardOlderThan forgets about it.
+//
+// Usage example:
+//
+//	func HandlePacket(in *layers.IPv6) err {
+//	    defragger := ip6defrag.NewIPv6Defragmenter()
+//	    in, err := defragger.DefragIPv6(in)
+//	    if err != nil {
+//	        return err
+//	    } else if in == nil {
+//	        return nil  // packet fragment, we don't have whole packet yet.
+//	    }
+//	    // At this point, we know that 'in' is defragmented.
+//	    ... do stuff to 'in' ...
+//	}
+func (d *IPv6Defragmenter) DefragIPv6(in *layers.IPv6) (*layers.IPv6, error) {
+	frag, err := findFragment(in)
+	if err != nil {
+		return nil, err
+	}
+	// check if we need to defrag
+	if frag == nil {
+		return in, nil
+	}
+	// perform security checks
+	if err := d.securityChecks(in, frag); err != nil {
+		return nil, err
+	}
+
+	debug.Printf("defrag: got id=%d offset=%d more=%t\n",
+		frag.Identification, frag.offset(), frag.MoreFragments)
+
+	// do we already has seen a flow between src/dst with that Id
+	ipf := newIPv6(in, frag)
+	d.Lock()
+	defer d.Unlock()
+	fl, exist := d.ipFlows[ipf]
+	if !exist {
+		debug.Printf("defrag: creating a new flow\n")
+		fl = new(fragmentList)
+		d.ipFlows[ipf] = fl
+	}
+	out, err := fl.insert(in, frag)
+	if out != nil || (err != nil && !fl.Discarded) {
+		delete(d.ipFlows, ipf)
+		return out, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// at last, if we hit the maximum frag list len
+	// without any defrag success, we just drop everything and
+	// raise an error
+	if fl.List.Len() > IPv6MaximumFragmentListLen {
+		delete(d.ipFlows, ipf)
+		return nil, fmt.Errorf("defrag: Fragment List hits its maximum "+
+			"size(%d), without success. Flushing the list",
+			IPv6MaximumFragmentListLen)
+	}
+	return nil, nil
+}
+
+// DefragPacket implements gopacket.Defragmenter, so that a
+// gopacket.PacketSource hands out reassembled IPv6 datagrams.  It runs
+// DefragIPv6 on the first IPv6 layer of p.  Once a datagram is complete,
+// the returned packet holds the layers of its last fragment preceding
+// IPv6, followed by the whole datagram, and carries the last fragment's
+// metadata.
+func (d *IPv6Defragmenter) DefragPacket(p gopacket.Packet, opts gopacket.DecodeOptions) (gopacket.Packet, error) {
+	in, ok := p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+	if !ok {
+		return p, nil
+	}
+	out, err := d.DefragIPv6(in)
+	if err != nil || out == nil {
+		return nil, err
+	} else if out == in {
+		return p, nil
+	}
+	data := append(append([]byte{}, out.Contents...), out.Payload...)
+	return gopacket.RebuildPacket(p, in, data, opts)
+}
+
+// DiscardOlderThan forgets all packets without any activity since
+// time t. It returns the number of FragmentList aka number of
+// fragment packets it has discarded.
+func (d *IPv6Defragmenter) DiscardOlderThan(t time.Time) int {
+	var nb int
+	d.Lock()
+	for k, v := range d.ipFlows {
+		if v.LastSeen.Before(t) {
+			nb = nb + 1
+			delete(d.ipFlows, k)
+		}
+	}
+	d.Unlock()
+	return nb
+}
+
+// securityChecks performs the needed security checks
+func (d *IPv6Defragmenter) securityChecks(ip *layers.IPv6, frag *fragmentHeader) error {
+	// non-final fragments must be a multiple of 8 bytes long
+	if frag.MoreFragments && len(frag.data)%8 != 0 {
+		return fmt.Errorf("defrag: fragment length %d is not a "+
+			"multiple of 8", len(frag.data))
+	}
+	if frag.MoreFragments && len(frag.data) == 0 {
+		return errors.New("defrag: empty non-final fragment")
+	}
+	// don't allow fragment that would oversize an IP packet
+	if frag.unfragmentable+frag.offset()+len(frag.data) > IPv6MaximumSize {
+		return fmt.Errorf("defrag: fragment will overrun "+
+			"(handcrafted? %d > %d)", frag.unfragmentable+frag.offset()+len(frag.data),
+			IPv6MaximumSize)
+	}
+	return nil
+}
+
+// fragmentHeader is an IPv6 fragment header found in the extension header
+// chain of an IPv6 packet, along with what the defragmenter needs to know
+// about its position in the packet.
+type fragmentHeader struct {
+	NextHeader     layers.IPProtocol
+	FragmentOffset uint16 // in units of 8 bytes
+	MoreFragments  bool
+	Identification uint32
+
+	// unfragmentable is the length of the extension headers before the
+	// fragment header, and nextHeader the offset within them of the next
+	// header field pointing to the fragment header, or -1 for the one in
+	// the IPv6 header.
+	unfragmentable int
+	nextHeader     int
+	// data is the fragment data following the fragment header.
+	data []byte
+}
+
+func (f *fragmentHeader) offset() int {
+	return int(f.FragmentOffset) * 8
+}
+
+// findFragment walks the extension header chain of ip, returning its
+// fragment header, or nil if it has none.
+func findFragment(ip *layers.IPv6) (*fragmentHeader, error) {
+	next := ip.NextHeader
+	data := ip.Payload
+	prev, off := -1, 0
+	for {
+		switch next {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			if len(data) < off+2 {
+				return nil, errors.New("defrag: truncated IPv6 extension header")
+			}
+			n := (int(data[off+1]) + 1) * 8
+			if len(data) < off+n {
+				return nil, errors.New("defrag: truncated IPv6 extension header")
+			}
+			next = layers.IPProtocol(data[off])
+			prev, off = off, off+n
+		case layers.IPProtocolIPv6Fragment:
+			if len(data) < off+8 {
+				return nil, errors.New("defrag: truncated IPv6 fragment header")
+			}
+			h := data[off : off+8]
+			f := &fragmentHeader{
+				NextHeader:     layers.IPProtocol(h[0]),
+				FragmentOffset: binary.BigEndian.Uint16(h[2:4]) >> 3,
+				MoreFragments:  h[3]&0x1 != 0,
+				Identification: binary.BigEndian.Uint32(h[4:8]),
+				unfragmentable: off,
+				nextHeader:     prev,
+				data:           data[off+8:],
+			}
+			if f.FragmentOffset == 0 && !f.MoreFragments {
+				// An atomic fragment (RFC 6946) is processed in
+				// isolation; it's a full packet already.
+				return nil, nil
+			}
+			return f, nil
+		default:
+			return nil, nil
+		}
+	}
+}
+
+// fragment is a fragment held by a fragmentList.
+type fragment struct {
+	offset int
+	data   []byte
+}
+
+// fragmentList holds a container/list used to contains IP
+// fragments, sorted by offset.  It stores internal counters to track the
+// maximum total of byte, and the current length it has received.
+// It also stores a flag to know if he has seen the last packet, and the
+// header and unfragmentable part of the first fragment.
+type fragmentList struct {
+	List          list.List
+	Highest       int
+	Current       int
+	FinalReceived bool
+	// Discarded is set once an overlap has been found: the packet is
+	// dropped, along with any other fragment of it.
+	Discarded   bool
+	LastSeen    time.Time
+	first       *layers.IPv6
+	firstHeader *fragmentHeader
+}
+
+// insert inserts an IPv6 fragment into the Fragment List, and builds the
+// defragmented packet if it was the last one missing.
+func (f *fragmentList) insert(in *layers.IPv6, frag *fragmentHeader) (*layers.IPv6, error) {
+	// packet.Metadata().Timestamp should have been better, but
+	// we don't have this info there...
+	f.LastSeen = time.Now()
+	if f.Discarded {
+		return nil, errors.New("defrag: dropping fragment of discarded overlapping packet")
+	}
+	start, end := frag.offset(), frag.offset()+len(frag.data)
+
+	// RFC 5722: overlapping fragments make us drop the whole packet.
+	// Exact duplicates, as sent by retransmissions, are just ignored.
+	var before *list.Element
+	for e := f.List.Front(); e != nil; e = e.Next() {
+		ef := e.Value.(*fragment)
+		eEnd := ef.offset + len(ef.data)
+		if ef.offset == start && eEnd == end && bytes.Equal(ef.data, frag.data) {
+			debug.Printf("defrag: ignoring duplicate fragment %d\n", start)
+			return nil, nil
+		}
+		if start < eEnd && ef.offset < end {
+			debug.Printf("defrag: fragment %d-%d overlaps %d-%d, discarding\n",
+				start, end, ef.offset, eEnd)
+			f.discard()
+			return nil, fmt.Errorf("defrag: overlapping fragment at offset %d", start)
+		}
+		if before == nil && start < ef.offset {
+			before = e
+		}
+	}
+	if f.FinalReceived && end > f.Highest {
+		f.discard()
+		return nil, fmt.Errorf("defrag: fragment at offset %d beyond final fragment", start)
+	}
+	if !frag.MoreFragments {
+		if end < f.Highest {
+			f.discard()
+			return nil, fmt.Errorf("defrag: final fragment at offset %d before other fragments", start)
+		}
+		f.FinalReceived = true
+	}
+
+	fr := &fragment{offset: start, data: frag.data}
+	if before != nil {
+		f.List.InsertBefore(fr, before)
+	} else {
+		f.List.PushBack(fr)
+	}
+	if start == 0 {
+		f.first = in
+		f.firstHeader = frag
+	}
+	if f.Highest < end {
+		f.Highest = end
+	}
+	f.Current += len(frag.data)
+
+	debug.Printf("defrag: insert ListLen: %d Highest:%d Current:%d\n",
+		f.List.Len(), f.Highest, f.Current)
+
+	// Ready to try defrag ?
+	if f.FinalReceived && f.Highest == f.Current {
+		return f.build()
+	}
+	return nil, nil
+}
+
+// discard drops the fragments of the list, and marks it as discarded.
+func (f *fragmentList) discard() {
+	f.List.Init()
+	f.Discarded = true
+	f.first = nil
+	f.firstHeader = nil
+}
+
+// build builds the final datagram from the header and unfragmentable
+// part of the first fragment followed by the data of all fragments.
+func (f *fragmentList) build() (*layers.IPv6, error) {
+	debug.Printf("defrag: building the datagram \n")
+	first, fh := f.first, f.firstHeader
+	payload := make([]byte, fh.unfragmentable, fh.unfragmentable+f.Highest)
+	copy(payload, first.Payload)
+	for e := f.List.Front(); e != nil; e = e.Next() {
+		payload = append(payload, e.Value.(*fragment).data...)
+	}
+	next := first.NextHeader
+	if fh.nextHeader < 0 {
+		next = fh.NextHeader
+	} else {
+		payload[fh.nextHeader] = byte(fh.NextHeader)
+	}
+	if len(payload) > IPv6MaximumSize {
+		return nil, fmt.Errorf("defrag: defragmented packet too big "+
+			"(%d > %d)", len(payload), IPv6MaximumSize)
+	}
+
+	header := &layers.IPv6{
+		Version:      first.Version,
+		TrafficClass: first.TrafficClass,
+		FlowLabel:    first.FlowLabel,
+		NextHeader:   next,
+		HopLimit:     first.HopLimit,
+		SrcIP:        first.SrcIP,
+		DstIP:        first.DstIP,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, header, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+	out := &layers.IPv6{}
+	if err := out.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ipv6 is a struct to be used as a key.
+type ipv6 struct {
+	ip6 gopacket.Flow
+	id  uint32
+}
+
+// newIPv6 returns a new initialized IPv6 Flow
+func newIPv6(ip *layers.IPv6, frag *fragmentHeader) ipv6 {
+	return ipv6{
+		ip6: ip.NetworkFlow(),
+		id:  frag.Identification,
+	}
+}
+
+// IPv6Defragmenter is a struct which embedded a map of
+// all fragment/packet.
+type IPv6Defragmenter struct {
+	sync.RWMutex
+	ipFlows map[ipv6]*fragmentList
+}
+
+// NewIPv6Defragmenter returns a new IPv6Defragmenter
+// with an initialized map.
+func NewIPv6Defragmenter() *IPv6Defragmenter {
+	return &IPv6Defragmenter{
+		ipFlows: make(map[ipv6]*fragmentList),
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+package ip6defrag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testSrcIP = net.ParseIP("2001:db8::1")
+	testDstIP = net.ParseIP("2001:db8::2")
+	// testDestOpts is a destination options header padded with PadN,
+	// followed by a fragment header.
+	testDestOpts = []byte{byte(layers.IPProtocolIPv6Fragment), 0, 1, 4, 0, 0, 0, 0}
+)
+
+// testDatagram returns a UDP datagram with n bytes of payload.
+func testDatagram(t *testing.T, n int) []byte {
+	payload := make([]byte, n)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	udp := &layers.UDP{SrcPort: 1234, DstPort: 5678}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testFragment returns a decoded IPv6 packet holding the fragment of
+// datagram at [offset, offset+n), with the given extension headers before
+// the fragment header.
+func testFragment(t *testing.T, ext []byte, id uint32, datagram []byte, offset, n int) *layers.IPv6 {
+	more := offset+n < len(datagram)
+	if !more {
+		n = len(datagram) - offset
+	}
+	next := layers.IPProtocolIPv6Fragment
+	if ext != nil {
+		next = layers.IPProtocolIPv6Destination
+	}
+	fh := make([]byte, 8)
+	fh[0] = byte(layers.IPProtocolUDP)
+	flags := uint16(offset)
+	if more {
+		flags |= 1
+	}
+	binary.BigEndian.PutUint16(fh[2:4], flags)
+	binary.BigEndian.PutUint32(fh[4:8], id)
+	payload := append(append(append([]byte{}, ext...), fh...), datagram[offset:offset+n]...)
+
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: next, SrcIP: testSrcIP, DstIP: testDstIP}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	p := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv6, gopacket.Default)
+	if p.ErrorLayer() != nil {
+		t.Fatal("Failed to decode packet:", p.ErrorLayer().Error())
+	}
+	return p.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+}
+
+func TestNotFrag(t *testing.T) {
+	ip := &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolUDP, SrcIP: testSrcIP, DstIP: testDstIP,
+		BaseLayer: layers.BaseLayer{Payload: testDatagram(t, 10)}}
+	defrag := NewIPv6Defragmenter()
+	out, err := defrag.DefragIPv6(ip)
+	if out != ip || err != nil {
+		t.Errorf("defrag: this packet do not need to be defrag ['%v']", err)
+	}
+}
+
+func TestDefragUDP(t *testing.T) {
+	datagram := testDatagram(t, 3000)
+	other := testDatagram(t, 2000)
+	defrag := NewIPv6Defragmenter()
+	for _, in := range []*layers.IPv6{
+		testFragment(t, testDestOpts, 1, datagram, 2464, 1232),
+		testFragment(t, nil, 2, other, 1232, 1232),
+		testFragment(t, testDestOpts, 1, datagram, 0, 1232),
+		testFragment(t, testDestOpts, 1, datagram, 0, 1232), // duplicate
+	} {
+		if out, err := defrag.DefragIPv6(in); out != nil || err != nil {
+			t.Fatalf("defrag: unexpected result %v, %v", out, err)
+		}
+	}
+	out, err := defrag.DefragIPv6(testFragment(t, testDestOpts, 1, datagram, 1232, 1232))
+	if out == nil || err != nil {
+		t.Fatalf("defrag: expected a defragmented packet, got %v", err)
+	}
+	if int(out.Length) != len(testDestOpts)+len(datagram) || out.NextHeader != layers.IPProtocolIPv6Destination {
+		t.Errorf("defrag: unexpected IPv6 header %+v", out)
+	}
+	p := gopacket.NewPacket(append(append([]byte{}, out.Contents...), out.Payload...), layers.LayerTypeIPv6, gopacket.Default)
+	if p.ErrorLayer() != nil {
+		t.Fatal("Failed to decode defragmented packet:", p.ErrorLayer().Error())
+	}
+	if dst, ok := p.Layer(layers.LayerTypeIPv6Destination).(*layers.IPv6Destination); !ok || dst.NextHeader != layers.IPProtocolUDP {
+		t.Errorf("defrag: missing or invalid destination options header in %v", p)
+	}
+	if udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || !bytes.Equal(udp.Contents, datagram[:8]) ||
+		!bytes.Equal(udp.Payload, datagram[8:]) {
+		t.Errorf("defrag: payload is not correctly defragmented")
+	}
+
+	out, err = defrag.DefragIPv6(testFragment(t, nil, 2, other, 0, 1232))
+	if out == nil || err != nil {
+		t.Fatalf("defrag: expected a defragmented packet, got %v", err)
+	}
+	if out.NextHeader != layers.IPProtocolUDP || !bytes.Equal(out.Payload, other) {
+		t.Errorf("defrag: second packet is not correctly defragmented")
+	}
+	if len(defrag.ipFlows) != 0 {
+		t.Errorf("defrag: %d flows left after defragmenting", len(defrag.ipFlows))
+	}
+}
+
+func TestDefragOverlap(t *testing.T) {
+	datagram := testDatagram(t, 3000)
+	defrag := NewIPv6Defragmenter()
+	if _, err := defrag.DefragIPv6(testFragment(t, nil, 1, datagram, 0, 1232)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := defrag.DefragIPv6(testFragment(t, nil, 1, datagram, 1224, 1232)); err == nil {
+		t.Error("defrag: expected an error for an overlapping fragment")
+	}
+	// The rest of the packet must be dropped too.
+	if out, err := defrag.DefragIPv6(testFragment(t, nil, 1, datagram, 1232, 2000)); out != nil || err == nil {
+		t.Errorf("defrag: expected fragment of discarded packet to be dropped, got %v, %v", out, err)
+	}
+	if n := defrag.DiscardOlderThan(time.Now().Add(time.Second)); n != 1 {
+		t.Errorf("defrag: discarded %d packets, want 1", n)
+	}
+}
+
+func TestDefragInvalid(t *testing.T) {
+	datagram := testDatagram(t, 3000)
+	defrag := NewIPv6Defragmenter()
+	if _, err := defrag.DefragIPv6(testFragment(t, nil, 1, datagram, 0, 1230)); err == nil {
+		t.Error("defrag: expected an error for a fragment length not a multiple of 8")
+	}
+	if _, err := defrag.DefragIPv6(testFragment(t, nil, 1, datagram, 1232, 2000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := defrag.DefragIPv6(testFragment(t, nil, 1, datagram, 0, 1224)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := defrag.DefragIPv6(testFragment(t, nil, 1, datagram, 1224, 2000)); err == nil {
+		t.Error("defrag: expected an error for an overlapping final fragment")
+	}
+}
+
+type sliceSource [][]byte
+
+func (s *sliceSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(*s) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := (*s)[0]
+	*s = (*s)[1:]
+	return data, gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}, nil
+}
+
+func TestDefragPacketSource(t *testing.T) {
+	datagram := testDatagram(t, 3000)
+	var src sliceSource
+	for _, offset := range []int{1232, 0, 2464} {
+		ip := testFragment(t, testDestOpts, 1, datagram, offset, 1232)
+		eth := &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+			DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+			EthernetType: layers.EthernetTypeIPv6,
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, eth, gopacket.Payload(append(ip.Contents, ip.Payload...))); err != nil {
+			t.Fatal(err)
+		}
+		src = append(src, buf.Bytes())
+	}
+	source := gopacket.NewPacketSource(&src, layers.LayerTypeEthernet)
+	source.Defragmenter = gopacket.Defragmenters{NewIPv6Defragmenter()}
+	p, err := source.NextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ErrorLayer() != nil {
+		t.Fatal("Failed to decode defragmented packet:", p.ErrorLayer().Error())
+	}
+	if p.Layer(layers.LayerTypeIPv6Fragment) != nil {
+		t.Errorf("defrag: fragment header left in %v", p)
+	}
+	if udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || !bytes.Equal(udp.Payload, datagram[8:]) {
+		t.Errorf("defrag: payload is not correctly defragmented")
+	}
+	if eth, ok := p.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); !ok || eth.DstMAC.String() != "00:01:02:03:04:06" {
+		t.Errorf("defrag: Ethernet header not kept in %v", p)
+	}
+	if ci := p.Metadata().CaptureInfo; ci.Length != len(p.Data()) || ci.CaptureLength != ci.Length {
+		t.Errorf("defrag: unexpected capture info %+v", ci)
+	}
+	if p, err := source.NextPacket(); err != io.EOF {
+		t.Errorf("defrag: expected io.EOF, got %v, %v", p, err)
+	}
+}
+
+// TestDefragPacketSource6in4 checks that the length of the IPv4 header
+// enclosing the fragments is fixed to hold the whole datagram.
+func TestDefragPacketSource6in4(t *testing.T) {
+	datagram := testDatagram(t, 100)
+	var src sliceSource
+	for _, offset := range []int{64, 0} {
+		ip := testFragment(t, nil, 1, datagram, offset, 64)
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+			&layers.Ethernet{
+				SrcMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 5},
+				DstMAC:       net.HardwareAddr{0, 1, 2, 3, 4, 6},
+				EthernetType: layers.EthernetTypeIPv4,
+			},
+			&layers.IPv4{
+				Version:  4,
+				TTL:      64,
+				Protocol: layers.IPProtocolIPv6,
+				SrcIP:    net.IP{192, 0, 2, 1},
+				DstIP:    net.IP{192, 0, 2, 2},
+			},
+			gopacket.Payload(append(ip.Contents, ip.Payload...))); err != nil {
+			t.Fatal(err)
+		}
+		src = append(src, buf.Bytes())
+	}
+	source := gopacket.NewPacketSource(&src, layers.LayerTypeEthernet)
+	source.Defragmenter = NewIPv6Defragmenter()
+	p, err := source.NextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ErrorLayer() != nil {
+		t.Fatal("Failed to decode defragmented packet:", p.ErrorLayer().Error())
+	}
+	if ip, ok := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4); !ok || ip.Length != uint16(20+40+len(datagram)) {
+		t.Errorf("defrag: unexpected IPv4 layer in %v", p)
+	}
+	if udp, ok := p.Layer(layers.LayerTypeUDP).(*layers.UDP); !ok || !bytes.Equal(udp.Payload, datagram[8:]) {
+		t.Errorf("defrag: payload is not correctly defragmented in %v", p)
+	}
+}
@@ -1029,7 +1029,7 @@ func TestICMP6(t *testing.T) {
 	if p.ErrorLayer() != nil {
 		t.Error("Failed to decode packet:", p.ErrorLayer().Error())
 	}
-	checkLayers(p, []gopacket.LayerType{LayerTypeEthernet, LayerTypeIPv6, LayerTypeICMPv6, gopacket.LayerTypePayload}, t)
+	checkLayers(p, []gopacket.LayerType{LayerTypeEthernet, LayerTypeIPv6, LayerTypeICMPv6, LayerTypeICMPv6NeighborSolicitation}, t)
 	testSerialization(t, p, testICMP6)
 }
 func BenchmarkDecodeICMP6(b *testing.B) {
@@ -1101,7 +1101,7 @@ func TestPPPoE_ICMPv6(t *testing.T) {
 		LayerTypePPP,
 		LayerTypeIPv6,
 		LayerTypeICMPv6,
-		gopacket.LayerTypePayload,
+		LayerTypeICMPv6NeighborAdvertisement,
 	}, t)
 	testSerialization(t, p, testPPPoE_ICMPv6)
 }
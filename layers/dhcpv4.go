@@ -0,0 +1,662 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+)
+
+// DHCPOp is the operation of a DHCPv4 message: request or reply.
+type DHCPOp byte
+
+const (
+	DHCPOpRequest DHCPOp = 1
+	DHCPOpReply   DHCPOp = 2
+)
+
+func (o DHCPOp) String() string {
+	switch o {
+	case DHCPOpRequest:
+		return "Request"
+	case DHCPOpReply:
+		return "Reply"
+	default:
+		return "Unknown"
+	}
+}
+
+// DHCPMsgType is the DHCP message type carried in DHCPOptMessageType.
+type DHCPMsgType byte
+
+const (
+	DHCPMsgTypeUnspecified DHCPMsgType = iota
+	DHCPMsgTypeDiscover
+	DHCPMsgTypeOffer
+	DHCPMsgTypeRequest
+	DHCPMsgTypeDecline
+	DHCPMsgTypeAck
+	DHCPMsgTypeNak
+	DHCPMsgTypeRelease
+	DHCPMsgTypeInform
+)
+
+func (o DHCPMsgType) String() string {
+	switch o {
+	case DHCPMsgTypeUnspecified:
+		return "Unspecified"
+	case DHCPMsgTypeDiscover:
+		return "Discover"
+	case DHCPMsgTypeOffer:
+		return "Offer"
+	case DHCPMsgTypeRequest:
+		return "Request"
+	case DHCPMsgTypeDecline:
+		return "Decline"
+	case DHCPMsgTypeAck:
+		return "Ack"
+	case DHCPMsgTypeNak:
+		return "Nak"
+	case DHCPMsgTypeRelease:
+		return "Release"
+	case DHCPMsgTypeInform:
+		return "Inform"
+	default:
+		return "Unknown"
+	}
+}
+
+// DHCPOpt is the type of a DHCPv4 option, from RFC 2132 unless noted.
+type DHCPOpt byte
+
+const (
+	DHCPOptPad            DHCPOpt = 0
+	DHCPOptSubnetMask     DHCPOpt = 1   // 4 bytes
+	DHCPOptTimeOffset     DHCPOpt = 2   // 4 bytes, signed seconds
+	DHCPOptRouter         DHCPOpt = 3   // n*4 bytes
+	DHCPOptTimeServer     DHCPOpt = 4   // n*4 bytes
+	DHCPOptNameServer     DHCPOpt = 5   // n*4 bytes
+	DHCPOptDNS            DHCPOpt = 6   // n*4 bytes
+	DHCPOptLogServer      DHCPOpt = 7   // n*4 bytes
+	DHCPOptHostname       DHCPOpt = 12  // string
+	DHCPOptDomainName     DHCPOpt = 15  // string
+	DHCPOptInterfaceMTU   DHCPOpt = 26  // 2 bytes
+	DHCPOptBroadcastAddr  DHCPOpt = 28  // 4 bytes
+	DHCPOptStaticRoute    DHCPOpt = 33  // n*8 bytes
+	DHCPOptNTPServers     DHCPOpt = 42  // n*4 bytes
+	DHCPOptVendorOption   DHCPOpt = 43  // vendor specific
+	DHCPOptRequestIP      DHCPOpt = 50  // 4 bytes
+	DHCPOptLeaseTime      DHCPOpt = 51  // 4 bytes, seconds
+	DHCPOptOverload       DHCPOpt = 52  // 1 byte
+	DHCPOptMessageType    DHCPOpt = 53  // 1 byte
+	DHCPOptServerID       DHCPOpt = 54  // 4 bytes
+	DHCPOptParamsRequest  DHCPOpt = 55  // n bytes, option types
+	DHCPOptMessage        DHCPOpt = 56  // string
+	DHCPOptMaxMessageSize DHCPOpt = 57  // 2 bytes
+	DHCPOptT1             DHCPOpt = 58  // 4 bytes, seconds
+	DHCPOptT2             DHCPOpt = 59  // 4 bytes, seconds
+	DHCPOptClassID        DHCPOpt = 60  // n bytes
+	DHCPOptClientID       DHCPOpt = 61  // n bytes
+	DHCPOptTFTPServerName DHCPOpt = 66  // string
+	DHCPOptBootfileName   DHCPOpt = 67  // string
+	DHCPOptRelayAgentInfo DHCPOpt = 82  // sub-options [RFC3046]
+	DHCPOptDomainSearch   DHCPOpt = 119 // compressed names [RFC3397]
+	DHCPOptClasslessRoute DHCPOpt = 121 // [RFC3442]
+	DHCPOptEnd            DHCPOpt = 255
+)
+
+func (o DHCPOpt) String() string {
+	switch o {
+	case DHCPOptPad:
+		return "Pad"
+	case DHCPOptSubnetMask:
+		return "SubnetMask"
+	case DHCPOptTimeOffset:
+		return "TimeOffset"
+	case DHCPOptRouter:
+		return "Router"
+	case DHCPOptTimeServer:
+		return "TimeServer"
+	case DHCPOptNameServer:
+		return "NameServer"
+	case DHCPOptDNS:
+		return "DNS"
+	case DHCPOptLogServer:
+		return "LogServer"
+	case DHCPOptHostname:
+		return "Hostname"
+	case DHCPOptDomainName:
+		return "DomainName"
+	case DHCPOptInterfaceMTU:
+		return "InterfaceMTU"
+	case DHCPOptBroadcastAddr:
+		return "BroadcastAddr"
+	case DHCPOptStaticRoute:
+		return "StaticRoute"
+	case DHCPOptNTPServers:
+		return "NTPServers"
+	case DHCPOptVendorOption:
+		return "VendorOption"
+	case DHCPOptRequestIP:
+		return "RequestIP"
+	case DHCPOptLeaseTime:
+		return "LeaseTime"
+	case DHCPOptOverload:
+		return "Overload"
+	case DHCPOptMessageType:
+		return "MessageType"
+	case DHCPOptServerID:
+		return "ServerID"
+	case DHCPOptParamsRequest:
+		return "ParamsRequest"
+	case DHCPOptMessage:
+		return "Message"
+	case DHCPOptMaxMessageSize:
+		return "MaxMessageSize"
+	case DHCPOptT1:
+		return "T1"
+	case DHCPOptT2:
+		return "T2"
+	case DHCPOptClassID:
+		return "ClassID"
+	case DHCPOptClientID:
+		return "ClientID"
+	case DHCPOptTFTPServerName:
+		return "TFTPServerName"
+	case DHCPOptBootfileName:
+		return "BootfileName"
+	case DHCPOptRelayAgentInfo:
+		return "RelayAgentInfo"
+	case DHCPOptDomainSearch:
+		return "DomainSearch"
+	case DHCPOptClasslessRoute:
+		return "ClasslessRoute"
+	case DHCPOptEnd:
+		return "End"
+	default:
+		return "Unknown"
+	}
+}
+
+// DHCPRelayAgentSubOpt is the type of a sub-option of the relay agent
+// information option (RFC 3046 and later).
+type DHCPRelayAgentSubOpt byte
+
+const (
+	DHCPRelayAgentSubOptCircuitID        DHCPRelayAgentSubOpt = 1  // [RFC3046]
+	DHCPRelayAgentSubOptRemoteID         DHCPRelayAgentSubOpt = 2  // [RFC3046]
+	DHCPRelayAgentSubOptLinkSelection    DHCPRelayAgentSubOpt = 5  // [RFC3527]
+	DHCPRelayAgentSubOptSubscriberID     DHCPRelayAgentSubOpt = 6  // [RFC3993]
+	DHCPRelayAgentSubOptServerIDOverride DHCPRelayAgentSubOpt = 11 // [RFC5107]
+)
+
+// dhcpMagic is the magic cookie starting the options (RFC 2131 section 3).
+const dhcpMagic uint32 = 0x63825363
+
+// dhcpMinLength is the minimum length of a BOOTP message (RFC 951), which
+// many relays and servers still enforce.
+const dhcpMinLength = 300
+
+//  DHCPv4 is specified in RFC 2131
+//  0                   1                   2                   3
+//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//  +---------------+---------------+---------------+---------------+
+//  |     op (1)    |   htype (1)   |   hlen (1)    |   hops (1)    |
+//  +---------------+---------------+---------------+---------------+
+//  |                            xid (4)                            |
+//  +-------------------------------+-------------------------------+
+//  |           secs (2)            |           flags (2)           |
+//  +-------------------------------+-------------------------------+
+//  |                          ciaddr  (4)                          |
+//  +---------------------------------------------------------------+
+//  |                          yiaddr  (4)                          |
+//  +---------------------------------------------------------------+
+//  |                          siaddr  (4)                          |
+//  +---------------------------------------------------------------+
+//  |                          giaddr  (4)                          |
+//  +---------------------------------------------------------------+
+//  |                          chaddr  (16)                         |
+//  +---------------------------------------------------------------+
+//  |                          sname   (64)                         |
+//  +---------------------------------------------------------------+
+//  |                          file    (128)                        |
+//  +---------------------------------------------------------------+
+//  |                       options (variable)                      |
+//  +---------------------------------------------------------------+
+
+// DHCPv4 contains data for a single DHCP packet.
+type DHCPv4 struct {
+	BaseLayer
+	Operation    DHCPOp
+	HardwareType LinkType
+	HardwareLen  uint8
+	HardwareOpts uint8 // hops
+	Xid          uint32
+	Secs         uint16
+	Flags        uint16
+	ClientIP     net.IP
+	YourClientIP net.IP
+	NextServerIP net.IP
+	RelayAgentIP net.IP
+	ClientHWAddr net.HardwareAddr
+	ServerName   []byte
+	File         []byte
+	Options      DHCPOptions
+}
+
+// DHCPOptions is used to get nicely printed option lists which would normally
+// be cut off after 5 options.
+type DHCPOptions []DHCPOption
+
+// String returns a string version of the options list.
+func (o DHCPOptions) String() string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('[')
+	for i, opt := range o {
+		buf.WriteString(opt.String())
+		if i+1 != len(o) {
+			buf.WriteString(", ")
+		}
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+// LayerType returns gopacket.LayerTypeDHCPv4
+func (d *DHCPv4) LayerType() gopacket.LayerType { return LayerTypeDHCPv4 }
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (d *DHCPv4) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 240 {
+		df.SetTruncated()
+		return fmt.Errorf("DHCPv4 length %d too short", len(data))
+	}
+	d.Operation = DHCPOp(data[0])
+	d.HardwareType = LinkType(data[1])
+	d.HardwareLen = data[2]
+	d.HardwareOpts = data[3]
+	d.Xid = binary.BigEndian.Uint32(data[4:8])
+	d.Secs = binary.BigEndian.Uint16(data[8:10])
+	d.Flags = binary.BigEndian.Uint16(data[10:12])
+	d.ClientIP = net.IP(data[12:16])
+	d.YourClientIP = net.IP(data[16:20])
+	d.NextServerIP = net.IP(data[20:24])
+	d.RelayAgentIP = net.IP(data[24:28])
+	if d.HardwareLen > 16 {
+		return fmt.Errorf("DHCPv4 hardware address length %d too long", d.HardwareLen)
+	}
+	d.ClientHWAddr = net.HardwareAddr(data[28 : 28+int(d.HardwareLen)])
+	d.ServerName = trimNUL(data[44:108])
+	d.File = trimNUL(data[108:236])
+	if binary.BigEndian.Uint32(data[236:240]) != dhcpMagic {
+		return errors.New("bad DHCPv4 magic cookie")
+	}
+
+	d.Options = d.Options[:0]
+	offset := 240
+	for offset < len(data) {
+		t := DHCPOpt(data[offset])
+		if t == DHCPOptEnd {
+			break
+		}
+		if t == DHCPOptPad {
+			offset++
+			continue
+		}
+		if offset+2 > len(data) || offset+2+int(data[offset+1]) > len(data) {
+			df.SetTruncated()
+			return fmt.Errorf("DHCPv4 option %v truncated", t)
+		}
+		o := DHCPOption{
+			Type:   t,
+			Length: data[offset+1],
+			Data:   data[offset+2 : offset+2+int(data[offset+1])],
+		}
+		// An option of the wrong length for its type is kept as is, so
+		// that one bad option doesn't lose the rest of the packet.
+		o.Err = o.check()
+		d.Options = append(d.Options, o)
+		offset += 2 + int(o.Length)
+	}
+	d.Contents = data
+	return nil
+}
+
+// trimNUL returns b up to its first NUL byte.
+func trimNUL(b []byte) []byte {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		return b[:i]
+	}
+	return b
+}
+
+// Len returns the length of a DHCPv4 packet, before padding.
+func (d *DHCPv4) Len() int {
+	n := 240
+	for _, o := range d.Options {
+		switch o.Type {
+		case DHCPOptEnd:
+		case DHCPOptPad:
+			n++
+		default:
+			n += 2 + len(o.Data)
+		}
+	}
+	return n + 1 // DHCPOptEnd
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+//
+// The End option is always added after Options, so any End in Options is
+// skipped, and the message is padded to the 300 byte minimum of BOOTP.
+func (d *DHCPv4) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	size := d.Len()
+	if size < dhcpMinLength {
+		size = dhcpMinLength
+	}
+	if len(d.ClientHWAddr) > 16 || len(d.ServerName) > 64 || len(d.File) > 128 {
+		return errors.New("DHCPv4 chaddr, sname or file too long")
+	}
+	data, err := b.PrependBytes(size)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		d.HardwareLen = uint8(len(d.ClientHWAddr))
+	}
+	data[0] = byte(d.Operation)
+	data[1] = byte(d.HardwareType)
+	data[2] = d.HardwareLen
+	data[3] = d.HardwareOpts
+	binary.BigEndian.PutUint32(data[4:8], d.Xid)
+	binary.BigEndian.PutUint16(data[8:10], d.Secs)
+	binary.BigEndian.PutUint16(data[10:12], d.Flags)
+	copy(data[12:28], lotsOfZeros[:16])
+	for i, ip := range []net.IP{d.ClientIP, d.YourClientIP, d.NextServerIP, d.RelayAgentIP} {
+		copy(data[12+4*i:16+4*i], ip.To4())
+	}
+	copy(data[28:44], lotsOfZeros[:16])
+	copy(data[28:44], d.ClientHWAddr)
+	copy(data[44:108], lotsOfZeros[:64])
+	copy(data[44:108], d.ServerName)
+	copy(data[108:236], lotsOfZeros[:128])
+	copy(data[108:236], d.File)
+	binary.BigEndian.PutUint32(data[236:240], dhcpMagic)
+
+	offset := 240
+	for i := range d.Options {
+		o := &d.Options[i]
+		switch o.Type {
+		case DHCPOptEnd:
+			continue
+		case DHCPOptPad:
+			data[offset] = 0
+			offset++
+			continue
+		}
+		if len(o.Data) > 255 {
+			return fmt.Errorf("DHCPv4 option %v too long: %d bytes", o.Type, len(o.Data))
+		}
+		if opts.FixLengths {
+			o.Length = uint8(len(o.Data))
+		} else if int(o.Length) != len(o.Data) {
+			return fmt.Errorf("DHCPv4 option %v length %d doesn't match its %d bytes of data", o.Type, o.Length, len(o.Data))
+		}
+		data[offset] = byte(o.Type)
+		data[offset+1] = o.Length
+		copy(data[offset+2:], o.Data)
+		offset += 2 + len(o.Data)
+	}
+	data[offset] = byte(DHCPOptEnd)
+	copy(data[offset+1:], lotsOfZeros[:len(data)-offset-1])
+	return nil
+}
+
+// CanDecode returns the set of layer types that this DecodingLayer can decode.
+func (d *DHCPv4) CanDecode() gopacket.LayerClass {
+	return LayerTypeDHCPv4
+}
+
+// NextLayerType returns the layer type contained by this DecodingLayer.
+func (d *DHCPv4) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypePayload
+}
+
+// Payload returns nil, since DHCPv4 carries no further layers.
+func (d *DHCPv4) Payload() []byte {
+	return nil
+}
+
+func decodeDHCPv4(data []byte, p gopacket.PacketBuilder) error {
+	dhcp := &DHCPv4{}
+	err := dhcp.DecodeFromBytes(data, p)
+	if err != nil {
+		return err
+	}
+	p.AddLayer(dhcp)
+	p.SetApplicationLayer(dhcp)
+	return nil
+}
+
+// Option returns the first option of type t, and whether there was one.
+func (d *DHCPv4) Option(t DHCPOpt) (DHCPOption, bool) {
+	for _, o := range d.Options {
+		if o.Type == t {
+			return o, true
+		}
+	}
+	return DHCPOption{}, false
+}
+
+// validOption returns the first option of type t if it decoded without error.
+func (d *DHCPv4) validOption(t DHCPOpt) (DHCPOption, bool) {
+	o, ok := d.Option(t)
+	if !ok || o.Err != nil {
+		return DHCPOption{}, false
+	}
+	return o, true
+}
+
+// MessageType returns the DHCP message type, or DHCPMsgTypeUnspecified for
+// plain BOOTP messages.
+func (d *DHCPv4) MessageType() DHCPMsgType {
+	if o, ok := d.validOption(DHCPOptMessageType); ok && len(o.Data) == 1 {
+		return DHCPMsgType(o.Data[0])
+	}
+	return DHCPMsgTypeUnspecified
+}
+
+// RequestedIP returns the requested IP address option, or nil.
+func (d *DHCPv4) RequestedIP() net.IP {
+	o, _ := d.validOption(DHCPOptRequestIP)
+	return o.IP()
+}
+
+// ServerID returns the server identifier option, or nil.
+func (d *DHCPv4) ServerID() net.IP {
+	o, _ := d.validOption(DHCPOptServerID)
+	return o.IP()
+}
+
+// LeaseTime returns the IP address lease time option in seconds, and whether
+// the option was present.
+func (d *DHCPv4) LeaseTime() (uint32, bool) {
+	o, ok := d.validOption(DHCPOptLeaseTime)
+	if !ok || len(o.Data) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(o.Data), true
+}
+
+// Routers returns the addresses in the router option.
+func (d *DHCPv4) Routers() []net.IP {
+	o, _ := d.validOption(DHCPOptRouter)
+	return o.IPs()
+}
+
+// DNSServers returns the addresses in the domain name server option.
+func (d *DHCPv4) DNSServers() []net.IP {
+	o, _ := d.validOption(DHCPOptDNS)
+	return o.IPs()
+}
+
+// RelayAgentInfo returns the sub-options of the relay agent information
+// option (option 82).
+func (d *DHCPv4) RelayAgentInfo() []DHCPRelayAgentSubOption {
+	o, _ := d.validOption(DHCPOptRelayAgentInfo)
+	subs, _ := decodeDHCPRelayAgentInfo(o.Data)
+	return subs
+}
+
+// DHCPOption represents a DHCP option.
+type DHCPOption struct {
+	Type   DHCPOpt
+	Length uint8
+	Data   []byte
+	// Err is set by decoding if Data has the wrong length for Type.  The
+	// option is still kept, and serialized, with its data as is, but the
+	// accessors of DHCPv4 like LeaseTime ignore it.
+	Err error
+}
+
+// NewDHCPOption constructs a new DHCPOption with a given type and data.
+func NewDHCPOption(t DHCPOpt, data []byte) DHCPOption {
+	return DHCPOption{Type: t, Length: uint8(len(data)), Data: data}
+}
+
+// NewDHCPOptionIPs constructs an option holding a list of IPv4 addresses,
+// like DHCPOptRouter or DHCPOptDNS.  IPs which aren't IPv4 are skipped.
+func NewDHCPOptionIPs(t DHCPOpt, ips ...net.IP) DHCPOption {
+	data := make([]byte, 0, 4*len(ips))
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			data = append(data, ip4...)
+		}
+	}
+	return NewDHCPOption(t, data)
+}
+
+// NewDHCPOptionUint32 constructs an option holding a 4 byte integer, like
+// DHCPOptLeaseTime.
+func NewDHCPOptionUint32(t DHCPOpt, v uint32) DHCPOption {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, v)
+	return NewDHCPOption(t, data)
+}
+
+// NewDHCPOptionRelayAgentInfo constructs a relay agent information option
+// from its sub-options.
+func NewDHCPOptionRelayAgentInfo(subs ...DHCPRelayAgentSubOption) DHCPOption {
+	var data []byte
+	for _, s := range subs {
+		data = append(data, byte(s.Type), byte(len(s.Data)))
+		data = append(data, s.Data...)
+	}
+	return NewDHCPOption(DHCPOptRelayAgentInfo, data)
+}
+
+// IP returns the data of an option holding a single IPv4 address, or nil if
+// the data isn't 4 bytes long.
+func (o DHCPOption) IP() net.IP {
+	if len(o.Data) != 4 {
+		return nil
+	}
+	return net.IP(o.Data)
+}
+
+// IPs returns the data of an option holding a list of IPv4 addresses.
+func (o DHCPOption) IPs() []net.IP {
+	var ips []net.IP
+	for i := 0; i+4 <= len(o.Data); i += 4 {
+		ips = append(ips, net.IP(o.Data[i:i+4]))
+	}
+	return ips
+}
+
+// String returns a string version of a DHCP Option.
+func (o DHCPOption) String() string {
+	switch o.Type {
+	case DHCPOptMessageType:
+		if len(o.Data) == 1 {
+			return fmt.Sprintf("Option(%s:%s)", o.Type, DHCPMsgType(o.Data[0]))
+		}
+	case DHCPOptSubnetMask, DHCPOptBroadcastAddr, DHCPOptRequestIP, DHCPOptServerID,
+		DHCPOptRouter, DHCPOptTimeServer, DHCPOptNameServer, DHCPOptDNS,
+		DHCPOptLogServer, DHCPOptNTPServers:
+		return fmt.Sprintf("Option(%s:%v)", o.Type, o.IPs())
+	case DHCPOptLeaseTime, DHCPOptT1, DHCPOptT2:
+		if len(o.Data) == 4 {
+			return fmt.Sprintf("Option(%s:%ds)", o.Type, binary.BigEndian.Uint32(o.Data))
+		}
+	case DHCPOptHostname, DHCPOptDomainName, DHCPOptMessage, DHCPOptTFTPServerName,
+		DHCPOptBootfileName:
+		return fmt.Sprintf("Option(%s:%q)", o.Type, o.Data)
+	case DHCPOptRelayAgentInfo:
+		if subs, err := decodeDHCPRelayAgentInfo(o.Data); err == nil {
+			return fmt.Sprintf("Option(%s:%v)", o.Type, subs)
+		}
+	}
+	return fmt.Sprintf("Option(%s:%x)", o.Type, o.Data)
+}
+
+// check returns an error if the option's data has the wrong length for its
+// type.
+func (o DHCPOption) check() error {
+	var ok bool
+	switch o.Type {
+	case DHCPOptMessageType, DHCPOptOverload:
+		ok = len(o.Data) == 1
+	case DHCPOptInterfaceMTU, DHCPOptMaxMessageSize:
+		ok = len(o.Data) == 2
+	case DHCPOptSubnetMask, DHCPOptTimeOffset, DHCPOptBroadcastAddr, DHCPOptRequestIP,
+		DHCPOptLeaseTime, DHCPOptServerID, DHCPOptT1, DHCPOptT2:
+		ok = len(o.Data) == 4
+	case DHCPOptRouter, DHCPOptTimeServer, DHCPOptNameServer, DHCPOptDNS,
+		DHCPOptLogServer, DHCPOptNTPServers:
+		ok = len(o.Data) > 0 && len(o.Data)%4 == 0
+	case DHCPOptStaticRoute:
+		ok = len(o.Data) > 0 && len(o.Data)%8 == 0
+	case DHCPOptRelayAgentInfo:
+		_, err := decodeDHCPRelayAgentInfo(o.Data)
+		ok = err == nil
+	default:
+		ok = true
+	}
+	if !ok {
+		return fmt.Errorf("invalid DHCPv4 option %v length %d", o.Type, len(o.Data))
+	}
+	return nil
+}
+
+// DHCPRelayAgentSubOption is a sub-option of the relay agent information
+// option.
+type DHCPRelayAgentSubOption struct {
+	Type DHCPRelayAgentSubOpt
+	Data []byte
+}
+
+func decodeDHCPRelayAgentInfo(data []byte) ([]DHCPRelayAgentSubOption, error) {
+	var subs []DHCPRelayAgentSubOption
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, errors.New("DHCPv4 relay agent sub-option truncated")
+		}
+		subs = append(subs, DHCPRelayAgentSubOption{
+			Type: DHCPRelayAgentSubOpt(data[0]),
+			Data: data[2 : 2+int(data[1])],
+		})
+		data = data[2+int(data[1]):]
+	}
+	return subs, nil
+}
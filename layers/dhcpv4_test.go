@@ -0,0 +1,235 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+func TestDHCPv4EncodeDecode(t *testing.T) {
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	dhcp := &DHCPv4{
+		Operation:    DHCPOpReply,
+		HardwareType: LinkTypeEthernet,
+		HardwareOpts: 1,
+		Xid:          0x12345678,
+		Flags:        0x8000,
+		YourClientIP: net.IP{10, 0, 0, 23},
+		RelayAgentIP: net.IP{10, 0, 0, 1},
+		ClientHWAddr: mac,
+		ServerName:   []byte("dhcp1"),
+		Options: DHCPOptions{
+			NewDHCPOption(DHCPOptMessageType, []byte{byte(DHCPMsgTypeAck)}),
+			NewDHCPOptionIPs(DHCPOptServerID, net.IP{10, 0, 0, 2}),
+			NewDHCPOptionUint32(DHCPOptLeaseTime, 86400),
+			NewDHCPOptionIPs(DHCPOptSubnetMask, net.IP{255, 255, 255, 0}),
+			NewDHCPOptionIPs(DHCPOptRouter, net.IP{10, 0, 0, 1}),
+			NewDHCPOptionIPs(DHCPOptDNS, net.IP{8, 8, 8, 8}, net.IP{8, 8, 4, 4}),
+			NewDHCPOption(DHCPOptDomainName, []byte("example.com")),
+			NewDHCPOptionRelayAgentInfo(
+				DHCPRelayAgentSubOption{Type: DHCPRelayAgentSubOptCircuitID, Data: []byte("eth0/1")},
+				DHCPRelayAgentSubOption{Type: DHCPRelayAgentSubOptRemoteID, Data: mac},
+			),
+		},
+	}
+	eth := &Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: EthernetTypeIPv4}
+	ip := &IPv4{Version: 4, TTL: 64, Protocol: IPProtocolUDP, SrcIP: net.IP{10, 0, 0, 2}, DstIP: net.IP{10, 0, 0, 1}}
+	udp := &UDP{SrcPort: 67, DstPort: 67}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, dhcp); err != nil {
+		t.Fatal(err)
+	}
+	p := gopacket.NewPacket(buf.Bytes(), LinkTypeEthernet, gopacket.Default)
+	if p.ErrorLayer() != nil {
+		t.Fatal("Failed to decode packet:", p.ErrorLayer().Error())
+	}
+	checkLayers(p, []gopacket.LayerType{LayerTypeEthernet, LayerTypeIPv4, LayerTypeUDP, LayerTypeDHCPv4}, t)
+	got, ok := p.Layer(LayerTypeDHCPv4).(*DHCPv4)
+	if !ok {
+		t.Fatal("No DHCPv4 layer found")
+	}
+	if p.ApplicationLayer() != got {
+		t.Error("DHCPv4 is not the application layer")
+	}
+	if got.Operation != DHCPOpReply || got.Xid != dhcp.Xid || got.Flags != 0x8000 || got.HardwareLen != 6 ||
+		!bytes.Equal(got.ClientHWAddr, mac) || string(got.ServerName) != "dhcp1" || len(got.File) != 0 {
+		t.Errorf("header mismatch: %+v", got)
+	}
+	if !got.YourClientIP.Equal(dhcp.YourClientIP) || !got.RelayAgentIP.Equal(dhcp.RelayAgentIP) ||
+		!got.ClientIP.Equal(net.IPv4zero) {
+		t.Errorf("wrong addresses %v %v %v", got.ClientIP, got.YourClientIP, got.RelayAgentIP)
+	}
+	if len(got.Options) != len(dhcp.Options) {
+		t.Fatalf("got %d options, want %d: %v", len(got.Options), len(dhcp.Options), got.Options)
+	}
+	if got.MessageType() != DHCPMsgTypeAck {
+		t.Errorf("got message type %v", got.MessageType())
+	}
+	if !got.ServerID().Equal(net.IP{10, 0, 0, 2}) {
+		t.Errorf("got server ID %v", got.ServerID())
+	}
+	if lease, ok := got.LeaseTime(); !ok || lease != 86400 {
+		t.Errorf("got lease time %d, %v", lease, ok)
+	}
+	if r := got.Routers(); len(r) != 1 || !r[0].Equal(net.IP{10, 0, 0, 1}) {
+		t.Errorf("got routers %v", r)
+	}
+	if d := got.DNSServers(); len(d) != 2 || !d[1].Equal(net.IP{8, 8, 4, 4}) {
+		t.Errorf("got DNS servers %v", d)
+	}
+	if got.RequestedIP() != nil {
+		t.Errorf("got requested IP %v", got.RequestedIP())
+	}
+	if subs := got.RelayAgentInfo(); len(subs) != 2 || string(subs[0].Data) != "eth0/1" ||
+		subs[1].Type != DHCPRelayAgentSubOptRemoteID || !bytes.Equal(subs[1].Data, mac) {
+		t.Errorf("got relay agent info %v", subs)
+	}
+
+	// Serializing the decoded layer gives back the same bytes.
+	buf2 := gopacket.NewSerializeBuffer()
+	if err := got.SerializeTo(buf2, gopacket.SerializeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf2.Bytes(), buf.Bytes()[42:]) {
+		t.Errorf("reserialized DHCPv4 differs\ngot  %x\nwant %x", buf2.Bytes(), buf.Bytes()[42:])
+	}
+}
+
+func TestDHCPv4DecodeErrors(t *testing.T) {
+	valid := make([]byte, 244)
+	copy(valid[236:], []byte{0x63, 0x82, 0x53, 0x63, byte(DHCPOptMessageType), 1, 1, 0xff})
+	var d DHCPv4
+	if err := d.DecodeFromBytes(valid, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if d.MessageType() != DHCPMsgTypeDiscover {
+		t.Errorf("got message type %v", d.MessageType())
+	}
+	for _, data := range [][]byte{
+		valid[:200],
+		append(append([]byte{}, valid[:236]...), 1, 2, 3, 4),
+		append(append([]byte{}, valid[:240]...), byte(DHCPOptHostname), 10, 'a'),
+	} {
+		if err := d.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err == nil {
+			t.Errorf("expected error decoding %x", data[236:])
+		}
+	}
+}
+
+func TestDHCPv4InvalidOptions(t *testing.T) {
+	data := make([]byte, 240)
+	copy(data[236:], []byte{0x63, 0x82, 0x53, 0x63})
+	data = append(data,
+		byte(DHCPOptLeaseTime), 3, 0, 0, 1,
+		byte(DHCPOptRouter), 6, 10, 0, 0, 1, 10, 0,
+		byte(DHCPOptMessageType), 1, byte(DHCPMsgTypeAck),
+		byte(DHCPOptEnd))
+	var d DHCPv4
+	if err := d.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Options) != 3 {
+		t.Fatalf("got options %v, want 3", d.Options)
+	}
+	for i, o := range d.Options[:2] {
+		if o.Err == nil {
+			t.Errorf("option %d: expected error for %v", i, o)
+		}
+	}
+	if d.Options[2].Err != nil {
+		t.Errorf("option 2: %v", d.Options[2].Err)
+	}
+	if !bytes.Equal(d.Options[0].Data, []byte{0, 0, 1}) {
+		t.Errorf("got lease time data %x, want 000001", d.Options[0].Data)
+	}
+	if lease, ok := d.LeaseTime(); ok {
+		t.Errorf("got lease time %d", lease)
+	}
+	if routers := d.Routers(); routers != nil {
+		t.Errorf("got routers %v", routers)
+	}
+	if d.MessageType() != DHCPMsgTypeAck {
+		t.Errorf("got message type %v, want %v", d.MessageType(), DHCPMsgTypeAck)
+	}
+
+	// The invalid options are serialized back as they were.
+	buf := gopacket.NewSerializeBuffer()
+	if err := d.SerializeTo(buf, gopacket.SerializeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes()[:len(data)], data) {
+		t.Errorf("reserialized DHCPv4 differs\ngot  %x\nwant %x", buf.Bytes(), data)
+	}
+}
+
+func TestDHCPv4Discover(t *testing.T) {
+	p := gopacket.NewPacket(testPacketDot11DataIP, LinkTypeIEEE80211Radio, gopacket.Default)
+	dhcp, ok := p.Layer(LayerTypeDHCPv4).(*DHCPv4)
+	if !ok {
+		t.Fatal("No DHCPv4 layer found")
+	}
+	if dhcp.Operation != DHCPOpRequest || dhcp.MessageType() != DHCPMsgTypeDiscover ||
+		dhcp.ClientHWAddr.String() != "00:19:e3:d3:53:52" {
+		t.Errorf("unexpected DHCPv4 layer %+v", dhcp)
+	}
+	if o, ok := dhcp.Option(DHCPOptHostname); !ok || string(o.Data) != "Macintosh-4" {
+		t.Errorf("got hostname %v, %v", o, ok)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := dhcp.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), dhcp.Contents) {
+		t.Errorf("reserialized DHCPv4 differs\ngot  %x\nwant %x", buf.Bytes(), dhcp.Contents)
+	}
+}
+
+func TestDHCPv4Padding(t *testing.T) {
+	buf := gopacket.NewSerializeBuffer()
+	if err := (&DHCPv4{}).SerializeTo(buf, gopacket.SerializeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(buf.Bytes()) != dhcpMinLength || buf.Bytes()[240] != byte(DHCPOptEnd) {
+		t.Errorf("got %d bytes, want %d ending options at 240", len(buf.Bytes()), dhcpMinLength)
+	}
+}
+
+func TestDHCPv4SerializeReuse(t *testing.T) {
+	buf := gopacket.NewSerializeBuffer()
+	offer := &DHCPv4{
+		Operation:    DHCPOpReply,
+		ClientIP:     net.IP{1, 1, 1, 1},
+		YourClientIP: net.IP{2, 2, 2, 2},
+		NextServerIP: net.IP{3, 3, 3, 3},
+		RelayAgentIP: net.IP{4, 4, 4, 4},
+	}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, offer); err != nil {
+		t.Fatal(err)
+	}
+	discover := &DHCPv4{
+		Operation: DHCPOpRequest,
+		Options:   []DHCPOption{NewDHCPOption(DHCPOptMessageType, []byte{byte(DHCPMsgTypeDiscover)})},
+	}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, discover); err != nil {
+		t.Fatal(err)
+	}
+	if addrs := buf.Bytes()[12:28]; !bytes.Equal(addrs, make([]byte, 16)) {
+		t.Errorf("got addresses %x, want zeros", addrs)
+	}
+
+	// Without FixLengths, option lengths must match their data.
+	discover.Options[0].Length = 2
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, discover); err == nil {
+		t.Error("expected error serializing an option with a stale length")
+	}
+}
@@ -0,0 +1,752 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+)
+
+// DHCPv6MsgType is the type of a DHCPv6 message.
+type DHCPv6MsgType byte
+
+// Constants for the DHCPv6 message types, from RFC 3315.
+const (
+	DHCPv6MsgTypeUnspecified DHCPv6MsgType = iota
+	DHCPv6MsgTypeSolicit
+	DHCPv6MsgTypeAdvertise
+	DHCPv6MsgTypeRequest
+	DHCPv6MsgTypeConfirm
+	DHCPv6MsgTypeRenew
+	DHCPv6MsgTypeRebind
+	DHCPv6MsgTypeReply
+	DHCPv6MsgTypeRelease
+	DHCPv6MsgTypeDecline
+	DHCPv6MsgTypeReconfigure
+	DHCPv6MsgTypeInformationRequest
+	DHCPv6MsgTypeRelayForward
+	DHCPv6MsgTypeRelayReply
+)
+
+func (o DHCPv6MsgType) String() string {
+	switch o {
+	case DHCPv6MsgTypeUnspecified:
+		return "Unspecified"
+	case DHCPv6MsgTypeSolicit:
+		return "Solicit"
+	case DHCPv6MsgTypeAdvertise:
+		return "Advertise"
+	case DHCPv6MsgTypeRequest:
+		return "Request"
+	case DHCPv6MsgTypeConfirm:
+		return "Confirm"
+	case DHCPv6MsgTypeRenew:
+		return "Renew"
+	case DHCPv6MsgTypeRebind:
+		return "Rebind"
+	case DHCPv6MsgTypeReply:
+		return "Reply"
+	case DHCPv6MsgTypeRelease:
+		return "Release"
+	case DHCPv6MsgTypeDecline:
+		return "Decline"
+	case DHCPv6MsgTypeReconfigure:
+		return "Reconfigure"
+	case DHCPv6MsgTypeInformationRequest:
+		return "InformationRequest"
+	case DHCPv6MsgTypeRelayForward:
+		return "RelayForward"
+	case DHCPv6MsgTypeRelayReply:
+		return "RelayReply"
+	default:
+		return "Unknown"
+	}
+}
+
+// IsRelay returns true for the message types sent between relay agents and
+// servers, which carry another message in a DHCPv6OptRelayMessage.
+func (o DHCPv6MsgType) IsRelay() bool {
+	return o == DHCPv6MsgTypeRelayForward || o == DHCPv6MsgTypeRelayReply
+}
+
+// DHCPv6Opt is the code of a DHCPv6 option, from RFC 3315 unless noted.
+type DHCPv6Opt uint16
+
+const (
+	DHCPv6OptClientID           DHCPv6Opt = 1
+	DHCPv6OptServerID           DHCPv6Opt = 2
+	DHCPv6OptIANA               DHCPv6Opt = 3
+	DHCPv6OptIATA               DHCPv6Opt = 4
+	DHCPv6OptIAAddr             DHCPv6Opt = 5
+	DHCPv6OptOro                DHCPv6Opt = 6
+	DHCPv6OptPreference         DHCPv6Opt = 7
+	DHCPv6OptElapsedTime        DHCPv6Opt = 8
+	DHCPv6OptRelayMessage       DHCPv6Opt = 9
+	DHCPv6OptAuth               DHCPv6Opt = 11
+	DHCPv6OptUnicast            DHCPv6Opt = 12
+	DHCPv6OptStatusCode         DHCPv6Opt = 13
+	DHCPv6OptRapidCommit        DHCPv6Opt = 14
+	DHCPv6OptUserClass          DHCPv6Opt = 15
+	DHCPv6OptVendorClass        DHCPv6Opt = 16
+	DHCPv6OptVendorOpts         DHCPv6Opt = 17
+	DHCPv6OptInterfaceID        DHCPv6Opt = 18
+	DHCPv6OptReconfigureMessage DHCPv6Opt = 19
+	DHCPv6OptReconfigureAccept  DHCPv6Opt = 20
+	DHCPv6OptDNSServers         DHCPv6Opt = 23 // [RFC3646]
+	DHCPv6OptDomainList         DHCPv6Opt = 24 // [RFC3646]
+	DHCPv6OptIAPD               DHCPv6Opt = 25 // [RFC3633]
+	DHCPv6OptIAPrefix           DHCPv6Opt = 26 // [RFC3633]
+	DHCPv6OptRemoteID           DHCPv6Opt = 37 // [RFC4649]
+)
+
+func (o DHCPv6Opt) String() string {
+	switch o {
+	case DHCPv6OptClientID:
+		return "ClientID"
+	case DHCPv6OptServerID:
+		return "ServerID"
+	case DHCPv6OptIANA:
+		return "IA_NA"
+	case DHCPv6OptIATA:
+		return "IA_TA"
+	case DHCPv6OptIAAddr:
+		return "IAAddr"
+	case DHCPv6OptOro:
+		return "Oro"
+	case DHCPv6OptPreference:
+		return "Preference"
+	case DHCPv6OptElapsedTime:
+		return "ElapsedTime"
+	case DHCPv6OptRelayMessage:
+		return "RelayMessage"
+	case DHCPv6OptAuth:
+		return "Auth"
+	case DHCPv6OptUnicast:
+		return "Unicast"
+	case DHCPv6OptStatusCode:
+		return "StatusCode"
+	case DHCPv6OptRapidCommit:
+		return "RapidCommit"
+	case DHCPv6OptUserClass:
+		return "UserClass"
+	case DHCPv6OptVendorClass:
+		return "VendorClass"
+	case DHCPv6OptVendorOpts:
+		return "VendorOpts"
+	case DHCPv6OptInterfaceID:
+		return "InterfaceID"
+	case DHCPv6OptReconfigureMessage:
+		return "ReconfigureMessage"
+	case DHCPv6OptReconfigureAccept:
+		return "ReconfigureAccept"
+	case DHCPv6OptDNSServers:
+		return "DNSServers"
+	case DHCPv6OptDomainList:
+		return "DomainList"
+	case DHCPv6OptIAPD:
+		return "IA_PD"
+	case DHCPv6OptIAPrefix:
+		return "IAPrefix"
+	case DHCPv6OptRemoteID:
+		return "RemoteID"
+	default:
+		return "Unknown"
+	}
+}
+
+// DHCPv6StatusCode is the status in a DHCPv6OptStatusCode option.
+type DHCPv6StatusCode uint16
+
+const (
+	DHCPv6StatusCodeSuccess       DHCPv6StatusCode = 0
+	DHCPv6StatusCodeUnspecFail    DHCPv6StatusCode = 1
+	DHCPv6StatusCodeNoAddrsAvail  DHCPv6StatusCode = 2
+	DHCPv6StatusCodeNoBinding     DHCPv6StatusCode = 3
+	DHCPv6StatusCodeNotOnLink     DHCPv6StatusCode = 4
+	DHCPv6StatusCodeUseMulticast  DHCPv6StatusCode = 5
+	DHCPv6StatusCodeNoPrefixAvail DHCPv6StatusCode = 6 // [RFC3633]
+)
+
+func (c DHCPv6StatusCode) String() string {
+	switch c {
+	case DHCPv6StatusCodeSuccess:
+		return "Success"
+	case DHCPv6StatusCodeUnspecFail:
+		return "UnspecFail"
+	case DHCPv6StatusCodeNoAddrsAvail:
+		return "NoAddrsAvail"
+	case DHCPv6StatusCodeNoBinding:
+		return "NoBinding"
+	case DHCPv6StatusCodeNotOnLink:
+		return "NotOnLink"
+	case DHCPv6StatusCodeUseMulticast:
+		return "UseMulticast"
+	case DHCPv6StatusCodeNoPrefixAvail:
+		return "NoPrefixAvail"
+	default:
+		return "Unknown"
+	}
+}
+
+// DHCPv6DUIDType is the type of a DHCP Unique Identifier.
+type DHCPv6DUIDType uint16
+
+const (
+	DHCPv6DUIDTypeLLT  DHCPv6DUIDType = 1 // link-layer address plus time
+	DHCPv6DUIDTypeEN   DHCPv6DUIDType = 2 // vendor-assigned, based on enterprise number
+	DHCPv6DUIDTypeLL   DHCPv6DUIDType = 3 // link-layer address
+	DHCPv6DUIDTypeUUID DHCPv6DUIDType = 4 // UUID [RFC6355]
+)
+
+//  DHCPv6 is specified in RFC 3315
+//  0                   1                   2                   3
+//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//  |    msg-type   |               transaction-id                  |
+//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//  |                            options                            |
+//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//
+//  Relay agent/server messages replace the transaction-id with:
+//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+//  |    msg-type   |   hop-count   |                               |
+//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+                               |
+//  |                         link-address (16)                     |
+//  |                               +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-|
+//  |                               |                               |
+//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+                               |
+//  |                         peer-address (16)                     |
+//  |                               +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-|
+//  |                               |                               |
+//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+                               |
+//  |                            options                            |
+//  +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+
+// DHCPv6 contains data for a single DHCPv6 message.
+//
+// Relay-forward and relay-reply messages hold the relayed message in a
+// DHCPv6OptRelayMessage option.  That option isn't included in Options;
+// instead its data is the layer's payload, and is decoded as another DHCPv6
+// layer.  When serializing a relay message, the bytes already in the buffer,
+// like those of a serialized inner DHCPv6 layer, are written as a relay
+// message option following Options.
+type DHCPv6 struct {
+	BaseLayer
+	MsgType       DHCPv6MsgType
+	HopCount      uint8  // relay messages only
+	LinkAddr      net.IP // relay messages only
+	PeerAddr      net.IP // relay messages only
+	TransactionID []byte // 3 bytes, other messages only
+	Options       DHCPv6Options
+}
+
+// LayerType returns gopacket.LayerTypeDHCPv6
+func (d *DHCPv6) LayerType() gopacket.LayerType { return LayerTypeDHCPv6 }
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (d *DHCPv6) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return fmt.Errorf("DHCPv6 length %d too short", len(data))
+	}
+	d.MsgType = DHCPv6MsgType(data[0])
+	offset := 4
+	if d.MsgType.IsRelay() {
+		if len(data) < 34 {
+			df.SetTruncated()
+			return fmt.Errorf("DHCPv6 relay message length %d too short", len(data))
+		}
+		d.HopCount = data[1]
+		d.LinkAddr = net.IP(data[2:18])
+		d.PeerAddr = net.IP(data[18:34])
+		d.TransactionID = nil
+		offset = 34
+	} else {
+		d.HopCount = 0
+		d.LinkAddr = nil
+		d.PeerAddr = nil
+		d.TransactionID = data[1:4]
+	}
+
+	var err error
+	d.Options, err = decodeDHCPv6Options(d.Options[:0], data[offset:])
+	if err != nil {
+		return err
+	}
+	d.BaseLayer = BaseLayer{Contents: data}
+	if d.MsgType.IsRelay() {
+		for i, o := range d.Options {
+			if o.Code == DHCPv6OptRelayMessage {
+				d.BaseLayer.Payload = o.Data
+				d.Options = append(d.Options[:i], d.Options[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Len returns the length of a DHCPv6 message, not including the relay
+// message option of relay messages.
+func (d *DHCPv6) Len() int {
+	n := 4
+	if d.MsgType.IsRelay() {
+		n = 34
+	}
+	for i := range d.Options {
+		n += d.Options[i].len()
+	}
+	return n
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+func (d *DHCPv6) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	header := 4
+	relayed := 0
+	if d.MsgType.IsRelay() {
+		header = 34
+		relayed = len(b.Bytes())
+		if relayed > 0xffff {
+			return fmt.Errorf("DHCPv6 relayed message too long: %d bytes", relayed)
+		}
+	}
+	data := make([]byte, header, d.Len()+4)
+	data[0] = byte(d.MsgType)
+	if d.MsgType.IsRelay() {
+		data[1] = d.HopCount
+		copy(data[2:18], d.LinkAddr.To16())
+		copy(data[18:34], d.PeerAddr.To16())
+	} else {
+		copy(data[1:4], d.TransactionID)
+	}
+	var err error
+	if data, err = encodeDHCPv6Options(data, d.Options, opts); err != nil {
+		return err
+	}
+	if d.MsgType.IsRelay() && relayed > 0 {
+		data = append(data, byte(DHCPv6OptRelayMessage>>8), byte(DHCPv6OptRelayMessage), byte(relayed>>8), byte(relayed))
+	}
+	bytes, err := b.PrependBytes(len(data))
+	if err != nil {
+		return err
+	}
+	copy(bytes, data)
+	return nil
+}
+
+// CanDecode returns the set of layer types that this DecodingLayer can decode.
+func (d *DHCPv6) CanDecode() gopacket.LayerClass {
+	return LayerTypeDHCPv6
+}
+
+// NextLayerType returns the layer type contained by this DecodingLayer: the
+// relayed message for relay messages.
+func (d *DHCPv6) NextLayerType() gopacket.LayerType {
+	if d.MsgType.IsRelay() && len(d.BaseLayer.Payload) > 0 {
+		return LayerTypeDHCPv6
+	}
+	return gopacket.LayerTypePayload
+}
+
+// Payload returns nil, since only relay messages carry further layers, and
+// those are protocol headers rather than application data.
+func (d *DHCPv6) Payload() []byte {
+	return nil
+}
+
+func decodeDHCPv6(data []byte, p gopacket.PacketBuilder) error {
+	dhcp := &DHCPv6{}
+	err := dhcp.DecodeFromBytes(data, p)
+	if err != nil {
+		return err
+	}
+	p.AddLayer(dhcp)
+	if dhcp.MsgType.IsRelay() && len(dhcp.BaseLayer.Payload) > 0 {
+		// Referring to LayerTypeDHCPv6 here would be an initialization loop.
+		return p.NextDecoder(gopacket.DecodeFunc(decodeDHCPv6))
+	}
+	p.SetApplicationLayer(dhcp)
+	return nil
+}
+
+// Option returns the first option with the given code, and whether there was
+// one.
+func (d *DHCPv6) Option(code DHCPv6Opt) (DHCPv6Option, bool) {
+	return d.Options.Option(code)
+}
+
+// DHCPv6Options is used to get nicely printed option lists which would
+// normally be cut off after 5 options.
+type DHCPv6Options []DHCPv6Option
+
+// String returns a string version of the options list.
+func (o DHCPv6Options) String() string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('[')
+	for i, opt := range o {
+		buf.WriteString(opt.String())
+		if i+1 != len(o) {
+			buf.WriteString(", ")
+		}
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+// Option returns the first option with the given code, and whether there was
+// one.
+func (o DHCPv6Options) Option(code DHCPv6Opt) (DHCPv6Option, bool) {
+	for _, opt := range o {
+		if opt.Code == code {
+			return opt, true
+		}
+	}
+	return DHCPv6Option{}, false
+}
+
+// DHCPv6Option is a DHCPv6 option.
+type DHCPv6Option struct {
+	Code   DHCPv6Opt
+	Length uint16
+	Data   []byte
+
+	// Decoded values.  When serializing, these are used in place of Data
+	// for their option codes.
+	DUID       DHCPv6DUID     // DHCPv6OptClientID, DHCPv6OptServerID
+	IA         DHCPv6IA       // DHCPv6OptIANA, DHCPv6OptIAPD
+	IAAddr     DHCPv6IAAddr   // DHCPv6OptIAAddr
+	IAPrefix   DHCPv6IAPrefix // DHCPv6OptIAPrefix
+	Status     DHCPv6Status   // DHCPv6OptStatusCode
+	DNSServers []net.IP       // DHCPv6OptDNSServers
+
+	// Err is set by decoding if Data doesn't decode for Code.  The option
+	// is still kept, and serialized, with its data as is, and its decoded
+	// values are left unset.
+	Err error
+}
+
+// NewDHCPv6Option constructs a new DHCPv6Option with the given code and
+// data.
+func NewDHCPv6Option(code DHCPv6Opt, data []byte) DHCPv6Option {
+	return DHCPv6Option{Code: code, Length: uint16(len(data)), Data: data}
+}
+
+// DHCPv6DUID is a DHCP Unique Identifier (RFC 3315 section 9).  Which fields
+// are used depends on Type; Identifier holds the UUID for
+// DHCPv6DUIDTypeUUID and the whole DUID after the type for unknown types.
+type DHCPv6DUID struct {
+	Type             DHCPv6DUIDType
+	HardwareType     uint16 // LLT, LL; ARP hardware type, 1 for Ethernet
+	Time             uint32 // LLT, seconds since 2000-01-01 UTC modulo 2^32
+	LinkLayerAddress net.HardwareAddr
+	EnterpriseNumber uint32 // EN
+	Identifier       []byte // EN, UUID and unknown types
+}
+
+// DHCPv6IA is an identity association for non-temporary addresses (IA_NA)
+// or for prefix delegation (IA_PD), holding DHCPv6OptIAAddr or
+// DHCPv6OptIAPrefix options respectively.
+type DHCPv6IA struct {
+	IAID    uint32
+	T1, T2  uint32
+	Options DHCPv6Options
+}
+
+// DHCPv6IAAddr is an address in an IA_NA.
+type DHCPv6IAAddr struct {
+	Address                          net.IP
+	PreferredLifetime, ValidLifetime uint32
+	Options                          DHCPv6Options
+}
+
+// DHCPv6IAPrefix is a prefix in an IA_PD.
+type DHCPv6IAPrefix struct {
+	PreferredLifetime, ValidLifetime uint32
+	PrefixLength                     uint8
+	Prefix                           net.IP
+	Options                          DHCPv6Options
+}
+
+// DHCPv6Status is the data of a status code option.
+type DHCPv6Status struct {
+	Code    DHCPv6StatusCode
+	Message []byte
+}
+
+// String returns a string version of a DHCPv6 option.
+func (o DHCPv6Option) String() string {
+	if o.Err != nil {
+		return fmt.Sprintf("Option(%s:%x)", o.Code, o.Data)
+	}
+	switch o.Code {
+	case DHCPv6OptClientID, DHCPv6OptServerID:
+		return fmt.Sprintf("Option(%s:%+v)", o.Code, o.DUID)
+	case DHCPv6OptIANA, DHCPv6OptIAPD:
+		return fmt.Sprintf("Option(%s:IAID=%d T1=%d T2=%d %v)", o.Code, o.IA.IAID, o.IA.T1, o.IA.T2, o.IA.Options)
+	case DHCPv6OptIAAddr:
+		return fmt.Sprintf("Option(%s:%v pref=%d valid=%d %v)", o.Code, o.IAAddr.Address,
+			o.IAAddr.PreferredLifetime, o.IAAddr.ValidLifetime, o.IAAddr.Options)
+	case DHCPv6OptIAPrefix:
+		return fmt.Sprintf("Option(%s:%v/%d pref=%d valid=%d %v)", o.Code, o.IAPrefix.Prefix, o.IAPrefix.PrefixLength,
+			o.IAPrefix.PreferredLifetime, o.IAPrefix.ValidLifetime, o.IAPrefix.Options)
+	case DHCPv6OptStatusCode:
+		return fmt.Sprintf("Option(%s:%s %q)", o.Code, o.Status.Code, o.Status.Message)
+	case DHCPv6OptDNSServers:
+		return fmt.Sprintf("Option(%s:%v)", o.Code, o.DNSServers)
+	}
+	return fmt.Sprintf("Option(%s:%x)", o.Code, o.Data)
+}
+
+func decodeDHCPv6Options(opts DHCPv6Options, data []byte) (DHCPv6Options, error) {
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("DHCPv6 option truncated")
+		}
+		o := DHCPv6Option{
+			Code:   DHCPv6Opt(binary.BigEndian.Uint16(data[:2])),
+			Length: binary.BigEndian.Uint16(data[2:4]),
+		}
+		if len(data) < 4+int(o.Length) {
+			return nil, fmt.Errorf("DHCPv6 option %v truncated", o.Code)
+		}
+		o.Data = data[4 : 4+int(o.Length)]
+		// An option which doesn't decode is kept as is, so that one bad
+		// option doesn't lose the rest of the message.
+		if err := o.decode(); err != nil {
+			o = DHCPv6Option{Code: o.Code, Length: o.Length, Data: o.Data, Err: err}
+		}
+		opts = append(opts, o)
+		data = data[4+int(o.Length):]
+	}
+	return opts, nil
+}
+
+// decode fills in the decoded values of the option from its data.
+func (o *DHCPv6Option) decode() error {
+	data := o.Data
+	var err error
+	switch o.Code {
+	case DHCPv6OptClientID, DHCPv6OptServerID:
+		if len(data) < 2 {
+			return errors.New("DHCPv6 DUID too short")
+		}
+		d := &o.DUID
+		d.Type = DHCPv6DUIDType(binary.BigEndian.Uint16(data[:2]))
+		switch d.Type {
+		case DHCPv6DUIDTypeLLT:
+			if len(data) < 8 {
+				return errors.New("DHCPv6 DUID-LLT too short")
+			}
+			d.HardwareType = binary.BigEndian.Uint16(data[2:4])
+			d.Time = binary.BigEndian.Uint32(data[4:8])
+			d.LinkLayerAddress = net.HardwareAddr(data[8:])
+		case DHCPv6DUIDTypeEN:
+			if len(data) < 6 {
+				return errors.New("DHCPv6 DUID-EN too short")
+			}
+			d.EnterpriseNumber = binary.BigEndian.Uint32(data[2:6])
+			d.Identifier = data[6:]
+		case DHCPv6DUIDTypeLL:
+			if len(data) < 4 {
+				return errors.New("DHCPv6 DUID-LL too short")
+			}
+			d.HardwareType = binary.BigEndian.Uint16(data[2:4])
+			d.LinkLayerAddress = net.HardwareAddr(data[4:])
+		default:
+			d.Identifier = data[2:]
+		}
+	case DHCPv6OptIANA, DHCPv6OptIAPD:
+		if len(data) < 12 {
+			return fmt.Errorf("DHCPv6 %v option too short", o.Code)
+		}
+		o.IA.IAID = binary.BigEndian.Uint32(data[:4])
+		o.IA.T1 = binary.BigEndian.Uint32(data[4:8])
+		o.IA.T2 = binary.BigEndian.Uint32(data[8:12])
+		o.IA.Options, err = decodeDHCPv6Options(nil, data[12:])
+	case DHCPv6OptIAAddr:
+		if len(data) < 24 {
+			return errors.New("DHCPv6 IAAddr option too short")
+		}
+		o.IAAddr.Address = net.IP(data[:16])
+		o.IAAddr.PreferredLifetime = binary.BigEndian.Uint32(data[16:20])
+		o.IAAddr.ValidLifetime = binary.BigEndian.Uint32(data[20:24])
+		o.IAAddr.Options, err = decodeDHCPv6Options(nil, data[24:])
+	case DHCPv6OptIAPrefix:
+		if len(data) < 25 {
+			return errors.New("DHCPv6 IAPrefix option too short")
+		}
+		o.IAPrefix.PreferredLifetime = binary.BigEndian.Uint32(data[:4])
+		o.IAPrefix.ValidLifetime = binary.BigEndian.Uint32(data[4:8])
+		o.IAPrefix.PrefixLength = data[8]
+		o.IAPrefix.Prefix = net.IP(data[9:25])
+		o.IAPrefix.Options, err = decodeDHCPv6Options(nil, data[25:])
+	case DHCPv6OptStatusCode:
+		if len(data) < 2 {
+			return errors.New("DHCPv6 status code option too short")
+		}
+		o.Status.Code = DHCPv6StatusCode(binary.BigEndian.Uint16(data[:2]))
+		o.Status.Message = data[2:]
+	case DHCPv6OptDNSServers:
+		if len(data)%16 != 0 {
+			return fmt.Errorf("invalid DHCPv6 DNS servers option length %d", len(data))
+		}
+		o.DNSServers = nil
+		for i := 0; i < len(data); i += 16 {
+			o.DNSServers = append(o.DNSServers, net.IP(data[i:i+16]))
+		}
+	}
+	return err
+}
+
+// len returns the encoded length of the option, including its header.
+func (o *DHCPv6Option) len() int {
+	n := 4
+	if o.Err != nil {
+		return n + len(o.Data)
+	}
+	switch o.Code {
+	case DHCPv6OptClientID, DHCPv6OptServerID:
+		switch o.DUID.Type {
+		case DHCPv6DUIDTypeLLT:
+			n += 8 + len(o.DUID.LinkLayerAddress)
+		case DHCPv6DUIDTypeEN:
+			n += 6 + len(o.DUID.Identifier)
+		case DHCPv6DUIDTypeLL:
+			n += 4 + len(o.DUID.LinkLayerAddress)
+		default:
+			n += 2 + len(o.DUID.Identifier)
+		}
+	case DHCPv6OptIANA, DHCPv6OptIAPD:
+		n += 12 + o.IA.Options.len()
+	case DHCPv6OptIAAddr:
+		n += 24 + o.IAAddr.Options.len()
+	case DHCPv6OptIAPrefix:
+		n += 25 + o.IAPrefix.Options.len()
+	case DHCPv6OptStatusCode:
+		n += 2 + len(o.Status.Message)
+	case DHCPv6OptDNSServers:
+		n += 16 * len(o.DNSServers)
+	default:
+		n += len(o.Data)
+	}
+	return n
+}
+
+func (o DHCPv6Options) len() int {
+	n := 0
+	for i := range o {
+		n += o[i].len()
+	}
+	return n
+}
+
+func encodeDHCPv6Options(data []byte, opts DHCPv6Options, so gopacket.SerializeOptions) ([]byte, error) {
+	var err error
+	for i := range opts {
+		if data, err = opts[i].encode(data, so); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// encode appends the option to data.
+func (o *DHCPv6Option) encode(data []byte, opts gopacket.SerializeOptions) ([]byte, error) {
+	start := len(data)
+	data = append(data, byte(o.Code>>8), byte(o.Code), 0, 0)
+	var err error
+	if o.Err != nil {
+		data = append(data, o.Data...)
+	} else {
+		data, err = o.encodeData(data, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	length := len(data) - start - 4
+	if length > 0xffff {
+		return nil, fmt.Errorf("DHCPv6 option %v too long: %d bytes", o.Code, length)
+	}
+	if opts.FixLengths {
+		o.Length = uint16(length)
+	}
+	binary.BigEndian.PutUint16(data[start+2:], o.Length)
+	return data, nil
+}
+
+// encodeData appends the data of the option to data, from its decoded values
+// for the option codes which have them.
+func (o *DHCPv6Option) encodeData(data []byte, opts gopacket.SerializeOptions) ([]byte, error) {
+	start := len(data)
+	var err error
+	switch o.Code {
+	case DHCPv6OptClientID, DHCPv6OptServerID:
+		d := &o.DUID
+		data = append(data, byte(d.Type>>8), byte(d.Type))
+		switch d.Type {
+		case DHCPv6DUIDTypeLLT:
+			data = append(data, byte(d.HardwareType>>8), byte(d.HardwareType),
+				byte(d.Time>>24), byte(d.Time>>16), byte(d.Time>>8), byte(d.Time))
+			data = append(data, d.LinkLayerAddress...)
+		case DHCPv6DUIDTypeEN:
+			data = append(data, byte(d.EnterpriseNumber>>24), byte(d.EnterpriseNumber>>16),
+				byte(d.EnterpriseNumber>>8), byte(d.EnterpriseNumber))
+			data = append(data, d.Identifier...)
+		case DHCPv6DUIDTypeLL:
+			data = append(data, byte(d.HardwareType>>8), byte(d.HardwareType))
+			data = append(data, d.LinkLayerAddress...)
+		default:
+			data = append(data, d.Identifier...)
+		}
+	case DHCPv6OptIANA, DHCPv6OptIAPD:
+		data = appendUint32s(data, o.IA.IAID, o.IA.T1, o.IA.T2)
+		data, err = encodeDHCPv6Options(data, o.IA.Options, opts)
+	case DHCPv6OptIAAddr:
+		data = append(data, o.IAAddr.Address.To16()...)
+		if len(data) != start+16 {
+			return nil, fmt.Errorf("invalid DHCPv6 IAAddr address %v", o.IAAddr.Address)
+		}
+		data = appendUint32s(data, o.IAAddr.PreferredLifetime, o.IAAddr.ValidLifetime)
+		data, err = encodeDHCPv6Options(data, o.IAAddr.Options, opts)
+	case DHCPv6OptIAPrefix:
+		data = appendUint32s(data, o.IAPrefix.PreferredLifetime, o.IAPrefix.ValidLifetime)
+		data = append(data, o.IAPrefix.PrefixLength)
+		data = append(data, o.IAPrefix.Prefix.To16()...)
+		if len(data) != start+25 {
+			return nil, fmt.Errorf("invalid DHCPv6 IAPrefix prefix %v", o.IAPrefix.Prefix)
+		}
+		data, err = encodeDHCPv6Options(data, o.IAPrefix.Options, opts)
+	case DHCPv6OptStatusCode:
+		data = append(data, byte(o.Status.Code>>8), byte(o.Status.Code))
+		data = append(data, o.Status.Message...)
+	case DHCPv6OptDNSServers:
+		for _, ip := range o.DNSServers {
+			ip16 := ip.To16()
+			if ip16 == nil {
+				return nil, fmt.Errorf("invalid DHCPv6 DNS server %v", ip)
+			}
+			data = append(data, ip16...)
+		}
+	default:
+		data = append(data, o.Data...)
+	}
+	return data, err
+}
+
+func appendUint32s(data []byte, vs ...uint32) []byte {
+	for _, v := range vs {
+		data = append(data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return data
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+func TestDHCPv6RelayedReply(t *testing.T) {
+	mac := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+	reply := &DHCPv6{
+		MsgType:       DHCPv6MsgTypeReply,
+		TransactionID: []byte{0xa1, 0xb2, 0xc3},
+		Options: DHCPv6Options{
+			{Code: DHCPv6OptClientID, DUID: DHCPv6DUID{Type: DHCPv6DUIDTypeLLT, HardwareType: 1, Time: 12345, LinkLayerAddress: mac}},
+			{Code: DHCPv6OptServerID, DUID: DHCPv6DUID{Type: DHCPv6DUIDTypeEN, EnterpriseNumber: 9, Identifier: []byte{1, 2, 3}}},
+			{Code: DHCPv6OptIANA, IA: DHCPv6IA{IAID: 1, T1: 1800, T2: 2880, Options: DHCPv6Options{
+				{Code: DHCPv6OptIAAddr, IAAddr: DHCPv6IAAddr{Address: net.ParseIP("2001:db8::100"), PreferredLifetime: 3600, ValidLifetime: 7200}},
+			}}},
+			{Code: DHCPv6OptIAPD, IA: DHCPv6IA{IAID: 2, T1: 1800, T2: 2880, Options: DHCPv6Options{
+				{Code: DHCPv6OptIAPrefix, IAPrefix: DHCPv6IAPrefix{PreferredLifetime: 3600, ValidLifetime: 7200, PrefixLength: 56, Prefix: net.ParseIP("2001:db8:100::")}},
+			}}},
+			{Code: DHCPv6OptDNSServers, DNSServers: []net.IP{net.ParseIP("2001:4860:4860::8888")}},
+			{Code: DHCPv6OptStatusCode, Status: DHCPv6Status{Code: DHCPv6StatusCodeSuccess, Message: []byte("ok")}},
+			NewDHCPv6Option(DHCPv6OptPreference, []byte{255}),
+		},
+	}
+	relay := &DHCPv6{
+		MsgType:  DHCPv6MsgTypeRelayReply,
+		HopCount: 0,
+		LinkAddr: net.ParseIP("2001:db8::1"),
+		PeerAddr: net.ParseIP("fe80::211:22ff:fe33:4455"),
+		Options: DHCPv6Options{
+			NewDHCPv6Option(DHCPv6OptInterfaceID, []byte("eth0")),
+		},
+	}
+	eth := &Ethernet{SrcMAC: mac, DstMAC: mac, EthernetType: EthernetTypeIPv6}
+	ip := &IPv6{Version: 6, HopLimit: 64, NextHeader: IPProtocolUDP, SrcIP: net.ParseIP("2001:db8::2"), DstIP: net.ParseIP("2001:db8::1")}
+	udp := &UDP{SrcPort: 547, DstPort: 547}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, relay, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	p := gopacket.NewPacket(buf.Bytes(), LinkTypeEthernet, gopacket.Default)
+	if p.ErrorLayer() != nil {
+		t.Fatal("Failed to decode packet:", p.ErrorLayer().Error())
+	}
+	checkLayers(p, []gopacket.LayerType{LayerTypeEthernet, LayerTypeIPv6, LayerTypeUDP, LayerTypeDHCPv6, LayerTypeDHCPv6}, t)
+	ls := p.Layers()
+	gotRelay, gotReply := ls[3].(*DHCPv6), ls[4].(*DHCPv6)
+	if p.ApplicationLayer() != gotReply {
+		t.Error("inner DHCPv6 message is not the application layer")
+	}
+	if gotRelay.MsgType != DHCPv6MsgTypeRelayReply || !gotRelay.LinkAddr.Equal(relay.LinkAddr) ||
+		!gotRelay.PeerAddr.Equal(relay.PeerAddr) || len(gotRelay.Options) != 1 ||
+		string(gotRelay.Options[0].Data) != "eth0" {
+		t.Errorf("unexpected relay message %+v", gotRelay)
+	}
+	if !bytes.Equal(gotRelay.LayerPayload(), gotReply.Contents) {
+		t.Error("relay payload is not the relayed message")
+	}
+	if gotReply.MsgType != DHCPv6MsgTypeReply || !bytes.Equal(gotReply.TransactionID, reply.TransactionID) {
+		t.Errorf("unexpected reply %+v", gotReply)
+	}
+	if len(gotReply.Options) != len(reply.Options) {
+		t.Fatalf("got %d options, want %d: %v", len(gotReply.Options), len(reply.Options), gotReply.Options)
+	}
+	for i, o := range gotReply.Options {
+		want := reply.Options[i]
+		if o.Code != want.Code || o.Length != want.Length {
+			t.Errorf("option %d: got %v length %d, want %v length %d", i, o.Code, o.Length, want.Code, want.Length)
+		}
+	}
+	if o, _ := gotReply.Option(DHCPv6OptClientID); !reflect.DeepEqual(o.DUID, reply.Options[0].DUID) {
+		t.Errorf("got client DUID %+v", o.DUID)
+	}
+	if o, _ := gotReply.Option(DHCPv6OptServerID); !reflect.DeepEqual(o.DUID, reply.Options[1].DUID) {
+		t.Errorf("got server DUID %+v", o.DUID)
+	}
+	na, _ := gotReply.Option(DHCPv6OptIANA)
+	if na.IA.IAID != 1 || na.IA.T2 != 2880 || len(na.IA.Options) != 1 ||
+		!na.IA.Options[0].IAAddr.Address.Equal(net.ParseIP("2001:db8::100")) ||
+		na.IA.Options[0].IAAddr.ValidLifetime != 7200 {
+		t.Errorf("got IA_NA %v", na)
+	}
+	pd, _ := gotReply.Option(DHCPv6OptIAPD)
+	if pd.IA.IAID != 2 || len(pd.IA.Options) != 1 || pd.IA.Options[0].IAPrefix.PrefixLength != 56 ||
+		!pd.IA.Options[0].IAPrefix.Prefix.Equal(net.ParseIP("2001:db8:100::")) {
+		t.Errorf("got IA_PD %v", pd)
+	}
+	if o, _ := gotReply.Option(DHCPv6OptDNSServers); len(o.DNSServers) != 1 ||
+		!o.DNSServers[0].Equal(net.ParseIP("2001:4860:4860::8888")) {
+		t.Errorf("got DNS servers %v", o)
+	}
+	if o, _ := gotReply.Option(DHCPv6OptStatusCode); o.Status.Code != DHCPv6StatusCodeSuccess || string(o.Status.Message) != "ok" {
+		t.Errorf("got status %v", o)
+	}
+
+	// Serializing the decoded layers gives back the same bytes.
+	buf2 := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf2, gopacket.SerializeOptions{}, gotRelay, gotReply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf2.Bytes(), gotRelay.Contents) {
+		t.Errorf("reserialized DHCPv6 differs\ngot  %x\nwant %x", buf2.Bytes(), gotRelay.Contents)
+	}
+}
+
+func TestDHCPv6DecodeErrors(t *testing.T) {
+	for _, data := range [][]byte{
+		{1, 2, 3},
+		{12, 0, 1, 2, 3},
+		{1, 0, 0, 1, 0, 1, 0, 10, 0},
+		{1, 0, 0, 1, 0, 3, 0, 4, 0, 0, 0},
+	} {
+		var d DHCPv6
+		if err := d.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err == nil {
+			t.Errorf("expected error decoding %x", data)
+		}
+	}
+}
+
+func TestDHCPv6InvalidOptions(t *testing.T) {
+	data := []byte{
+		byte(DHCPv6MsgTypeSolicit), 0, 0, 1,
+		0, byte(DHCPv6OptClientID), 0, 1, 0,
+		0, byte(DHCPv6OptIANA), 0, 20, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, byte(DHCPv6OptIAAddr), 0, 4, 0x20, 0x01, 0x0d, 0xb8,
+		0, byte(DHCPv6OptStatusCode), 0, 1, 0,
+		0, byte(DHCPv6OptDNSServers), 0, 4, 8, 8, 8, 8,
+		0, byte(DHCPv6OptElapsedTime), 0, 2, 0, 10,
+	}
+	var d DHCPv6
+	if err := d.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Options) != 5 {
+		t.Fatalf("got options %v, want 5", d.Options)
+	}
+	for _, i := range []int{0, 2, 3} {
+		if o := d.Options[i]; o.Err == nil {
+			t.Errorf("option %d: expected error for %v", i, o)
+		}
+	}
+	if o := d.Options[0]; o.DUID.Type != 0 || !bytes.Equal(o.Data, []byte{0}) {
+		t.Errorf("got client ID %+v", o)
+	}
+	if o := d.Options[3]; o.DNSServers != nil || !bytes.Equal(o.Data, []byte{8, 8, 8, 8}) {
+		t.Errorf("got DNS servers %+v", o)
+	}
+	// The IA_NA decodes, keeping its invalid address.
+	na := d.Options[1]
+	if na.Err != nil || na.IA.IAID != 1 || len(na.IA.Options) != 1 || na.IA.Options[0].Err == nil {
+		t.Errorf("got IA_NA %+v", na)
+	}
+	if o := d.Options[4]; o.Err != nil || !bytes.Equal(o.Data, []byte{0, 10}) {
+		t.Errorf("got elapsed time %+v", o)
+	}
+
+	// The invalid options are serialized back as they were.
+	buf := gopacket.NewSerializeBuffer()
+	if err := d.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("reserialized DHCPv6 differs\ngot  %x\nwant %x", buf.Bytes(), data)
+	}
+}
@@ -7,10 +7,12 @@
 package layers
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/google/gopacket"
+	"io"
 	"net"
 )
 
@@ -45,6 +47,16 @@ const (
 	DNSTypeTXT   DNSType = 16 // text strings
 	DNSTypeAAAA  DNSType = 28 // a IPv6 host address [RFC3596]
 	DNSTypeSRV   DNSType = 33 // server discovery [RFC2782] [RFC6195]
+
+	DNSTypeOPT    DNSType = 41  // EDNS0 option pseudo-RR [RFC6891]
+	DNSTypeDS     DNSType = 43  // delegation signer [RFC4034]
+	DNSTypeRRSIG  DNSType = 46  // RRset signature [RFC4034]
+	DNSTypeNSEC   DNSType = 47  // next secure record [RFC4034]
+	DNSTypeDNSKEY DNSType = 48  // DNS public key [RFC4034]
+	DNSTypeNSEC3  DNSType = 50  // hashed next secure record [RFC5155]
+	DNSTypeIXFR   DNSType = 251 // incremental zone transfer [RFC1995]
+	DNSTypeAXFR   DNSType = 252 // full zone transfer [RFC1035]
+	DNSTypeCAA    DNSType = 257 // certification authority authorization [RFC6844]
 )
 
 type DNSResponseCode uint8
@@ -111,6 +123,17 @@ func (drc DNSResponseCode) String() string {
 	}
 }
 
+// DNSOptionCode is the code of an option in an EDNS0 OPT record.
+type DNSOptionCode uint16
+
+const (
+	DNSOptionCodeNSID         DNSOptionCode = 3  // Name Server Identifier  [RFC5001]
+	DNSOptionCodeClientSubnet DNSOptionCode = 8  // Client Subnet           [RFC7871]
+	DNSOptionCodeCookie       DNSOptionCode = 10 // DNS Cookie              [RFC7873]
+	DNSOptionCodeTCPKeepalive DNSOptionCode = 11 // edns-tcp-keepalive      [RFC7828]
+	DNSOptionCodePadding      DNSOptionCode = 12 // Padding                 [RFC7830]
+)
+
 type DNSOpCode uint8
 
 const (
@@ -298,8 +321,74 @@ func (d *DNS) Payload() []byte {
 	return nil
 }
 
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+//
+// Names are compressed as described in RFC 1035 section 4.1.4, both in
+// record headers and inside the RDATA of NS, CNAME, PTR, SOA and MX records.
+// With FixLengths, QDCount, ANCount, NSCount, ARCount and the DataLength of
+// each resource record are set from the entries actually written.
+func (d *DNS) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	if opts.FixLengths {
+		d.QDCount = uint16(len(d.Questions))
+		d.ANCount = uint16(len(d.Answers))
+		d.NSCount = uint16(len(d.Authorities))
+		d.ARCount = uint16(len(d.Additionals))
+	}
+	// Compression pointers are offsets from the start of the message, so
+	// the message is built up front and then copied into the buffer.
+	data := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(data, d.ID)
+	data[2] = (uint8(d.OpCode) & 0xf) << 3
+	if d.QR {
+		data[2] |= 0x80
+	}
+	if d.AA {
+		data[2] |= 0x04
+	}
+	if d.TC {
+		data[2] |= 0x02
+	}
+	if d.RD {
+		data[2] |= 0x01
+	}
+	data[3] = (d.Z&0x7)<<4 | uint8(d.ResponseCode)&0xf
+	if d.RA {
+		data[3] |= 0x80
+	}
+	binary.BigEndian.PutUint16(data[4:], d.QDCount)
+	binary.BigEndian.PutUint16(data[6:], d.ANCount)
+	binary.BigEndian.PutUint16(data[8:], d.NSCount)
+	binary.BigEndian.PutUint16(data[10:], d.ARCount)
+
+	names := map[string]int{}
+	var err error
+	for i := range d.Questions {
+		if data, err = d.Questions[i].encode(data, names); err != nil {
+			return err
+		}
+	}
+	for _, rrs := range [][]DNSResourceRecord{d.Answers, d.Authorities, d.Additionals} {
+		for i := range rrs {
+			if data, err = rrs[i].encode(data, names, opts); err != nil {
+				return err
+			}
+		}
+	}
+
+	buf, err := b.PrependBytes(len(data))
+	if err != nil {
+		return err
+	}
+	copy(buf, data)
+	return nil
+}
+
 var maxRecursion = errors.New("max DNS recursion level hit")
 
+var errDNSNameOutOfRange = errors.New("dns name overflows message")
+
 const maxRecursionLevel = 255
 
 func decodeName(data []byte, offset int, buffer *[]byte, level int) ([]byte, int, error) {
@@ -308,6 +397,9 @@ func decodeName(data []byte, offset int, buffer *[]byte, level int) ([]byte, int
 	}
 	start := len(*buffer)
 	index := offset
+	if index < 0 || index >= len(data) {
+		return nil, 0, errDNSNameOutOfRange
+	}
 	if data[index] == 0x00 {
 		return nil, index + 1, nil
 	}
@@ -328,6 +420,9 @@ loop:
 				return nil, 0,
 					fmt.Errorf("dns name is too long")
 			}
+			if index2 >= len(data) {
+				return nil, 0, errDNSNameOutOfRange
+			}
 			*buffer = append(*buffer, '.')
 			*buffer = append(*buffer, data[index+1:index2]...)
 			index = index2
@@ -353,6 +448,9 @@ loop:
 			      - a sequence of labels ending with a pointer
 			*/
 
+			if index+2 > len(data) {
+				return nil, 0, errDNSNameOutOfRange
+			}
 			offsetp := int(binary.BigEndian.Uint16(data[index:index+2]) & 0x3fff)
 			// This looks a little tricky, but actually isn't.  Because of how
 			// decodeName is written, calling it appends the decoded name to the
@@ -374,9 +472,47 @@ loop:
 				data[index], index)
 		}
 	}
+	if len(*buffer) == start {
+		// A pointer to the root.
+		return nil, index + 1, nil
+	}
 	return (*buffer)[start+1:], index + 1, nil
 }
 
+// encodeName appends the wire form of name to data.  If names is non-nil, it
+// maps the names already written to their offsets in data, and is used to
+// replace the longest already written suffix of name with a pointer.
+func encodeName(data []byte, name []byte, names map[string]int) ([]byte, error) {
+	if len(name) > 0 && name[len(name)-1] == '.' {
+		name = name[:len(name)-1]
+	}
+	if len(name) > 253 {
+		return nil, fmt.Errorf("dns name %q is too long", name)
+	}
+	for len(name) > 0 {
+		if names != nil {
+			if offset, ok := names[string(name)]; ok {
+				return append(data, 0xc0|byte(offset>>8), byte(offset)), nil
+			}
+			if len(data) <= 0x3fff {
+				names[string(name)] = len(data)
+			}
+		}
+		label := name
+		if i := bytes.IndexByte(name, '.'); i >= 0 {
+			label, name = name[:i], name[i+1:]
+		} else {
+			name = nil
+		}
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid dns label %q", label)
+		}
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	return append(data, 0), nil
+}
+
 type DNSQuestion struct {
 	Name  []byte
 	Type  DNSType
@@ -389,6 +525,9 @@ func (q *DNSQuestion) decode(data []byte, offset int, df gopacket.DecodeFeedback
 		return 0, err
 	}
 
+	if endq+4 > len(data) {
+		return 0, errors.New("dns question overflows message")
+	}
 	q.Name = name
 	q.Type = DNSType(binary.BigEndian.Uint16(data[endq : endq+2]))
 	q.Class = DNSClass(binary.BigEndian.Uint16(data[endq+2 : endq+4]))
@@ -396,6 +535,15 @@ func (q *DNSQuestion) decode(data []byte, offset int, df gopacket.DecodeFeedback
 	return endq + 4, nil
 }
 
+func (q *DNSQuestion) encode(data []byte, names map[string]int) ([]byte, error) {
+	data, err := encodeName(data, q.Name, names)
+	if err != nil {
+		return nil, err
+	}
+	data = append(data, byte(q.Type>>8), byte(q.Type), byte(q.Class>>8), byte(q.Class))
+	return data, nil
+}
+
 //  DNSResourceRecord
 //  0  1  2  3  4  5  6  7  8  9  0  1  2  3  4  5
 //  +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
@@ -435,6 +583,17 @@ type DNSResourceRecord struct {
 	SOA            DNSSOA
 	SRV            DNSSRV
 	MX             DNSMX
+	DS             DNSDS
+	DNSKEY         DNSKey
+	RRSIG          DNSRRSIG
+	NSEC           DNSNSEC
+	NSEC3          DNSNSEC3
+	CAA            DNSCAA
+
+	// EDNS0 values of an OPT record.  When serializing an OPT record, EDNS is
+	// written in place of Class and TTL.
+	EDNS DNSEDNS
+	OPT  []DNSOPT
 
 	// Undecoded TXT for backward compatibility
 	TXT []byte
@@ -447,11 +606,17 @@ func (rr *DNSResourceRecord) decode(data []byte, offset int, df gopacket.DecodeF
 		return 0, err
 	}
 
+	if endq+10 > len(data) {
+		return 0, errors.New("dns resource record overflows message")
+	}
 	rr.Name = name
 	rr.Type = DNSType(binary.BigEndian.Uint16(data[endq : endq+2]))
 	rr.Class = DNSClass(binary.BigEndian.Uint16(data[endq+2 : endq+4]))
 	rr.TTL = binary.BigEndian.Uint32(data[endq+4 : endq+8])
 	rr.DataLength = binary.BigEndian.Uint16(data[endq+8 : endq+10])
+	if endq+10+int(rr.DataLength) > len(data) {
+		return 0, errors.New("dns resource record data overflows message")
+	}
 	rr.Data = data[endq+10 : endq+10+int(rr.DataLength)]
 
 	if err = rr.decodeRData(data, endq+10, buffer); err != nil {
@@ -461,6 +626,37 @@ func (rr *DNSResourceRecord) decode(data []byte, offset int, df gopacket.DecodeF
 	return endq + 10 + int(rr.DataLength), nil
 }
 
+// encode appends the resource record to data.
+func (rr *DNSResourceRecord) encode(data []byte, names map[string]int, opts gopacket.SerializeOptions) ([]byte, error) {
+	data, err := encodeName(data, rr.Name, names)
+	if err != nil {
+		return nil, err
+	}
+	start := len(data)
+	data = append(data, lotsOfZeros[:10]...)
+	binary.BigEndian.PutUint16(data[start:], uint16(rr.Type))
+	if rr.Type == DNSTypeOPT {
+		binary.BigEndian.PutUint16(data[start+2:], rr.EDNS.UDPSize)
+		binary.BigEndian.PutUint32(data[start+4:], rr.EDNS.ttl())
+	} else {
+		binary.BigEndian.PutUint16(data[start+2:], uint16(rr.Class))
+		binary.BigEndian.PutUint32(data[start+4:], rr.TTL)
+	}
+
+	if data, err = rr.encodeRData(data, names); err != nil {
+		return nil, err
+	}
+	length := len(data) - start - 10
+	if length > 0xffff {
+		return nil, fmt.Errorf("dns rdata too long: %d bytes", length)
+	}
+	if opts.FixLengths {
+		rr.DataLength = uint16(length)
+	}
+	binary.BigEndian.PutUint16(data[start+8:], rr.DataLength)
+	return data, nil
+}
+
 func (rr *DNSResourceRecord) String() string {
 	if (rr.Class == DNSClassIN) && ((rr.Type == DNSTypeA) || (rr.Type == DNSTypeAAAA)) {
 		return net.IP(rr.Data).String()
@@ -523,12 +719,18 @@ func (rr *DNSResourceRecord) decodeRData(data []byte, offset int, buffer *[]byte
 			return err
 		}
 		rr.SOA.RName = name
+		if endq+20 > len(data) {
+			return errors.New("SOA record too short")
+		}
 		rr.SOA.Serial = binary.BigEndian.Uint32(data[endq : endq+4])
 		rr.SOA.Refresh = binary.BigEndian.Uint32(data[endq+4 : endq+8])
 		rr.SOA.Retry = binary.BigEndian.Uint32(data[endq+8 : endq+12])
 		rr.SOA.Expire = binary.BigEndian.Uint32(data[endq+12 : endq+16])
 		rr.SOA.Minimum = binary.BigEndian.Uint32(data[endq+16 : endq+20])
 	case DNSTypeMX:
+		if len(rr.Data) < 3 {
+			return errors.New("MX record too short")
+		}
 		rr.MX.Preference = binary.BigEndian.Uint16(data[offset : offset+2])
 		name, _, err := decodeName(data, offset+2, buffer, 1)
 		if err != nil {
@@ -536,6 +738,9 @@ func (rr *DNSResourceRecord) decodeRData(data []byte, offset int, buffer *[]byte
 		}
 		rr.MX.Name = name
 	case DNSTypeSRV:
+		if len(rr.Data) < 7 {
+			return errors.New("SRV record too short")
+		}
 		rr.SRV.Priority = binary.BigEndian.Uint16(data[offset : offset+2])
 		rr.SRV.Weight = binary.BigEndian.Uint16(data[offset+2 : offset+4])
 		rr.SRV.Port = binary.BigEndian.Uint16(data[offset+4 : offset+6])
@@ -544,10 +749,283 @@ func (rr *DNSResourceRecord) decodeRData(data []byte, offset int, buffer *[]byte
 			return err
 		}
 		rr.SRV.Name = name
+	case DNSTypeOPT:
+		rr.EDNS = DNSEDNS{
+			UDPSize:       uint16(rr.Class),
+			ExtendedRCode: uint8(rr.TTL >> 24),
+			Version:       uint8(rr.TTL >> 16),
+			DO:            rr.TTL&0x8000 != 0,
+			Z:             uint16(rr.TTL & 0x7fff),
+		}
+		return rr.decodeOPT()
+	case DNSTypeDS:
+		if len(rr.Data) < 4 {
+			return errors.New("DS record too short")
+		}
+		rr.DS.KeyTag = binary.BigEndian.Uint16(rr.Data[:2])
+		rr.DS.Algorithm = rr.Data[2]
+		rr.DS.DigestType = rr.Data[3]
+		rr.DS.Digest = rr.Data[4:]
+	case DNSTypeDNSKEY:
+		if len(rr.Data) < 4 {
+			return errors.New("DNSKEY record too short")
+		}
+		rr.DNSKEY.Flags = binary.BigEndian.Uint16(rr.Data[:2])
+		rr.DNSKEY.Protocol = rr.Data[2]
+		rr.DNSKEY.Algorithm = rr.Data[3]
+		rr.DNSKEY.PublicKey = rr.Data[4:]
+	case DNSTypeRRSIG:
+		if len(rr.Data) < 19 {
+			return errors.New("RRSIG record too short")
+		}
+		rr.RRSIG.TypeCovered = DNSType(binary.BigEndian.Uint16(rr.Data[:2]))
+		rr.RRSIG.Algorithm = rr.Data[2]
+		rr.RRSIG.Labels = rr.Data[3]
+		rr.RRSIG.OriginalTTL = binary.BigEndian.Uint32(rr.Data[4:8])
+		rr.RRSIG.Expiration = binary.BigEndian.Uint32(rr.Data[8:12])
+		rr.RRSIG.Inception = binary.BigEndian.Uint32(rr.Data[12:16])
+		rr.RRSIG.KeyTag = binary.BigEndian.Uint16(rr.Data[16:18])
+		name, endq, err := decodeName(data, offset+18, buffer, 1)
+		if err != nil {
+			return err
+		}
+		end := offset + len(rr.Data)
+		if endq > end {
+			return errors.New("RRSIG signer name overflows record")
+		}
+		rr.RRSIG.SignerName = name
+		rr.RRSIG.Signature = data[endq:end]
+	case DNSTypeNSEC:
+		if len(rr.Data) < 1 {
+			return errors.New("NSEC record too short")
+		}
+		name, endq, err := decodeName(data, offset, buffer, 1)
+		if err != nil {
+			return err
+		}
+		end := offset + len(rr.Data)
+		if endq > end {
+			return errors.New("NSEC next domain name overflows record")
+		}
+		rr.NSEC.NextDomainName = name
+		if rr.NSEC.Types, err = decodeTypeBitmap(data[endq:end]); err != nil {
+			return err
+		}
+	case DNSTypeNSEC3:
+		return rr.decodeNSEC3()
+	case DNSTypeCAA:
+		if len(rr.Data) < 2 || len(rr.Data) < 2+int(rr.Data[1]) {
+			return errors.New("CAA record too short")
+		}
+		rr.CAA.Flags = rr.Data[0]
+		rr.CAA.Tag = rr.Data[2 : 2+int(rr.Data[1])]
+		rr.CAA.Value = rr.Data[2+int(rr.Data[1]):]
+	}
+	return nil
+}
+
+func (rr *DNSResourceRecord) decodeNSEC3() error {
+	data := rr.Data
+	if len(data) < 5 || len(data) < 6+int(data[4]) {
+		return errors.New("NSEC3 record too short")
+	}
+	rr.NSEC3.HashAlgorithm = data[0]
+	rr.NSEC3.Flags = data[1]
+	rr.NSEC3.Iterations = binary.BigEndian.Uint16(data[2:4])
+	rr.NSEC3.Salt = data[5 : 5+int(data[4])]
+	data = data[5+int(data[4]):]
+	if len(data) < 1+int(data[0]) {
+		return errors.New("NSEC3 record too short")
+	}
+	rr.NSEC3.NextHashedOwnerName = data[1 : 1+int(data[0])]
+	var err error
+	rr.NSEC3.Types, err = decodeTypeBitmap(data[1+int(data[0]):])
+	return err
+}
+
+func (rr *DNSResourceRecord) decodeOPT() error {
+	rr.OPT = rr.OPT[:0]
+	for data := rr.Data; len(data) > 0; {
+		if len(data) < 4 {
+			return errors.New("EDNS0 option too short")
+		}
+		length := 4 + int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < length {
+			return errors.New("EDNS0 option overflows record")
+		}
+		o := DNSOPT{
+			Code: DNSOptionCode(binary.BigEndian.Uint16(data[:2])),
+			Data: data[4:length],
+		}
+		// An option which doesn't decode is kept with its raw data, so that
+		// one unusual option doesn't lose the rest of the message.
+		o.Err = o.decode()
+		rr.OPT = append(rr.OPT, o)
+		data = data[length:]
 	}
 	return nil
 }
 
+// decodeTypeBitmap decodes the type bit maps of NSEC and NSEC3 records, as
+// described in RFC 4034 section 4.1.2.
+func decodeTypeBitmap(data []byte) ([]DNSType, error) {
+	var types []DNSType
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errors.New("DNS type bitmap too short")
+		}
+		window, length := int(data[0]), int(data[1])
+		if length == 0 || length > 32 || len(data) < 2+length {
+			return nil, fmt.Errorf("invalid DNS type bitmap length %d", length)
+		}
+		for i, b := range data[2 : 2+length] {
+			for bit := uint(0); bit < 8; bit++ {
+				if b&(0x80>>bit) != 0 {
+					types = append(types, DNSType(window<<8|i<<3|int(bit)))
+				}
+			}
+		}
+		data = data[2+length:]
+	}
+	return types, nil
+}
+
+// encodeTypeBitmap appends the type bit maps for types to data.
+func encodeTypeBitmap(data []byte, types []DNSType) []byte {
+	for window := 0; window < 256; window++ {
+		var bitmap [32]byte
+		length := 0
+		for _, t := range types {
+			if int(t>>8) != window {
+				continue
+			}
+			i := int(t&0xff) / 8
+			bitmap[i] |= 0x80 >> (t & 0x7)
+			if i >= length {
+				length = i + 1
+			}
+		}
+		if length > 0 {
+			data = append(data, byte(window), byte(length))
+			data = append(data, bitmap[:length]...)
+		}
+	}
+	return data
+}
+
+func encodeCharacterStrings(data []byte, strings [][]byte) ([]byte, error) {
+	for _, s := range strings {
+		if len(s) > 255 {
+			return nil, fmt.Errorf("dns <character-string> too long: %d bytes", len(s))
+		}
+		data = append(data, byte(len(s)))
+		data = append(data, s...)
+	}
+	return data, nil
+}
+
+// encodeRData appends the RDATA of the record to data, built from the decoded
+// values for the types decodeRData understands and from Data otherwise.
+func (rr *DNSResourceRecord) encodeRData(data []byte, names map[string]int) ([]byte, error) {
+	var err error
+	switch rr.Type {
+	case DNSTypeA:
+		ip := rr.IP.To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %v for DNS A record", rr.IP)
+		}
+		data = append(data, ip...)
+	case DNSTypeAAAA:
+		ip := rr.IP.To16()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv6 address %v for DNS AAAA record", rr.IP)
+		}
+		data = append(data, ip...)
+	case DNSTypeTXT, DNSTypeHINFO:
+		if rr.TXTs == nil {
+			// Only the undecoded form was given.
+			data = append(data, rr.TXT...)
+		} else if data, err = encodeCharacterStrings(data, rr.TXTs); err != nil {
+			return nil, err
+		}
+	case DNSTypeNS:
+		data, err = encodeName(data, rr.NS, names)
+	case DNSTypeCNAME:
+		data, err = encodeName(data, rr.CNAME, names)
+	case DNSTypePTR:
+		data, err = encodeName(data, rr.PTR, names)
+	case DNSTypeSOA:
+		if data, err = encodeName(data, rr.SOA.MName, names); err != nil {
+			return nil, err
+		}
+		if data, err = encodeName(data, rr.SOA.RName, names); err != nil {
+			return nil, err
+		}
+		for _, v := range []uint32{rr.SOA.Serial, rr.SOA.Refresh, rr.SOA.Retry, rr.SOA.Expire, rr.SOA.Minimum} {
+			data = append(data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+		}
+	case DNSTypeMX:
+		data = append(data, byte(rr.MX.Preference>>8), byte(rr.MX.Preference))
+		data, err = encodeName(data, rr.MX.Name, names)
+	case DNSTypeSRV:
+		data = append(data,
+			byte(rr.SRV.Priority>>8), byte(rr.SRV.Priority),
+			byte(rr.SRV.Weight>>8), byte(rr.SRV.Weight),
+			byte(rr.SRV.Port>>8), byte(rr.SRV.Port))
+		// RFC 2782 forbids compressing the SRV target.
+		data, err = encodeName(data, rr.SRV.Name, nil)
+	case DNSTypeOPT:
+		for i := range rr.OPT {
+			if data, err = rr.OPT[i].encode(data); err != nil {
+				return nil, err
+			}
+		}
+	case DNSTypeDS:
+		data = append(data, byte(rr.DS.KeyTag>>8), byte(rr.DS.KeyTag), rr.DS.Algorithm, rr.DS.DigestType)
+		data = append(data, rr.DS.Digest...)
+	case DNSTypeDNSKEY:
+		data = append(data, byte(rr.DNSKEY.Flags>>8), byte(rr.DNSKEY.Flags), rr.DNSKEY.Protocol, rr.DNSKEY.Algorithm)
+		data = append(data, rr.DNSKEY.PublicKey...)
+	case DNSTypeRRSIG:
+		s := &rr.RRSIG
+		data = append(data, byte(s.TypeCovered>>8), byte(s.TypeCovered), s.Algorithm, s.Labels)
+		for _, v := range []uint32{s.OriginalTTL, s.Expiration, s.Inception} {
+			data = append(data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+		}
+		data = append(data, byte(s.KeyTag>>8), byte(s.KeyTag))
+		// RFC 4034 forbids compressing names in DNSSEC records.
+		if data, err = encodeName(data, s.SignerName, nil); err != nil {
+			return nil, err
+		}
+		data = append(data, s.Signature...)
+	case DNSTypeNSEC:
+		if data, err = encodeName(data, rr.NSEC.NextDomainName, nil); err != nil {
+			return nil, err
+		}
+		data = encodeTypeBitmap(data, rr.NSEC.Types)
+	case DNSTypeNSEC3:
+		n := &rr.NSEC3
+		if len(n.Salt) > 255 || len(n.NextHashedOwnerName) > 255 {
+			return nil, errors.New("NSEC3 salt or hash too long")
+		}
+		data = append(data, n.HashAlgorithm, n.Flags, byte(n.Iterations>>8), byte(n.Iterations), byte(len(n.Salt)))
+		data = append(data, n.Salt...)
+		data = append(data, byte(len(n.NextHashedOwnerName)))
+		data = append(data, n.NextHashedOwnerName...)
+		data = encodeTypeBitmap(data, n.Types)
+	case DNSTypeCAA:
+		if len(rr.CAA.Tag) > 255 {
+			return nil, errors.New("CAA tag too long")
+		}
+		data = append(data, rr.CAA.Flags, byte(len(rr.CAA.Tag)))
+		data = append(data, rr.CAA.Tag...)
+		data = append(data, rr.CAA.Value...)
+	default:
+		data = append(data, rr.Data...)
+	}
+	return data, err
+}
+
 type DNSSOA struct {
 	MName, RName                            []byte
 	Serial, Refresh, Retry, Expire, Minimum uint32
@@ -562,3 +1040,206 @@ type DNSMX struct {
 	Preference uint16
 	Name       []byte
 }
+
+// DNSDS is the RDATA of a DS record (RFC 4034 section 5).
+type DNSDS struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+// DNSKey is the RDATA of a DNSKEY record (RFC 4034 section 2).
+type DNSKey struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+}
+
+// DNSRRSIG is the RDATA of an RRSIG record (RFC 4034 section 3).  Expiration
+// and Inception are in seconds since the Unix epoch, modulo 2^32.
+type DNSRRSIG struct {
+	TypeCovered           DNSType
+	Algorithm, Labels     uint8
+	OriginalTTL           uint32
+	Expiration, Inception uint32
+	KeyTag                uint16
+	SignerName            []byte
+	Signature             []byte
+}
+
+// DNSNSEC is the RDATA of an NSEC record (RFC 4034 section 4).
+type DNSNSEC struct {
+	NextDomainName []byte
+	Types          []DNSType
+}
+
+// DNSNSEC3 is the RDATA of an NSEC3 record (RFC 5155 section 3).
+type DNSNSEC3 struct {
+	HashAlgorithm       uint8
+	Flags               uint8
+	Iterations          uint16
+	Salt                []byte
+	NextHashedOwnerName []byte
+	Types               []DNSType
+}
+
+// DNSCAA is the RDATA of a CAA record (RFC 6844 section 5.1).
+type DNSCAA struct {
+	Flags uint8
+	Tag   []byte
+	Value []byte
+}
+
+// DNSEDNS contains the fields RFC 6891 stores in the CLASS and TTL of an OPT
+// record.
+type DNSEDNS struct {
+	UDPSize       uint16 // requestor's UDP payload size
+	ExtendedRCode uint8  // upper 8 bits of the 12 bit response code
+	Version       uint8
+	DO            bool   // DNSSEC OK
+	Z             uint16 // reserved, 15 bits
+}
+
+func (e DNSEDNS) ttl() uint32 {
+	ttl := uint32(e.ExtendedRCode)<<24 | uint32(e.Version)<<16 | uint32(e.Z&0x7fff)
+	if e.DO {
+		ttl |= 0x8000
+	}
+	return ttl
+}
+
+// DNSOPT is an option in an EDNS0 OPT record.
+type DNSOPT struct {
+	Code DNSOptionCode
+	Data []byte
+
+	// Decoded values.  When serializing, these are used in place of Data for
+	// their option codes.
+	ClientSubnet DNSClientSubnet
+	Cookie       DNSCookie
+	// Err is set by decoding if Data isn't valid for Code.  The decoded
+	// values are then left zero, and Data is serialized as is.
+	Err error
+}
+
+// DNSClientSubnet is the data of a client subnet option (RFC 7871).  Only the
+// first SourcePrefixLength bits of Address are sent.
+type DNSClientSubnet struct {
+	Family             uint16 // 1 for IPv4, 2 for IPv6
+	SourcePrefixLength uint8
+	ScopePrefixLength  uint8
+	Address            net.IP
+}
+
+// DNSCookie is the data of a cookie option (RFC 7873).  Server is empty in
+// requests which don't know a server cookie yet.
+type DNSCookie struct {
+	Client []byte // always 8 bytes
+	Server []byte // 8 to 32 bytes
+}
+
+func (o *DNSOPT) decode() error {
+	switch o.Code {
+	case DNSOptionCodeClientSubnet:
+		if len(o.Data) < 4 {
+			return errors.New("EDNS0 client subnet option too short")
+		}
+		c := DNSClientSubnet{
+			Family:             binary.BigEndian.Uint16(o.Data[:2]),
+			SourcePrefixLength: o.Data[2],
+			ScopePrefixLength:  o.Data[3],
+		}
+		switch c.Family {
+		case 1:
+			c.Address = make(net.IP, net.IPv4len)
+		case 2:
+			c.Address = make(net.IP, net.IPv6len)
+		default:
+			return fmt.Errorf("unknown EDNS0 client subnet family %d", c.Family)
+		}
+		if len(o.Data)-4 > len(c.Address) {
+			return errors.New("EDNS0 client subnet address too long")
+		}
+		copy(c.Address, o.Data[4:])
+		o.ClientSubnet = c
+	case DNSOptionCodeCookie:
+		if len(o.Data) < 8 || len(o.Data) > 40 {
+			return fmt.Errorf("invalid EDNS0 cookie length %d", len(o.Data))
+		}
+		o.Cookie.Client = o.Data[:8]
+		o.Cookie.Server = o.Data[8:]
+	}
+	return nil
+}
+
+func (o *DNSOPT) encode(data []byte) ([]byte, error) {
+	start := len(data)
+	data = append(data, byte(o.Code>>8), byte(o.Code), 0, 0)
+	switch {
+	case o.Err != nil:
+		data = append(data, o.Data...)
+	case o.Code == DNSOptionCodeClientSubnet:
+		c := &o.ClientSubnet
+		var ip net.IP
+		switch c.Family {
+		case 1:
+			ip = c.Address.To4()
+		case 2:
+			ip = c.Address.To16()
+		}
+		n := (int(c.SourcePrefixLength) + 7) / 8
+		if ip == nil || n > len(ip) {
+			return nil, fmt.Errorf("invalid EDNS0 client subnet %v/%d", c.Address, c.SourcePrefixLength)
+		}
+		data = append(data, byte(c.Family>>8), byte(c.Family), c.SourcePrefixLength, c.ScopePrefixLength)
+		data = append(data, ip[:n]...)
+	case o.Code == DNSOptionCodeCookie:
+		if len(o.Cookie.Client) != 8 || len(o.Cookie.Server) > 32 {
+			return nil, errors.New("invalid EDNS0 cookie length")
+		}
+		data = append(data, o.Cookie.Client...)
+		data = append(data, o.Cookie.Server...)
+	default:
+		data = append(data, o.Data...)
+	}
+	length := len(data) - start - 4
+	if length > 0xffff {
+		return nil, fmt.Errorf("EDNS0 option too long: %d bytes", length)
+	}
+	binary.BigEndian.PutUint16(data[start+2:], uint16(length))
+	return data, nil
+}
+
+// DNSTCPDecoder decodes the DNS messages in a TCP stream, such as one put
+// back together by tcpassembly and read through a tcpreader.ReaderStream.
+// Over TCP each message is preceded by its length as a 2 byte integer (RFC
+// 1035 section 4.2.2).
+type DNSTCPDecoder struct {
+	r      io.Reader
+	length [2]byte
+}
+
+// NewDNSTCPDecoder returns a decoder reading DNS messages from r.
+func NewDNSTCPDecoder(r io.Reader) *DNSTCPDecoder {
+	return &DNSTCPDecoder{r: r}
+}
+
+// Decode reads the next message from the stream and decodes it into d.  It
+// returns io.EOF if the stream ends between two messages, and
+// io.ErrUnexpectedEOF if it ends inside one.  Each message is read into a new
+// buffer, which d's Contents and byte slices then point into.
+func (t *DNSTCPDecoder) Decode(d *DNS) (err error) {
+	if _, err = io.ReadFull(t.r, t.length[:]); err != nil {
+		return err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(t.length[:]))
+	if _, err = io.ReadFull(t.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return d.DecodeFromBytes(data, gopacket.NilDecodeFeedback)
+}
@@ -0,0 +1,329 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+func TestDNSSerializeRoundTrip(t *testing.T) {
+	for _, data := range [][]byte{testDNSQueryA, testDNSRRA, testDNSAAAA, testDNSMXSOA} {
+		dns := loadDNS(data, t)
+		if dns == nil {
+			t.Fatal("Failed to get a pointer to DNS struct")
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := dns.SerializeTo(buf, gopacket.SerializeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		want := data[ /*eth*/ 14+ /*ipv4*/ 20+ /*udp*/ 8:]
+		if got := buf.Bytes(); !bytes.Equal(got, want) {
+			t.Errorf("serialized DNS differs\ngot  %x\nwant %x", got, want)
+		}
+	}
+}
+
+func TestDNSSerializeFixLengths(t *testing.T) {
+	dns := &DNS{
+		ID: 0x1234, QR: true, OpCode: DNSOpCodeQuery, AA: true, RD: true, RA: true,
+		ResponseCode: DNSResponseCodeNXDomain,
+		Questions: []DNSQuestion{
+			{Name: []byte("example.com"), Type: DNSTypeA, Class: DNSClassIN},
+		},
+		Answers: []DNSResourceRecord{
+			{Name: []byte("example.com"), Type: DNSTypeA, Class: DNSClassIN, TTL: 60, IP: net.IP{192, 0, 2, 1}},
+			{Name: []byte("example.com"), Type: DNSTypeAAAA, Class: DNSClassIN, TTL: 60, IP: net.ParseIP("2001:db8::1")},
+			{Name: []byte("www.example.com"), Type: DNSTypeCNAME, Class: DNSClassIN, TTL: 60, CNAME: []byte("example.com")},
+			{Name: []byte("1.2.0.192.in-addr.arpa"), Type: DNSTypePTR, Class: DNSClassIN, TTL: 60, PTR: []byte("host.example.com")},
+			{Name: []byte("example.com"), Type: DNSTypeMX, Class: DNSClassIN, TTL: 60, MX: DNSMX{Preference: 10, Name: []byte("mail.example.com")}},
+			{Name: []byte("_sip._tcp.example.com"), Type: DNSTypeSRV, Class: DNSClassIN, TTL: 60, SRV: DNSSRV{Priority: 1, Weight: 2, Port: 5060, Name: []byte("sip.example.com")}},
+			{Name: []byte("example.com"), Type: DNSTypeTXT, Class: DNSClassIN, TTL: 60, TXTs: [][]byte{[]byte("v=spf1 -all"), []byte("hello")}},
+		},
+		Authorities: []DNSResourceRecord{
+			{Name: []byte("example.com"), Type: DNSTypeNS, Class: DNSClassIN, TTL: 3600, NS: []byte("ns1.example.com")},
+			{Name: []byte("example.com"), Type: DNSTypeSOA, Class: DNSClassIN, TTL: 3600, SOA: DNSSOA{
+				MName: []byte("ns1.example.com"), RName: []byte("hostmaster.example.com"),
+				Serial: 2014010101, Refresh: 7200, Retry: 1800, Expire: 1209600, Minimum: 300,
+			}},
+		},
+		Additionals: []DNSResourceRecord{
+			{Name: []byte("ns1.example.com"), Type: DNSTypeA, Class: DNSClassIN, TTL: 3600, IP: net.IP{192, 0, 2, 53}},
+		},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	if dns.QDCount != 1 || dns.ANCount != 7 || dns.NSCount != 2 || dns.ARCount != 1 {
+		t.Errorf("wrong counts %d/%d/%d/%d", dns.QDCount, dns.ANCount, dns.NSCount, dns.ARCount)
+	}
+	if dns.Answers[0].DataLength != 4 || dns.Answers[1].DataLength != 16 {
+		t.Errorf("wrong data lengths %d, %d", dns.Answers[0].DataLength, dns.Answers[1].DataLength)
+	}
+	// The answer name and the CNAME target both point back at the question.
+	if got := buf.Bytes()[29:31]; !bytes.Equal(got, []byte{0xc0, 0x0c}) {
+		t.Errorf("answer name not compressed: %x", got)
+	}
+
+	var got DNS
+	if err := got.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != dns.ID || got.QR != dns.QR || got.AA != dns.AA || got.RD != dns.RD ||
+		got.RA != dns.RA || got.TC || got.ResponseCode != dns.ResponseCode {
+		t.Errorf("header mismatch: got %+v", got)
+	}
+	for i, rr := range got.Answers {
+		want := dns.Answers[i]
+		if string(rr.Name) != string(want.Name) || rr.Type != want.Type || rr.TTL != want.TTL {
+			t.Errorf("answer %d: got %s %v %d", i, rr.Name, rr.Type, rr.TTL)
+		}
+	}
+	if !got.Answers[0].IP.Equal(dns.Answers[0].IP) || !got.Answers[1].IP.Equal(dns.Answers[1].IP) {
+		t.Errorf("wrong addresses %v, %v", got.Answers[0].IP, got.Answers[1].IP)
+	}
+	if string(got.Answers[2].CNAME) != "example.com" {
+		t.Errorf("wrong CNAME %q", got.Answers[2].CNAME)
+	}
+	if string(got.Answers[3].PTR) != "host.example.com" {
+		t.Errorf("wrong PTR %q", got.Answers[3].PTR)
+	}
+	if !reflect.DeepEqual(got.Answers[4].MX, dns.Answers[4].MX) {
+		t.Errorf("wrong MX %+v", got.Answers[4].MX)
+	}
+	if !reflect.DeepEqual(got.Answers[5].SRV, dns.Answers[5].SRV) {
+		t.Errorf("wrong SRV %+v", got.Answers[5].SRV)
+	}
+	if !reflect.DeepEqual(got.Answers[6].TXTs, dns.Answers[6].TXTs) {
+		t.Errorf("wrong TXTs %q", got.Answers[6].TXTs)
+	}
+	if string(got.Authorities[0].NS) != "ns1.example.com" {
+		t.Errorf("wrong NS %q", got.Authorities[0].NS)
+	}
+	if !reflect.DeepEqual(got.Authorities[1].SOA, dns.Authorities[1].SOA) {
+		t.Errorf("wrong SOA %+v", got.Authorities[1].SOA)
+	}
+	if string(got.Additionals[0].Name) != "ns1.example.com" {
+		t.Errorf("wrong additional name %q", got.Additionals[0].Name)
+	}
+}
+
+func TestDNSSerializeErrors(t *testing.T) {
+	for _, dns := range []*DNS{
+		{Questions: []DNSQuestion{{Name: []byte("a..b"), Type: DNSTypeA}}},
+		{Questions: []DNSQuestion{{Name: bytes.Repeat([]byte("a"), 64), Type: DNSTypeA}}},
+		{Answers: []DNSResourceRecord{{Name: []byte("a"), Type: DNSTypeA, IP: net.ParseIP("::1")}}},
+		{Answers: []DNSResourceRecord{{Name: []byte("a"), Type: DNSTypeTXT, TXTs: [][]byte{make([]byte, 256)}}}},
+	} {
+		buf := gopacket.NewSerializeBuffer()
+		if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err == nil {
+			t.Errorf("expected error serializing %+v", dns)
+		}
+	}
+}
+
+func TestDNSSerializeEDNSAndDNSSEC(t *testing.T) {
+	dns := &DNS{
+		ID: 7, QR: true,
+		Questions: []DNSQuestion{{Name: []byte("example.com"), Type: DNSTypeDNSKEY, Class: DNSClassIN}},
+		Answers: []DNSResourceRecord{
+			{Name: []byte("example.com"), Type: DNSTypeDNSKEY, Class: DNSClassIN, TTL: 300,
+				DNSKEY: DNSKey{Flags: 257, Protocol: 3, Algorithm: 13, PublicKey: []byte{1, 2, 3, 4}}},
+			{Name: []byte("example.com"), Type: DNSTypeRRSIG, Class: DNSClassIN, TTL: 300,
+				RRSIG: DNSRRSIG{TypeCovered: DNSTypeDNSKEY, Algorithm: 13, Labels: 2, OriginalTTL: 300,
+					Expiration: 1500000000, Inception: 1400000000, KeyTag: 12345,
+					SignerName: []byte("example.com"), Signature: []byte{9, 8, 7}}},
+			{Name: []byte("example.com"), Type: DNSTypeDS, Class: DNSClassIN, TTL: 300,
+				DS: DNSDS{KeyTag: 12345, Algorithm: 13, DigestType: 2, Digest: []byte{0xaa, 0xbb}}},
+			{Name: []byte("example.com"), Type: DNSTypeNSEC, Class: DNSClassIN, TTL: 300,
+				NSEC: DNSNSEC{NextDomainName: []byte("a.example.com"), Types: []DNSType{DNSTypeA, DNSTypeNS, DNSTypeRRSIG, DNSTypeCAA}}},
+			{Name: []byte("abc.example.com"), Type: DNSTypeNSEC3, Class: DNSClassIN, TTL: 300,
+				NSEC3: DNSNSEC3{HashAlgorithm: 1, Flags: 1, Iterations: 10, Salt: []byte{0xca, 0xfe},
+					NextHashedOwnerName: []byte{1, 2, 3, 4, 5}, Types: []DNSType{DNSTypeAAAA}}},
+			{Name: []byte("example.com"), Type: DNSTypeCAA, Class: DNSClassIN, TTL: 300,
+				CAA: DNSCAA{Flags: 128, Tag: []byte("issue"), Value: []byte("ca.example.net")}},
+		},
+		Additionals: []DNSResourceRecord{
+			{Type: DNSTypeOPT, EDNS: DNSEDNS{UDPSize: 4096, ExtendedRCode: 1, DO: true},
+				OPT: []DNSOPT{
+					{Code: DNSOptionCodeClientSubnet, ClientSubnet: DNSClientSubnet{
+						Family: 1, SourcePrefixLength: 24, Address: net.IP{192, 0, 2, 0}}},
+					{Code: DNSOptionCodeCookie, Cookie: DNSCookie{
+						Client: []byte{1, 2, 3, 4, 5, 6, 7, 8}, Server: []byte{8, 7, 6, 5, 4, 3, 2, 1}}},
+					{Code: DNSOptionCodeNSID, Data: []byte("ns1")},
+				}},
+		},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	var got DNS
+	if err := got.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Answers[0].DNSKEY, dns.Answers[0].DNSKEY) {
+		t.Errorf("wrong DNSKEY %+v", got.Answers[0].DNSKEY)
+	}
+	if !reflect.DeepEqual(got.Answers[1].RRSIG, dns.Answers[1].RRSIG) {
+		t.Errorf("wrong RRSIG %+v", got.Answers[1].RRSIG)
+	}
+	if !reflect.DeepEqual(got.Answers[2].DS, dns.Answers[2].DS) {
+		t.Errorf("wrong DS %+v", got.Answers[2].DS)
+	}
+	if !reflect.DeepEqual(got.Answers[3].NSEC, dns.Answers[3].NSEC) {
+		t.Errorf("wrong NSEC %+v", got.Answers[3].NSEC)
+	}
+	if !reflect.DeepEqual(got.Answers[4].NSEC3, dns.Answers[4].NSEC3) {
+		t.Errorf("wrong NSEC3 %+v", got.Answers[4].NSEC3)
+	}
+	if !reflect.DeepEqual(got.Answers[5].CAA, dns.Answers[5].CAA) {
+		t.Errorf("wrong CAA %+v", got.Answers[5].CAA)
+	}
+
+	opt := got.Additionals[0]
+	if opt.Class != 4096 || opt.TTL != 0x01008000 || opt.EDNS != dns.Additionals[0].EDNS {
+		t.Errorf("wrong OPT header: class %d ttl %#x edns %+v", opt.Class, opt.TTL, opt.EDNS)
+	}
+	if len(opt.OPT) != 3 {
+		t.Fatalf("got %d EDNS0 options, want 3", len(opt.OPT))
+	}
+	if cs := opt.OPT[0].ClientSubnet; cs.Family != 1 || cs.SourcePrefixLength != 24 ||
+		!cs.Address.Equal(net.IP{192, 0, 2, 0}) || len(opt.OPT[0].Data) != 7 {
+		t.Errorf("wrong client subnet %+v, data %x", cs, opt.OPT[0].Data)
+	}
+	if !reflect.DeepEqual(opt.OPT[1].Cookie, dns.Additionals[0].OPT[1].Cookie) {
+		t.Errorf("wrong cookie %+v", opt.OPT[1].Cookie)
+	}
+	if string(opt.OPT[2].Data) != "ns1" {
+		t.Errorf("wrong NSID %q", opt.OPT[2].Data)
+	}
+}
+
+func TestDNSInvalidEDNSOptions(t *testing.T) {
+	raw := [][]byte{
+		{0, 3, 24, 0, 192, 0, 2},       // unknown family
+		{0, 1, 32, 0, 192, 0, 2, 1, 2}, // address too long
+		{1, 2, 3, 4},                   // cookie too short
+		append([]byte{1, 2, 3, 4, 5, 6, 7, 8}, make([]byte, 33)...), // server cookie too long
+	}
+	codes := []DNSOptionCode{DNSOptionCodeClientSubnet, DNSOptionCodeClientSubnet, DNSOptionCodeCookie, DNSOptionCodeCookie}
+	opt := DNSResourceRecord{Type: DNSTypeOPT, EDNS: DNSEDNS{UDPSize: 4096}}
+	for i, data := range raw {
+		// Options with Err set are serialized from their data.
+		opt.OPT = append(opt.OPT, DNSOPT{Code: codes[i], Data: data, Err: errors.New("invalid")})
+	}
+	dns := &DNS{ID: 1, Additionals: []DNSResourceRecord{opt}}
+	buf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	var got DNS
+	if err := got.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Additionals) != 1 || len(got.Additionals[0].OPT) != len(raw) {
+		t.Fatalf("got additionals %+v", got.Additionals)
+	}
+	for i, o := range got.Additionals[0].OPT {
+		if o.Err == nil || !bytes.Equal(o.Data, raw[i]) {
+			t.Errorf("option %d: got error %v, data %x, want an error and %x", i, o.Err, o.Data, raw[i])
+		}
+		if o.ClientSubnet.Address != nil || o.ClientSubnet.Family != 0 || o.Cookie.Client != nil {
+			t.Errorf("option %d: got decoded values %+v, %+v", i, o.ClientSubnet, o.Cookie)
+		}
+	}
+
+	// The options are serialized back as they were.
+	buf2 := gopacket.NewSerializeBuffer()
+	if err := got.SerializeTo(buf2, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf2.Bytes(), buf.Bytes()) {
+		t.Errorf("reserialized DNS differs\ngot  %x\nwant %x", buf2.Bytes(), buf.Bytes())
+	}
+}
+
+func TestDNSDecodeMalformed(t *testing.T) {
+	header := func(qd, an byte) []byte {
+		return []byte{0, 1, 0, 0, 0, qd, 0, an, 0, 0, 0, 0}
+	}
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"missing question", header(1, 0)},
+		{"label overflow", append(header(1, 0), 5, 'a')},
+		{"truncated pointer", append(header(1, 0), 0xc0)},
+		{"pointer overflow", append(header(1, 0), 0xc0, 0xff, 0, 1, 0, 1)},
+		{"truncated question", append(header(1, 0), 0, 0, 1)},
+		{"truncated record", append(header(0, 1), 0, 0, 1, 0, 1, 0, 0, 0)},
+		{"record data overflow", append(header(0, 1), 0, 0, 1, 0, 1, 0, 0, 0, 0, 0, 4, 1)},
+		{"short MX", append(header(0, 1), 0, 0, 15, 0, 1, 0, 0, 0, 0, 0, 1, 1)},
+		{"short SOA", append(header(0, 1), 0, 0, 6, 0, 1, 0, 0, 0, 0, 0, 2, 0, 0)},
+	} {
+		var d DNS
+		if err := d.DecodeFromBytes(test.data, gopacket.NilDecodeFeedback); err == nil {
+			t.Errorf("%s: expected error decoding %x", test.name, test.data)
+		}
+	}
+
+	// A pointer to the root name, here the first byte of the question type.
+	var d DNS
+	if err := d.DecodeFromBytes(append(header(1, 0), 0xc0, 14, 0, 1, 0, 1), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if q := d.Questions[0]; len(q.Name) != 0 || q.Type != DNSTypeA {
+		t.Errorf("got question %+v", q)
+	}
+}
+
+func TestDNSTCPDecoder(t *testing.T) {
+	var stream []byte
+	for _, id := range []uint16{1, 2} {
+		dns := &DNS{ID: id, Questions: []DNSQuestion{{Name: []byte("example.com"), Type: DNSTypeAXFR, Class: DNSClassIN}}}
+		buf := gopacket.NewSerializeBuffer()
+		if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, byte(len(buf.Bytes())>>8), byte(len(buf.Bytes())))
+		stream = append(stream, buf.Bytes()...)
+	}
+
+	dec := NewDNSTCPDecoder(bytes.NewReader(stream))
+	var dns DNS
+	for _, id := range []uint16{1, 2} {
+		if err := dec.Decode(&dns); err != nil {
+			t.Fatal(err)
+		}
+		if dns.ID != id || len(dns.Questions) != 1 || dns.Questions[0].Type != DNSTypeAXFR {
+			t.Errorf("got ID %d, questions %+v", dns.ID, dns.Questions)
+		}
+	}
+	if err := dec.Decode(&dns); err != io.EOF {
+		t.Errorf("got %v at end of stream, want io.EOF", err)
+	}
+
+	dec = NewDNSTCPDecoder(bytes.NewReader(stream[:len(stream)-3]))
+	dec.Decode(&dns)
+	if err := dec.Decode(&dns); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v for truncated message, want io.ErrUnexpectedEOF", err)
+	}
+
+	// A message with more questions than it holds must fail, not panic.
+	dec = NewDNSTCPDecoder(bytes.NewReader([]byte{0, 14, 0, 1, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 1, 'a'}))
+	if err := dec.Decode(&dns); err == nil {
+		t.Error("expected error decoding malformed message")
+	}
+}
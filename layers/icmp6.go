@@ -22,12 +22,18 @@ const (
 	ICMPv6TypeParameterProblem       = 4
 	ICMPv6TypeEchoRequest            = 128
 	ICMPv6TypeEchoReply              = 129
+	// The following are from RFC 2710
+	ICMPv6TypeMLDQuery  = 130
+	ICMPv6TypeMLDReport = 131
+	ICMPv6TypeMLDDone   = 132
 	// The following are from RFC 4861
 	ICMPv6TypeRouterSolicitation    = 133
 	ICMPv6TypeRouterAdvertisement   = 134
 	ICMPv6TypeNeighborSolicitation  = 135
 	ICMPv6TypeNeighborAdvertisement = 136
 	ICMPv6TypeRedirect              = 137
+	// The following are from RFC 3810
+	ICMPv6TypeMLDv2Report = 143
 )
 
 const (
@@ -90,6 +96,15 @@ var (
 		ICMPv6TypeEchoReply: icmpv6TypeCodeInfoStruct{
 			"EchoReply", nil,
 		},
+		ICMPv6TypeMLDQuery: icmpv6TypeCodeInfoStruct{
+			"MLDQuery", nil,
+		},
+		ICMPv6TypeMLDReport: icmpv6TypeCodeInfoStruct{
+			"MLDReport", nil,
+		},
+		ICMPv6TypeMLDDone: icmpv6TypeCodeInfoStruct{
+			"MLDDone", nil,
+		},
 		ICMPv6TypeRouterSolicitation: icmpv6TypeCodeInfoStruct{
 			"RouterSolicitation", nil,
 		},
@@ -105,6 +120,9 @@ var (
 		ICMPv6TypeRedirect: icmpv6TypeCodeInfoStruct{
 			"Redirect", nil,
 		},
+		ICMPv6TypeMLDv2Report: icmpv6TypeCodeInfoStruct{
+			"MLDv2Report", nil,
+		},
 	}
 )
 
@@ -160,7 +178,32 @@ func CreateICMPv6TypeCode(typ uint8, code uint8) ICMPv6TypeCode {
 	return ICMPv6TypeCode(binary.BigEndian.Uint16([]byte{typ, code}))
 }
 
-// ICMPv6 is the layer for IPv6 ICMP packet data
+// icmpv6TypeLayers maps the ICMPv6 types that have their own message layers
+// (neighbor discovery and MLD) to those layers.  For these types the ICMPv6
+// layer is only the 4-byte type/code/checksum header, and the type-specific
+// bytes that follow it belong to the message layer.
+var icmpv6TypeLayers = map[uint8]gopacket.LayerType{}
+
+func init() {
+	icmpv6TypeLayers[ICMPv6TypeRouterSolicitation] = LayerTypeICMPv6RouterSolicitation
+	icmpv6TypeLayers[ICMPv6TypeRouterAdvertisement] = LayerTypeICMPv6RouterAdvertisement
+	icmpv6TypeLayers[ICMPv6TypeNeighborSolicitation] = LayerTypeICMPv6NeighborSolicitation
+	icmpv6TypeLayers[ICMPv6TypeNeighborAdvertisement] = LayerTypeICMPv6NeighborAdvertisement
+	icmpv6TypeLayers[ICMPv6TypeRedirect] = LayerTypeICMPv6Redirect
+	icmpv6TypeLayers[ICMPv6TypeMLDQuery] = LayerTypeICMPv6MLDQuery
+	icmpv6TypeLayers[ICMPv6TypeMLDReport] = LayerTypeICMPv6MLDReport
+	icmpv6TypeLayers[ICMPv6TypeMLDDone] = LayerTypeICMPv6MLDDone
+	icmpv6TypeLayers[ICMPv6TypeMLDv2Report] = LayerTypeICMPv6MLDv2Report
+}
+
+// ICMPv6 is the layer for IPv6 ICMP packet data.
+//
+// Neighbor discovery and MLD messages are decoded into their own layers
+// following this one (ICMPv6RouterAdvertisement, ICMPv6MLDQuery, etc.).  For
+// those messages, Contents holds only the first 4 bytes, and TypeBytes, while
+// still set when decoding, is not written when serializing this layer around
+// a message layer with SerializeLayers: the message layer writes it instead.
+// TypeBytes is written otherwise, as for all other messages.
 type ICMPv6 struct {
 	BaseLayer
 	TypeCode  ICMPv6TypeCode
@@ -181,7 +224,11 @@ func (i *ICMPv6) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error
 	i.TypeCode = CreateICMPv6TypeCode(data[0], data[1])
 	i.Checksum = binary.BigEndian.Uint16(data[2:4])
 	i.TypeBytes = data[4:8]
-	i.BaseLayer = BaseLayer{data[:8], data[8:]}
+	if _, ok := icmpv6TypeLayers[i.TypeCode.Type()]; ok {
+		i.BaseLayer = BaseLayer{data[:4], data[4:]}
+	} else {
+		i.BaseLayer = BaseLayer{data[:8], data[8:]}
+	}
 	return nil
 }
 
@@ -189,6 +236,14 @@ func (i *ICMPv6) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error
 // SerializationBuffer, implementing gopacket.SerializableLayer.
 // See the docs for gopacket.SerializableLayer for more info.
 func (i *ICMPv6) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	if wrapsICMPv6Message(b) {
+		bytes, err := b.PrependBytes(4)
+		if err != nil {
+			return err
+		}
+		i.TypeCode.SerializeTo(bytes)
+		return i.serializeChecksum(b, bytes, opts)
+	}
 	if i.TypeBytes == nil {
 		i.TypeBytes = lotsOfZeros[:4]
 	} else if len(i.TypeBytes) != 4 {
@@ -200,6 +255,30 @@ func (i *ICMPv6) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.Serialize
 	}
 	i.TypeCode.SerializeTo(bytes)
 	copy(bytes[4:8], i.TypeBytes)
+	return i.serializeChecksum(b, bytes, opts)
+}
+
+// wrapsICMPv6Message returns whether the last layer serialized into b is one
+// of the neighbor discovery or MLD message layers, which write the 4 bytes
+// following the checksum themselves.
+func wrapsICMPv6Message(b gopacket.SerializeBuffer) bool {
+	t, ok := b.(gopacket.SerializeLayerTracker)
+	if !ok {
+		return false
+	}
+	ls := t.Layers()
+	if len(ls) == 0 {
+		return false
+	}
+	for _, l := range icmpv6TypeLayers {
+		if ls[len(ls)-1] == l {
+			return true
+		}
+	}
+	return false
+}
+
+func (i *ICMPv6) serializeChecksum(b gopacket.SerializeBuffer, bytes []byte, opts gopacket.SerializeOptions) error {
 	if opts.ComputeChecksums {
 		bytes[2] = 0
 		bytes[3] = 0
@@ -220,6 +299,9 @@ func (i *ICMPv6) CanDecode() gopacket.LayerClass {
 
 // NextLayerType returns the layer type contained by this DecodingLayer.
 func (i *ICMPv6) NextLayerType() gopacket.LayerType {
+	if t, ok := icmpv6TypeLayers[i.TypeCode.Type()]; ok {
+		return t
+	}
 	return gopacket.LayerTypePayload
 }
 
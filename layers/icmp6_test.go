@@ -34,7 +34,7 @@ func TestPacketICMPv6(t *testing.T) {
 	if p.ErrorLayer() != nil {
 		t.Error("Failed to decode packet:", p.ErrorLayer().Error())
 	}
-	checkLayers(p, []gopacket.LayerType{LayerTypeEthernet, LayerTypeIPv6, LayerTypeICMPv6, gopacket.LayerTypePayload}, t)
+	checkLayers(p, []gopacket.LayerType{LayerTypeEthernet, LayerTypeIPv6, LayerTypeICMPv6, LayerTypeICMPv6NeighborAdvertisement}, t)
 	if got, ok := p.Layer(LayerTypeIPv6).(*IPv6); ok {
 		want := &IPv6{
 			BaseLayer: BaseLayer{
@@ -64,8 +64,8 @@ func TestPacketICMPv6(t *testing.T) {
 	if got, ok := p.Layer(LayerTypeICMPv6).(*ICMPv6); ok {
 		want := &ICMPv6{
 			BaseLayer: BaseLayer{
-				Contents: []byte{0x88, 0x0, 0x1e, 0xd6, 0x40, 0x0, 0x0, 0x0},
-				Payload: []byte{0x26, 0x20, 0x0, 0x0, 0x10,
+				Contents: []byte{0x88, 0x0, 0x1e, 0xd6},
+				Payload: []byte{0x40, 0x0, 0x0, 0x0, 0x26, 0x20, 0x0, 0x0, 0x10,
 					0x5, 0x0, 0x0, 0x26, 0xbe, 0x5, 0xff, 0xfe, 0x27, 0xb, 0x17},
 			},
 			TypeCode:  0x8800,
@@ -82,3 +82,39 @@ func TestPacketICMPv6(t *testing.T) {
 		t.Error("No ICMPv6 layer type found in packet")
 	}
 }
+
+func TestICMPv6SerializeTypeBytes(t *testing.T) {
+	target := net.ParseIP("fe80::1")
+	for _, test := range []struct {
+		name   string
+		layers []gopacket.SerializableLayer
+		want   []byte
+	}{
+		{
+			// TypeBytes is written before a payload, as it always was.
+			"payload",
+			[]gopacket.SerializableLayer{
+				&ICMPv6{TypeCode: CreateICMPv6TypeCode(ICMPv6TypeNeighborSolicitation, 0), TypeBytes: []byte{0, 0, 0, 0}},
+				gopacket.Payload(target),
+			},
+			append([]byte{ICMPv6TypeNeighborSolicitation, 0, 0, 0, 0, 0, 0, 0}, target...),
+		},
+		{
+			// The message layer writes the reserved bytes instead.
+			"message",
+			[]gopacket.SerializableLayer{
+				&ICMPv6{TypeCode: CreateICMPv6TypeCode(ICMPv6TypeNeighborSolicitation, 0), TypeBytes: []byte{1, 2, 3, 4}},
+				&ICMPv6NeighborSolicitation{TargetAddress: target},
+			},
+			append([]byte{ICMPv6TypeNeighborSolicitation, 0, 0, 0, 0, 0, 0, 0}, target...),
+		},
+	} {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, test.layers...); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.Bytes(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %x, want %x", test.name, got, test.want)
+		}
+	}
+}
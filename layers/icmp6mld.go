@@ -0,0 +1,383 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/google/gopacket"
+)
+
+// ICMPv6MLDQuery is a multicast listener query (RFC 2710 section 3, RFC 3810
+// section 5.1), following an ICMPv6 layer.  MLDv1 and MLDv2 queries share an
+// ICMPv6 type, and are told apart by their length.
+type ICMPv6MLDQuery struct {
+	BaseLayer
+	// MaximumResponseCode is the maximum response delay in milliseconds for
+	// MLDv1.  MLDv2 encodes larger values as a floating point number; use
+	// MaximumResponseDelay to decode it.
+	MaximumResponseCode uint16
+	MulticastAddress    net.IP // unspecified for general queries
+
+	// The following are only used for MLDv2 queries; a query is serialized
+	// as MLDv2 if MLDv2 is set.
+	MLDv2                    bool
+	SuppressRouterProcessing bool
+	RobustnessVariable       uint8 // 3 bits
+	QueryIntervalCode        uint8
+	SourceAddresses          []net.IP
+}
+
+// MaximumResponseDelay returns the maximum response delay in milliseconds.
+func (i *ICMPv6MLDQuery) MaximumResponseDelay() uint32 {
+	c := uint32(i.MaximumResponseCode)
+	if !i.MLDv2 || c < 0x8000 {
+		return c
+	}
+	return (c&0x0fff | 0x1000) << ((c>>12)&0x7 + 3)
+}
+
+// QueryInterval returns the querier's query interval in seconds (MLDv2 only).
+func (i *ICMPv6MLDQuery) QueryInterval() uint32 {
+	c := uint32(i.QueryIntervalCode)
+	if c < 0x80 {
+		return c
+	}
+	return (c&0x0f | 0x10) << ((c>>4)&0x7 + 3)
+}
+
+// LayerType returns LayerTypeICMPv6MLDQuery.
+func (i *ICMPv6MLDQuery) LayerType() gopacket.LayerType { return LayerTypeICMPv6MLDQuery }
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (i *ICMPv6MLDQuery) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 20 {
+		df.SetTruncated()
+		return fmt.Errorf("ICMPv6 MLD query length %d too short", len(data))
+	}
+	i.MaximumResponseCode = binary.BigEndian.Uint16(data[0:2])
+	i.MulticastAddress = net.IP(data[4:20])
+	i.SourceAddresses = i.SourceAddresses[:0]
+	i.MLDv2 = len(data) >= 24
+	if !i.MLDv2 {
+		i.SuppressRouterProcessing = false
+		i.RobustnessVariable = 0
+		i.QueryIntervalCode = 0
+		i.BaseLayer = BaseLayer{Contents: data[:20], Payload: data[20:]}
+		return nil
+	}
+	i.SuppressRouterProcessing = data[20]&0x08 != 0
+	i.RobustnessVariable = data[20] & 0x07
+	i.QueryIntervalCode = data[21]
+	n := int(binary.BigEndian.Uint16(data[22:24]))
+	end := 24 + 16*n
+	if len(data) < end {
+		df.SetTruncated()
+		return fmt.Errorf("ICMPv6 MLDv2 query with %d sources truncated", n)
+	}
+	for j := 24; j < end; j += 16 {
+		i.SourceAddresses = append(i.SourceAddresses, net.IP(data[j:j+16]))
+	}
+	i.BaseLayer = BaseLayer{Contents: data[:end], Payload: data[end:]}
+	return nil
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+func (i *ICMPv6MLDQuery) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	data := []byte{byte(i.MaximumResponseCode >> 8), byte(i.MaximumResponseCode), 0, 0}
+	data, err := appendICMPv6Addrs(data, icmpv6MulticastAddress(i.MulticastAddress))
+	if err != nil {
+		return err
+	}
+	if i.MLDv2 {
+		if len(i.SourceAddresses) > 0xffff {
+			return fmt.Errorf("too many ICMPv6 MLDv2 query sources: %d", len(i.SourceAddresses))
+		}
+		flags := i.RobustnessVariable & 0x07
+		if i.SuppressRouterProcessing {
+			flags |= 0x08
+		}
+		data = append(data, flags, i.QueryIntervalCode,
+			byte(len(i.SourceAddresses)>>8), byte(len(i.SourceAddresses)))
+		if data, err = appendICMPv6Addrs(data, i.SourceAddresses...); err != nil {
+			return err
+		}
+	}
+	bytes, err := b.PrependBytes(len(data))
+	if err != nil {
+		return err
+	}
+	copy(bytes, data)
+	return nil
+}
+
+// CanDecode returns the set of layer types that this DecodingLayer can decode.
+func (i *ICMPv6MLDQuery) CanDecode() gopacket.LayerClass {
+	return LayerTypeICMPv6MLDQuery
+}
+
+// NextLayerType returns the layer type contained by this DecodingLayer.
+func (i *ICMPv6MLDQuery) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypePayload
+}
+
+func decodeICMPv6MLDQuery(data []byte, p gopacket.PacketBuilder) error {
+	i := &ICMPv6MLDQuery{}
+	return decodingLayerDecoder(i, data, p)
+}
+
+// icmpv6MulticastAddress returns the multicast address field to serialize:
+// the unspecified address if none is set.
+func icmpv6MulticastAddress(ip net.IP) net.IP {
+	if ip == nil {
+		return net.IPv6unspecified
+	}
+	return ip
+}
+
+// ICMPv6MLDReport is an MLDv1 multicast listener report (RFC 2710 section
+// 3), following an ICMPv6 layer.
+type ICMPv6MLDReport struct {
+	BaseLayer
+	MaximumResponseDelay uint16 // unused in reports
+	MulticastAddress     net.IP
+}
+
+// LayerType returns LayerTypeICMPv6MLDReport.
+func (i *ICMPv6MLDReport) LayerType() gopacket.LayerType { return LayerTypeICMPv6MLDReport }
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (i *ICMPv6MLDReport) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	return decodeICMPv6MLDv1(&i.BaseLayer, &i.MaximumResponseDelay, &i.MulticastAddress, data, df, "report")
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+func (i *ICMPv6MLDReport) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	return serializeICMPv6MLDv1(b, i.MaximumResponseDelay, i.MulticastAddress)
+}
+
+// CanDecode returns the set of layer types that this DecodingLayer can decode.
+func (i *ICMPv6MLDReport) CanDecode() gopacket.LayerClass {
+	return LayerTypeICMPv6MLDReport
+}
+
+// NextLayerType returns the layer type contained by this DecodingLayer.
+func (i *ICMPv6MLDReport) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypePayload
+}
+
+func decodeICMPv6MLDReport(data []byte, p gopacket.PacketBuilder) error {
+	i := &ICMPv6MLDReport{}
+	return decodingLayerDecoder(i, data, p)
+}
+
+// ICMPv6MLDDone is an MLDv1 multicast listener done message (RFC 2710
+// section 3), following an ICMPv6 layer.
+type ICMPv6MLDDone struct {
+	BaseLayer
+	MaximumResponseDelay uint16 // unused in done messages
+	MulticastAddress     net.IP
+}
+
+// LayerType returns LayerTypeICMPv6MLDDone.
+func (i *ICMPv6MLDDone) LayerType() gopacket.LayerType { return LayerTypeICMPv6MLDDone }
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (i *ICMPv6MLDDone) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	return decodeICMPv6MLDv1(&i.BaseLayer, &i.MaximumResponseDelay, &i.MulticastAddress, data, df, "done")
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+func (i *ICMPv6MLDDone) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	return serializeICMPv6MLDv1(b, i.MaximumResponseDelay, i.MulticastAddress)
+}
+
+// CanDecode returns the set of layer types that this DecodingLayer can decode.
+func (i *ICMPv6MLDDone) CanDecode() gopacket.LayerClass {
+	return LayerTypeICMPv6MLDDone
+}
+
+// NextLayerType returns the layer type contained by this DecodingLayer.
+func (i *ICMPv6MLDDone) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypePayload
+}
+
+func decodeICMPv6MLDDone(data []byte, p gopacket.PacketBuilder) error {
+	i := &ICMPv6MLDDone{}
+	return decodingLayerDecoder(i, data, p)
+}
+
+func decodeICMPv6MLDv1(base *BaseLayer, delay *uint16, addr *net.IP, data []byte, df gopacket.DecodeFeedback, name string) error {
+	if len(data) < 20 {
+		df.SetTruncated()
+		return fmt.Errorf("ICMPv6 MLD %s length %d too short", name, len(data))
+	}
+	*delay = binary.BigEndian.Uint16(data[0:2])
+	*addr = net.IP(data[4:20])
+	*base = BaseLayer{Contents: data[:20], Payload: data[20:]}
+	return nil
+}
+
+func serializeICMPv6MLDv1(b gopacket.SerializeBuffer, delay uint16, addr net.IP) error {
+	data, err := appendICMPv6Addrs([]byte{byte(delay >> 8), byte(delay), 0, 0}, icmpv6MulticastAddress(addr))
+	if err != nil {
+		return err
+	}
+	bytes, err := b.PrependBytes(len(data))
+	if err != nil {
+		return err
+	}
+	copy(bytes, data)
+	return nil
+}
+
+// MLDv2RecordType is the type of an MLDv2 multicast address record.
+type MLDv2RecordType uint8
+
+// The following are from RFC 3810 section 5.2.12
+const (
+	MLDv2RecordTypeModeIsInclude   MLDv2RecordType = 1
+	MLDv2RecordTypeModeIsExclude   MLDv2RecordType = 2
+	MLDv2RecordTypeChangeToInclude MLDv2RecordType = 3
+	MLDv2RecordTypeChangeToExclude MLDv2RecordType = 4
+	MLDv2RecordTypeAllowNewSources MLDv2RecordType = 5
+	MLDv2RecordTypeBlockOldSources MLDv2RecordType = 6
+)
+
+func (t MLDv2RecordType) String() string {
+	switch t {
+	case MLDv2RecordTypeModeIsInclude:
+		return "ModeIsInclude"
+	case MLDv2RecordTypeModeIsExclude:
+		return "ModeIsExclude"
+	case MLDv2RecordTypeChangeToInclude:
+		return "ChangeToInclude"
+	case MLDv2RecordTypeChangeToExclude:
+		return "ChangeToExclude"
+	case MLDv2RecordTypeAllowNewSources:
+		return "AllowNewSources"
+	case MLDv2RecordTypeBlockOldSources:
+		return "BlockOldSources"
+	default:
+		return fmt.Sprintf("Unknown(%d)", uint8(t))
+	}
+}
+
+// MLDv2MulticastAddressRecord is a record of an MLDv2 report.  AuxData must
+// be a multiple of 4 bytes long.
+type MLDv2MulticastAddressRecord struct {
+	RecordType       MLDv2RecordType
+	MulticastAddress net.IP
+	SourceAddresses  []net.IP
+	AuxData          []byte
+}
+
+// ICMPv6MLDv2Report is an MLDv2 multicast listener report (RFC 3810 section
+// 5.2), following an ICMPv6 layer.
+type ICMPv6MLDv2Report struct {
+	BaseLayer
+	Records []MLDv2MulticastAddressRecord
+}
+
+// LayerType returns LayerTypeICMPv6MLDv2Report.
+func (i *ICMPv6MLDv2Report) LayerType() gopacket.LayerType { return LayerTypeICMPv6MLDv2Report }
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (i *ICMPv6MLDv2Report) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return fmt.Errorf("ICMPv6 MLDv2 report length %d too short", len(data))
+	}
+	n := int(binary.BigEndian.Uint16(data[2:4]))
+	i.Records = i.Records[:0]
+	offset := 4
+	for j := 0; j < n; j++ {
+		if len(data) < offset+20 {
+			df.SetTruncated()
+			return fmt.Errorf("ICMPv6 MLDv2 report record %d truncated", j)
+		}
+		r := MLDv2MulticastAddressRecord{
+			RecordType:       MLDv2RecordType(data[offset]),
+			MulticastAddress: net.IP(data[offset+4 : offset+20]),
+		}
+		aux := 4 * int(data[offset+1])
+		sources := int(binary.BigEndian.Uint16(data[offset+2 : offset+4]))
+		offset += 20
+		if len(data) < offset+16*sources+aux {
+			df.SetTruncated()
+			return fmt.Errorf("ICMPv6 MLDv2 report record %d truncated", j)
+		}
+		for k := 0; k < sources; k++ {
+			r.SourceAddresses = append(r.SourceAddresses, net.IP(data[offset:offset+16]))
+			offset += 16
+		}
+		if aux > 0 {
+			r.AuxData = data[offset : offset+aux]
+			offset += aux
+		}
+		i.Records = append(i.Records, r)
+	}
+	i.BaseLayer = BaseLayer{Contents: data[:offset], Payload: data[offset:]}
+	return nil
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+func (i *ICMPv6MLDv2Report) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	if len(i.Records) > 0xffff {
+		return fmt.Errorf("too many ICMPv6 MLDv2 report records: %d", len(i.Records))
+	}
+	data := []byte{0, 0, byte(len(i.Records) >> 8), byte(len(i.Records))}
+	var err error
+	for _, r := range i.Records {
+		if len(r.SourceAddresses) > 0xffff {
+			return fmt.Errorf("too many ICMPv6 MLDv2 record sources: %d", len(r.SourceAddresses))
+		}
+		if len(r.AuxData)%4 != 0 || len(r.AuxData) > 4*0xff {
+			return fmt.Errorf("invalid ICMPv6 MLDv2 record auxiliary data length %d", len(r.AuxData))
+		}
+		data = append(data, byte(r.RecordType), byte(len(r.AuxData)/4),
+			byte(len(r.SourceAddresses)>>8), byte(len(r.SourceAddresses)))
+		if data, err = appendICMPv6Addrs(data, r.MulticastAddress); err != nil {
+			return err
+		}
+		if data, err = appendICMPv6Addrs(data, r.SourceAddresses...); err != nil {
+			return err
+		}
+		data = append(data, r.AuxData...)
+	}
+	bytes, err := b.PrependBytes(len(data))
+	if err != nil {
+		return err
+	}
+	copy(bytes, data)
+	return nil
+}
+
+// CanDecode returns the set of layer types that this DecodingLayer can decode.
+func (i *ICMPv6MLDv2Report) CanDecode() gopacket.LayerClass {
+	return LayerTypeICMPv6MLDv2Report
+}
+
+// NextLayerType returns the layer type contained by this DecodingLayer.
+func (i *ICMPv6MLDv2Report) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypePayload
+}
+
+func decodeICMPv6MLDv2Report(data []byte, p gopacket.PacketBuilder) error {
+	i := &ICMPv6MLDv2Report{}
+	return decodingLayerDecoder(i, data, p)
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+func TestICMPv6MLDQuery(t *testing.T) {
+	group := net.ParseIP("ff02::1:3")
+	v1 := &ICMPv6MLDQuery{MaximumResponseCode: 10000, MulticastAddress: group}
+	data, p := serializeICMPv6(t, ICMPv6TypeMLDQuery, v1)
+	checkLayers(p, []gopacket.LayerType{LayerTypeEthernet, LayerTypeIPv6, LayerTypeICMPv6, LayerTypeICMPv6MLDQuery}, t)
+	got := p.Layer(LayerTypeICMPv6MLDQuery).(*ICMPv6MLDQuery)
+	if got.MLDv2 || got.MaximumResponseDelay() != 10000 || !got.MulticastAddress.Equal(group) {
+		t.Errorf("unexpected MLDv1 query %+v", got)
+	}
+	checkICMPv6Reserialize(t, p, data)
+
+	v2 := &ICMPv6MLDQuery{
+		MaximumResponseCode:      0x8123,
+		MLDv2:                    true,
+		SuppressRouterProcessing: true,
+		RobustnessVariable:       2,
+		QueryIntervalCode:        125,
+		SourceAddresses:          []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")},
+	}
+	data, p = serializeICMPv6(t, ICMPv6TypeMLDQuery, v2)
+	got = p.Layer(LayerTypeICMPv6MLDQuery).(*ICMPv6MLDQuery)
+	if !got.MLDv2 || !got.SuppressRouterProcessing || got.RobustnessVariable != 2 ||
+		got.QueryInterval() != 125 || !got.MulticastAddress.Equal(net.IPv6unspecified) ||
+		len(got.SourceAddresses) != 2 || !got.SourceAddresses[1].Equal(v2.SourceAddresses[1]) {
+		t.Errorf("unexpected MLDv2 query %+v", got)
+	}
+	if d := got.MaximumResponseDelay(); d != 0x1123<<3 {
+		t.Errorf("MLDv2 maximum response delay: got %d, want %d", d, 0x1123<<3)
+	}
+	checkICMPv6Reserialize(t, p, data)
+}
+
+func TestICMPv6MLDReports(t *testing.T) {
+	group := net.ParseIP("ff05::1:3")
+	data, p := serializeICMPv6(t, ICMPv6TypeMLDReport, &ICMPv6MLDReport{MulticastAddress: group})
+	if got, ok := p.Layer(LayerTypeICMPv6MLDReport).(*ICMPv6MLDReport); !ok || !got.MulticastAddress.Equal(group) {
+		t.Errorf("unexpected MLD report %+v", p.Layers())
+	}
+	checkICMPv6Reserialize(t, p, data)
+
+	data, p = serializeICMPv6(t, ICMPv6TypeMLDDone, &ICMPv6MLDDone{MulticastAddress: group})
+	if got, ok := p.Layer(LayerTypeICMPv6MLDDone).(*ICMPv6MLDDone); !ok || !got.MulticastAddress.Equal(group) {
+		t.Errorf("unexpected MLD done %+v", p.Layers())
+	}
+	checkICMPv6Reserialize(t, p, data)
+
+	report := &ICMPv6MLDv2Report{Records: []MLDv2MulticastAddressRecord{
+		{RecordType: MLDv2RecordTypeChangeToExclude, MulticastAddress: group},
+		{
+			RecordType:       MLDv2RecordTypeAllowNewSources,
+			MulticastAddress: net.ParseIP("ff3e::8000:1"),
+			SourceAddresses:  []net.IP{net.ParseIP("2001:db8::10")},
+			AuxData:          []byte{1, 2, 3, 4},
+		},
+	}}
+	data, p = serializeICMPv6(t, ICMPv6TypeMLDv2Report, report)
+	checkLayers(p, []gopacket.LayerType{LayerTypeEthernet, LayerTypeIPv6, LayerTypeICMPv6, LayerTypeICMPv6MLDv2Report}, t)
+	got := p.Layer(LayerTypeICMPv6MLDv2Report).(*ICMPv6MLDv2Report)
+	if len(got.Records) != 2 {
+		t.Fatalf("got %d records, want 2", len(got.Records))
+	}
+	r := got.Records[1]
+	if got.Records[0].RecordType != MLDv2RecordTypeChangeToExclude || len(got.Records[0].SourceAddresses) != 0 ||
+		r.RecordType != MLDv2RecordTypeAllowNewSources || !r.MulticastAddress.Equal(report.Records[1].MulticastAddress) ||
+		len(r.SourceAddresses) != 1 || !r.SourceAddresses[0].Equal(report.Records[1].SourceAddresses[0]) ||
+		string(r.AuxData) != "\x01\x02\x03\x04" {
+		t.Errorf("unexpected MLDv2 records %+v", got.Records)
+	}
+	checkICMPv6Reserialize(t, p, data)
+
+	var bad ICMPv6MLDv2Report
+	if err := bad.DecodeFromBytes(data[58:len(data)-4], gopacket.NilDecodeFeedback); err == nil {
+		t.Error("expected error decoding truncated MLDv2 report")
+	}
+}
@@ -0,0 +1,627 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+)
+
+// ICMPv6Opt is the type of a neighbor discovery option.
+type ICMPv6Opt uint8
+
+const (
+	// The following are from RFC 4861
+	ICMPv6OptSourceAddress    ICMPv6Opt = 1
+	ICMPv6OptTargetAddress    ICMPv6Opt = 2
+	ICMPv6OptPrefixInfo       ICMPv6Opt = 3
+	ICMPv6OptRedirectedHeader ICMPv6Opt = 4
+	ICMPv6OptMTU              ICMPv6Opt = 5
+	// The following are from RFC 8106
+	ICMPv6OptRDNSS ICMPv6Opt = 25
+	ICMPv6OptDNSSL ICMPv6Opt = 31
+)
+
+func (o ICMPv6Opt) String() string {
+	switch o {
+	case ICMPv6OptSourceAddress:
+		return "SourceAddress"
+	case ICMPv6OptTargetAddress:
+		return "TargetAddress"
+	case ICMPv6OptPrefixInfo:
+		return "PrefixInfo"
+	case ICMPv6OptRedirectedHeader:
+		return "RedirectedHeader"
+	case ICMPv6OptMTU:
+		return "MTU"
+	case ICMPv6OptRDNSS:
+		return "RDNSS"
+	case ICMPv6OptDNSSL:
+		return "DNSSL"
+	default:
+		return fmt.Sprintf("Unknown(%d)", uint8(o))
+	}
+}
+
+// ICMPv6Options is used to get nicely printed option lists which would
+// normally be cut off after 5 options.
+type ICMPv6Options []ICMPv6Option
+
+// String returns a string version of the options list.
+func (o ICMPv6Options) String() string {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('[')
+	for i, opt := range o {
+		buf.WriteString(opt.String())
+		if i+1 != len(o) {
+			buf.WriteString(", ")
+		}
+	}
+	buf.WriteByte(']')
+	return buf.String()
+}
+
+// Option returns the first option of the given type, and whether there was
+// one.
+func (o ICMPv6Options) Option(t ICMPv6Opt) (ICMPv6Option, bool) {
+	for _, opt := range o {
+		if opt.Type == t {
+			return opt, true
+		}
+	}
+	return ICMPv6Option{}, false
+}
+
+// ICMPv6Option is a neighbor discovery option.  Length is in units of 8
+// bytes and includes the type and length bytes; Data is everything after
+// them, including any padding.
+type ICMPv6Option struct {
+	Type   ICMPv6Opt
+	Length uint8
+	Data   []byte
+
+	// Decoded values.  When serializing, these are used in place of Data
+	// for their option types.
+	LinkLayerAddress net.HardwareAddr // ICMPv6OptSourceAddress, ICMPv6OptTargetAddress
+	PrefixInfo       ICMPv6PrefixInfo // ICMPv6OptPrefixInfo
+	MTU              uint32           // ICMPv6OptMTU
+	RDNSS            ICMPv6RDNSS      // ICMPv6OptRDNSS
+	DNSSL            ICMPv6DNSSL      // ICMPv6OptDNSSL
+}
+
+// ICMPv6PrefixInfo is the data of a prefix information option.
+type ICMPv6PrefixInfo struct {
+	PrefixLength      uint8
+	OnLink            bool // L flag
+	Autonomous        bool // A flag, usable for address autoconfiguration
+	ValidLifetime     uint32
+	PreferredLifetime uint32
+	Prefix            net.IP
+}
+
+// ICMPv6RDNSS is the data of a recursive DNS server option.
+type ICMPv6RDNSS struct {
+	Lifetime uint32
+	Servers  []net.IP
+}
+
+// ICMPv6DNSSL is the data of a DNS search list option.
+type ICMPv6DNSSL struct {
+	Lifetime uint32
+	Domains  []string
+}
+
+// String returns a string version of a neighbor discovery option.
+func (o ICMPv6Option) String() string {
+	switch o.Type {
+	case ICMPv6OptSourceAddress, ICMPv6OptTargetAddress:
+		return fmt.Sprintf("Option(%s:%v)", o.Type, o.LinkLayerAddress)
+	case ICMPv6OptPrefixInfo:
+		p := o.PrefixInfo
+		return fmt.Sprintf("Option(%s:%v/%d onlink=%t auto=%t valid=%d pref=%d)", o.Type,
+			p.Prefix, p.PrefixLength, p.OnLink, p.Autonomous, p.ValidLifetime, p.PreferredLifetime)
+	case ICMPv6OptMTU:
+		return fmt.Sprintf("Option(%s:%d)", o.Type, o.MTU)
+	case ICMPv6OptRDNSS:
+		return fmt.Sprintf("Option(%s:%v lifetime=%d)", o.Type, o.RDNSS.Servers, o.RDNSS.Lifetime)
+	case ICMPv6OptDNSSL:
+		return fmt.Sprintf("Option(%s:%v lifetime=%d)", o.Type, o.DNSSL.Domains, o.DNSSL.Lifetime)
+	}
+	return fmt.Sprintf("Option(%s:%x)", o.Type, o.Data)
+}
+
+func decodeICMPv6Options(opts ICMPv6Options, data []byte) (ICMPv6Options, error) {
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errors.New("ICMPv6 option truncated")
+		}
+		o := ICMPv6Option{Type: ICMPv6Opt(data[0]), Length: data[1]}
+		if o.Length == 0 {
+			return nil, fmt.Errorf("ICMPv6 option %v has zero length", o.Type)
+		}
+		n := 8 * int(o.Length)
+		if len(data) < n {
+			return nil, fmt.Errorf("ICMPv6 option %v truncated", o.Type)
+		}
+		o.Data = data[2:n]
+		if err := o.decode(); err != nil {
+			return nil, err
+		}
+		opts = append(opts, o)
+		data = data[n:]
+	}
+	return opts, nil
+}
+
+// decode fills in the decoded values of the option from its data.
+func (o *ICMPv6Option) decode() error {
+	data := o.Data
+	switch o.Type {
+	case ICMPv6OptSourceAddress, ICMPv6OptTargetAddress:
+		o.LinkLayerAddress = net.HardwareAddr(data)
+	case ICMPv6OptPrefixInfo:
+		if len(data) < 30 {
+			return errors.New("ICMPv6 prefix information option too short")
+		}
+		p := &o.PrefixInfo
+		p.PrefixLength = data[0]
+		p.OnLink = data[1]&0x80 != 0
+		p.Autonomous = data[1]&0x40 != 0
+		p.ValidLifetime = binary.BigEndian.Uint32(data[2:6])
+		p.PreferredLifetime = binary.BigEndian.Uint32(data[6:10])
+		p.Prefix = net.IP(data[14:30])
+	case ICMPv6OptMTU:
+		if len(data) < 6 {
+			return errors.New("ICMPv6 MTU option too short")
+		}
+		o.MTU = binary.BigEndian.Uint32(data[2:6])
+	case ICMPv6OptRDNSS:
+		if len(data) < 22 || (len(data)-6)%16 != 0 {
+			return fmt.Errorf("invalid ICMPv6 RDNSS option length %d", len(data))
+		}
+		o.RDNSS.Lifetime = binary.BigEndian.Uint32(data[2:6])
+		o.RDNSS.Servers = nil
+		for i := 6; i < len(data); i += 16 {
+			o.RDNSS.Servers = append(o.RDNSS.Servers, net.IP(data[i:i+16]))
+		}
+	case ICMPv6OptDNSSL:
+		if len(data) < 6 {
+			return errors.New("ICMPv6 DNSSL option too short")
+		}
+		o.DNSSL.Lifetime = binary.BigEndian.Uint32(data[2:6])
+		o.DNSSL.Domains = nil
+		var labels []string
+		for i := 6; i < len(data); {
+			l := int(data[i])
+			i++
+			if l == 0 {
+				if labels == nil {
+					// The rest is padding.
+					break
+				}
+				o.DNSSL.Domains = append(o.DNSSL.Domains, strings.Join(labels, "."))
+				labels = nil
+				continue
+			}
+			if l > 63 || i+l > len(data) {
+				return errors.New("invalid ICMPv6 DNSSL domain name")
+			}
+			labels = append(labels, string(data[i:i+l]))
+			i += l
+		}
+		if labels != nil {
+			return errors.New("ICMPv6 DNSSL domain name truncated")
+		}
+	}
+	return nil
+}
+
+func encodeICMPv6Options(data []byte, opts ICMPv6Options, so gopacket.SerializeOptions) ([]byte, error) {
+	var err error
+	for i := range opts {
+		if data, err = opts[i].encode(data, so); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// encode appends the option to data, padded to its length.
+func (o *ICMPv6Option) encode(data []byte, opts gopacket.SerializeOptions) ([]byte, error) {
+	start := len(data)
+	data = append(data, byte(o.Type), 0)
+	switch o.Type {
+	case ICMPv6OptSourceAddress, ICMPv6OptTargetAddress:
+		data = append(data, o.LinkLayerAddress...)
+	case ICMPv6OptPrefixInfo:
+		p := &o.PrefixInfo
+		var flags byte
+		if p.OnLink {
+			flags |= 0x80
+		}
+		if p.Autonomous {
+			flags |= 0x40
+		}
+		data = append(data, p.PrefixLength, flags)
+		data = appendUint32s(data, p.ValidLifetime, p.PreferredLifetime, 0)
+		data = append(data, p.Prefix.To16()...)
+		if len(data) != start+32 {
+			return nil, fmt.Errorf("invalid ICMPv6 prefix %v", p.Prefix)
+		}
+	case ICMPv6OptMTU:
+		data = append(data, 0, 0)
+		data = appendUint32s(data, o.MTU)
+	case ICMPv6OptRDNSS:
+		data = append(data, 0, 0)
+		data = appendUint32s(data, o.RDNSS.Lifetime)
+		for _, ip := range o.RDNSS.Servers {
+			ip16 := ip.To16()
+			if ip16 == nil {
+				return nil, fmt.Errorf("invalid ICMPv6 RDNSS server %v", ip)
+			}
+			data = append(data, ip16...)
+		}
+	case ICMPv6OptDNSSL:
+		data = append(data, 0, 0)
+		data = appendUint32s(data, o.DNSSL.Lifetime)
+		for _, domain := range o.DNSSL.Domains {
+			for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+				if len(label) == 0 || len(label) > 63 {
+					return nil, fmt.Errorf("invalid ICMPv6 DNSSL domain %q", domain)
+				}
+				data = append(data, byte(len(label)))
+				data = append(data, label...)
+			}
+			data = append(data, 0)
+		}
+	default:
+		data = append(data, o.Data...)
+	}
+	n := len(data) - start
+	if opts.FixLengths {
+		o.Length = uint8((n + 7) / 8)
+		if (n+7)/8 > 0xff {
+			return nil, fmt.Errorf("ICMPv6 option %v too long: %d bytes", o.Type, n)
+		}
+	} else if n > 8*int(o.Length) {
+		return nil, fmt.Errorf("ICMPv6 option %v length %d too short for %d bytes", o.Type, o.Length, n)
+	}
+	data[start+1] = o.Length
+	for len(data)-start < 8*int(o.Length) {
+		data = append(data, 0)
+	}
+	return data, nil
+}
+
+// NewICMPv6Option constructs a new ICMPv6Option with the given type and
+// data, which should be padded so that the option is a multiple of 8 bytes
+// long.  The decoded values of the option, which are serialized in place of
+// data, are decoded from it; they are left zero if data isn't valid for t.
+func NewICMPv6Option(t ICMPv6Opt, data []byte) ICMPv6Option {
+	o := ICMPv6Option{Type: t, Length: uint8((len(data) + 2) / 8), Data: data}
+	if err := o.decode(); err != nil {
+		return ICMPv6Option{Type: t, Length: o.Length, Data: data}
+	}
+	return o
+}
+
+// decodeICMPv6NDMessage and serializeICMPv6NDMessage handle what the
+// neighbor discovery messages share: a fixed part followed by options.
+func decodeICMPv6NDMessage(base *BaseLayer, opts *ICMPv6Options, data []byte, fixed int, df gopacket.DecodeFeedback, name string) error {
+	if len(data) < fixed {
+		df.SetTruncated()
+		return fmt.Errorf("ICMPv6 %s length %d too short", name, len(data))
+	}
+	var err error
+	if *opts, err = decodeICMPv6Options((*opts)[:0], data[fixed:]); err != nil {
+		return err
+	}
+	*base = BaseLayer{Contents: data}
+	return nil
+}
+
+func serializeICMPv6NDMessage(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions, fixed []byte, options ICMPv6Options) error {
+	data, err := encodeICMPv6Options(fixed, options, opts)
+	if err != nil {
+		return err
+	}
+	bytes, err := b.PrependBytes(len(data))
+	if err != nil {
+		return err
+	}
+	copy(bytes, data)
+	return nil
+}
+
+// ICMPv6RouterSolicitation is a router solicitation message (RFC 4861
+// section 4.1), following an ICMPv6 layer.
+type ICMPv6RouterSolicitation struct {
+	BaseLayer
+	Options ICMPv6Options
+}
+
+// LayerType returns LayerTypeICMPv6RouterSolicitation.
+func (i *ICMPv6RouterSolicitation) LayerType() gopacket.LayerType {
+	return LayerTypeICMPv6RouterSolicitation
+}
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (i *ICMPv6RouterSolicitation) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	return decodeICMPv6NDMessage(&i.BaseLayer, &i.Options, data, 4, df, "router solicitation")
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+func (i *ICMPv6RouterSolicitation) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	return serializeICMPv6NDMessage(b, opts, make([]byte, 4), i.Options)
+}
+
+// CanDecode returns the set of layer types that this DecodingLayer can decode.
+func (i *ICMPv6RouterSolicitation) CanDecode() gopacket.LayerClass {
+	return LayerTypeICMPv6RouterSolicitation
+}
+
+// NextLayerType returns the layer type contained by this DecodingLayer.
+func (i *ICMPv6RouterSolicitation) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypeZero
+}
+
+func decodeICMPv6RouterSolicitation(data []byte, p gopacket.PacketBuilder) error {
+	i := &ICMPv6RouterSolicitation{}
+	return decodingLayerDecoder(i, data, p)
+}
+
+// ICMPv6RouterAdvertisement is a router advertisement message (RFC 4861
+// section 4.2), following an ICMPv6 layer.
+type ICMPv6RouterAdvertisement struct {
+	BaseLayer
+	HopLimit       uint8
+	Flags          uint8
+	RouterLifetime uint16 // seconds
+	ReachableTime  uint32 // milliseconds
+	RetransTimer   uint32 // milliseconds
+	Options        ICMPv6Options
+}
+
+// ManagedAddressConfig returns whether the M flag is set: addresses are
+// available from DHCPv6.
+func (i *ICMPv6RouterAdvertisement) ManagedAddressConfig() bool {
+	return i.Flags&0x80 != 0
+}
+
+// OtherConfig returns whether the O flag is set: other configuration is
+// available from DHCPv6.
+func (i *ICMPv6RouterAdvertisement) OtherConfig() bool {
+	return i.Flags&0x40 != 0
+}
+
+// LayerType returns LayerTypeICMPv6RouterAdvertisement.
+func (i *ICMPv6RouterAdvertisement) LayerType() gopacket.LayerType {
+	return LayerTypeICMPv6RouterAdvertisement
+}
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (i *ICMPv6RouterAdvertisement) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := decodeICMPv6NDMessage(&i.BaseLayer, &i.Options, data, 12, df, "router advertisement"); err != nil {
+		return err
+	}
+	i.HopLimit = data[0]
+	i.Flags = data[1]
+	i.RouterLifetime = binary.BigEndian.Uint16(data[2:4])
+	i.ReachableTime = binary.BigEndian.Uint32(data[4:8])
+	i.RetransTimer = binary.BigEndian.Uint32(data[8:12])
+	return nil
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+func (i *ICMPv6RouterAdvertisement) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	fixed := []byte{i.HopLimit, i.Flags, byte(i.RouterLifetime >> 8), byte(i.RouterLifetime)}
+	fixed = appendUint32s(fixed, i.ReachableTime, i.RetransTimer)
+	return serializeICMPv6NDMessage(b, opts, fixed, i.Options)
+}
+
+// CanDecode returns the set of layer types that this DecodingLayer can decode.
+func (i *ICMPv6RouterAdvertisement) CanDecode() gopacket.LayerClass {
+	return LayerTypeICMPv6RouterAdvertisement
+}
+
+// NextLayerType returns the layer type contained by this DecodingLayer.
+func (i *ICMPv6RouterAdvertisement) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypeZero
+}
+
+func decodeICMPv6RouterAdvertisement(data []byte, p gopacket.PacketBuilder) error {
+	i := &ICMPv6RouterAdvertisement{}
+	return decodingLayerDecoder(i, data, p)
+}
+
+// ICMPv6NeighborSolicitation is a neighbor solicitation message (RFC 4861
+// section 4.3), following an ICMPv6 layer.
+type ICMPv6NeighborSolicitation struct {
+	BaseLayer
+	TargetAddress net.IP
+	Options       ICMPv6Options
+}
+
+// LayerType returns LayerTypeICMPv6NeighborSolicitation.
+func (i *ICMPv6NeighborSolicitation) LayerType() gopacket.LayerType {
+	return LayerTypeICMPv6NeighborSolicitation
+}
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (i *ICMPv6NeighborSolicitation) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := decodeICMPv6NDMessage(&i.BaseLayer, &i.Options, data, 20, df, "neighbor solicitation"); err != nil {
+		return err
+	}
+	i.TargetAddress = net.IP(data[4:20])
+	return nil
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+func (i *ICMPv6NeighborSolicitation) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	fixed, err := appendICMPv6Addrs(make([]byte, 4), i.TargetAddress)
+	if err != nil {
+		return err
+	}
+	return serializeICMPv6NDMessage(b, opts, fixed, i.Options)
+}
+
+// CanDecode returns the set of layer types that this DecodingLayer can decode.
+func (i *ICMPv6NeighborSolicitation) CanDecode() gopacket.LayerClass {
+	return LayerTypeICMPv6NeighborSolicitation
+}
+
+// NextLayerType returns the layer type contained by this DecodingLayer.
+func (i *ICMPv6NeighborSolicitation) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypeZero
+}
+
+func decodeICMPv6NeighborSolicitation(data []byte, p gopacket.PacketBuilder) error {
+	i := &ICMPv6NeighborSolicitation{}
+	return decodingLayerDecoder(i, data, p)
+}
+
+// ICMPv6NeighborAdvertisement is a neighbor advertisement message (RFC 4861
+// section 4.4), following an ICMPv6 layer.
+type ICMPv6NeighborAdvertisement struct {
+	BaseLayer
+	Flags         uint8
+	TargetAddress net.IP
+	Options       ICMPv6Options
+}
+
+// Router returns whether the R flag is set: the sender is a router.
+func (i *ICMPv6NeighborAdvertisement) Router() bool {
+	return i.Flags&0x80 != 0
+}
+
+// Solicited returns whether the S flag is set: the advertisement answers a
+// neighbor solicitation.
+func (i *ICMPv6NeighborAdvertisement) Solicited() bool {
+	return i.Flags&0x40 != 0
+}
+
+// Override returns whether the O flag is set: the advertisement should
+// override existing cache entries.
+func (i *ICMPv6NeighborAdvertisement) Override() bool {
+	return i.Flags&0x20 != 0
+}
+
+// LayerType returns LayerTypeICMPv6NeighborAdvertisement.
+func (i *ICMPv6NeighborAdvertisement) LayerType() gopacket.LayerType {
+	return LayerTypeICMPv6NeighborAdvertisement
+}
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (i *ICMPv6NeighborAdvertisement) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := decodeICMPv6NDMessage(&i.BaseLayer, &i.Options, data, 20, df, "neighbor advertisement"); err != nil {
+		return err
+	}
+	i.Flags = data[0]
+	i.TargetAddress = net.IP(data[4:20])
+	return nil
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+func (i *ICMPv6NeighborAdvertisement) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	fixed, err := appendICMPv6Addrs([]byte{i.Flags, 0, 0, 0}, i.TargetAddress)
+	if err != nil {
+		return err
+	}
+	return serializeICMPv6NDMessage(b, opts, fixed, i.Options)
+}
+
+// CanDecode returns the set of layer types that this DecodingLayer can decode.
+func (i *ICMPv6NeighborAdvertisement) CanDecode() gopacket.LayerClass {
+	return LayerTypeICMPv6NeighborAdvertisement
+}
+
+// NextLayerType returns the layer type contained by this DecodingLayer.
+func (i *ICMPv6NeighborAdvertisement) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypeZero
+}
+
+func decodeICMPv6NeighborAdvertisement(data []byte, p gopacket.PacketBuilder) error {
+	i := &ICMPv6NeighborAdvertisement{}
+	return decodingLayerDecoder(i, data, p)
+}
+
+// ICMPv6Redirect is a redirect message (RFC 4861 section 4.5), following an
+// ICMPv6 layer.
+type ICMPv6Redirect struct {
+	BaseLayer
+	TargetAddress      net.IP
+	DestinationAddress net.IP
+	Options            ICMPv6Options
+}
+
+// LayerType returns LayerTypeICMPv6Redirect.
+func (i *ICMPv6Redirect) LayerType() gopacket.LayerType {
+	return LayerTypeICMPv6Redirect
+}
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (i *ICMPv6Redirect) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := decodeICMPv6NDMessage(&i.BaseLayer, &i.Options, data, 36, df, "redirect"); err != nil {
+		return err
+	}
+	i.TargetAddress = net.IP(data[4:20])
+	i.DestinationAddress = net.IP(data[20:36])
+	return nil
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+// See the docs for gopacket.SerializableLayer for more info.
+func (i *ICMPv6Redirect) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	fixed, err := appendICMPv6Addrs(make([]byte, 4), i.TargetAddress, i.DestinationAddress)
+	if err != nil {
+		return err
+	}
+	return serializeICMPv6NDMessage(b, opts, fixed, i.Options)
+}
+
+// CanDecode returns the set of layer types that this DecodingLayer can decode.
+func (i *ICMPv6Redirect) CanDecode() gopacket.LayerClass {
+	return LayerTypeICMPv6Redirect
+}
+
+// NextLayerType returns the layer type contained by this DecodingLayer.
+func (i *ICMPv6Redirect) NextLayerType() gopacket.LayerType {
+	return gopacket.LayerTypeZero
+}
+
+func decodeICMPv6Redirect(data []byte, p gopacket.PacketBuilder) error {
+	i := &ICMPv6Redirect{}
+	return decodingLayerDecoder(i, data, p)
+}
+
+// appendICMPv6Addrs appends the 16-byte forms of the given IPv6 addresses
+// to data.
+func appendICMPv6Addrs(data []byte, addrs ...net.IP) ([]byte, error) {
+	for _, addr := range addrs {
+		ip16 := addr.To16()
+		if ip16 == nil {
+			return nil, fmt.Errorf("invalid ICMPv6 address %v", addr)
+		}
+		data = append(data, ip16...)
+	}
+	return data, nil
+}
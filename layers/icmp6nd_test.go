@@ -0,0 +1,208 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+// serializeICMPv6 serializes msg in an Ethernet/IPv6/ICMPv6 packet with the
+// given ICMPv6 type, and decodes the result.
+func serializeICMPv6(t *testing.T, typ uint8, msg gopacket.SerializableLayer) ([]byte, gopacket.Packet) {
+	eth := &Ethernet{
+		SrcMAC:       net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01},
+		EthernetType: EthernetTypeIPv6,
+	}
+	ip := &IPv6{Version: 6, HopLimit: 255, NextHeader: IPProtocolICMPv6,
+		SrcIP: net.ParseIP("fe80::211:22ff:fe33:4455"), DstIP: net.ParseIP("ff02::1")}
+	icmp := &ICMPv6{TypeCode: CreateICMPv6TypeCode(typ, 0)}
+	icmp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, icmp, msg); err != nil {
+		t.Fatal(err)
+	}
+	p := gopacket.NewPacket(buf.Bytes(), LinkTypeEthernet, gopacket.Default)
+	if p.ErrorLayer() != nil {
+		t.Fatal("Failed to decode packet:", p.ErrorLayer().Error())
+	}
+	return buf.Bytes(), p
+}
+
+// checkICMPv6Reserialize checks that the decoded layers of p serialize back
+// to want, without fixing lengths or checksums.
+func checkICMPv6Reserialize(t *testing.T, p gopacket.Packet, want []byte) {
+	buf := gopacket.NewSerializeBuffer()
+	var ls []gopacket.SerializableLayer
+	for _, l := range p.Layers() {
+		ls = append(ls, l.(gopacket.SerializableLayer))
+	}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("reserialized packet differs:\ngot  %x\nwant %x", buf.Bytes(), want)
+	}
+}
+
+func TestICMPv6RouterAdvertisement(t *testing.T) {
+	ra := &ICMPv6RouterAdvertisement{
+		HopLimit:       64,
+		Flags:          0x40,
+		RouterLifetime: 1800,
+		ReachableTime:  30000,
+		RetransTimer:   1000,
+		Options: ICMPv6Options{
+			{Type: ICMPv6OptSourceAddress, LinkLayerAddress: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}},
+			{Type: ICMPv6OptMTU, MTU: 1500},
+			{Type: ICMPv6OptPrefixInfo, PrefixInfo: ICMPv6PrefixInfo{
+				PrefixLength: 64, OnLink: true, Autonomous: true,
+				ValidLifetime: 86400, PreferredLifetime: 14400, Prefix: net.ParseIP("2001:db8:1::"),
+			}},
+			{Type: ICMPv6OptRDNSS, RDNSS: ICMPv6RDNSS{Lifetime: 600, Servers: []net.IP{
+				net.ParseIP("2001:db8::53"), net.ParseIP("2001:db8::54"),
+			}}},
+			{Type: ICMPv6OptDNSSL, DNSSL: ICMPv6DNSSL{Lifetime: 600, Domains: []string{"example.com", "lab.example.org"}}},
+			NewICMPv6Option(42, []byte{1, 2, 3, 4, 5, 6}),
+		},
+	}
+	data, p := serializeICMPv6(t, ICMPv6TypeRouterAdvertisement, ra)
+	checkLayers(p, []gopacket.LayerType{LayerTypeEthernet, LayerTypeIPv6, LayerTypeICMPv6, LayerTypeICMPv6RouterAdvertisement}, t)
+	icmp := p.Layer(LayerTypeICMPv6).(*ICMPv6)
+	if !bytes.Equal(icmp.TypeBytes, []byte{64, 0x40, 0x07, 0x08}) {
+		t.Errorf("ICMPv6 type bytes: got %x", icmp.TypeBytes)
+	}
+	got := p.Layer(LayerTypeICMPv6RouterAdvertisement).(*ICMPv6RouterAdvertisement)
+	if got.HopLimit != 64 || !got.OtherConfig() || got.ManagedAddressConfig() ||
+		got.RouterLifetime != 1800 || got.ReachableTime != 30000 || got.RetransTimer != 1000 {
+		t.Errorf("unexpected router advertisement %+v", got)
+	}
+	if len(got.Options) != len(ra.Options) {
+		t.Fatalf("got %d options, want %d: %v", len(got.Options), len(ra.Options), got.Options)
+	}
+	wantLengths := []uint8{1, 1, 4, 5, 5, 1}
+	for i, o := range got.Options {
+		if o.Type != ra.Options[i].Type || o.Length != wantLengths[i] {
+			t.Errorf("option %d: got %v length %d, want %v length %d", i, o.Type, o.Length, ra.Options[i].Type, wantLengths[i])
+		}
+	}
+	if o, _ := got.Options.Option(ICMPv6OptSourceAddress); o.LinkLayerAddress.String() != "00:11:22:33:44:55" {
+		t.Errorf("source link-layer address: got %v", o.LinkLayerAddress)
+	}
+	if o, _ := got.Options.Option(ICMPv6OptMTU); o.MTU != 1500 {
+		t.Errorf("MTU: got %d", o.MTU)
+	}
+	o, _ := got.Options.Option(ICMPv6OptPrefixInfo)
+	o.PrefixInfo.Prefix = o.PrefixInfo.Prefix.To16()
+	if !reflect.DeepEqual(o.PrefixInfo, ra.Options[2].PrefixInfo) {
+		t.Errorf("prefix information: got %+v, want %+v", o.PrefixInfo, ra.Options[2].PrefixInfo)
+	}
+	if o, _ := got.Options.Option(ICMPv6OptRDNSS); o.RDNSS.Lifetime != 600 || len(o.RDNSS.Servers) != 2 ||
+		!o.RDNSS.Servers[1].Equal(net.ParseIP("2001:db8::54")) {
+		t.Errorf("RDNSS: got %+v", o.RDNSS)
+	}
+	if o, _ := got.Options.Option(ICMPv6OptDNSSL); !reflect.DeepEqual(o.DNSSL, ra.Options[4].DNSSL) {
+		t.Errorf("DNSSL: got %+v, want %+v", o.DNSSL, ra.Options[4].DNSSL)
+	}
+	if o, _ := got.Options.Option(42); !bytes.Equal(o.Data, []byte{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("unknown option data: got %x", o.Data)
+	}
+	checkICMPv6Reserialize(t, p, data)
+}
+
+// TestICMPv6OptionData checks that options built with NewICMPv6Option
+// serialize their data.
+func TestICMPv6OptionData(t *testing.T) {
+	prefix := []byte{64, 0xc0, 0, 1, 0x51, 0x80, 0, 0, 0x38, 0x40, 0, 0, 0, 0}
+	prefix = append(prefix, net.ParseIP("2001:db8:1::")...)
+	rdnss := append([]byte{0, 0, 0, 0, 2, 0x58}, net.ParseIP("2001:db8::53")...)
+	dnssl := []byte{0, 0, 0, 0, 2, 0x58, 3, 'l', 'a', 'b', 0, 0, 0, 0}
+	ra := &ICMPv6RouterAdvertisement{HopLimit: 64, RouterLifetime: 1800}
+	for _, o := range []struct {
+		typ  ICMPv6Opt
+		data []byte
+	}{
+		{ICMPv6OptSourceAddress, []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}},
+		{ICMPv6OptMTU, []byte{0, 0, 0, 0, 0x05, 0xdc}},
+		{ICMPv6OptPrefixInfo, prefix},
+		{ICMPv6OptRDNSS, rdnss},
+		{ICMPv6OptDNSSL, dnssl},
+	} {
+		ra.Options = append(ra.Options, NewICMPv6Option(o.typ, o.data))
+	}
+	_, p := serializeICMPv6(t, ICMPv6TypeRouterAdvertisement, ra)
+	got := p.Layer(LayerTypeICMPv6RouterAdvertisement).(*ICMPv6RouterAdvertisement)
+	if len(got.Options) != len(ra.Options) {
+		t.Fatalf("got %d options, want %d: %v", len(got.Options), len(ra.Options), got.Options)
+	}
+	for i, o := range got.Options {
+		if o.Type != ra.Options[i].Type || !bytes.Equal(o.Data, ra.Options[i].Data) {
+			t.Errorf("option %d: got %v %x, want %v %x", i, o.Type, o.Data, ra.Options[i].Type, ra.Options[i].Data)
+		}
+	}
+	if o, _ := got.Options.Option(ICMPv6OptMTU); o.MTU != 1500 {
+		t.Errorf("MTU: got %d", o.MTU)
+	}
+}
+
+func TestICMPv6NeighborMessages(t *testing.T) {
+	target := net.ParseIP("2001:db8::1")
+	ns := &ICMPv6NeighborSolicitation{
+		TargetAddress: target,
+		Options: ICMPv6Options{
+			{Type: ICMPv6OptSourceAddress, LinkLayerAddress: net.HardwareAddr{0, 1, 2, 3, 4, 5}},
+		},
+	}
+	data, p := serializeICMPv6(t, ICMPv6TypeNeighborSolicitation, ns)
+	checkLayers(p, []gopacket.LayerType{LayerTypeEthernet, LayerTypeIPv6, LayerTypeICMPv6, LayerTypeICMPv6NeighborSolicitation}, t)
+	if got := p.Layer(LayerTypeICMPv6NeighborSolicitation).(*ICMPv6NeighborSolicitation); !got.TargetAddress.Equal(target) || len(got.Options) != 1 {
+		t.Errorf("unexpected neighbor solicitation %+v", got)
+	}
+	checkICMPv6Reserialize(t, p, data)
+
+	redirect := &ICMPv6Redirect{TargetAddress: net.ParseIP("fe80::1"), DestinationAddress: target}
+	data, p = serializeICMPv6(t, ICMPv6TypeRedirect, redirect)
+	if got := p.Layer(LayerTypeICMPv6Redirect).(*ICMPv6Redirect); !got.TargetAddress.Equal(redirect.TargetAddress) ||
+		!got.DestinationAddress.Equal(target) || len(got.Options) != 0 {
+		t.Errorf("unexpected redirect %+v", got)
+	}
+	checkICMPv6Reserialize(t, p, data)
+
+	p = gopacket.NewPacket(testPacketICMPv6, LinkTypeEthernet, gopacket.Default)
+	na, ok := p.Layer(LayerTypeICMPv6NeighborAdvertisement).(*ICMPv6NeighborAdvertisement)
+	if !ok {
+		t.Fatal("No neighbor advertisement layer found in packet")
+	}
+	if na.Router() || !na.Solicited() || na.Override() || !na.TargetAddress.Equal(net.ParseIP("2620:0:1005:0:26be:5ff:fe27:b17")) {
+		t.Errorf("unexpected neighbor advertisement %+v", na)
+	}
+	checkICMPv6Reserialize(t, p, testPacketICMPv6)
+}
+
+func TestICMPv6NDDecodeErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+	}{
+		{"short", []byte{0, 0, 0}},
+		{"zero length option", []byte{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}},
+		{"truncated option", []byte{0, 0, 0, 0, 1, 2, 0, 0, 0, 0, 0, 0}},
+		{"short prefix info", []byte{0, 0, 0, 0, 3, 1, 0, 0, 0, 0, 0, 0}},
+		{"bad DNSSL", []byte{0, 0, 0, 0, 31, 2, 0, 0, 0, 0, 0, 0, 64, 'a', 'b', 0, 0, 0, 0, 0}},
+	} {
+		var rs ICMPv6RouterSolicitation
+		if err := rs.DecodeFromBytes(test.data, gopacket.NilDecodeFeedback); err == nil {
+			t.Errorf("%s: expected error decoding %x", test.name, test.data)
+		}
+	}
+}
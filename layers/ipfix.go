@@ -0,0 +1,191 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/gopacket"
+)
+
+func decodeIPFIX(data []byte, p gopacket.PacketBuilder) error {
+	x := &IPFIX{}
+	x.SetTemplateCache(DefaultNetFlowTemplateCache, netFlowExporter(p))
+	if err := x.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(x)
+	p.SetApplicationLayer(x)
+	return nil
+}
+
+// IPFIX is an IPFIX message (RFC 7011).
+type IPFIX struct {
+	BaseLayer
+	NetFlowSets
+	Version             uint16
+	Length              uint16
+	ExportTime          uint32 // seconds since the epoch
+	SequenceNumber      uint32
+	ObservationDomainID uint32
+}
+
+const ipfixHeaderLength = 16
+
+// LayerType returns LayerTypeIPFIX.
+func (x *IPFIX) LayerType() gopacket.LayerType { return LayerTypeIPFIX }
+
+// CanDecode returns LayerTypeIPFIX.
+func (x *IPFIX) CanDecode() gopacket.LayerClass { return LayerTypeIPFIX }
+
+// NextLayerType returns gopacket.LayerTypePayload.
+func (x *IPFIX) NextLayerType() gopacket.LayerType { return gopacket.LayerTypePayload }
+
+// Payload returns nil, since IPFIX messages carry no payload.
+func (x *IPFIX) Payload() []byte { return nil }
+
+// DecodeFromBytes decodes the given bytes into this layer, decoding its data
+// sets with the templates of its cache and of the message itself.
+func (x *IPFIX) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < ipfixHeaderLength {
+		df.SetTruncated()
+		return fmt.Errorf("IPFIX message too short: %d bytes", len(data))
+	}
+	x.Version = binary.BigEndian.Uint16(data[0:2])
+	if x.Version != 10 {
+		return fmt.Errorf("Invalid IPFIX version %d", x.Version)
+	}
+	x.Length = binary.BigEndian.Uint16(data[2:4])
+	if int(x.Length) < ipfixHeaderLength {
+		return fmt.Errorf("Invalid IPFIX message length %d", x.Length)
+	}
+	if int(x.Length) > len(data) {
+		df.SetTruncated()
+		return fmt.Errorf("IPFIX message too short: %d bytes, want %d", len(data), x.Length)
+	}
+	x.ExportTime = binary.BigEndian.Uint32(data[4:8])
+	x.SequenceNumber = binary.BigEndian.Uint32(data[8:12])
+	x.ObservationDomainID = binary.BigEndian.Uint32(data[12:16])
+	x.BaseLayer = BaseLayer{Contents: data[:x.Length]}
+	return x.decodeSets(data[ipfixHeaderLength:x.Length], x.Version, x.ObservationDomainID, parseIPFIXTemplates)
+}
+
+// parseIPFIXTemplates parses IPFIX template and options template sets, with
+// IDs 2 and 3.
+func parseIPFIXTemplates(s *NetFlowSets, id uint16, data []byte) (templates []NetFlowTemplate, withdrawn []uint16, options bool, err error) {
+	if id != 2 && id != 3 {
+		return nil, nil, false, fmt.Errorf("Invalid IPFIX set ID %d", id)
+	}
+	options = id == 3
+	header := 4
+	if options {
+		header = 6
+	}
+	// Withdrawal records are 4 bytes long in both kinds of sets.
+	for len(data) >= 4 {
+		t := NetFlowTemplate{ID: binary.BigEndian.Uint16(data[0:2])}
+		count := int(binary.BigEndian.Uint16(data[2:4]))
+		if count == 0 {
+			// A template withdrawal.  Withdrawals of all templates, with
+			// the ID of the set, are left to the templates replacing them.
+			if t.ID >= 256 {
+				withdrawn = append(withdrawn, t.ID)
+			}
+			data = data[4:]
+			continue
+		}
+		if len(data) < header {
+			// Padding.
+			break
+		}
+		if options {
+			t.ScopeFields = int(binary.BigEndian.Uint16(data[4:6]))
+			if t.ScopeFields == 0 || t.ScopeFields > count {
+				return nil, nil, false, fmt.Errorf("Invalid IPFIX options template scope field count %d", t.ScopeFields)
+			}
+		}
+		data = data[header:]
+		for i := 0; i < count; i++ {
+			if len(data) < 4 {
+				return nil, nil, false, errors.New("IPFIX template too short")
+			}
+			f := NetFlowField{
+				Type:   NetFlowFieldType(binary.BigEndian.Uint16(data[0:2]) & 0x7fff),
+				Length: binary.BigEndian.Uint16(data[2:4]),
+			}
+			if data[0]&0x80 != 0 {
+				if len(data) < 8 {
+					return nil, nil, false, errors.New("IPFIX template too short")
+				}
+				f.EnterpriseNumber = binary.BigEndian.Uint32(data[4:8])
+				data = data[4:]
+			}
+			data = data[4:]
+			t.Fields = append(t.Fields, f)
+		}
+		templates = append(templates, t)
+	}
+	return templates, withdrawn, options, nil
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.
+func (x *IPFIX) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	sets, _, err := x.appendSets(nil, appendIPFIXTemplates)
+	if err != nil {
+		return err
+	}
+	length := ipfixHeaderLength + len(sets)
+	if length > 0xffff {
+		return fmt.Errorf("IPFIX message too long: %d bytes", length)
+	}
+	bytes, err := b.PrependBytes(length)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		x.Version = 10
+		x.Length = uint16(length)
+	}
+	binary.BigEndian.PutUint16(bytes[0:], x.Version)
+	binary.BigEndian.PutUint16(bytes[2:], x.Length)
+	binary.BigEndian.PutUint32(bytes[4:], x.ExportTime)
+	binary.BigEndian.PutUint32(bytes[8:], x.SequenceNumber)
+	binary.BigEndian.PutUint32(bytes[12:], x.ObservationDomainID)
+	copy(bytes[ipfixHeaderLength:], sets)
+	return nil
+}
+
+// appendIPFIXTemplates appends an IPFIX template or options template set.
+func appendIPFIXTemplates(b []byte, templates []NetFlowTemplate, options bool) ([]byte, error) {
+	start := len(b)
+	if options {
+		b = append(b, 0, 3, 0, 0)
+	} else {
+		b = append(b, 0, 2, 0, 0)
+	}
+	for _, t := range templates {
+		b = append(b, byte(t.ID>>8), byte(t.ID), byte(len(t.Fields)>>8), byte(len(t.Fields)))
+		if options {
+			b = append(b, byte(t.ScopeFields>>8), byte(t.ScopeFields))
+		}
+		for _, f := range t.Fields {
+			typ := uint16(f.Type)
+			if f.EnterpriseNumber != 0 {
+				typ |= 0x8000
+			}
+			b = append(b, byte(typ>>8), byte(typ), byte(f.Length>>8), byte(f.Length))
+			if f.EnterpriseNumber != 0 {
+				e := f.EnterpriseNumber
+				b = append(b, byte(e>>24), byte(e>>16), byte(e>>8), byte(e))
+			}
+		}
+	}
+	return netFlowEndSet(b, start)
+}
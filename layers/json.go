@@ -0,0 +1,622 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// The JSON representation of a packet is an object with its metadata and
+// the list of its layers:
+//
+//	{
+//	  "metadata": {"timestamp": "2018-01-02T03:04:05.000000006Z", "capture_length": 60, ...},
+//	  "layers": [
+//	    {"type": "Ethernet", "fields": {"SrcMAC": "00:11:22:33:44:55", ..., "EthernetType": {"name": "IPv4", "value": 2048}, ...}},
+//	    ...
+//	    {"type": "Payload", "data": "474554202f"}
+//	  ]
+//	}
+//
+// Layers are identified by the name of their LayerType.  Struct layers
+// have their exported fields in "fields", keyed by the Go field name and in
+// the order of the struct, except for BaseLayer, which is omitted.  Fields
+// of embedded structs are included as if they were fields of the layer.
+// Layers which are byte slices, like gopacket.Payload, and decode failures
+// store their bytes in "data", and decode failures also have an "error".
+//
+// Field values are encoded as follows:
+//
+//   - byte slices and arrays as hex strings
+//   - net.IP and net.HardwareAddr in their string form
+//   - time.Time in RFC 3339 format with nanoseconds
+//   - named integer types with a String method, like EthernetType, as an
+//     object with the "name" returned by String and the numeric "value"
+//   - other numbers, bools and strings as JSON numbers, bools and strings
+//   - structs as objects, other slices and arrays as arrays
+//   - nil pointers and slices as null
+//
+// Fields of other types, like interfaces and functions, are omitted.
+
+// jsonLayerTypes maps LayerType names to the structs implementing them,
+// for unmarshaling.
+var jsonLayerTypes = map[string]reflect.Type{}
+
+func init() {
+	for _, l := range []gopacket.Layer{
+		&ARP{}, &CiscoDiscovery{}, &CiscoDiscoveryInfo{}, &DHCPv4{}, &DHCPv6{}, &DNS{},
+		&Dot11{}, &Dot11Ctrl{}, &Dot11CtrlAck{}, &Dot11CtrlBlockAck{},
+		&Dot11CtrlBlockAckReq{}, &Dot11CtrlCFEnd{}, &Dot11CtrlCFEndAck{},
+		&Dot11CtrlCTS{}, &Dot11CtrlPowersavePoll{}, &Dot11CtrlRTS{},
+		&Dot11Data{}, &Dot11DataCFAck{}, &Dot11DataCFAckNoData{},
+		&Dot11DataCFAckPoll{}, &Dot11DataCFAckPollNoData{}, &Dot11DataCFPoll{},
+		&Dot11DataCFPollNoData{}, &Dot11DataNull{}, &Dot11DataQOSCFAckPollNoData{},
+		&Dot11DataQOSCFPollNoData{}, &Dot11DataQOSData{}, &Dot11DataQOSDataCFAck{},
+		&Dot11DataQOSDataCFAckPoll{}, &Dot11DataQOSDataCFPoll{}, &Dot11DataQOSNull{},
+		&Dot11InformationElement{}, &Dot11MgmtATIM{}, &Dot11MgmtAction{},
+		&Dot11MgmtActionNoAck{}, &Dot11MgmtArubaWLAN{}, &Dot11MgmtAssociationReq{},
+		&Dot11MgmtAssociationResp{}, &Dot11MgmtAuthentication{}, &Dot11MgmtBeacon{},
+		&Dot11MgmtDeauthentication{}, &Dot11MgmtDisassociation{},
+		&Dot11MgmtMeasurementPilot{}, &Dot11MgmtProbeReq{}, &Dot11MgmtProbeResp{},
+		&Dot11MgmtReassociationReq{}, &Dot11MgmtReassociationResp{}, &Dot11WEP{},
+		&Dot1Q{}, &EAP{}, &EAPOL{}, &EtherIP{}, &Ethernet{}, &EthernetCTP{},
+		&EthernetCTPForwardData{}, &EthernetCTPReply{}, &FDDI{}, &GRE{},
+		&ICMPv4{}, &ICMPv6{}, &ICMPv6MLDDone{}, &ICMPv6MLDQuery{},
+		&ICMPv6MLDReport{}, &ICMPv6MLDv2Report{}, &ICMPv6NeighborAdvertisement{},
+		&ICMPv6NeighborSolicitation{}, &ICMPv6Redirect{},
+		&ICMPv6RouterAdvertisement{}, &ICMPv6RouterSolicitation{},
+		&IGMP{}, &IPFIX{}, &IPSecAH{}, &IPSecESP{}, &IPv4{}, &IPv6{},
+		&IPv6Destination{}, &IPv6Fragment{}, &IPv6HopByHop{}, &IPv6Routing{},
+		&LLC{}, &LinkLayerDiscovery{}, &LinkLayerDiscoveryInfo{}, &LinuxSLL{},
+		&Loopback{}, &MPLS{}, &NetFlowV5{}, &NetFlowV9{}, &NortelDiscovery{},
+		&PFLog{}, &PPP{}, &PPPoE{},
+		&PrismHeader{}, &RUDP{}, &RadioTap{}, &SCTP{}, &SCTPCookieEcho{},
+		&SCTPData{}, &SCTPEmptyLayer{}, &SCTPError{}, &SCTPHeartbeat{},
+		&SCTPInit{}, &SCTPSack{}, &SCTPShutdown{}, &SCTPShutdownAck{},
+		&SCTPUnknownChunkType{}, &SFlowDatagram{}, &SNAP{}, &TCP{}, &UDP{},
+		&UDPLite{}, &USB{}, &USBBulk{}, &USBControl{}, &USBInterrupt{},
+		&USBRequestBlockSetup{}, &VXLAN{},
+	} {
+		jsonLayerTypes[l.LayerType().String()] = reflect.TypeOf(l).Elem()
+	}
+	// Structs implementing more than one layer type, depending on a field.
+	for lt, l := range map[gopacket.LayerType]gopacket.Layer{
+		LayerTypeSCTPInitAck:          &SCTPInit{},
+		LayerTypeSCTPHeartbeatAck:     &SCTPHeartbeat{},
+		LayerTypeSCTPAbort:            &SCTPError{},
+		LayerTypeSCTPShutdownComplete: &SCTPEmptyLayer{},
+	} {
+		jsonLayerTypes[lt.String()] = reflect.TypeOf(l).Elem()
+	}
+}
+
+// jsonMetadata is the JSON representation of gopacket.PacketMetadata.
+type jsonMetadata struct {
+	Timestamp      time.Time `json:"timestamp"`
+	CaptureLength  int       `json:"capture_length"`
+	Length         int       `json:"length"`
+	InterfaceIndex int       `json:"interface_index"`
+	Truncated      bool      `json:"truncated,omitempty"`
+}
+
+type jsonPacket struct {
+	Metadata *jsonMetadata     `json:"metadata,omitempty"`
+	Layers   []json.RawMessage `json:"layers"`
+}
+
+type jsonLayer struct {
+	Type   string          `json:"type"`
+	Fields json.RawMessage `json:"fields,omitempty"`
+	Data   string          `json:"data,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// MarshalPacketJSON returns the JSON representation of a packet and all of
+// its layers.
+func MarshalPacketJSON(p gopacket.Packet) ([]byte, error) {
+	var jp jsonPacket
+	if md := p.Metadata(); md != nil {
+		jp.Metadata = &jsonMetadata{
+			Timestamp:      md.Timestamp,
+			CaptureLength:  md.CaptureLength,
+			Length:         md.Length,
+			InterfaceIndex: md.InterfaceIndex,
+			Truncated:      md.Truncated,
+		}
+	}
+	jp.Layers = []json.RawMessage{}
+	for _, l := range p.Layers() {
+		data, err := MarshalLayerJSON(l)
+		if err != nil {
+			return nil, err
+		}
+		jp.Layers = append(jp.Layers, data)
+	}
+	return json.Marshal(jp)
+}
+
+// MarshalLayerJSON returns the JSON representation of a single layer.
+func MarshalLayerJSON(l gopacket.Layer) ([]byte, error) {
+	jl := jsonLayer{Type: l.LayerType().String()}
+	v := reflect.ValueOf(l)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	switch {
+	case v.Kind() == reflect.Struct:
+		if df, ok := l.(*gopacket.DecodeFailure); ok {
+			jl.Data = hex.EncodeToString(df.LayerContents())
+			if err := df.Error(); err != nil {
+				jl.Error = err.Error()
+			}
+			break
+		}
+		var buf bytes.Buffer
+		if err := encodeJSONValue(&buf, v, 0); err != nil {
+			return nil, fmt.Errorf("encoding %v layer: %v", l.LayerType(), err)
+		}
+		jl.Fields = buf.Bytes()
+	case v.Kind() == reflect.Slice && isJSONBytes(v.Type()):
+		jl.Data = hex.EncodeToString(v.Bytes())
+	default:
+		return nil, fmt.Errorf("can't encode %v layer of type %T", l.LayerType(), l)
+	}
+	return json.Marshal(jl)
+}
+
+// UnmarshalPacketJSON decodes the JSON representation of a packet created
+// by MarshalPacketJSON, returning its layers, which can be passed to
+// gopacket.SerializeLayers to rebuild the packet, and its capture info.
+// Decode failures are returned as gopacket.Payload containing the bytes
+// which could not be decoded.
+func UnmarshalPacketJSON(data []byte) ([]gopacket.SerializableLayer, gopacket.CaptureInfo, error) {
+	var jp jsonPacket
+	var ci gopacket.CaptureInfo
+	if err := json.Unmarshal(data, &jp); err != nil {
+		return nil, ci, err
+	}
+	if md := jp.Metadata; md != nil {
+		ci = gopacket.CaptureInfo{
+			Timestamp:      md.Timestamp,
+			CaptureLength:  md.CaptureLength,
+			Length:         md.Length,
+			InterfaceIndex: md.InterfaceIndex,
+		}
+	}
+	var ls []gopacket.SerializableLayer
+	for i, raw := range jp.Layers {
+		l, err := UnmarshalLayerJSON(raw)
+		if err != nil {
+			return nil, ci, fmt.Errorf("layer %d: %v", i, err)
+		}
+		sl, ok := l.(gopacket.SerializableLayer)
+		if !ok {
+			return nil, ci, fmt.Errorf("layer %d: %v layers can't be serialized", i, l.LayerType())
+		}
+		ls = append(ls, sl)
+	}
+	return ls, ci, nil
+}
+
+// UnmarshalLayerJSON decodes the JSON representation of a single layer
+// created by MarshalLayerJSON.  Fields missing from the JSON are left zero.
+func UnmarshalLayerJSON(data []byte) (gopacket.Layer, error) {
+	var jl jsonLayer
+	if err := json.Unmarshal(data, &jl); err != nil {
+		return nil, err
+	}
+	switch jl.Type {
+	case gopacket.LayerTypePayload.String(), gopacket.LayerTypeDecodeFailure.String():
+		b, err := hex.DecodeString(jl.Data)
+		if err != nil {
+			return nil, err
+		}
+		return gopacket.Payload(b), nil
+	case gopacket.LayerTypeFragment.String():
+		b, err := hex.DecodeString(jl.Data)
+		if err != nil {
+			return nil, err
+		}
+		f := gopacket.Fragment(b)
+		return &f, nil
+	}
+	t, ok := jsonLayerTypes[jl.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown layer type %q", jl.Type)
+	}
+	v := reflect.New(t)
+	if len(jl.Fields) > 0 {
+		d := json.NewDecoder(bytes.NewReader(jl.Fields))
+		d.UseNumber()
+		var x interface{}
+		if err := d.Decode(&x); err != nil {
+			return nil, err
+		}
+		if err := decodeJSONValue(v.Elem(), x, jl.Type); err != nil {
+			return nil, err
+		}
+	}
+	return v.Interface().(gopacket.Layer), nil
+}
+
+// maxJSONDepth limits the nesting of encoded values, to guard against
+// cycles.
+const maxJSONDepth = 32
+
+var (
+	baseLayerType = reflect.TypeOf(BaseLayer{})
+	timeType      = reflect.TypeOf(time.Time{})
+	ipType        = reflect.TypeOf(net.IP(nil))
+	macType       = reflect.TypeOf(net.HardwareAddr(nil))
+	stringerType  = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+type jsonField struct {
+	name  string
+	index []int
+	depth int
+}
+
+var (
+	jsonFieldsMu    sync.Mutex
+	jsonFieldsCache = map[reflect.Type][]jsonField{}
+)
+
+// jsonFieldList returns the fields of the struct type t which are part of
+// the JSON representation.  Like in Go, fields of embedded structs are
+// promoted unless they are hidden by a field of the same name at a lower
+// depth, or are ambiguous.
+func jsonFieldList(t reflect.Type) []jsonField {
+	jsonFieldsMu.Lock()
+	defer jsonFieldsMu.Unlock()
+	if fields, ok := jsonFieldsCache[t]; ok {
+		return fields
+	}
+	var all []jsonField
+	var collect func(t reflect.Type, index []int)
+	collect = func(t reflect.Type, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			fi := append(append([]int{}, index...), i)
+			if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+				if sf.PkgPath == "" && sf.Type != baseLayerType {
+					collect(sf.Type, fi)
+				}
+				continue
+			}
+			if sf.PkgPath == "" && jsonSupported(sf.Type) {
+				all = append(all, jsonField{sf.Name, fi, len(index)})
+			}
+		}
+	}
+	collect(t, nil)
+	count := map[string]int{}
+	minDepth := map[string]int{}
+	for _, f := range all {
+		if d, ok := minDepth[f.name]; !ok || f.depth < d {
+			minDepth[f.name] = f.depth
+			count[f.name] = 0
+		}
+		if f.depth == minDepth[f.name] {
+			count[f.name]++
+		}
+	}
+	var fields []jsonField
+	for _, f := range all {
+		if f.depth == minDepth[f.name] && count[f.name] == 1 {
+			fields = append(fields, f)
+		}
+	}
+	jsonFieldsCache[t] = fields
+	return fields
+}
+
+// jsonFields calls fn for all fields of the struct value v which are part
+// of the JSON representation.
+func jsonFields(v reflect.Value, fn func(name string, f reflect.Value) error) error {
+	for _, f := range jsonFieldList(v.Type()) {
+		if err := fn(f.name, v.FieldByIndex(f.index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonSupported returns true for types which can be represented in JSON.
+func jsonSupported(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Interface, reflect.Func, reflect.Chan, reflect.UnsafePointer, reflect.Complex64, reflect.Complex128, reflect.Map:
+		return false
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return jsonSupported(t.Elem())
+	}
+	return true
+}
+
+func isJSONEnum(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return t.Implements(stringerType)
+	}
+	return false
+}
+
+// isJSONBytes returns true for slices and arrays of bytes, which are encoded
+// as hex strings.
+func isJSONBytes(t reflect.Type) bool {
+	return t.Elem().Kind() == reflect.Uint8 && !isJSONEnum(t.Elem())
+}
+
+func encodeJSONValue(buf *bytes.Buffer, v reflect.Value, depth int) error {
+	if depth > maxJSONDepth {
+		return errors.New("value nested too deeply")
+	}
+	t := v.Type()
+	if v.Kind() == reflect.Slice && v.IsNil() {
+		buf.WriteString("null")
+		return nil
+	}
+	switch {
+	case t == ipType, t == macType:
+		return writeJSON(buf, v.Interface().(fmt.Stringer).String())
+	case t == timeType:
+		return writeJSON(buf, v.Interface().(time.Time).Format(time.RFC3339Nano))
+	case isJSONEnum(t):
+		buf.WriteString(`{"name":`)
+		if err := writeJSON(buf, v.Interface().(fmt.Stringer).String()); err != nil {
+			return err
+		}
+		buf.WriteString(`,"value":`)
+		if v.Kind() <= reflect.Int64 {
+			buf.WriteString(strconv.FormatInt(v.Int(), 10))
+		} else {
+			buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+		}
+		buf.WriteByte('}')
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		buf.WriteString(strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64, reflect.String:
+		return writeJSON(buf, v.Interface())
+	case reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		return encodeJSONValue(buf, v.Elem(), depth+1)
+	case reflect.Slice, reflect.Array:
+		if isJSONBytes(t) {
+			b := make([]byte, v.Len())
+			for i := range b {
+				b[i] = byte(v.Index(i).Uint())
+			}
+			return writeJSON(buf, hex.EncodeToString(b))
+		}
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeJSONValue(buf, v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case reflect.Struct:
+		buf.WriteByte('{')
+		first := true
+		err := jsonFields(v, func(name string, f reflect.Value) error {
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			writeJSON(buf, name)
+			buf.WriteByte(':')
+			return encodeJSONValue(buf, f, depth+1)
+		})
+		if err != nil {
+			return err
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("can't encode %v", t)
+	}
+	return nil
+}
+
+func writeJSON(buf *bytes.Buffer, x interface{}) error {
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
+
+// decodeJSONValue stores x, as decoded by encoding/json with UseNumber, in
+// the settable value v.  path is used in error messages.
+func decodeJSONValue(v reflect.Value, x interface{}, path string) error {
+	t := v.Type()
+	fail := func() error {
+		return fmt.Errorf("%s: can't decode %T into %v", path, x, t)
+	}
+	if x == nil {
+		v.Set(reflect.Zero(t))
+		return nil
+	}
+	switch {
+	case t == ipType:
+		s, ok := x.(string)
+		if !ok {
+			return fail()
+		}
+		if s == "" {
+			return nil
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("%s: invalid IP address %q", path, s)
+		}
+		if ip4 := ip.To4(); ip4 != nil && !bytes.ContainsRune([]byte(s), ':') {
+			ip = ip4
+		}
+		v.Set(reflect.ValueOf(ip))
+		return nil
+	case t == macType:
+		s, ok := x.(string)
+		if !ok {
+			return fail()
+		}
+		if s == "" {
+			return nil
+		}
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		v.Set(reflect.ValueOf(mac))
+		return nil
+	case t == timeType:
+		s, ok := x.(string)
+		if !ok {
+			return fail()
+		}
+		ts, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		v.Set(reflect.ValueOf(ts))
+		return nil
+	case isJSONEnum(t):
+		// Accept plain numbers as well as {"name": ..., "value": ...}.
+		if obj, ok := x.(map[string]interface{}); ok {
+			if x, ok = obj["value"]; !ok {
+				return fmt.Errorf("%s: missing enum value", path)
+			}
+		}
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		b, ok := x.(bool)
+		if !ok {
+			return fail()
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		num, ok := x.(json.Number)
+		if !ok {
+			return fail()
+		}
+		n, err := strconv.ParseInt(string(num), 10, t.Bits())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		num, ok := x.(json.Number)
+		if !ok {
+			return fail()
+		}
+		n, err := strconv.ParseUint(string(num), 10, t.Bits())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		num, ok := x.(json.Number)
+		if !ok {
+			return fail()
+		}
+		f, err := strconv.ParseFloat(string(num), t.Bits())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		s, ok := x.(string)
+		if !ok {
+			return fail()
+		}
+		v.SetString(s)
+	case reflect.Ptr:
+		p := reflect.New(t.Elem())
+		if err := decodeJSONValue(p.Elem(), x, path); err != nil {
+			return err
+		}
+		v.Set(p)
+	case reflect.Slice, reflect.Array:
+		if isJSONBytes(t) {
+			s, ok := x.(string)
+			if !ok {
+				return fail()
+			}
+			b, err := hex.DecodeString(s)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			if v.Kind() == reflect.Array {
+				if len(b) != v.Len() {
+					return fmt.Errorf("%s: expected %d bytes, got %d", path, v.Len(), len(b))
+				}
+			} else {
+				v.Set(reflect.MakeSlice(t, len(b), len(b)))
+			}
+			for i, c := range b {
+				v.Index(i).SetUint(uint64(c))
+			}
+			return nil
+		}
+		list, ok := x.([]interface{})
+		if !ok {
+			return fail()
+		}
+		if v.Kind() == reflect.Array {
+			if len(list) != v.Len() {
+				return fmt.Errorf("%s: expected %d elements, got %d", path, v.Len(), len(list))
+			}
+		} else {
+			v.Set(reflect.MakeSlice(t, len(list), len(list)))
+		}
+		for i, e := range list {
+			if err := decodeJSONValue(v.Index(i), e, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		obj, ok := x.(map[string]interface{})
+		if !ok {
+			return fail()
+		}
+		return jsonFields(v, func(name string, f reflect.Value) error {
+			if e, ok := obj[name]; ok {
+				return decodeJSONValue(f, e, path+"."+name)
+			}
+			return nil
+		})
+	default:
+		return fail()
+	}
+	return nil
+}
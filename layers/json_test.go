@@ -0,0 +1,126 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	p := gopacket.NewPacket(testSimpleTCPPacket, LinkTypeEthernet, gopacket.Default)
+	if p.ErrorLayer() != nil {
+		t.Fatal(p.ErrorLayer().Error())
+	}
+	md := p.Metadata()
+	md.Timestamp = time.Date(2018, 1, 2, 3, 4, 5, 6, time.UTC)
+	md.CaptureLength = len(testSimpleTCPPacket)
+	md.Length = 1000
+	md.InterfaceIndex = 3
+
+	data, err := MarshalPacketJSON(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`"timestamp":"2018-01-02T03:04:05.000000006Z"`,
+		`"type":"Ethernet"`,
+		`"DstMAC":"00:00:0c:9f:f0:20"`,
+		`"EthernetType":{"name":"IPv4","value":2048}`,
+		`"SrcIP":"172.17.81.73"`,
+		`"Protocol":{"name":"TCP","value":6}`,
+		`"DstPort":{"name":"80(http)","value":80}`,
+		`"ACK":true`,
+		`"type":"Payload","data":"474554202f`,
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("JSON does not contain %s:\n%s", want, data)
+		}
+	}
+
+	ls, ci, err := UnmarshalPacketJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci != md.CaptureInfo {
+		t.Errorf("capture info: got %+v, want %+v", ci, md.CaptureInfo)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), testSimpleTCPPacket) {
+		t.Errorf("rebuilt packet differs:\ngot  %x\nwant %x", buf.Bytes(), testSimpleTCPPacket)
+	}
+}
+
+// TestJSONStable checks that decoding and encoding again yields the same
+// JSON, for all layer types and some real packets.
+func TestJSONStable(t *testing.T) {
+	var ls []gopacket.Layer
+	for _, typ := range jsonLayerTypes {
+		ls = append(ls, reflect.New(typ).Interface().(gopacket.Layer))
+	}
+	for _, p := range []gopacket.Packet{
+		gopacket.NewPacket(testSimpleTCPPacket, LinkTypeEthernet, gopacket.Default),
+		gopacket.NewPacket(testPacketDot11MgmtBeacon, LinkTypeIEEE80211Radio, gopacket.Default),
+		gopacket.NewPacket(testPacketDot11DataIP, LinkTypeIEEE80211Radio, gopacket.Default),
+	} {
+		ls = append(ls, p.Layers()...)
+	}
+	for _, l := range ls {
+		data, err := MarshalLayerJSON(l)
+		if err != nil {
+			t.Errorf("%v: %v", l.LayerType(), err)
+			continue
+		}
+		l2, err := UnmarshalLayerJSON(data)
+		if err != nil {
+			t.Errorf("%v: %v\n%s", l.LayerType(), err, data)
+			continue
+		}
+		if l2.LayerType() != l.LayerType() {
+			t.Errorf("%v: decoded as %v", l.LayerType(), l2.LayerType())
+		}
+		data2, err := MarshalLayerJSON(l2)
+		if err != nil {
+			t.Errorf("%v: %v", l.LayerType(), err)
+			continue
+		}
+		if !bytes.Equal(data, data2) {
+			t.Errorf("%v: JSON changed:\n%s\n%s", l.LayerType(), data, data2)
+		}
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	for _, data := range []string{
+		`{"type":"NoSuchLayer"}`,
+		`{"type":"IPv4","fields":{"SrcIP":"1.2.3"}}`,
+		`{"type":"IPv4","fields":{"TTL":300}}`,
+		`{"type":"TCP","fields":{"SYN":1}}`,
+		`{"type":"Payload","data":"xyz"}`,
+		`{"type":"Ethernet","fields":{"SrcMAC":"00:11"}}`,
+	} {
+		if _, err := UnmarshalLayerJSON([]byte(data)); err == nil {
+			t.Errorf("%s should not decode", data)
+		}
+	}
+	// Enum values may be given as plain numbers.
+	l, err := UnmarshalLayerJSON([]byte(`{"type":"IPv4","fields":{"Protocol":17,"TTL":5}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := l.(*IPv4); ip.Protocol != IPProtocolUDP || ip.TTL != 5 {
+		t.Errorf("got %+v", ip)
+	}
+}
@@ -118,6 +118,20 @@ var (
 	LayerTypeSFlow                       = gopacket.RegisterLayerType(114, gopacket.LayerTypeMetadata{"SFlow", gopacket.DecodeFunc(decodeSFlow)})
 	LayerTypePrismHeader                 = gopacket.RegisterLayerType(115, gopacket.LayerTypeMetadata{"Prism monitor mode header", gopacket.DecodeFunc(decodePrismHeader)})
 	LayerTypeVXLAN                       = gopacket.RegisterLayerType(116, gopacket.LayerTypeMetadata{"VXLAN", gopacket.DecodeFunc(decodeVXLAN)})
+	LayerTypeDHCPv4                      = gopacket.RegisterLayerType(117, gopacket.LayerTypeMetadata{"DHCPv4", gopacket.DecodeFunc(decodeDHCPv4)})
+	LayerTypeDHCPv6                      = gopacket.RegisterLayerType(118, gopacket.LayerTypeMetadata{"DHCPv6", gopacket.DecodeFunc(decodeDHCPv6)})
+	LayerTypeICMPv6RouterSolicitation    = gopacket.RegisterLayerType(119, gopacket.LayerTypeMetadata{"ICMPv6RouterSolicitation", gopacket.DecodeFunc(decodeICMPv6RouterSolicitation)})
+	LayerTypeICMPv6RouterAdvertisement   = gopacket.RegisterLayerType(120, gopacket.LayerTypeMetadata{"ICMPv6RouterAdvertisement", gopacket.DecodeFunc(decodeICMPv6RouterAdvertisement)})
+	LayerTypeICMPv6NeighborSolicitation  = gopacket.RegisterLayerType(121, gopacket.LayerTypeMetadata{"ICMPv6NeighborSolicitation", gopacket.DecodeFunc(decodeICMPv6NeighborSolicitation)})
+	LayerTypeICMPv6NeighborAdvertisement = gopacket.RegisterLayerType(122, gopacket.LayerTypeMetadata{"ICMPv6NeighborAdvertisement", gopacket.DecodeFunc(decodeICMPv6NeighborAdvertisement)})
+	LayerTypeICMPv6Redirect              = gopacket.RegisterLayerType(123, gopacket.LayerTypeMetadata{"ICMPv6Redirect", gopacket.DecodeFunc(decodeICMPv6Redirect)})
+	LayerTypeICMPv6MLDQuery              = gopacket.RegisterLayerType(124, gopacket.LayerTypeMetadata{"ICMPv6MLDQuery", gopacket.DecodeFunc(decodeICMPv6MLDQuery)})
+	LayerTypeICMPv6MLDReport             = gopacket.RegisterLayerType(125, gopacket.LayerTypeMetadata{"ICMPv6MLDReport", gopacket.DecodeFunc(decodeICMPv6MLDReport)})
+	LayerTypeICMPv6MLDDone               = gopacket.RegisterLayerType(126, gopacket.LayerTypeMetadata{"ICMPv6MLDDone", gopacket.DecodeFunc(decodeICMPv6MLDDone)})
+	LayerTypeICMPv6MLDv2Report           = gopacket.RegisterLayerType(127, gopacket.LayerTypeMetadata{"ICMPv6MLDv2Report", gopacket.DecodeFunc(decodeICMPv6MLDv2Report)})
+	LayerTypeNetFlowV5                   = gopacket.RegisterLayerType(128, gopacket.LayerTypeMetadata{"NetFlowV5", gopacket.DecodeFunc(decodeNetFlowV5)})
+	LayerTypeNetFlowV9                   = gopacket.RegisterLayerType(129, gopacket.LayerTypeMetadata{"NetFlowV9", gopacket.DecodeFunc(decodeNetFlowV9)})
+	LayerTypeIPFIX                       = gopacket.RegisterLayerType(130, gopacket.LayerTypeMetadata{"IPFIX", gopacket.DecodeFunc(decodeIPFIX)})
 )
 
 var (
@@ -0,0 +1,802 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// NetFlow version 5, version 9 and IPFIX (RFC 7011, which calls itself
+// version 10) are flow export protocols: routers and probes send them to
+// collectors to report the traffic they see, summed up per flow.
+//
+// NetFlow v5 records have a fixed format.  NetFlow v9 and IPFIX records are
+// described by templates, sent by the exporter every so often and used to
+// decode the records of the following messages.  Templates are kept in a
+// NetFlowTemplateCache.
+
+func decodeNetFlowV5(data []byte, p gopacket.PacketBuilder) error {
+	n := &NetFlowV5{}
+	if err := n.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(n)
+	p.SetApplicationLayer(n)
+	return nil
+}
+
+// NetFlowV5 is a NetFlow version 5 export packet.
+type NetFlowV5 struct {
+	BaseLayer
+	Version      uint16
+	Count        uint16
+	SysUptime    uint32 // milliseconds since the exporter booted
+	UnixSecs     uint32
+	UnixNsecs    uint32
+	FlowSequence uint32
+	EngineType   uint8
+	EngineID     uint8
+	// SamplingInterval holds the sampling mode in its 2 most significant
+	// bits, and the sampling interval in the others.
+	SamplingInterval uint16
+	Records          []NetFlowV5Record
+}
+
+// NetFlowV5Record is a flow record of a NetFlow version 5 export packet.
+type NetFlowV5Record struct {
+	SrcAddr, DstAddr, NextHop net.IP
+	// Input and Output are the SNMP indexes of the interfaces.
+	Input, Output uint16
+	Packets       uint32
+	Octets        uint32
+	// First and Last are the SysUptime of the first and last packets of
+	// the flow.
+	First, Last      uint32
+	SrcPort, DstPort uint16
+	TCPFlags         uint8
+	Protocol         IPProtocol
+	ToS              uint8
+	SrcAS, DstAS     uint16
+	SrcMask, DstMask uint8
+}
+
+const (
+	netFlowV5HeaderLength = 24
+	netFlowV5RecordLength = 48
+)
+
+// LayerType returns LayerTypeNetFlowV5.
+func (n *NetFlowV5) LayerType() gopacket.LayerType { return LayerTypeNetFlowV5 }
+
+// CanDecode returns LayerTypeNetFlowV5.
+func (n *NetFlowV5) CanDecode() gopacket.LayerClass { return LayerTypeNetFlowV5 }
+
+// NextLayerType returns gopacket.LayerTypePayload.
+func (n *NetFlowV5) NextLayerType() gopacket.LayerType { return gopacket.LayerTypePayload }
+
+// Payload returns nil, since NetFlow packets carry no payload.
+func (n *NetFlowV5) Payload() []byte { return nil }
+
+// DecodeFromBytes decodes the given bytes into this layer.
+func (n *NetFlowV5) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < netFlowV5HeaderLength {
+		df.SetTruncated()
+		return fmt.Errorf("NetFlow v5 packet too short: %d bytes", len(data))
+	}
+	n.Version = binary.BigEndian.Uint16(data[0:2])
+	if n.Version != 5 {
+		return fmt.Errorf("Invalid NetFlow v5 version %d", n.Version)
+	}
+	n.Count = binary.BigEndian.Uint16(data[2:4])
+	n.SysUptime = binary.BigEndian.Uint32(data[4:8])
+	n.UnixSecs = binary.BigEndian.Uint32(data[8:12])
+	n.UnixNsecs = binary.BigEndian.Uint32(data[12:16])
+	n.FlowSequence = binary.BigEndian.Uint32(data[16:20])
+	n.EngineType = data[20]
+	n.EngineID = data[21]
+	n.SamplingInterval = binary.BigEndian.Uint16(data[22:24])
+	length := netFlowV5HeaderLength + int(n.Count)*netFlowV5RecordLength
+	if len(data) < length {
+		df.SetTruncated()
+		return fmt.Errorf("NetFlow v5 packet too short for %d records: %d bytes", n.Count, len(data))
+	}
+	n.Records = n.Records[:0]
+	for r := data[netFlowV5HeaderLength:length]; len(r) > 0; r = r[netFlowV5RecordLength:] {
+		n.Records = append(n.Records, NetFlowV5Record{
+			SrcAddr:  net.IP(r[0:4]),
+			DstAddr:  net.IP(r[4:8]),
+			NextHop:  net.IP(r[8:12]),
+			Input:    binary.BigEndian.Uint16(r[12:14]),
+			Output:   binary.BigEndian.Uint16(r[14:16]),
+			Packets:  binary.BigEndian.Uint32(r[16:20]),
+			Octets:   binary.BigEndian.Uint32(r[20:24]),
+			First:    binary.BigEndian.Uint32(r[24:28]),
+			Last:     binary.BigEndian.Uint32(r[28:32]),
+			SrcPort:  binary.BigEndian.Uint16(r[32:34]),
+			DstPort:  binary.BigEndian.Uint16(r[34:36]),
+			TCPFlags: r[37],
+			Protocol: IPProtocol(r[38]),
+			ToS:      r[39],
+			SrcAS:    binary.BigEndian.Uint16(r[40:42]),
+			DstAS:    binary.BigEndian.Uint16(r[42:44]),
+			SrcMask:  r[44],
+			DstMask:  r[45],
+		})
+	}
+	n.BaseLayer = BaseLayer{Contents: data[:length]}
+	return nil
+}
+
+// NetFlowFieldType is the type of a field of NetFlow v9 and IPFIX records,
+// that is an information element identifier, as assigned by IANA.
+type NetFlowFieldType uint16
+
+// Common information elements, decoded into the typed fields of
+// NetFlowRecord.
+const (
+	NetFlowFieldOctetDeltaCount          NetFlowFieldType = 1
+	NetFlowFieldPacketDeltaCount         NetFlowFieldType = 2
+	NetFlowFieldProtocolIdentifier       NetFlowFieldType = 4
+	NetFlowFieldIPClassOfService         NetFlowFieldType = 5
+	NetFlowFieldTCPControlBits           NetFlowFieldType = 6
+	NetFlowFieldSourceTransportPort      NetFlowFieldType = 7
+	NetFlowFieldSourceIPv4Address        NetFlowFieldType = 8
+	NetFlowFieldSourceIPv4PrefixLength   NetFlowFieldType = 9
+	NetFlowFieldIngressInterface         NetFlowFieldType = 10
+	NetFlowFieldDestinationTransportPort NetFlowFieldType = 11
+	NetFlowFieldDestinationIPv4Address   NetFlowFieldType = 12
+	NetFlowFieldDestinationIPv4Prefix    NetFlowFieldType = 13
+	NetFlowFieldEgressInterface          NetFlowFieldType = 14
+	NetFlowFieldIPNextHopIPv4Address     NetFlowFieldType = 15
+	NetFlowFieldBGPSourceASNumber        NetFlowFieldType = 16
+	NetFlowFieldBGPDestinationASNumber   NetFlowFieldType = 17
+	NetFlowFieldFlowEndSysUpTime         NetFlowFieldType = 21
+	NetFlowFieldFlowStartSysUpTime       NetFlowFieldType = 22
+	NetFlowFieldSourceIPv6Address        NetFlowFieldType = 27
+	NetFlowFieldDestinationIPv6Address   NetFlowFieldType = 28
+	NetFlowFieldSourceIPv6PrefixLength   NetFlowFieldType = 29
+	NetFlowFieldDestinationIPv6Prefix    NetFlowFieldType = 30
+	NetFlowFieldIPNextHopIPv6Address     NetFlowFieldType = 62
+	NetFlowFieldFlowEndReason            NetFlowFieldType = 136
+	NetFlowFieldFlowStartSeconds         NetFlowFieldType = 150
+	NetFlowFieldFlowEndSeconds           NetFlowFieldType = 151
+	NetFlowFieldFlowStartMilliseconds    NetFlowFieldType = 152
+	NetFlowFieldFlowEndMilliseconds      NetFlowFieldType = 153
+)
+
+// NetFlowReverseEnterpriseNumber is the enterprise number of the reverse
+// information elements of bidirectional IPFIX flows (RFC 5103): the reverse
+// counterpart of an information element has its identifier, with this
+// enterprise number.
+const NetFlowReverseEnterpriseNumber = 29305
+
+// NetFlowVariableLength is the length of the fields of variable length.
+const NetFlowVariableLength = 0xffff
+
+// NetFlowField describes a field of NetFlow v9 and IPFIX records.
+type NetFlowField struct {
+	Type NetFlowFieldType
+	// Length is the length of the field in bytes, or NetFlowVariableLength.
+	Length uint16
+	// EnterpriseNumber is the enterprise defining the field, for IPFIX
+	// enterprise-specific information elements, or 0.
+	EnterpriseNumber uint32
+}
+
+// NetFlowTemplate describes the records of a NetFlow v9 or IPFIX data set.
+type NetFlowTemplate struct {
+	ID uint16
+	// ScopeFields is the number of scope fields at the start of the fields
+	// of options templates, which describe the records giving information
+	// about the exporter rather than about flows.
+	ScopeFields int
+	Fields      []NetFlowField
+}
+
+// NetFlowFieldValue is the value of a field of a NetFlow v9 or IPFIX record.
+type NetFlowFieldValue struct {
+	NetFlowField
+	Value []byte
+}
+
+// NetFlowRecord is a record of a NetFlow v9 or IPFIX data set.  All its
+// fields are in Fields, and the common information elements are also decoded
+// into the other fields, which are left zero when absent.
+type NetFlowRecord struct {
+	Fields []NetFlowFieldValue
+
+	SrcAddr, DstAddr, NextHop net.IP
+	SrcPort, DstPort          uint16
+	Protocol                  IPProtocol
+	ToS, TCPFlags             uint8
+	SrcMask, DstMask          uint8
+	Input, Output             uint32
+	SrcAS, DstAS              uint32
+	Octets, Packets           uint64
+	// ReverseOctets and ReversePackets count the reverse direction of
+	// bidirectional flows.
+	ReverseOctets, ReversePackets uint64
+	// FirstSwitched and LastSwitched are the exporter's SysUptime of the
+	// first and last packets of the flow, in milliseconds.
+	FirstSwitched, LastSwitched uint32
+	// FlowStart and FlowEnd are the times of the first and last packets of
+	// the flow, as given in seconds or milliseconds.
+	FlowStart, FlowEnd time.Time
+	FlowEndReason      uint8
+}
+
+// NetFlowDataSet is a set of NetFlow v9 or IPFIX records sharing a
+// template.
+type NetFlowDataSet struct {
+	TemplateID uint16
+	// Data holds the records of the set, as found in the packet.
+	Data []byte
+	// Options is set when the template is an options template.
+	Options bool
+	// Records holds the decoded records, if the template was known.
+	Records []NetFlowRecord
+}
+
+// netFlowUint decodes the unsigned integer b, encoded with up to 8 bytes.
+func netFlowUint(b []byte) (v uint64) {
+	if len(b) > 8 {
+		b = b[len(b)-8:]
+	}
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return
+}
+
+// decode fills in the typed fields of r from r.Fields.
+func (r *NetFlowRecord) decode() {
+	for _, f := range r.Fields {
+		v := f.Value
+		if f.EnterpriseNumber == NetFlowReverseEnterpriseNumber {
+			switch f.Type {
+			case NetFlowFieldOctetDeltaCount:
+				r.ReverseOctets = netFlowUint(v)
+			case NetFlowFieldPacketDeltaCount:
+				r.ReversePackets = netFlowUint(v)
+			}
+			continue
+		}
+		if f.EnterpriseNumber != 0 {
+			continue
+		}
+		switch f.Type {
+		case NetFlowFieldOctetDeltaCount:
+			r.Octets = netFlowUint(v)
+		case NetFlowFieldPacketDeltaCount:
+			r.Packets = netFlowUint(v)
+		case NetFlowFieldProtocolIdentifier:
+			r.Protocol = IPProtocol(netFlowUint(v))
+		case NetFlowFieldIPClassOfService:
+			r.ToS = uint8(netFlowUint(v))
+		case NetFlowFieldTCPControlBits:
+			r.TCPFlags = uint8(netFlowUint(v))
+		case NetFlowFieldSourceTransportPort:
+			r.SrcPort = uint16(netFlowUint(v))
+		case NetFlowFieldDestinationTransportPort:
+			r.DstPort = uint16(netFlowUint(v))
+		case NetFlowFieldSourceIPv4Address, NetFlowFieldSourceIPv6Address:
+			r.SrcAddr = net.IP(v)
+		case NetFlowFieldDestinationIPv4Address, NetFlowFieldDestinationIPv6Address:
+			r.DstAddr = net.IP(v)
+		case NetFlowFieldIPNextHopIPv4Address, NetFlowFieldIPNextHopIPv6Address:
+			r.NextHop = net.IP(v)
+		case NetFlowFieldSourceIPv4PrefixLength, NetFlowFieldSourceIPv6PrefixLength:
+			r.SrcMask = uint8(netFlowUint(v))
+		case NetFlowFieldDestinationIPv4Prefix, NetFlowFieldDestinationIPv6Prefix:
+			r.DstMask = uint8(netFlowUint(v))
+		case NetFlowFieldIngressInterface:
+			r.Input = uint32(netFlowUint(v))
+		case NetFlowFieldEgressInterface:
+			r.Output = uint32(netFlowUint(v))
+		case NetFlowFieldBGPSourceASNumber:
+			r.SrcAS = uint32(netFlowUint(v))
+		case NetFlowFieldBGPDestinationASNumber:
+			r.DstAS = uint32(netFlowUint(v))
+		case NetFlowFieldFlowStartSysUpTime:
+			r.FirstSwitched = uint32(netFlowUint(v))
+		case NetFlowFieldFlowEndSysUpTime:
+			r.LastSwitched = uint32(netFlowUint(v))
+		case NetFlowFieldFlowStartSeconds:
+			r.FlowStart = time.Unix(int64(netFlowUint(v)), 0)
+		case NetFlowFieldFlowEndSeconds:
+			r.FlowEnd = time.Unix(int64(netFlowUint(v)), 0)
+		case NetFlowFieldFlowStartMilliseconds:
+			r.FlowStart = netFlowMilliseconds(netFlowUint(v))
+		case NetFlowFieldFlowEndMilliseconds:
+			r.FlowEnd = netFlowMilliseconds(netFlowUint(v))
+		case NetFlowFieldFlowEndReason:
+			r.FlowEndReason = uint8(netFlowUint(v))
+		}
+	}
+}
+
+func netFlowMilliseconds(ms uint64) time.Time {
+	return time.Unix(int64(ms/1000), int64(ms%1000)*int64(time.Millisecond))
+}
+
+// decodeRecords decodes the records of data set s with template t.
+func (s *NetFlowDataSet) decodeRecords(t *NetFlowTemplate) error {
+	s.Options = t.ScopeFields > 0
+	min := 0
+	for _, f := range t.Fields {
+		if f.Length != NetFlowVariableLength {
+			min += int(f.Length)
+		} else {
+			min++
+		}
+	}
+	if min == 0 {
+		return fmt.Errorf("Invalid NetFlow template %d without data", t.ID)
+	}
+	for data := s.Data; len(data) >= min && !netFlowPadding(data); {
+		r := NetFlowRecord{Fields: make([]NetFlowFieldValue, len(t.Fields))}
+		for i, f := range t.Fields {
+			length := int(f.Length)
+			if f.Length == NetFlowVariableLength {
+				if len(data) < 1 {
+					return errors.New("NetFlow record too short")
+				}
+				length, data = int(data[0]), data[1:]
+				if length == 0xff {
+					if len(data) < 2 {
+						return errors.New("NetFlow record too short")
+					}
+					length, data = int(binary.BigEndian.Uint16(data)), data[2:]
+				}
+			}
+			if len(data) < length {
+				return errors.New("NetFlow record too short")
+			}
+			r.Fields[i] = NetFlowFieldValue{f, data[:length]}
+			data = data[length:]
+		}
+		r.decode()
+		s.Records = append(s.Records, r)
+	}
+	return nil
+}
+
+// netFlowPadding returns whether data, what is left of a set after its
+// records, is padding: sets are padded with zeros to a multiple of 4 bytes.
+func netFlowPadding(data []byte) bool {
+	if len(data) >= 4 {
+		return false
+	}
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// NetFlowTemplateCache keeps the templates of NetFlow v9 and IPFIX exporters,
+// to decode the records of the messages following them.  Templates are
+// scoped by exporter, by version, and by observation domain, called source
+// ID in NetFlow v9.  It is safe for concurrent use.
+type NetFlowTemplateCache struct {
+	mu        sync.RWMutex
+	max       int
+	templates map[netFlowTemplateKey]*list.Element
+	lru       list.List // of *netFlowCachedTemplate, least recently added first
+}
+
+type netFlowTemplateKey struct {
+	exporter gopacket.Endpoint
+	version  uint16
+	domain   uint32
+	id       uint16
+}
+
+type netFlowCachedTemplate struct {
+	key      netFlowTemplateKey
+	template *NetFlowTemplate
+}
+
+// NewNetFlowTemplateCache returns a new empty NetFlowTemplateCache, holding
+// up to max templates.  Once it is full, adding a template drops the one
+// added the least recently: exporters send their templates again every so
+// often, so the templates in use stay.  If max <= 0, the number of templates
+// is unlimited.
+func NewNetFlowTemplateCache(max int) *NetFlowTemplateCache {
+	return &NetFlowTemplateCache{max: max, templates: make(map[netFlowTemplateKey]*list.Element)}
+}
+
+// NetFlowMaxTemplates is the number of templates held by
+// DefaultNetFlowTemplateCache.
+const NetFlowMaxTemplates = 4096
+
+// DefaultNetFlowTemplateCache is the cache used when decoding NetFlow v9 and
+// IPFIX packets with gopacket.NewPacket.  The exporter of the templates is
+// the source of the packet's network layer.  Since anyone can send templates
+// from any address, it only holds NetFlowMaxTemplates templates.
+var DefaultNetFlowTemplateCache = NewNetFlowTemplateCache(NetFlowMaxTemplates)
+
+// Template returns the template with the given ID of the given exporter,
+// version and observation domain, or nil if it isn't known.
+func (c *NetFlowTemplateCache) Template(exporter gopacket.Endpoint, version uint16, domain uint32, id uint16) *NetFlowTemplate {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if e := c.templates[netFlowTemplateKey{exporter, version, domain, id}]; e != nil {
+		return e.Value.(*netFlowCachedTemplate).template
+	}
+	return nil
+}
+
+// AddTemplate adds t to the templates of the given exporter, version and
+// observation domain, replacing the one with the same ID.
+func (c *NetFlowTemplateCache) AddTemplate(exporter gopacket.Endpoint, version uint16, domain uint32, t *NetFlowTemplate) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := netFlowTemplateKey{exporter, version, domain, t.ID}
+	if e := c.templates[key]; e != nil {
+		e.Value.(*netFlowCachedTemplate).template = t
+		c.lru.MoveToBack(e)
+		return
+	}
+	if c.max > 0 && len(c.templates) >= c.max {
+		e := c.lru.Front()
+		delete(c.templates, e.Value.(*netFlowCachedTemplate).key)
+		c.lru.Remove(e)
+	}
+	c.templates[key] = c.lru.PushBack(&netFlowCachedTemplate{key, t})
+}
+
+// RemoveTemplate removes the template with the given ID of the given
+// exporter, version and observation domain.
+func (c *NetFlowTemplateCache) RemoveTemplate(exporter gopacket.Endpoint, version uint16, domain uint32, id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := netFlowTemplateKey{exporter, version, domain, id}
+	if e := c.templates[key]; e != nil {
+		delete(c.templates, key)
+		c.lru.Remove(e)
+	}
+}
+
+// NetFlowSets holds what NetFlow v9 and IPFIX messages share: their sets,
+// and how to find the templates of their data sets.
+type NetFlowSets struct {
+	Templates       []NetFlowTemplate
+	OptionTemplates []NetFlowTemplate
+	DataSets        []NetFlowDataSet
+
+	exporter gopacket.Endpoint
+	cache    *NetFlowTemplateCache
+}
+
+// SetTemplateCache sets the cache holding the templates of previous messages,
+// which is updated with the ones of each message decoded, and the exporter
+// identifying the sender of the messages in it.  Without a cache, only the
+// templates of a message itself are used to decode it.  Packets decoded with
+// gopacket.NewPacket use DefaultNetFlowTemplateCache, with the source of
+// their network layer as exporter; DecodingLayer users must set a cache for
+// templates to be kept, and their exporter if they receive from several
+// hosts.
+func (s *NetFlowSets) SetTemplateCache(c *NetFlowTemplateCache, exporter gopacket.Endpoint) {
+	s.cache, s.exporter = c, exporter
+}
+
+// netFlowExporter returns the source of the network layer of the packet being
+// built by p, if any.
+func netFlowExporter(p gopacket.PacketBuilder) gopacket.Endpoint {
+	if pkt, ok := p.(gopacket.Packet); ok {
+		if n := pkt.NetworkLayer(); n != nil {
+			return n.NetworkFlow().Src()
+		}
+	}
+	return gopacket.Endpoint{}
+}
+
+// netFlowSetParser parses the template sets of one version.
+type netFlowSetParser func(s *NetFlowSets, id uint16, data []byte) (templates []NetFlowTemplate, withdrawn []uint16, options bool, err error)
+
+// decodeSets decodes the sets in data, using parse for template sets.
+func (s *NetFlowSets) decodeSets(data []byte, version uint16, domain uint32, parse netFlowSetParser) error {
+	s.Templates = s.Templates[:0]
+	s.OptionTemplates = s.OptionTemplates[:0]
+	s.DataSets = s.DataSets[:0]
+	local := map[uint16]*NetFlowTemplate{}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return errors.New("NetFlow set header too short")
+		}
+		id, length := binary.BigEndian.Uint16(data[0:2]), int(binary.BigEndian.Uint16(data[2:4]))
+		if length < 4 || length > len(data) {
+			return fmt.Errorf("Invalid NetFlow set length %d", length)
+		}
+		body := data[4:length]
+		data = data[length:]
+		if id >= 256 {
+			ds := NetFlowDataSet{TemplateID: id, Data: body}
+			t := local[id]
+			if t == nil && s.cache != nil {
+				t = s.cache.Template(s.exporter, version, domain, id)
+			}
+			if t != nil {
+				if err := ds.decodeRecords(t); err != nil {
+					return err
+				}
+			}
+			s.DataSets = append(s.DataSets, ds)
+			continue
+		}
+		templates, withdrawn, options, err := parse(s, id, body)
+		if err != nil {
+			return err
+		}
+		for i := range templates {
+			t := &templates[i]
+			if t.ID < 256 {
+				return fmt.Errorf("Invalid NetFlow template ID %d", t.ID)
+			}
+			local[t.ID] = t
+			if s.cache != nil {
+				s.cache.AddTemplate(s.exporter, version, domain, t)
+			}
+		}
+		for _, id := range withdrawn {
+			delete(local, id)
+			if s.cache != nil {
+				s.cache.RemoveTemplate(s.exporter, version, domain, id)
+			}
+		}
+		if options {
+			s.OptionTemplates = append(s.OptionTemplates, templates...)
+		} else {
+			s.Templates = append(s.Templates, templates...)
+		}
+	}
+	return nil
+}
+
+func decodeNetFlowV9(data []byte, p gopacket.PacketBuilder) error {
+	// NetFlow versions share ports, so decode other versions as such.
+	if len(data) >= 2 {
+		switch binary.BigEndian.Uint16(data) {
+		case 5:
+			return decodeNetFlowV5(data, p)
+		case 10:
+			return decodeIPFIX(data, p)
+		}
+	}
+	n := &NetFlowV9{}
+	n.SetTemplateCache(DefaultNetFlowTemplateCache, netFlowExporter(p))
+	if err := n.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(n)
+	p.SetApplicationLayer(n)
+	return nil
+}
+
+// NetFlowV9 is a NetFlow version 9 export packet (RFC 3954).  Decoding it as
+// a layer of a packet decodes NetFlow v5 and IPFIX packets as such, since
+// NetFlow versions share UDP ports.
+type NetFlowV9 struct {
+	BaseLayer
+	NetFlowSets
+	Version        uint16
+	Count          uint16
+	SysUptime      uint32 // milliseconds since the exporter booted
+	UnixSecs       uint32
+	SequenceNumber uint32
+	SourceID       uint32
+}
+
+const netFlowV9HeaderLength = 20
+
+// LayerType returns LayerTypeNetFlowV9.
+func (n *NetFlowV9) LayerType() gopacket.LayerType { return LayerTypeNetFlowV9 }
+
+// CanDecode returns LayerTypeNetFlowV9.
+func (n *NetFlowV9) CanDecode() gopacket.LayerClass { return LayerTypeNetFlowV9 }
+
+// NextLayerType returns gopacket.LayerTypePayload.
+func (n *NetFlowV9) NextLayerType() gopacket.LayerType { return gopacket.LayerTypePayload }
+
+// Payload returns nil, since NetFlow packets carry no payload.
+func (n *NetFlowV9) Payload() []byte { return nil }
+
+// DecodeFromBytes decodes the given bytes into this layer, decoding its data
+// sets with the templates of its cache and of the packet itself.
+func (n *NetFlowV9) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < netFlowV9HeaderLength {
+		df.SetTruncated()
+		return fmt.Errorf("NetFlow v9 packet too short: %d bytes", len(data))
+	}
+	n.Version = binary.BigEndian.Uint16(data[0:2])
+	if n.Version != 9 {
+		return fmt.Errorf("Invalid NetFlow v9 version %d", n.Version)
+	}
+	n.Count = binary.BigEndian.Uint16(data[2:4])
+	n.SysUptime = binary.BigEndian.Uint32(data[4:8])
+	n.UnixSecs = binary.BigEndian.Uint32(data[8:12])
+	n.SequenceNumber = binary.BigEndian.Uint32(data[12:16])
+	n.SourceID = binary.BigEndian.Uint32(data[16:20])
+	n.BaseLayer = BaseLayer{Contents: data}
+	return n.decodeSets(data[netFlowV9HeaderLength:], n.Version, n.SourceID, parseNetFlowV9Templates)
+}
+
+// parseNetFlowV9Templates parses NetFlow v9 template and options template
+// flowsets, with IDs 0 and 1.
+func parseNetFlowV9Templates(s *NetFlowSets, id uint16, data []byte) (templates []NetFlowTemplate, withdrawn []uint16, options bool, err error) {
+	switch id {
+	case 0:
+		for len(data) >= 4 {
+			t := NetFlowTemplate{ID: binary.BigEndian.Uint16(data[0:2])}
+			count := int(binary.BigEndian.Uint16(data[2:4]))
+			data = data[4:]
+			if len(data) < 4*count {
+				return nil, nil, false, errors.New("NetFlow v9 template too short")
+			}
+			for i := 0; i < count; i++ {
+				t.Fields = append(t.Fields, NetFlowField{
+					Type:   NetFlowFieldType(binary.BigEndian.Uint16(data[0:2])),
+					Length: binary.BigEndian.Uint16(data[2:4]),
+				})
+				data = data[4:]
+			}
+			templates = append(templates, t)
+		}
+		return templates, nil, false, nil
+	case 1:
+		// Options templates are padded, and have at least a scope field.
+		for len(data) >= 10 {
+			t := NetFlowTemplate{ID: binary.BigEndian.Uint16(data[0:2])}
+			scopeLength := int(binary.BigEndian.Uint16(data[2:4]))
+			optionLength := int(binary.BigEndian.Uint16(data[4:6]))
+			data = data[6:]
+			if scopeLength%4 != 0 || optionLength%4 != 0 || len(data) < scopeLength+optionLength {
+				return nil, nil, false, errors.New("Invalid NetFlow v9 options template")
+			}
+			t.ScopeFields = scopeLength / 4
+			for i := 0; i < scopeLength+optionLength; i += 4 {
+				t.Fields = append(t.Fields, NetFlowField{
+					Type:   NetFlowFieldType(binary.BigEndian.Uint16(data[i : i+2])),
+					Length: binary.BigEndian.Uint16(data[i+2 : i+4]),
+				})
+			}
+			data = data[scopeLength+optionLength:]
+			templates = append(templates, t)
+		}
+		return templates, nil, true, nil
+	default:
+		return nil, nil, false, fmt.Errorf("Invalid NetFlow v9 flowset ID %d", id)
+	}
+}
+
+// netFlowTemplateSetEncoder appends the template sets of one version.
+type netFlowTemplateSetEncoder func(b []byte, templates []NetFlowTemplate, options bool) ([]byte, error)
+
+// appendSets appends the sets of s to b, encoding the template sets with
+// encode, and returns the number of records appended.  Data sets are encoded
+// from their Records, or from their Data if they have none.
+func (s *NetFlowSets) appendSets(b []byte, encode netFlowTemplateSetEncoder) ([]byte, int, error) {
+	var err error
+	if len(s.Templates) > 0 {
+		if b, err = encode(b, s.Templates, false); err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(s.OptionTemplates) > 0 {
+		if b, err = encode(b, s.OptionTemplates, true); err != nil {
+			return nil, 0, err
+		}
+	}
+	records := len(s.Templates) + len(s.OptionTemplates)
+	for _, ds := range s.DataSets {
+		if ds.TemplateID < 256 {
+			return nil, 0, fmt.Errorf("Invalid NetFlow data set template ID %d", ds.TemplateID)
+		}
+		start := len(b)
+		b = append(b, byte(ds.TemplateID>>8), byte(ds.TemplateID), 0, 0)
+		if len(ds.Records) == 0 {
+			b = append(b, ds.Data...)
+		}
+		for _, r := range ds.Records {
+			for _, f := range r.Fields {
+				switch {
+				case f.Length != NetFlowVariableLength:
+					if len(f.Value) != int(f.Length) {
+						return nil, 0, fmt.Errorf("NetFlow field %d is %d bytes long, want %d", f.Type, len(f.Value), f.Length)
+					}
+				case len(f.Value) < 0xff:
+					b = append(b, byte(len(f.Value)))
+				case len(f.Value) <= 0xffff:
+					b = append(b, 0xff, byte(len(f.Value)>>8), byte(len(f.Value)))
+				default:
+					return nil, 0, fmt.Errorf("NetFlow field %d too long: %d bytes", f.Type, len(f.Value))
+				}
+				b = append(b, f.Value...)
+			}
+		}
+		records += len(ds.Records)
+		if b, err = netFlowEndSet(b, start); err != nil {
+			return nil, 0, err
+		}
+	}
+	return b, records, nil
+}
+
+// netFlowEndSet pads the set starting at start in b to 4 bytes, and sets its
+// length.
+func netFlowEndSet(b []byte, start int) ([]byte, error) {
+	for (len(b)-start)%4 != 0 {
+		b = append(b, 0)
+	}
+	if len(b)-start > 0xffff {
+		return nil, fmt.Errorf("NetFlow set too long: %d bytes", len(b)-start)
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b, nil
+}
+
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.  With
+// FixLengths, Count is set to the number of template and data records.
+func (n *NetFlowV9) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	sets, records, err := n.appendSets(nil, appendNetFlowV9Templates)
+	if err != nil {
+		return err
+	}
+	bytes, err := b.PrependBytes(netFlowV9HeaderLength + len(sets))
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		n.Version = 9
+		n.Count = uint16(records)
+	}
+	binary.BigEndian.PutUint16(bytes[0:], n.Version)
+	binary.BigEndian.PutUint16(bytes[2:], n.Count)
+	binary.BigEndian.PutUint32(bytes[4:], n.SysUptime)
+	binary.BigEndian.PutUint32(bytes[8:], n.UnixSecs)
+	binary.BigEndian.PutUint32(bytes[12:], n.SequenceNumber)
+	binary.BigEndian.PutUint32(bytes[16:], n.SourceID)
+	copy(bytes[netFlowV9HeaderLength:], sets)
+	return nil
+}
+
+// appendNetFlowV9Templates appends a NetFlow v9 template or options template
+// flowset.
+func appendNetFlowV9Templates(b []byte, templates []NetFlowTemplate, options bool) ([]byte, error) {
+	start := len(b)
+	if options {
+		b = append(b, 0, 1, 0, 0)
+	} else {
+		b = append(b, 0, 0, 0, 0)
+	}
+	for _, t := range templates {
+		if options {
+			scope, option := 4*t.ScopeFields, 4*(len(t.Fields)-t.ScopeFields)
+			b = append(b, byte(t.ID>>8), byte(t.ID), byte(scope>>8), byte(scope), byte(option>>8), byte(option))
+		} else {
+			b = append(b, byte(t.ID>>8), byte(t.ID), byte(len(t.Fields)>>8), byte(len(t.Fields)))
+		}
+		for _, f := range t.Fields {
+			if f.EnterpriseNumber != 0 {
+				return nil, fmt.Errorf("NetFlow v9 can't export field %d of enterprise %d", f.Type, f.EnterpriseNumber)
+			}
+			b = append(b, byte(f.Type>>8), byte(f.Type), byte(f.Length>>8), byte(f.Length))
+		}
+	}
+	return netFlowEndSet(b, start)
+}
@@ -0,0 +1,353 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package layers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// netFlowBytes builds NetFlow messages: each value is appended big-endian,
+// with the size of its type.
+func netFlowBytes(values ...interface{}) (b []byte) {
+	for _, v := range values {
+		switch v := v.(type) {
+		case uint8:
+			b = append(b, v)
+		case uint16:
+			b = append(b, byte(v>>8), byte(v))
+		case uint32:
+			b = append(b, 0, 0, 0, 0)
+			binary.BigEndian.PutUint32(b[len(b)-4:], v)
+		case net.IP:
+			b = append(b, v...)
+		case []byte:
+			b = append(b, v...)
+		default:
+			panic(v)
+		}
+	}
+	return
+}
+
+// netFlowUDPPacket wraps payload in an IPv4/UDP packet sent by exporter to
+// port.
+func netFlowUDPPacket(t *testing.T, exporter net.IP, port UDPPort, payload []byte) gopacket.Packet {
+	ip := &IPv4{Version: 4, TTL: 64, Protocol: IPProtocolUDP, SrcIP: exporter, DstIP: net.IP{10, 0, 0, 1}}
+	udp := &UDP{SrcPort: 50000, DstPort: port}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	p := gopacket.NewPacket(buf.Bytes(), LayerTypeIPv4, gopacket.Default)
+	if p.ErrorLayer() != nil {
+		t.Fatal("Failed to decode packet:", p.ErrorLayer().Error())
+	}
+	return p
+}
+
+func TestNetFlowV5(t *testing.T) {
+	data := netFlowBytes(
+		uint16(5), uint16(1), uint32(100000), uint32(1500000000), uint32(0), uint32(42), uint8(1), uint8(2), uint16(0x4064),
+		net.IP{10, 0, 0, 2}, net.IP{10, 0, 0, 3}, net.IP{10, 0, 0, 254}, uint16(1), uint16(2),
+		uint32(10), uint32(1000), uint32(90000), uint32(99000), uint16(1234), uint16(80),
+		uint8(0), uint8(0x1b), uint8(6), uint8(0), uint16(65000), uint16(65001), uint8(24), uint8(16), uint16(0))
+	// NetFlow v5 packets are recognized on NetFlow v9 ports.
+	p := netFlowUDPPacket(t, net.IP{192, 168, 0, 5}, 2055, data)
+	n, ok := p.Layer(LayerTypeNetFlowV5).(*NetFlowV5)
+	if !ok {
+		t.Fatal("No NetFlowV5 layer in", p)
+	}
+	if n.Count != 1 || n.SysUptime != 100000 || n.FlowSequence != 42 || n.EngineID != 2 || n.SamplingInterval != 0x4064 {
+		t.Errorf("Wrong header %+v", n)
+	}
+	want := NetFlowV5Record{
+		SrcAddr: net.IP{10, 0, 0, 2}, DstAddr: net.IP{10, 0, 0, 3}, NextHop: net.IP{10, 0, 0, 254},
+		Input: 1, Output: 2, Packets: 10, Octets: 1000, First: 90000, Last: 99000,
+		SrcPort: 1234, DstPort: 80, TCPFlags: 0x1b, Protocol: IPProtocolTCP,
+		SrcAS: 65000, DstAS: 65001, SrcMask: 24, DstMask: 16,
+	}
+	if len(n.Records) != 1 || !reflect.DeepEqual(n.Records[0], want) {
+		t.Errorf("Wrong records:\ngot  %+v\nwant %+v", n.Records, want)
+	}
+	if p := gopacket.NewPacket(data[:60], LayerTypeNetFlowV5, gopacket.Default); p.ErrorLayer() == nil {
+		t.Error("Truncated packet decoded without error")
+	}
+}
+
+func TestNetFlowV9(t *testing.T) {
+	exporter := net.IP{192, 168, 0, 9}
+	template := netFlowBytes(
+		uint16(0), uint16(28), uint16(256), uint16(5),
+		uint16(NetFlowFieldSourceIPv4Address), uint16(4),
+		uint16(NetFlowFieldDestinationIPv4Address), uint16(4),
+		uint16(NetFlowFieldProtocolIdentifier), uint16(1),
+		uint16(NetFlowFieldOctetDeltaCount), uint16(4),
+		uint16(NetFlowFieldFlowEndSysUpTime), uint16(4))
+	options := netFlowBytes(
+		uint16(1), uint16(20), uint16(257), uint16(4), uint16(4),
+		uint16(1), uint16(4), // System scope
+		uint16(34), uint16(4), // samplingInterval
+		uint16(0)) // padding
+	dataSet := netFlowBytes(
+		uint16(256), uint16(40),
+		net.IP{10, 0, 0, 2}, net.IP{10, 0, 0, 3}, uint8(17), uint32(1500), uint32(5000),
+		net.IP{10, 0, 0, 4}, net.IP{10, 0, 0, 5}, uint8(6), uint32(60), uint32(6000),
+		uint8(0), uint8(0)) // padding
+	header := func(count uint16, seq uint32) []byte {
+		return netFlowBytes(uint16(9), count, uint32(7000), uint32(1500000000), seq, uint32(3))
+	}
+
+	// The data set can't be decoded before its template is known.
+	p := netFlowUDPPacket(t, exporter, 9995, netFlowBytes(header(2, 1), dataSet))
+	n := p.Layer(LayerTypeNetFlowV9).(*NetFlowV9)
+	if len(n.DataSets) != 1 || n.DataSets[0].TemplateID != 256 || n.DataSets[0].Records != nil {
+		t.Errorf("Decoded data set without template: %+v", n.DataSets)
+	}
+
+	p = netFlowUDPPacket(t, exporter, 9995, netFlowBytes(header(3, 2), template, options, dataSet))
+	n = p.Layer(LayerTypeNetFlowV9).(*NetFlowV9)
+	if n.SequenceNumber != 2 || n.SourceID != 3 || len(n.Templates) != 1 || len(n.OptionTemplates) != 1 {
+		t.Fatalf("Wrong NetFlow v9 layer %+v", n)
+	}
+	if o := n.OptionTemplates[0]; o.ID != 257 || o.ScopeFields != 1 || len(o.Fields) != 2 {
+		t.Errorf("Wrong options template %+v", o)
+	}
+	// The template is now cached for the following packets of the exporter.
+	p = netFlowUDPPacket(t, exporter, 9995, netFlowBytes(header(2, 3), dataSet))
+	n = p.Layer(LayerTypeNetFlowV9).(*NetFlowV9)
+	if len(n.DataSets) != 1 || len(n.DataSets[0].Records) != 2 {
+		t.Fatalf("Wrong data sets %+v", n.DataSets)
+	}
+	r := n.DataSets[0].Records[1]
+	if !r.SrcAddr.Equal(net.IP{10, 0, 0, 4}) || !r.DstAddr.Equal(net.IP{10, 0, 0, 5}) || r.Protocol != IPProtocolTCP || r.Octets != 60 || r.LastSwitched != 6000 || len(r.Fields) != 5 {
+		t.Errorf("Wrong record %+v", r)
+	}
+	// Templates are scoped by exporter.
+	p = netFlowUDPPacket(t, net.IP{192, 168, 0, 10}, 9995, netFlowBytes(header(2, 1), dataSet))
+	if n = p.Layer(LayerTypeNetFlowV9).(*NetFlowV9); n.DataSets[0].Records != nil {
+		t.Error("Used template of another exporter")
+	}
+}
+
+// TestNetFlowPadding checks that the padding of data sets isn't decoded as
+// records when they are shorter than 4 bytes.
+func TestNetFlowPadding(t *testing.T) {
+	data := netFlowBytes(
+		uint16(9), uint16(2), uint32(7000), uint32(1500000000), uint32(1), uint32(3),
+		uint16(0), uint16(12), uint16(256), uint16(1),
+		uint16(NetFlowFieldProtocolIdentifier), uint16(1),
+		uint16(256), uint16(12),
+		uint8(6), uint8(17), uint8(0), uint8(1), uint8(58), // records
+		uint8(0), uint8(0), uint8(0)) // padding
+	n := &NetFlowV9{}
+	if err := n.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.DataSets) != 1 {
+		t.Fatalf("Wrong data sets %+v", n.DataSets)
+	}
+	var got []IPProtocol
+	for _, r := range n.DataSets[0].Records {
+		got = append(got, r.Protocol)
+	}
+	if want := []IPProtocol{6, 17, 0, 1, 58}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got protocols %v, want %v", got, want)
+	}
+}
+
+func TestIPFIX(t *testing.T) {
+	cache := NewNetFlowTemplateCache(0)
+	exporter := NewIPEndpoint(net.IP{192, 168, 0, 11})
+	message := func(sets ...[]byte) []byte {
+		b := netFlowBytes(uint16(10), uint16(0), uint32(1500000000), uint32(1), uint32(7))
+		for _, s := range sets {
+			b = append(b, s...)
+		}
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		return b
+	}
+	template := netFlowBytes(
+		uint16(2), uint16(36), uint16(300), uint16(6),
+		uint16(NetFlowFieldSourceIPv6Address), uint16(16),
+		uint16(NetFlowFieldSourceTransportPort), uint16(2),
+		uint16(NetFlowFieldOctetDeltaCount), uint16(8),
+		uint16(0x8000|NetFlowFieldOctetDeltaCount), uint16(4), uint32(NetFlowReverseEnterpriseNumber),
+		uint16(NetFlowFieldFlowStartMilliseconds), uint16(8),
+		uint16(82), uint16(NetFlowVariableLength)) // interfaceName
+	options := netFlowBytes(
+		uint16(3), uint16(18), uint16(301), uint16(2), uint16(1),
+		uint16(149), uint16(4), // observationDomainId
+		uint16(41), uint16(8)) // exportedMessageTotalCount
+	src := net.ParseIP("2001:db8::1")
+	dataSet := netFlowBytes(
+		uint16(300), uint16(4+16+2+8+4+8+1+4),
+		src, uint16(443), []byte{0, 0, 0, 0, 0, 0, 0x10, 0}, uint32(8192),
+		[]byte{0, 0, 0x01, 0x5d, 0x3e, 0xf7, 0x98, 0x0a}, uint8(4), []byte("eth0"))
+
+	x := &IPFIX{}
+	x.SetTemplateCache(cache, exporter)
+	if err := x.DecodeFromBytes(message(template, options), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if x.ObservationDomainID != 7 || len(x.Templates) != 1 || len(x.OptionTemplates) != 1 {
+		t.Fatalf("Wrong IPFIX layer %+v", x)
+	}
+	if f := x.Templates[0].Fields[3]; f != (NetFlowField{NetFlowFieldOctetDeltaCount, 4, NetFlowReverseEnterpriseNumber}) {
+		t.Errorf("Wrong enterprise field %+v", f)
+	}
+	if o := x.OptionTemplates[0]; o.ID != 301 || o.ScopeFields != 1 || len(o.Fields) != 2 {
+		t.Errorf("Wrong options template %+v", o)
+	}
+
+	if err := x.DecodeFromBytes(message(dataSet), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if len(x.Templates) != 0 || len(x.DataSets) != 1 || len(x.DataSets[0].Records) != 1 {
+		t.Fatalf("Wrong data sets %+v", x.DataSets)
+	}
+	r := x.DataSets[0].Records[0]
+	start := time.Unix(1500000000, 10*int64(time.Millisecond))
+	if !r.SrcAddr.Equal(src) || r.SrcPort != 443 || r.Octets != 4096 || r.ReverseOctets != 8192 || !r.FlowStart.Equal(start) {
+		t.Errorf("Wrong record %+v", r)
+	}
+	if v := r.Fields[5]; string(v.Value) != "eth0" {
+		t.Errorf("Wrong variable length field %+v", v)
+	}
+
+	// Withdraw the template.
+	if err := x.DecodeFromBytes(message(netFlowBytes(uint16(2), uint16(8), uint16(300), uint16(0)), dataSet), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if x.DataSets[0].Records != nil {
+		t.Error("Used withdrawn template")
+	}
+	if cache.Template(exporter, 10, 7, 300) != nil || cache.Template(exporter, 10, 7, 301) == nil {
+		t.Error("Wrong cached templates")
+	}
+
+	// Withdraw the options template, in a set holding nothing else.
+	if err := x.DecodeFromBytes(message(netFlowBytes(uint16(3), uint16(8), uint16(301), uint16(0))), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if cache.Template(exporter, 10, 7, 301) != nil {
+		t.Error("Options template not withdrawn")
+	}
+
+	// IPFIX is recognized on its port and on NetFlow ports.
+	for _, port := range []UDPPort{4739, 2055} {
+		p := netFlowUDPPacket(t, net.IP{192, 168, 0, 11}, port, message(template, dataSet))
+		if x, ok := p.Layer(LayerTypeIPFIX).(*IPFIX); !ok || len(x.DataSets[0].Records) != 1 {
+			t.Errorf("Port %d: wrong IPFIX layer in %v", port, p)
+		}
+	}
+}
+
+func TestNetFlowTemplateCache(t *testing.T) {
+	cache := NewNetFlowTemplateCache(2)
+	exporter := NewIPEndpoint(net.IP{192, 168, 0, 12})
+	for _, id := range []uint16{256, 257, 256, 258} {
+		cache.AddTemplate(exporter, 9, 0, &NetFlowTemplate{ID: id})
+	}
+	// 257 was added the least recently, 256 having been sent again.
+	for id, want := range map[uint16]bool{256: true, 257: false, 258: true} {
+		if got := cache.Template(exporter, 9, 0, id) != nil; got != want {
+			t.Errorf("template %d: cached %v, want %v", id, got, want)
+		}
+	}
+	cache.RemoveTemplate(exporter, 9, 0, 256)
+	cache.AddTemplate(exporter, 9, 0, &NetFlowTemplate{ID: 259})
+	if cache.Template(exporter, 9, 0, 258) == nil || cache.Template(exporter, 9, 0, 259) == nil {
+		t.Error("template dropped from a cache which isn't full")
+	}
+}
+
+func TestNetFlowSerialize(t *testing.T) {
+	template := NetFlowTemplate{ID: 256, Fields: []NetFlowField{
+		{Type: NetFlowFieldSourceIPv4Address, Length: 4},
+		{Type: NetFlowFieldPacketDeltaCount, Length: 8},
+		{Type: 82, Length: NetFlowVariableLength},
+	}}
+	options := NetFlowTemplate{ID: 257, ScopeFields: 1, Fields: []NetFlowField{
+		{Type: 144, Length: 4}, // exportingProcessId
+		{Type: 41, Length: 8},  // exportedMessageTotalCount
+	}}
+	record := func(iface string) NetFlowRecord {
+		return NetFlowRecord{Fields: []NetFlowFieldValue{
+			{template.Fields[0], []byte{10, 0, 0, 1}},
+			{template.Fields[1], []byte{0, 0, 0, 0, 0, 0, 0, 42}},
+			{template.Fields[2], []byte(iface)},
+		}}
+	}
+	long := string(make([]byte, 300))
+	sets := NetFlowSets{
+		Templates:       []NetFlowTemplate{template},
+		OptionTemplates: []NetFlowTemplate{options},
+		DataSets:        []NetFlowDataSet{{TemplateID: 256, Records: []NetFlowRecord{record("eth0"), record(long)}}},
+	}
+	opts := gopacket.SerializeOptions{FixLengths: true}
+
+	for _, l := range []gopacket.SerializableLayer{
+		&IPFIX{NetFlowSets: sets, SequenceNumber: 5, ObservationDomainID: 1},
+		&NetFlowV9{NetFlowSets: sets, SequenceNumber: 5, SourceID: 1},
+	} {
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, opts, l); err != nil {
+			t.Fatal(err)
+		}
+		var sets *NetFlowSets
+		var decoded gopacket.DecodingLayer
+		switch l.(type) {
+		case *IPFIX:
+			x := &IPFIX{}
+			decoded, sets = x, &x.NetFlowSets
+		case *NetFlowV9:
+			n := &NetFlowV9{}
+			decoded, sets = n, &n.NetFlowSets
+		}
+		if err := decoded.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+			t.Fatalf("%v: %v", l.(gopacket.Layer).LayerType(), err)
+		}
+		if !reflect.DeepEqual(sets.Templates, []NetFlowTemplate{template}) || !reflect.DeepEqual(sets.OptionTemplates, []NetFlowTemplate{options}) {
+			t.Errorf("%v: wrong templates %+v %+v", l.(gopacket.Layer).LayerType(), sets.Templates, sets.OptionTemplates)
+		}
+		if len(sets.DataSets) != 1 || len(sets.DataSets[0].Records) != 2 {
+			t.Fatalf("%v: wrong data sets %+v", l.(gopacket.Layer).LayerType(), sets.DataSets)
+		}
+		if r := sets.DataSets[0].Records[1]; r.Packets != 42 || string(r.Fields[2].Value) != long {
+			t.Errorf("%v: wrong record %+v", l.(gopacket.Layer).LayerType(), r)
+		}
+
+		data, err := MarshalLayerJSON(l.(gopacket.Layer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("Cache")) || strings.Contains(gopacket.LayerString(l.(gopacket.Layer)), "Cache") {
+			t.Errorf("%v: template cache in JSON or string:\n%s", l.(gopacket.Layer).LayerType(), data)
+		}
+		l2, err := UnmarshalLayerJSON(data)
+		if err != nil {
+			t.Fatalf("%v: %v", l.(gopacket.Layer).LayerType(), err)
+		}
+		buf2 := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf2, opts, l2.(gopacket.SerializableLayer)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf2.Bytes(), buf.Bytes()) {
+			t.Errorf("%v: JSON round trip changed the message:\ngot  %x\nwant %x", l.(gopacket.Layer).LayerType(), buf2.Bytes(), buf.Bytes())
+		}
+	}
+}
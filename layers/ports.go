@@ -64,8 +64,16 @@ func (a UDPPort) LayerType() gopacket.LayerType {
 	switch a {
 	case 53:
 		return LayerTypeDNS
+	case 67, 68:
+		return LayerTypeDHCPv4
+	case 546, 547:
+		return LayerTypeDHCPv6
 	case 4789:
 		return LayerTypeVXLAN
+	case 2055, 9995, 9996:
+		return LayerTypeNetFlowV9
+	case 4739:
+		return LayerTypeIPFIX
 	case 6343:
 		return LayerTypeSFlow
 	default:
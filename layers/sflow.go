@@ -5,7 +5,7 @@
 // tree.
 
 /*
-This layer decodes SFlow version 5 datagrams.
+This layer decodes and encodes SFlow version 5 datagrams.
 
 The specification can be found here: http://sflow.org/sflow_version_5.txt
 
@@ -327,6 +327,107 @@ func (s *SFlowDatagram) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback)
 	return nil
 }
 
+// SerializeTo writes the serialized form of this layer into the
+// SerializationBuffer, implementing gopacket.SerializableLayer.  Flow samples
+// are written before counter samples.  With FixLengths, it also sets the
+// version, sample count, and the lengths and counts of the samples and their
+// records.
+func (s *SFlowDatagram) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	for i := len(s.CounterSamples) - 1; i >= 0; i-- {
+		if err := s.CounterSamples[i].SerializeTo(b, opts); err != nil {
+			return err
+		}
+	}
+	for i := len(s.FlowSamples) - 1; i >= 0; i-- {
+		if err := s.FlowSamples[i].SerializeTo(b, opts); err != nil {
+			return err
+		}
+	}
+	addressType, address := sflowIP(s.AgentAddress)
+	bytes, err := b.PrependBytes(24 + len(address))
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		s.DatagramVersion = 5
+		s.SampleCount = uint32(len(s.FlowSamples) + len(s.CounterSamples))
+	}
+	binary.BigEndian.PutUint32(bytes, s.DatagramVersion)
+	binary.BigEndian.PutUint32(bytes[4:], uint32(addressType))
+	n := 8 + copy(bytes[8:], address)
+	binary.BigEndian.PutUint32(bytes[n:], s.SubAgentID)
+	binary.BigEndian.PutUint32(bytes[n+4:], s.SequenceNumber)
+	binary.BigEndian.PutUint32(bytes[n+8:], s.AgentUptime)
+	binary.BigEndian.PutUint32(bytes[n+12:], s.SampleCount)
+	return nil
+}
+
+// sflowIP returns the type and bytes of ip as encoded in SFlow address
+// unions.  A nil ip has the unknown type, and no bytes.
+func sflowIP(ip net.IP) (SFlowIPType, []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return SFlowIPv4, ip4
+	}
+	if len(ip) == net.IPv6len {
+		return SFlowIPv6, ip
+	}
+	return 0, nil
+}
+
+// putSFlowIP writes the address union of ip to bytes, and returns the number
+// of bytes written.
+func putSFlowIP(bytes []byte, ip net.IP) int {
+	addressType, address := sflowIP(ip)
+	binary.BigEndian.PutUint32(bytes, uint32(addressType))
+	return 4 + copy(bytes[4:], address)
+}
+
+// sflowStringLength returns the length of s encoded as an XDR string, with its
+// length and padding.
+func sflowStringLength(s string) int {
+	return 4 + len(s) + (4-len(s)%4)%4
+}
+
+// putSFlowString writes s as an XDR string to bytes, and returns the number
+// of bytes written.
+func putSFlowString(bytes []byte, s string) int {
+	binary.BigEndian.PutUint32(bytes, uint32(len(s)))
+	n := 4 + copy(bytes[4:], s)
+	for ; n%4 != 0; n++ {
+		bytes[n] = 0
+	}
+	return n
+}
+
+// serializeSFlowRecord serializes the flow or counter record r, which may be
+// stored by value or by pointer.  The lengths of records stored by value are
+// only fixed in the serialized data.
+func serializeSFlowRecord(r SFlowRecord, b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	switch r := r.(type) {
+	case SFlowRawPacketFlowRecord:
+		return r.SerializeTo(b, opts)
+	case SFlowExtendedSwitchFlowRecord:
+		return r.SerializeTo(b, opts)
+	case SFlowExtendedRouterFlowRecord:
+		return r.SerializeTo(b, opts)
+	case SFlowExtendedGatewayFlowRecord:
+		return r.SerializeTo(b, opts)
+	case SFlowExtendedURLRecord:
+		return r.SerializeTo(b, opts)
+	case SFlowExtendedUserFlow:
+		return r.SerializeTo(b, opts)
+	case SFlowGenericInterfaceCounters:
+		return r.SerializeTo(b, opts)
+	case SFlowEthernetCounters:
+		return r.SerializeTo(b, opts)
+	case interface {
+		SerializeTo(gopacket.SerializeBuffer, gopacket.SerializeOptions) error
+	}:
+		return r.SerializeTo(b, opts)
+	}
+	return fmt.Errorf("Unsupported SFlow record %T", r)
+}
+
 // SFlowFlowSample represents a sampled packet and contains
 // one or more records describing the packet
 type SFlowFlowSample struct {
@@ -502,6 +603,38 @@ func decodeFlowSample(data *[]byte) (SFlowFlowSample, error) {
 	return s, nil
 }
 
+// SerializeTo writes the serialized form of this sample and its records into
+// the SerializationBuffer.  With FixLengths, it also sets the format, length
+// and record count of the sample, and the lengths of its records.
+func (fs *SFlowFlowSample) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	start := len(b.Bytes())
+	for i := len(fs.Records) - 1; i >= 0; i-- {
+		if err := serializeSFlowRecord(fs.Records[i], b, opts); err != nil {
+			return err
+		}
+	}
+	bytes, err := b.PrependBytes(40)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		fs.Format = SFlowTypeFlowSample
+		fs.SampleLength = uint32(len(b.Bytes()) - start - 8)
+		fs.RecordCount = uint32(len(fs.Records))
+	}
+	binary.BigEndian.PutUint32(bytes, uint32(fs.EnterpriseID)<<12|uint32(fs.Format))
+	binary.BigEndian.PutUint32(bytes[4:], fs.SampleLength)
+	binary.BigEndian.PutUint32(bytes[8:], fs.SequenceNumber)
+	binary.BigEndian.PutUint32(bytes[12:], uint32(fs.SourceIDClass)<<30|uint32(fs.SourceIDIndex))
+	binary.BigEndian.PutUint32(bytes[16:], fs.SamplingRate)
+	binary.BigEndian.PutUint32(bytes[20:], fs.SamplePool)
+	binary.BigEndian.PutUint32(bytes[24:], fs.Dropped)
+	binary.BigEndian.PutUint32(bytes[28:], fs.InputInterface)
+	binary.BigEndian.PutUint32(bytes[32:], fs.OutputInterface)
+	binary.BigEndian.PutUint32(bytes[36:], fs.RecordCount)
+	return nil
+}
+
 // Counter samples report information about various counter
 // objects. Typically these are items like IfInOctets, or
 // CPU / Memory stats, etc. SFlow will report these at regular
@@ -633,6 +766,33 @@ func decodeCounterSample(data *[]byte) (SFlowCounterSample, error) {
 	return s, nil
 }
 
+// SerializeTo writes the serialized form of this sample and its records into
+// the SerializationBuffer.  With FixLengths, it also sets the format, length
+// and record count of the sample, and the lengths of its records.
+func (cs *SFlowCounterSample) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	start := len(b.Bytes())
+	for i := len(cs.Records) - 1; i >= 0; i-- {
+		if err := serializeSFlowRecord(cs.Records[i], b, opts); err != nil {
+			return err
+		}
+	}
+	bytes, err := b.PrependBytes(20)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		cs.Format = SFlowTypeCounterSample
+		cs.SampleLength = uint32(len(b.Bytes()) - start - 8)
+		cs.RecordCount = uint32(len(cs.Records))
+	}
+	binary.BigEndian.PutUint32(bytes, uint32(cs.EnterpriseID)<<12|uint32(cs.Format))
+	binary.BigEndian.PutUint32(bytes[4:], cs.SampleLength)
+	binary.BigEndian.PutUint32(bytes[8:], cs.SequenceNumber)
+	binary.BigEndian.PutUint32(bytes[12:], uint32(cs.SourceIDClass)<<30|uint32(cs.SourceIDIndex))
+	binary.BigEndian.PutUint32(bytes[16:], cs.RecordCount)
+	return nil
+}
+
 // SFlowBaseFlowRecord holds the fields common to all records
 // of type SFlowFlowRecordType
 type SFlowBaseFlowRecord struct {
@@ -645,6 +805,12 @@ func (bfr SFlowBaseFlowRecord) GetType() SFlowFlowRecordType {
 	return bfr.Format
 }
 
+// serializeHeader writes the data format and length of the record to bytes.
+func (bfr SFlowBaseFlowRecord) serializeHeader(bytes []byte) {
+	binary.BigEndian.PutUint32(bytes, uint32(bfr.EnterpriseID)<<12|uint32(bfr.Format))
+	binary.BigEndian.PutUint32(bytes[4:], bfr.FlowDataLength)
+}
+
 // SFlowFlowRecordType denotes what kind of Flow Record is
 // represented. See RFC 3176
 type SFlowFlowRecordType uint32
@@ -818,6 +984,39 @@ func decodeRawPacketFlowRecord(data *[]byte) (SFlowRawPacketFlowRecord, error) {
 	return rec, nil
 }
 
+// SerializeTo writes the serialized form of this record into the
+// SerializationBuffer.  The header written is the data of Header, truncated
+// to HeaderLength if it is shorter.  With FixLengths, it also sets the format
+// and length of the record, and HeaderLength.
+func (rec *SFlowRawPacketFlowRecord) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	var header []byte
+	if rec.Header != nil {
+		header = rec.Header.Data()
+	}
+	if rec.HeaderLength != 0 && int(rec.HeaderLength) < len(header) {
+		header = header[:rec.HeaderLength]
+	}
+	length := 16 + len(header) + (4-len(header)%4)%4
+	bytes, err := b.PrependBytes(8 + length)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		rec.Format = SFlowTypeRawPacketFlow
+		rec.FlowDataLength = uint32(length)
+		rec.HeaderLength = uint32(len(header))
+	}
+	rec.serializeHeader(bytes)
+	binary.BigEndian.PutUint32(bytes[8:], uint32(rec.HeaderProtocol))
+	binary.BigEndian.PutUint32(bytes[12:], rec.FrameLength)
+	binary.BigEndian.PutUint32(bytes[16:], rec.PayloadRemoved)
+	binary.BigEndian.PutUint32(bytes[20:], rec.HeaderLength)
+	for n := 24 + copy(bytes[24:], header); n < len(bytes); n++ {
+		bytes[n] = 0
+	}
+	return nil
+}
+
 // SFlowExtendedSwitchFlowRecord give additional information
 // about the sampled packet if it's available. It's mainly
 // useful for getting at the incoming and outgoing VLANs
@@ -861,6 +1060,26 @@ func decodeExtendedSwitchFlowRecord(data *[]byte) (SFlowExtendedSwitchFlowRecord
 	return es, nil
 }
 
+// SerializeTo writes the serialized form of this record into the
+// SerializationBuffer.  With FixLengths, it also sets the format and length
+// of the record.
+func (es *SFlowExtendedSwitchFlowRecord) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	bytes, err := b.PrependBytes(24)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		es.Format = SFlowTypeExtendedSwitchFlow
+		es.FlowDataLength = 16
+	}
+	es.serializeHeader(bytes)
+	binary.BigEndian.PutUint32(bytes[8:], es.IncomingVLAN)
+	binary.BigEndian.PutUint32(bytes[12:], es.IncomingVLANPriority)
+	binary.BigEndian.PutUint32(bytes[16:], es.OutgoingVLAN)
+	binary.BigEndian.PutUint32(bytes[20:], es.OutgoingVLANPriority)
+	return nil
+}
+
 // SFlowExtendedRouterFlowRecord gives additional information
 // about the layer 3 routing information used to forward
 // the packet
@@ -901,6 +1120,27 @@ func decodeExtendedRouterFlowRecord(data *[]byte) (SFlowExtendedRouterFlowRecord
 	return er, nil
 }
 
+// SerializeTo writes the serialized form of this record into the
+// SerializationBuffer.  With FixLengths, it also sets the format and length
+// of the record.
+func (er *SFlowExtendedRouterFlowRecord) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	_, nextHop := sflowIP(er.NextHop)
+	length := 4 + len(nextHop) + 8
+	bytes, err := b.PrependBytes(8 + length)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		er.Format = SFlowTypeExtendedRouterFlow
+		er.FlowDataLength = uint32(length)
+	}
+	er.serializeHeader(bytes)
+	n := 8 + putSFlowIP(bytes[8:], er.NextHop)
+	binary.BigEndian.PutUint32(bytes[n:], er.NextHopSourceMask)
+	binary.BigEndian.PutUint32(bytes[n+4:], er.NextHopDestinationMask)
+	return nil
+}
+
 // SFlowExtendedGatewayFlowRecord describes information treasured by
 // nework engineers everywhere: AS path information listing which
 // BGP peer sent the packet, and various other BGP related info.
@@ -1045,6 +1285,53 @@ func decodeExtendedGatewayFlowRecord(data *[]byte) (SFlowExtendedGatewayFlowReco
 	return eg, nil
 }
 
+// SerializeTo writes the serialized form of this record into the
+// SerializationBuffer.  With FixLengths, it also sets the format, length and
+// AS path count of the record, and the counts of its AS paths.
+func (eg *SFlowExtendedGatewayFlowRecord) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	_, nextHop := sflowIP(eg.NextHop)
+	length := 4 + len(nextHop) + 16 + 4 + 4*len(eg.Communities) + 4
+	for _, path := range eg.ASPath {
+		length += 8 + 4*len(path.Members)
+	}
+	bytes, err := b.PrependBytes(8 + length)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		eg.Format = SFlowTypeExtendedGatewayFlow
+		eg.FlowDataLength = uint32(length)
+		eg.ASPathCount = uint32(len(eg.ASPath))
+		for i := range eg.ASPath {
+			eg.ASPath[i].Count = uint32(len(eg.ASPath[i].Members))
+		}
+	}
+	eg.serializeHeader(bytes)
+	n := 8 + putSFlowIP(bytes[8:], eg.NextHop)
+	binary.BigEndian.PutUint32(bytes[n:], eg.AS)
+	binary.BigEndian.PutUint32(bytes[n+4:], eg.SourceAS)
+	binary.BigEndian.PutUint32(bytes[n+8:], eg.PeerAS)
+	binary.BigEndian.PutUint32(bytes[n+12:], eg.ASPathCount)
+	n += 16
+	for _, path := range eg.ASPath {
+		binary.BigEndian.PutUint32(bytes[n:], uint32(path.Type))
+		binary.BigEndian.PutUint32(bytes[n+4:], path.Count)
+		n += 8
+		for _, member := range path.Members {
+			binary.BigEndian.PutUint32(bytes[n:], member)
+			n += 4
+		}
+	}
+	binary.BigEndian.PutUint32(bytes[n:], uint32(len(eg.Communities)))
+	n += 4
+	for _, community := range eg.Communities {
+		binary.BigEndian.PutUint32(bytes[n:], community)
+		n += 4
+	}
+	binary.BigEndian.PutUint32(bytes[n:], eg.LocalPref)
+	return nil
+}
+
 // **************************************************
 //  Extended URL Flow Record
 // **************************************************
@@ -1112,6 +1399,26 @@ func decodeExtendedURLRecord(data *[]byte) (SFlowExtendedURLRecord, error) {
 	return eur, nil
 }
 
+// SerializeTo writes the serialized form of this record into the
+// SerializationBuffer.  With FixLengths, it also sets the format and length
+// of the record.
+func (eur *SFlowExtendedURLRecord) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	length := 4 + sflowStringLength(eur.URL) + sflowStringLength(eur.Host)
+	bytes, err := b.PrependBytes(8 + length)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		eur.Format = SFlowTypeExtendedUrlFlow
+		eur.FlowDataLength = uint32(length)
+	}
+	eur.serializeHeader(bytes)
+	binary.BigEndian.PutUint32(bytes[8:], uint32(eur.Direction))
+	n := 12 + putSFlowString(bytes[12:], eur.URL)
+	putSFlowString(bytes[n:], eur.Host)
+	return nil
+}
+
 // **************************************************
 //  Extended User Flow Record
 // **************************************************
@@ -1429,6 +1736,27 @@ func decodeExtendedUserFlow(data *[]byte) (SFlowExtendedUserFlow, error) {
 	return eu, nil
 }
 
+// SerializeTo writes the serialized form of this record into the
+// SerializationBuffer.  With FixLengths, it also sets the format and length
+// of the record.
+func (eu *SFlowExtendedUserFlow) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	length := 8 + sflowStringLength(eu.SourceUserID) + sflowStringLength(eu.DestinationUserID)
+	bytes, err := b.PrependBytes(8 + length)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		eu.Format = SFlowTypeExtendedUserFlow
+		eu.FlowDataLength = uint32(length)
+	}
+	eu.serializeHeader(bytes)
+	binary.BigEndian.PutUint32(bytes[8:], uint32(eu.SourceCharSet))
+	n := 12 + putSFlowString(bytes[12:], eu.SourceUserID)
+	binary.BigEndian.PutUint32(bytes[n:], uint32(eu.DestinationCharSet))
+	putSFlowString(bytes[n+4:], eu.DestinationUserID)
+	return nil
+}
+
 // **************************************************
 //  Counter Record
 // **************************************************
@@ -1469,6 +1797,12 @@ func (bcr SFlowBaseCounterRecord) GetType() SFlowCounterRecordType {
 	panic(unrecognized)
 }
 
+// serializeHeader writes the data format and length of the record to bytes.
+func (bcr SFlowBaseCounterRecord) serializeHeader(bytes []byte) {
+	binary.BigEndian.PutUint32(bytes, uint32(bcr.EnterpriseID)<<12|uint32(bcr.Format))
+	binary.BigEndian.PutUint32(bytes[4:], bcr.FlowDataLength)
+}
+
 // **************************************************
 //  Counter Record
 // **************************************************
@@ -1572,6 +1906,41 @@ func decodeGenericInterfaceCounters(data *[]byte) (SFlowGenericInterfaceCounters
 	return gic, nil
 }
 
+// SerializeTo writes the serialized form of this record into the
+// SerializationBuffer.  With FixLengths, it also sets the format and length
+// of the record.
+func (gic *SFlowGenericInterfaceCounters) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	bytes, err := b.PrependBytes(96)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		gic.Format = SFlowTypeGenericInterfaceCounters
+		gic.FlowDataLength = 88
+	}
+	gic.serializeHeader(bytes)
+	binary.BigEndian.PutUint32(bytes[8:], gic.IfIndex)
+	binary.BigEndian.PutUint32(bytes[12:], gic.IfType)
+	binary.BigEndian.PutUint64(bytes[16:], gic.IfSpeed)
+	binary.BigEndian.PutUint32(bytes[24:], gic.IfDirection)
+	binary.BigEndian.PutUint32(bytes[28:], gic.IfStatus)
+	binary.BigEndian.PutUint64(bytes[32:], gic.IfInOctets)
+	binary.BigEndian.PutUint32(bytes[40:], gic.IfInUcastPkts)
+	binary.BigEndian.PutUint32(bytes[44:], gic.IfInMulticastPkts)
+	binary.BigEndian.PutUint32(bytes[48:], gic.IfInBroadcastPkts)
+	binary.BigEndian.PutUint32(bytes[52:], gic.IfInDiscards)
+	binary.BigEndian.PutUint32(bytes[56:], gic.IfInErrors)
+	binary.BigEndian.PutUint32(bytes[60:], gic.IfInUnknownProtos)
+	binary.BigEndian.PutUint64(bytes[64:], gic.IfOutOctets)
+	binary.BigEndian.PutUint32(bytes[72:], gic.IfOutUcastPkts)
+	binary.BigEndian.PutUint32(bytes[76:], gic.IfOutMulticastPkts)
+	binary.BigEndian.PutUint32(bytes[80:], gic.IfOutBroadcastPkts)
+	binary.BigEndian.PutUint32(bytes[84:], gic.IfOutDiscards)
+	binary.BigEndian.PutUint32(bytes[88:], gic.IfOutErrors)
+	binary.BigEndian.PutUint32(bytes[92:], gic.IfPromiscuousMode)
+	return nil
+}
+
 // **************************************************
 //  Counter Record
 // **************************************************
@@ -1625,3 +1994,28 @@ func decodeEthernetCounters(data *[]byte) (SFlowEthernetCounters, error) {
 	*data, ec.SymbolErrors = (*data)[4:], binary.BigEndian.Uint32((*data)[:4])
 	return ec, nil
 }
+
+// SerializeTo writes the serialized form of this record into the
+// SerializationBuffer.  With FixLengths, it also sets the format and length
+// of the record.
+func (ec *SFlowEthernetCounters) SerializeTo(b gopacket.SerializeBuffer, opts gopacket.SerializeOptions) error {
+	bytes, err := b.PrependBytes(60)
+	if err != nil {
+		return err
+	}
+	if opts.FixLengths {
+		ec.Format = SFlowTypeEthernetInterfaceCounters
+		ec.FlowDataLength = 52
+	}
+	ec.serializeHeader(bytes)
+	for i, v := range []uint32{
+		ec.AlignmentErrors, ec.FCSErrors, ec.SingleCollisionFrames,
+		ec.MultipleCollisionFrames, ec.SQETestErrors, ec.DeferredTransmissions,
+		ec.LateCollisions, ec.ExcessiveCollisions, ec.InternalMacTransmitErrors,
+		ec.CarrierSenseErrors, ec.FrameTooLongs, ec.InternalMacReceiveErrors,
+		ec.SymbolErrors,
+	} {
+		binary.BigEndian.PutUint32(bytes[8+4*i:], v)
+	}
+	return nil
+}
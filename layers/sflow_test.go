@@ -6,7 +6,9 @@
 package layers
 
 import (
+	"bytes"
 	"github.com/google/gopacket"
+	"net"
 	"reflect"
 	"testing"
 )
@@ -793,6 +795,125 @@ func TestPacketPacket0(t *testing.T) {
 	}
 }
 
+// Serializing the test packets doesn't give back their bytes, since flow
+// samples are written before counter samples, and padding is zeroed, but
+// serializing them again should, with the same lengths.
+func TestSFlowSerializeRoundTrip(t *testing.T) {
+	for i, packet := range [][]byte{SFlowTestPacket1, SFlowTestPacket2} {
+		data := packet[ /*eth*/ 14+ /*ipv4*/ 20+ /*udp*/ 8:]
+		for j, opts := range []gopacket.SerializeOptions{{}, {FixLengths: true}, {}} {
+			var sflow SFlowDatagram
+			if err := sflow.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+				t.Fatalf("packet %d, pass %d: %v", i, j, err)
+			}
+			buf := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buf, opts, &sflow); err != nil {
+				t.Fatalf("packet %d, pass %d: %v", i, j, err)
+			}
+			if len(buf.Bytes()) != len(data) || (j > 0 && !bytes.Equal(buf.Bytes(), data)) {
+				t.Errorf("packet %d, pass %d: serialized as\n%v\nwant\n%v", i, j, buf.Bytes(), data)
+			}
+			data = buf.Bytes()
+		}
+	}
+}
+
+func TestSFlowSerialize(t *testing.T) {
+	header := []byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x08, 0x06,
+		0x00, 0x01, 0x08, 0x00, 0x06, 0x04, 0x00, 0x01,
+	}
+	records := []SFlowRecord{
+		&SFlowExtendedSwitchFlowRecord{IncomingVLAN: 10, IncomingVLANPriority: 1, OutgoingVLAN: 20, OutgoingVLANPriority: 2},
+		SFlowExtendedRouterFlowRecord{NextHop: net.ParseIP("2001:db8::1"), NextHopSourceMask: 64, NextHopDestinationMask: 48},
+		&SFlowExtendedGatewayFlowRecord{
+			NextHop:     net.IP{192, 168, 0, 1},
+			AS:          65000,
+			SourceAS:    65001,
+			PeerAS:      65002,
+			ASPath:      []SFlowASDestination{{Type: SFlowASSequence, Members: []uint32{65002, 65003}}, {Type: SFlowASSet, Members: []uint32{65004}}},
+			Communities: []uint32{1, 2, 3},
+			LocalPref:   100,
+		},
+		&SFlowExtendedURLRecord{Direction: SFlowURLdst, URL: "/index.html", Host: "example.com"},
+		&SFlowExtendedUserFlow{SourceCharSet: SFlowCSUTF8, SourceUserID: "alice", DestinationCharSet: SFlowCSUTF8, DestinationUserID: "bob"},
+	}
+	sflow := &SFlowDatagram{
+		AgentAddress:   net.IP{10, 0, 0, 1},
+		SubAgentID:     1,
+		SequenceNumber: 2,
+		AgentUptime:    3000,
+		FlowSamples: []SFlowFlowSample{{
+			SequenceNumber:  4,
+			SourceIDIndex:   5,
+			SamplingRate:    100,
+			SamplePool:      1000,
+			InputInterface:  5,
+			OutputInterface: 6,
+			Records: append([]SFlowRecord{&SFlowRawPacketFlowRecord{
+				HeaderProtocol: SFlowProtoEthernet,
+				FrameLength:    64,
+				Header:         gopacket.NewPacket(header, LayerTypeEthernet, gopacket.Default),
+			}}, records...),
+		}},
+		CounterSamples: []SFlowCounterSample{{
+			SequenceNumber: 7,
+			SourceIDIndex:  5,
+			Records: []SFlowRecord{
+				&SFlowGenericInterfaceCounters{IfIndex: 5, IfType: 6, IfSpeed: 1e9, IfDirection: 1, IfStatus: 3, IfInOctets: 1 << 40, IfInUcastPkts: 8, IfOutOctets: 9, IfPromiscuousMode: 1},
+				SFlowEthernetCounters{FCSErrors: 10, SymbolErrors: 11},
+			},
+		}},
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, sflow); err != nil {
+		t.Fatal(err)
+	}
+	var got SFlowDatagram
+	if err := got.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	if got.DatagramVersion != 5 || got.SampleCount != 2 || !got.AgentAddress.Equal(sflow.AgentAddress) || got.AgentUptime != 3000 {
+		t.Errorf("got datagram version %d, %d samples, agent %v, uptime %d", got.DatagramVersion, got.SampleCount, got.AgentAddress, got.AgentUptime)
+	}
+	if len(got.FlowSamples) != 1 || len(got.CounterSamples) != 1 {
+		t.Fatalf("got %d flow samples, %d counter samples, want 1, 1", len(got.FlowSamples), len(got.CounterSamples))
+	}
+
+	fs := got.FlowSamples[0]
+	if fs.SampleLength != sflow.FlowSamples[0].SampleLength || fs.RecordCount != 6 || fs.SamplingRate != 100 || fs.InputInterface != 5 {
+		t.Errorf("got flow sample %+v", fs)
+	}
+	raw, ok := fs.Records[0].(SFlowRawPacketFlowRecord)
+	if !ok {
+		t.Fatalf("got record %T, want SFlowRawPacketFlowRecord", fs.Records[0])
+	}
+	if raw.HeaderLength != uint32(len(header)) || raw.FrameLength != 64 || !bytes.Equal(raw.Header.Data()[:raw.HeaderLength], header) {
+		t.Errorf("got raw packet record %+v", raw)
+	}
+	// The lengths of the records are fixed in place when stored by pointer.
+	router := records[1].(SFlowExtendedRouterFlowRecord)
+	router.Format, router.FlowDataLength = SFlowTypeExtendedRouterFlow, 28
+	records[1] = &router
+	for i, want := range records {
+		if got := fs.Records[i+1]; !reflect.DeepEqual(reflect.ValueOf(want).Elem().Interface(), got) {
+			t.Errorf("record %d: got %+v, want %+v", i, got, want)
+		}
+	}
+
+	cs := got.CounterSamples[0]
+	if cs.SampleLength != 12+96+60 || cs.RecordCount != 2 || cs.SequenceNumber != 7 || cs.SourceIDIndex != 5 {
+		t.Errorf("got counter sample %+v", cs)
+	}
+	ethernet := SFlowEthernetCounters{FCSErrors: 10, SymbolErrors: 11}
+	ethernet.Format, ethernet.FlowDataLength = SFlowTypeEthernetInterfaceCounters, 52
+	for i, want := range []SFlowRecord{*sflow.CounterSamples[0].Records[0].(*SFlowGenericInterfaceCounters), ethernet} {
+		if !reflect.DeepEqual(cs.Records[i], want) {
+			t.Errorf("counter record %d: got %+v, want %+v", i, cs.Records[i], want)
+		}
+	}
+}
+
 func BenchmarkDecodeSFlowPacket1(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		gopacket.NewPacket(SFlowTestPacket1, LinkTypeEthernet, gopacket.NoCopy)
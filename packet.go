@@ -745,7 +745,11 @@ type PacketSource struct {
 	// of packet data.  This can/should be changed by the user to reflect the
 	// way packets should be decoded.
 	DecodeOptions
-	c chan Packet
+	// Defragmenter, if set, is handed every decoded packet.  Fragments are
+	// absorbed by it, and each reassembled datagram is returned by
+	// NextPacket in place of its last fragment.
+	Defragmenter Defragmenter
+	c            chan Packet
 }
 
 // NewPacketSource creates a packet data source.
@@ -758,15 +762,111 @@ func NewPacketSource(source PacketDataSource, decoder Decoder) *PacketSource {
 
 // NextPacket returns the next decoded packet from the PacketSource.  On error,
 // it returns a nil packet and a non-nil error.
+//
+// If a Defragmenter is set, NextPacket keeps reading packet data until it
+// gets a packet which is not a fragment, or which completes a datagram.
 func (p *PacketSource) NextPacket() (Packet, error) {
-	data, ci, err := p.source.ReadPacketData()
+	for {
+		data, ci, err := p.source.ReadPacketData()
+		if err != nil {
+			return nil, err
+		}
+		packet := NewPacket(data, p.decoder, p.DecodeOptions)
+		m := packet.Metadata()
+		m.CaptureInfo = ci
+		m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+		if p.Defragmenter == nil {
+			return packet, nil
+		}
+		if packet, err = p.Defragmenter.DefragPacket(packet, p.DecodeOptions); packet != nil || err != nil {
+			return packet, err
+		}
+	}
+}
+
+// Defragmenter reassembles fragmented datagrams out of decoded packets.
+// ip4defrag.IPv4Defragmenter and ip6defrag.IPv6Defragmenter implement it.
+type Defragmenter interface {
+	// DefragPacket returns p itself if it isn't a fragment, and nil if p is
+	// a fragment of a datagram which is not complete yet.  Once the last
+	// fragment of a datagram is given, DefragPacket returns a new packet
+	// holding the whole datagram, decoded with opts.
+	DefragPacket(p Packet, opts DecodeOptions) (Packet, error)
+}
+
+// Defragmenters chains several Defragmenters, typically one per network
+// protocol, handing the packet returned by each to the next one.
+type Defragmenters []Defragmenter
+
+// DefragPacket implements Defragmenter.
+func (ds Defragmenters) DefragPacket(p Packet, opts DecodeOptions) (Packet, error) {
+	for _, d := range ds {
+		var err error
+		if p, err = d.DefragPacket(p, opts); p == nil || err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// RebuildPacket decodes a new packet made of the layers of p preceding l,
+// followed by data in place of l and the layers it encloses.  It is meant
+// for Defragmenters, to wrap a reassembled datagram in the link and tunnel
+// layers of its fragments.
+//
+// The preceding layers are serialized again, fixing their lengths and
+// checksums to enclose data, which modifies them in p.  The contents of
+// layers which are not SerializableLayers are copied as is.  The new packet
+// carries the metadata of p, with lengths fixed.
+func RebuildPacket(p Packet, l Layer, data []byte, opts DecodeOptions) (Packet, error) {
+	ls := p.Layers()
+	i := 0
+	for i < len(ls) && ls[i] != l {
+		i++
+	}
+	if i == len(ls) {
+		return nil, fmt.Errorf("layer %v not in packet", l.LayerType())
+	}
+	buf := NewSerializeBuffer()
+	bytes, err := buf.PrependBytes(len(data))
 	if err != nil {
 		return nil, err
 	}
-	packet := NewPacket(data, p.decoder, p.DecodeOptions)
+	copy(bytes, data)
+	sopts := SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	for j := i - 1; j >= 0; j-- {
+		if c, ok := ls[j].(interface {
+			SetNetworkLayerForChecksum(NetworkLayer) error
+		}); ok {
+			for k := j - 1; k >= 0; k-- {
+				if n, ok := ls[k].(NetworkLayer); ok {
+					if err := c.SetNetworkLayerForChecksum(n); err != nil {
+						return nil, err
+					}
+					break
+				}
+			}
+		}
+		if s, ok := ls[j].(SerializableLayer); ok {
+			if err := s.SerializeTo(buf, sopts); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		contents := ls[j].LayerContents()
+		bytes, err := buf.PrependBytes(len(contents))
+		if err != nil {
+			return nil, err
+		}
+		copy(bytes, contents)
+	}
+	data = buf.Bytes()
+	opts.NoCopy = true // data is not shared with anyone
+	packet := NewPacket(data, ls[0].LayerType(), opts)
 	m := packet.Metadata()
-	m.CaptureInfo = ci
-	m.Truncated = m.Truncated || ci.CaptureLength < ci.Length
+	m.CaptureInfo = p.Metadata().CaptureInfo
+	m.CaptureLength = len(data)
+	m.Length = len(data)
 	return packet, nil
 }
 
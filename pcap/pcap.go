@@ -106,6 +106,7 @@ import (
 	"unsafe"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/bpf"
 	"github.com/google/gopacket/layers"
 )
 
@@ -176,13 +177,10 @@ type BPF struct {
 	bpf  _Ctype_struct_bpf_program // takes a finalizer, not overriden by outsiders
 }
 
-// BPFInstruction is a byte encoded structure holding a BPF instruction
-type BPFInstruction struct {
-	Code uint16
-	Jt   uint8
-	Jf   uint8
-	K    uint32
-}
+// BPFInstruction is a byte encoded structure holding a BPF instruction.
+// It is the same type as bpf.Instruction, so compiled filters can be run
+// without libpcap by bpf.NewVM.
+type BPFInstruction = bpf.Instruction
 
 // BlockForever, when passed into OpenLive/SetTimeout, causes it to block forever
 // waiting for packets, while still returning incoming packets to userland relatively
@@ -0,0 +1,583 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// NgReaderOptions holds options for reading a pcapng file.
+type NgReaderOptions struct {
+	// WantMixedLinkType enables reading packets from interfaces with a link
+	// type different from the first interface.  If this is false, packets
+	// of such interfaces are skipped (or rejected, see
+	// ErrorOnMismatchingLinkType).
+	WantMixedLinkType bool
+	// ErrorOnMismatchingLinkType makes the reader return an error, instead
+	// of skipping, when it encounters an interface with a link type
+	// different from the first one.  Only used if WantMixedLinkType is
+	// false.
+	ErrorOnMismatchingLinkType bool
+	// SkipUnknownVersion skips sections with an unknown major version
+	// instead of returning an error.
+	SkipUnknownVersion bool
+}
+
+// DefaultNgReaderOptions provides sane defaults for a pcapng reader.
+var DefaultNgReaderOptions = NgReaderOptions{}
+
+// NgReader wraps an underlying io.Reader to read packet data in pcapng
+// format.  See https://github.com/pcapng/pcapng for information on the
+// file format.
+//
+// Section headers, interface descriptions, enhanced, simple and obsolete
+// packet blocks, name resolution and interface statistics blocks are
+// understood; all other blocks are skipped.  The returned CaptureInfo has
+// its InterfaceIndex set to the index of the interface the packet was
+// captured on, which can be used with Interface to look up the link type
+// and other interface properties.
+type NgReader struct {
+	r         io.Reader
+	options   NgReaderOptions
+	byteOrder binary.ByteOrder
+	linkType  layers.LinkType
+
+	sectionInfo NgSectionInfo
+	ifaces      []NgInterface
+	names       []NgResolvedName
+	// skipSection is set while skipping a section with unknown version
+	skipSection bool
+	// reusable buffer
+	buf []byte
+	// last packet options read
+	packetOptions NgPacketOptions
+}
+
+// NewNgReader returns a new NgReader object, for reading packet data
+// from the given reader.  The reader must be open and positioned at the
+// start of a section header block.  Blocks are read up to and including the
+// first interface description block, so that LinkType returns a sensible
+// value.
+//
+//	// Create new reader:
+//	f, _ := os.Open("/tmp/file.pcapng")
+//	defer f.Close()
+//	r, err := NewNgReader(f, DefaultNgReaderOptions)
+//	data, ci, err := r.ReadPacketData()
+func NewNgReader(r io.Reader, options NgReaderOptions) (*NgReader, error) {
+	ret := &NgReader{r: r, options: options}
+	typ, body, err := ret.readBlock()
+	if err != nil {
+		return nil, err
+	}
+	if typ != ngBlockTypeSectionHeader {
+		return nil, errors.New("pcapng file does not start with a section header")
+	}
+	if err := ret.readSectionHeader(body); err != nil {
+		return nil, err
+	}
+	for len(ret.ifaces) == 0 {
+		typ, body, err := ret.readBlock()
+		if err != nil {
+			if err == io.EOF {
+				return nil, errors.New("pcapng file contains no interface")
+			}
+			return nil, err
+		}
+		switch typ {
+		case ngBlockTypeEnhancedPacket, ngBlockTypeSimplePacket, ngBlockTypePacket:
+			return nil, errors.New("pcapng packet block found before any interface description")
+		}
+		if _, _, _, err := ret.handleBlock(typ, body); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// readBlock reads the next block and returns its type and body, without the
+// type, length and trailing length fields.  Section headers determine the
+// byte order of the section, which is why the byte order magic is read
+// before the length is interpreted.
+func (r *NgReader) readBlock() (typ uint32, body []byte, err error) {
+	var hdr [12]byte
+	if _, err = io.ReadFull(r.r, hdr[:8]); err != nil {
+		return
+	}
+	// The section header type is a palindrome, so the byte order does not
+	// matter here.
+	typ = binary.LittleEndian.Uint32(hdr[0:4])
+	headerLen := 8
+	if typ == ngBlockTypeSectionHeader {
+		if _, err = io.ReadFull(r.r, hdr[8:12]); err != nil {
+			return 0, nil, unexpectedEOF(err)
+		}
+		switch ngByteOrderMagic {
+		case binary.LittleEndian.Uint32(hdr[8:12]):
+			r.byteOrder = binary.LittleEndian
+		case binary.BigEndian.Uint32(hdr[8:12]):
+			r.byteOrder = binary.BigEndian
+		default:
+			return 0, nil, fmt.Errorf("unknown pcapng byte order magic %x", hdr[8:12])
+		}
+		headerLen = 12
+	} else if r.byteOrder == nil {
+		return 0, nil, errors.New("pcapng block found before section header")
+	}
+	typ = r.byteOrder.Uint32(hdr[0:4])
+	length := r.byteOrder.Uint32(hdr[4:8])
+	if length < uint32(headerLen)+4 || length%4 != 0 {
+		return 0, nil, fmt.Errorf("invalid pcapng block length %d", length)
+	}
+	if length > ngMaxBlockSize {
+		return 0, nil, fmt.Errorf("pcapng block length %d exceeds maximum of %d", length, ngMaxBlockSize)
+	}
+	// Body includes the byte order magic for section headers, so that
+	// parsing is uniform.
+	bodyLen := int(length) - 12
+	if cap(r.buf) < bodyLen+4 {
+		r.buf = make([]byte, bodyLen+4)
+	}
+	buf := r.buf[:bodyLen+4]
+	copy(buf, hdr[8:headerLen])
+	if _, err = io.ReadFull(r.r, buf[headerLen-8:]); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	if trailer := r.byteOrder.Uint32(buf[bodyLen:]); trailer != length {
+		return 0, nil, fmt.Errorf("pcapng block length mismatch: %d != %d", length, trailer)
+	}
+	return typ, buf[:bodyLen], nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// parseOptions calls fn for every option in data, until the end of
+// options marker or the end of data.
+func (r *NgReader) parseOptions(data []byte, fn func(code uint16, value []byte) error) error {
+	for len(data) >= 4 {
+		code := r.byteOrder.Uint16(data[0:2])
+		length := int(r.byteOrder.Uint16(data[2:4]))
+		if code == ngOptionCodeEndOfOptions {
+			return nil
+		}
+		padded := (length + 3) &^ 3
+		if 4+padded > len(data) {
+			return fmt.Errorf("pcapng option %d of length %d exceeds block", code, length)
+		}
+		if err := fn(code, data[4:4+length]); err != nil {
+			return err
+		}
+		data = data[4+padded:]
+	}
+	return nil
+}
+
+func (r *NgReader) readSectionHeader(body []byte) error {
+	if len(body) < 16 {
+		return errors.New("pcapng section header too short")
+	}
+	major := r.byteOrder.Uint16(body[4:6])
+	if major != ngVersionMajor {
+		if r.options.SkipUnknownVersion {
+			r.skipSection = true
+			return nil
+		}
+		return fmt.Errorf("unknown pcapng major version %d", major)
+	}
+	// minor version 6:8 and section length 8:16 are ignored
+	r.skipSection = false
+	r.sectionInfo = NgSectionInfo{}
+	r.ifaces = r.ifaces[:0]
+	r.names = nil
+	return r.parseOptions(body[16:], func(code uint16, value []byte) error {
+		switch code {
+		case ngOptionCodeComment:
+			r.sectionInfo.Comments = append(r.sectionInfo.Comments, string(value))
+		case ngOptionCodeHardware:
+			r.sectionInfo.Hardware = string(value)
+		case ngOptionCodeOS:
+			r.sectionInfo.OS = string(value)
+		case ngOptionCodeUserApp:
+			r.sectionInfo.Application = string(value)
+		}
+		return nil
+	})
+}
+
+func (r *NgReader) readInterfaceDescriptor(body []byte) error {
+	if len(body) < 8 {
+		return errors.New("pcapng interface description too short")
+	}
+	intf := NgInterface{
+		LinkType:            layers.LinkType(r.byteOrder.Uint16(body[0:2])),
+		SnapLength:          r.byteOrder.Uint32(body[4:8]),
+		TimestampResolution: NgResolutionMicro,
+		FCSLength:           -1,
+	}
+	err := r.parseOptions(body[8:], func(code uint16, value []byte) error {
+		switch code {
+		case ngOptionCodeComment:
+			intf.Comments = append(intf.Comments, string(value))
+		case ngOptionCodeIfName:
+			intf.Name = string(value)
+		case ngOptionCodeIfDesc:
+			intf.Description = string(value)
+		case ngOptionCodeIfOS:
+			intf.OS = string(value)
+		case ngOptionCodeIfFilter:
+			// The first byte is the filter type, 0 means libpcap filter
+			// string.
+			if len(value) > 0 && value[0] == 0 {
+				intf.Filter = string(value[1:])
+			}
+		case ngOptionCodeIfSpeed:
+			if len(value) != 8 {
+				return errors.New("invalid pcapng if_speed option")
+			}
+			intf.Speed = r.byteOrder.Uint64(value)
+		case ngOptionCodeIfTsresol:
+			if len(value) != 1 {
+				return errors.New("invalid pcapng if_tsresol option")
+			}
+			intf.TimestampResolution = NgResolution(value[0])
+		case ngOptionCodeIfFcslen:
+			if len(value) != 1 {
+				return errors.New("invalid pcapng if_fcslen option")
+			}
+			intf.FCSLength = int(value[0])
+		case ngOptionCodeIfTsoffset:
+			if len(value) != 8 {
+				return errors.New("invalid pcapng if_tsoffset option")
+			}
+			intf.TimestampOffset = int64(r.byteOrder.Uint64(value))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if intf.unitsPerSecond, err = intf.TimestampResolution.unitsPerSecond(); err != nil {
+		return err
+	}
+	intf.Statistics = NgInterfaceStatistics{
+		PacketsReceived: -1,
+		PacketsDropped:  -1,
+		PacketsAccepted: -1,
+		OSDropped:       -1,
+		UserDelivered:   -1,
+	}
+	if len(r.ifaces) == 0 {
+		r.linkType = intf.LinkType
+	} else if intf.LinkType != r.linkType && !r.options.WantMixedLinkType && r.options.ErrorOnMismatchingLinkType {
+		return fmt.Errorf("pcapng interface %d has link type %v, expected %v", len(r.ifaces), intf.LinkType, r.linkType)
+	}
+	r.ifaces = append(r.ifaces, intf)
+	return nil
+}
+
+func (r *NgReader) readInterfaceStatistics(body []byte) error {
+	if len(body) < 12 {
+		return errors.New("pcapng interface statistics too short")
+	}
+	id := int(r.byteOrder.Uint32(body[0:4]))
+	if id >= len(r.ifaces) {
+		return fmt.Errorf("pcapng interface statistics for unknown interface %d", id)
+	}
+	intf := &r.ifaces[id]
+	stats := NgInterfaceStatistics{
+		LastUpdate:      intf.timestamp(r.rawTimestamp(body[4:12])),
+		PacketsReceived: -1,
+		PacketsDropped:  -1,
+		PacketsAccepted: -1,
+		OSDropped:       -1,
+		UserDelivered:   -1,
+	}
+	err := r.parseOptions(body[12:], func(code uint16, value []byte) error {
+		if code == ngOptionCodeComment {
+			stats.Comments = append(stats.Comments, string(value))
+			return nil
+		}
+		if len(value) != 8 {
+			return nil
+		}
+		switch code {
+		case ngOptionCodeIsbStart:
+			stats.StartTime = intf.timestamp(r.rawTimestamp(value))
+		case ngOptionCodeIsbEnd:
+			stats.EndTime = intf.timestamp(r.rawTimestamp(value))
+		case ngOptionCodeIsbIfRecv:
+			stats.PacketsReceived = int64(r.byteOrder.Uint64(value))
+		case ngOptionCodeIsbIfDrop:
+			stats.PacketsDropped = int64(r.byteOrder.Uint64(value))
+		case ngOptionCodeIsbAccept:
+			stats.PacketsAccepted = int64(r.byteOrder.Uint64(value))
+		case ngOptionCodeIsbOSDrop:
+			stats.OSDropped = int64(r.byteOrder.Uint64(value))
+		case ngOptionCodeIsbUsrDeliv:
+			stats.UserDelivered = int64(r.byteOrder.Uint64(value))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	intf.Statistics = stats
+	return nil
+}
+
+func (r *NgReader) readNameResolution(body []byte) error {
+	for len(body) >= 4 {
+		typ := r.byteOrder.Uint16(body[0:2])
+		length := int(r.byteOrder.Uint16(body[2:4]))
+		padded := (length + 3) &^ 3
+		if 4+padded > len(body) {
+			return errors.New("pcapng name resolution record exceeds block")
+		}
+		value := body[4 : 4+length]
+		body = body[4+padded:]
+		var addrLen int
+		switch typ {
+		case ngNameRecordEnd:
+			// The remainder are options, which we don't expose.
+			return nil
+		case ngNameRecordIPv4:
+			addrLen = net.IPv4len
+		case ngNameRecordIPv6:
+			addrLen = net.IPv6len
+		default:
+			continue
+		}
+		if len(value) < addrLen {
+			return errors.New("pcapng name resolution record too short")
+		}
+		r.names = append(r.names, NgResolvedName{
+			Addr:  net.IP(append([]byte(nil), value[:addrLen]...)),
+			Names: splitNull(value[addrLen:]),
+		})
+	}
+	return nil
+}
+
+// splitNull splits a list of null terminated strings.
+func splitNull(data []byte) (out []string) {
+	start := 0
+	for i, b := range data {
+		if b == 0 {
+			if i > start {
+				out = append(out, string(data[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	if start < len(data) {
+		out = append(out, string(data[start:]))
+	}
+	return
+}
+
+func (r *NgReader) rawTimestamp(data []byte) uint64 {
+	return uint64(r.byteOrder.Uint32(data[0:4]))<<32 | uint64(r.byteOrder.Uint32(data[4:8]))
+}
+
+// readEnhancedPacket decodes an enhanced packet block.  The returned data
+// points into the reader's buffer.
+func (r *NgReader) readEnhancedPacket(body []byte) (data []byte, ci gopacket.CaptureInfo, err error) {
+	if len(body) < 20 {
+		err = errors.New("pcapng enhanced packet block too short")
+		return
+	}
+	id := int(r.byteOrder.Uint32(body[0:4]))
+	if id >= len(r.ifaces) {
+		err = fmt.Errorf("pcapng packet for unknown interface %d", id)
+		return
+	}
+	ci.InterfaceIndex = id
+	ci.Timestamp = r.ifaces[id].timestamp(r.rawTimestamp(body[4:12]))
+	ci.CaptureLength = int(r.byteOrder.Uint32(body[12:16]))
+	ci.Length = int(r.byteOrder.Uint32(body[16:20]))
+	padded := (ci.CaptureLength + 3) &^ 3
+	if 20+padded > len(body) || padded < ci.CaptureLength {
+		err = fmt.Errorf("pcapng capture length %d exceeds block", ci.CaptureLength)
+		return
+	}
+	data = body[20 : 20+ci.CaptureLength]
+	r.packetOptions = NgPacketOptions{}
+	err = r.parseOptions(body[20+padded:], func(code uint16, value []byte) error {
+		switch code {
+		case ngOptionCodeComment:
+			r.packetOptions.Comments = append(r.packetOptions.Comments, string(value))
+		case ngOptionCodeEpbFlags:
+			if len(value) == 4 {
+				r.packetOptions.Flags = r.byteOrder.Uint32(value)
+			}
+		case ngOptionCodeEpbDropCnt:
+			if len(value) == 8 {
+				r.packetOptions.DropCount = r.byteOrder.Uint64(value)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// readSimplePacket decodes a simple packet block, which always belongs to
+// the first interface and carries no timestamp.
+func (r *NgReader) readSimplePacket(body []byte) (data []byte, ci gopacket.CaptureInfo, err error) {
+	if len(body) < 4 {
+		err = errors.New("pcapng simple packet block too short")
+		return
+	}
+	ci.Length = int(r.byteOrder.Uint32(body[0:4]))
+	ci.CaptureLength = ci.Length
+	if snap := int(r.ifaces[0].SnapLength); snap > 0 && ci.CaptureLength > snap {
+		ci.CaptureLength = snap
+	}
+	if ci.CaptureLength > len(body)-4 {
+		ci.CaptureLength = len(body) - 4
+	}
+	r.packetOptions = NgPacketOptions{}
+	return body[4 : 4+ci.CaptureLength], ci, nil
+}
+
+// readObsoletePacket decodes the obsolete packet block still written by
+// some old tools.
+func (r *NgReader) readObsoletePacket(body []byte) (data []byte, ci gopacket.CaptureInfo, err error) {
+	if len(body) < 20 {
+		err = errors.New("pcapng packet block too short")
+		return
+	}
+	id := int(r.byteOrder.Uint16(body[0:2]))
+	if id >= len(r.ifaces) {
+		err = fmt.Errorf("pcapng packet for unknown interface %d", id)
+		return
+	}
+	ci.InterfaceIndex = id
+	ci.Timestamp = r.ifaces[id].timestamp(r.rawTimestamp(body[4:12]))
+	ci.CaptureLength = int(r.byteOrder.Uint32(body[12:16]))
+	ci.Length = int(r.byteOrder.Uint32(body[16:20]))
+	if ci.CaptureLength < 0 || 20+ci.CaptureLength > len(body) {
+		err = fmt.Errorf("pcapng capture length %d exceeds block", ci.CaptureLength)
+		return
+	}
+	r.packetOptions = NgPacketOptions{DropCount: uint64(r.byteOrder.Uint16(body[2:4]))}
+	return body[20 : 20+ci.CaptureLength], ci, nil
+}
+
+// handleBlock processes a single block.  If the block contains a packet,
+// packet is true and data/ci are set.
+func (r *NgReader) handleBlock(typ uint32, body []byte) (packet bool, data []byte, ci gopacket.CaptureInfo, err error) {
+	if typ == ngBlockTypeSectionHeader {
+		err = r.readSectionHeader(body)
+		return
+	}
+	if r.skipSection {
+		return
+	}
+	switch typ {
+	case ngBlockTypeInterfaceDescriptor:
+		err = r.readInterfaceDescriptor(body)
+	case ngBlockTypeInterfaceStatistics:
+		err = r.readInterfaceStatistics(body)
+	case ngBlockTypeNameResolution:
+		err = r.readNameResolution(body)
+	case ngBlockTypeEnhancedPacket:
+		data, ci, err = r.readEnhancedPacket(body)
+		packet = true
+	case ngBlockTypeSimplePacket:
+		if len(r.ifaces) == 0 {
+			err = errors.New("pcapng simple packet block without interface")
+			return
+		}
+		data, ci, err = r.readSimplePacket(body)
+		packet = true
+	case ngBlockTypePacket:
+		data, ci, err = r.readObsoletePacket(body)
+		packet = true
+	}
+	return
+}
+
+// ReadPacketData returns the next packet in the file, skipping over all
+// other blocks.  The returned data is only valid until the next call to
+// ReadPacketData.
+func (r *NgReader) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	for {
+		var typ uint32
+		var body []byte
+		if typ, body, err = r.readBlock(); err != nil {
+			return
+		}
+		var packet bool
+		if packet, data, ci, err = r.handleBlock(typ, body); err != nil || !packet {
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if !r.options.WantMixedLinkType && r.ifaces[ci.InterfaceIndex].LinkType != r.linkType {
+			continue
+		}
+		return
+	}
+}
+
+// ReadPacketDataWithOptions is like ReadPacketData, but additionally
+// returns the options (comments, flags, drop count) attached to the packet.
+func (r *NgReader) ReadPacketDataWithOptions() (data []byte, ci gopacket.CaptureInfo, options NgPacketOptions, err error) {
+	data, ci, err = r.ReadPacketData()
+	options = r.packetOptions
+	return
+}
+
+// LinkType returns the link type of the first interface, as a
+// layers.LinkType.
+func (r *NgReader) LinkType() layers.LinkType {
+	return r.linkType
+}
+
+// NInterfaces returns the number of interfaces seen so far in the current
+// section.
+func (r *NgReader) NInterfaces() int {
+	return len(r.ifaces)
+}
+
+// Interface returns the interface with the given index, as used in
+// CaptureInfo.InterfaceIndex.
+func (r *NgReader) Interface(i int) (NgInterface, error) {
+	if i < 0 || i >= len(r.ifaces) {
+		return NgInterface{}, fmt.Errorf("interface %d does not exist", i)
+	}
+	return r.ifaces[i], nil
+}
+
+// SectionInfo returns information about the current section.
+func (r *NgReader) SectionInfo() NgSectionInfo {
+	return r.sectionInfo
+}
+
+// ResolvedNames returns all name resolution records seen so far in the
+// current section.
+func (r *NgReader) ResolvedNames() []NgResolvedName {
+	return r.names
+}
+
+// Reader formater
+func (r *NgReader) String() string {
+	return fmt.Sprintf("PcapNgFile interfaces: %d linktype: %s", len(r.ifaces), r.linkType)
+}
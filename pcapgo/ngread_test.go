@@ -0,0 +1,162 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var ngBigEndianFile = []byte{
+	0x0a, 0x0d, 0x0d, 0x0a, 0x00, 0x00, 0x00, 0x1c, // SHB, length
+	0x1a, 0x2b, 0x3c, 0x4d, 0x00, 0x01, 0x00, 0x00, // magic, maj, min
+	0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // section length
+	0x00, 0x00, 0x00, 0x1c, // length
+	0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x20, // IDB, length
+	0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, // linktype, reserved, snaplen
+	0x00, 0x09, 0x00, 0x01, 0x09, 0x00, 0x00, 0x00, // if_tsresol = 9
+	0x00, 0x00, 0x00, 0x00, // end of options
+	0x00, 0x00, 0x00, 0x20, // length
+	0x00, 0x00, 0x00, 0x06, 0x00, 0x00, 0x00, 0x24, // EPB, length
+	0x00, 0x00, 0x00, 0x00, // interface
+	0x13, 0x95, 0x07, 0x94, 0xd1, 0x63, 0x04, 0x01, // timestamp
+	0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x08, // cap len, full len
+	0x01, 0x02, 0x03, 0x04, // data
+	0x00, 0x00, 0x00, 0x24, // length
+	0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x14, // SPB, length
+	0x00, 0x00, 0x00, 0x03, // full len
+	0x05, 0x06, 0x07, 0x00, // data, padding
+	0x00, 0x00, 0x00, 0x14, // length
+}
+
+func TestNgReaderBigEndian(t *testing.T) {
+	r, err := NewNgReader(bytes.NewReader(ngBigEndianFile), DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.LinkType() != layers.LinkTypeEthernet {
+		t.Errorf("wrong link type %v", r.LinkType())
+	}
+	intf, err := r.Interface(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if intf.SnapLength != 0xffff || intf.TimestampResolution != NgResolutionNano {
+		t.Errorf("wrong interface %+v", intf)
+	}
+
+	data, ci, err := r.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ci.Timestamp.Equal(time.Date(2014, 9, 18, 12, 13, 14, 1, time.UTC)) {
+		t.Errorf("Invalid time read: %v", ci.Timestamp)
+	}
+	if ci.CaptureLength != 4 || ci.Length != 8 || ci.InterfaceIndex != 0 {
+		t.Errorf("Invalid capture info %+v", ci)
+	}
+	if want := []byte{1, 2, 3, 4}; !bytes.Equal(data, want) {
+		t.Errorf("buf mismatch:\nwant: %+v\ngot:  %+v", want, data)
+	}
+
+	data, ci, err = r.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.CaptureLength != 3 || ci.Length != 3 {
+		t.Errorf("Invalid capture info %+v", ci)
+	}
+	if want := []byte{5, 6, 7}; !bytes.Equal(data, want) {
+		t.Errorf("buf mismatch:\nwant: %+v\ngot:  %+v", want, data)
+	}
+
+	if _, _, err = r.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestNgReaderFail(t *testing.T) {
+	for _, test := range [][]byte{
+		// not a section header
+		ngBigEndianFile[28:],
+		// bad byte order magic
+		append([]byte{0x0a, 0x0d, 0x0d, 0x0a, 0x00, 0x00, 0x00, 0x1c, 0x1a, 0x2b, 0x3c, 0x4e}, ngBigEndianFile[12:]...),
+		// no interface
+		ngBigEndianFile[:28],
+		// truncated block
+		ngBigEndianFile[:50],
+		// packet before interface
+		append(append([]byte{}, ngBigEndianFile[:28]...), ngBigEndianFile[60:]...),
+	} {
+		if _, err := NewNgReader(bytes.NewReader(test), DefaultNgReaderOptions); err == nil {
+			t.Errorf("Should fail but did not: %x", test)
+		}
+	}
+}
+
+func TestNgReaderMixedLinkType(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewNgWriter(&buf, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	intf := DefaultNgInterface
+	intf.LinkType = layers.LinkTypeRaw
+	if _, err := w.AddInterface(intf); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1, 0)
+	for i := 0; i < 4; i++ {
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: 1, Length: 1, InterfaceIndex: i % 2}
+		if err := w.WritePacket(ci, []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		options NgReaderOptions
+		want    []byte
+	}{
+		{NgReaderOptions{}, []byte{0, 2}},
+		{NgReaderOptions{WantMixedLinkType: true}, []byte{0, 1, 2, 3}},
+	} {
+		r, err := NewNgReader(bytes.NewReader(buf.Bytes()), test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []byte
+		for {
+			data, ci, err := r.ReadPacketData()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			intf, _ := r.Interface(ci.InterfaceIndex)
+			if want := []layers.LinkType{layers.LinkTypeEthernet, layers.LinkTypeRaw}[data[0]%2]; intf.LinkType != want {
+				t.Errorf("packet %d: link type %v, want %v", data[0], intf.LinkType, want)
+			}
+			got = append(got, data[0])
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%+v: got packets %v, want %v", test.options, got, test.want)
+		}
+	}
+
+	r, err := NewNgReader(bytes.NewReader(buf.Bytes()), NgReaderOptions{ErrorOnMismatchingLinkType: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.ReadPacketData(); err == nil {
+		t.Error("expected error for mismatching link type")
+	}
+}
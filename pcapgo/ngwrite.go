@@ -0,0 +1,322 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// NgWriterOptions holds options for creating a pcapng file.
+type NgWriterOptions struct {
+	// SectionInfo will be written to the section header.
+	SectionInfo NgSectionInfo
+}
+
+// DefaultNgWriterOptions contains the default section information.
+var DefaultNgWriterOptions = NgWriterOptions{
+	SectionInfo: NgSectionInfo{
+		Hardware:    runtime.GOARCH,
+		OS:          runtime.GOOS,
+		Application: "gopacket",
+	},
+}
+
+// DefaultNgInterface contains the default interface description used by
+// NewNgWriter.
+var DefaultNgInterface = NgInterface{
+	Name:                "intf0",
+	OS:                  runtime.GOOS,
+	SnapLength:          0,
+	TimestampResolution: NgResolutionNano,
+	FCSLength:           -1,
+}
+
+// NgWriter wraps an underlying io.Writer to write packet data in pcapng
+// format.  See https://github.com/pcapng/pcapng for information on the
+// file format.
+//
+// We currently write a single section in little-endian encoding, using
+// enhanced packet blocks for all packets.  CaptureInfo.InterfaceIndex
+// selects the interface a packet is written for.
+type NgWriter struct {
+	w      io.Writer
+	ifaces []NgInterface
+	buf    []byte
+}
+
+// NewNgWriter returns a new writer object, for writing packet data out to
+// the given writer.  A section header and an interface description with the
+// given link type (see DefaultNgInterface) are written immediately.
+//
+//	f, _ := os.Create("/tmp/file.pcapng")
+//	w, err := pcapgo.NewNgWriter(f, layers.LinkTypeEthernet)
+//	w.WritePacket(gopacket.CaptureInfo{...}, data1)
+//	f.Close()
+func NewNgWriter(w io.Writer, linkType layers.LinkType) (*NgWriter, error) {
+	intf := DefaultNgInterface
+	intf.LinkType = linkType
+	return NewNgWriterInterface(w, intf, DefaultNgWriterOptions)
+}
+
+// NewNgWriterInterface returns a new writer object, writing a section
+// header with the given options and the given interface as interface 0.
+func NewNgWriterInterface(w io.Writer, intf NgInterface, options NgWriterOptions) (*NgWriter, error) {
+	ret := &NgWriter{w: w}
+	if err := ret.writeSectionHeader(options.SectionInfo); err != nil {
+		return nil, err
+	}
+	if _, err := ret.AddInterface(intf); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ngOptionWriter accumulates options of a block.
+type ngOptionWriter []byte
+
+func (o *ngOptionWriter) add(code uint16, value []byte) {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint16(hdr[0:2], code)
+	binary.LittleEndian.PutUint16(hdr[2:4], uint16(len(value)))
+	*o = append(*o, hdr[:]...)
+	*o = append(*o, value...)
+	*o = append(*o, lotsOfZeros[:pad4(len(value))]...)
+}
+
+func (o *ngOptionWriter) addString(code uint16, value string) {
+	if value != "" {
+		o.add(code, []byte(value))
+	}
+}
+
+func (o *ngOptionWriter) addComments(comments []string) {
+	for _, c := range comments {
+		o.addString(ngOptionCodeComment, c)
+	}
+}
+
+func (o *ngOptionWriter) addUint64(code uint16, value uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], value)
+	o.add(code, b[:])
+}
+
+// end terminates the options, if there are any.
+func (o *ngOptionWriter) end() {
+	if len(*o) > 0 {
+		o.add(ngOptionCodeEndOfOptions, nil)
+	}
+}
+
+var lotsOfZeros [4]byte
+
+func pad4(n int) int {
+	return (4 - n&3) & 3
+}
+
+// writeBlock writes a block with the given type, fixed part, variable
+// (padded) part and options.
+func (w *NgWriter) writeBlock(typ uint32, fixed, variable []byte, options ngOptionWriter) error {
+	length := 12 + len(fixed) + len(variable) + pad4(len(variable)) + len(options)
+	if length > ngMaxBlockSize {
+		return fmt.Errorf("pcapng block length %d exceeds maximum of %d", length, ngMaxBlockSize)
+	}
+	w.buf = w.buf[:0]
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], typ)
+	w.buf = append(w.buf, b[:]...)
+	binary.LittleEndian.PutUint32(b[:], uint32(length))
+	w.buf = append(w.buf, b[:]...)
+	w.buf = append(w.buf, fixed...)
+	w.buf = append(w.buf, variable...)
+	w.buf = append(w.buf, lotsOfZeros[:pad4(len(variable))]...)
+	w.buf = append(w.buf, options...)
+	w.buf = append(w.buf, b[:]...)
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+func (w *NgWriter) writeSectionHeader(info NgSectionInfo) error {
+	var fixed [16]byte
+	binary.LittleEndian.PutUint32(fixed[0:4], ngByteOrderMagic)
+	binary.LittleEndian.PutUint16(fixed[4:6], ngVersionMajor)
+	binary.LittleEndian.PutUint16(fixed[6:8], ngVersionMinor)
+	// -1 means unknown section length
+	binary.LittleEndian.PutUint64(fixed[8:16], 0xFFFFFFFFFFFFFFFF)
+	var opts ngOptionWriter
+	opts.addComments(info.Comments)
+	opts.addString(ngOptionCodeHardware, info.Hardware)
+	opts.addString(ngOptionCodeOS, info.OS)
+	opts.addString(ngOptionCodeUserApp, info.Application)
+	opts.end()
+	return w.writeBlock(ngBlockTypeSectionHeader, fixed[:], nil, opts)
+}
+
+// AddInterface writes an interface description block for the given
+// interface and returns its index, to be used as
+// CaptureInfo.InterfaceIndex.
+func (w *NgWriter) AddInterface(intf NgInterface) (id int, err error) {
+	if intf.unitsPerSecond, err = intf.TimestampResolution.unitsPerSecond(); err != nil {
+		return 0, err
+	}
+	var fixed [8]byte
+	binary.LittleEndian.PutUint16(fixed[0:2], uint16(intf.LinkType))
+	binary.LittleEndian.PutUint32(fixed[4:8], intf.SnapLength)
+	var opts ngOptionWriter
+	opts.addComments(intf.Comments)
+	opts.addString(ngOptionCodeIfName, intf.Name)
+	opts.addString(ngOptionCodeIfDesc, intf.Description)
+	if intf.Filter != "" {
+		opts.add(ngOptionCodeIfFilter, append([]byte{0}, intf.Filter...))
+	}
+	opts.addString(ngOptionCodeIfOS, intf.OS)
+	if intf.Speed != 0 {
+		opts.addUint64(ngOptionCodeIfSpeed, intf.Speed)
+	}
+	if intf.TimestampResolution != NgResolutionMicro {
+		opts.add(ngOptionCodeIfTsresol, []byte{byte(intf.TimestampResolution)})
+	}
+	if intf.FCSLength >= 0 {
+		opts.add(ngOptionCodeIfFcslen, []byte{byte(intf.FCSLength)})
+	}
+	if intf.TimestampOffset != 0 {
+		opts.addUint64(ngOptionCodeIfTsoffset, uint64(intf.TimestampOffset))
+	}
+	opts.end()
+	if err := w.writeBlock(ngBlockTypeInterfaceDescriptor, fixed[:], nil, opts); err != nil {
+		return 0, err
+	}
+	w.ifaces = append(w.ifaces, intf)
+	return len(w.ifaces) - 1, nil
+}
+
+func putTimestamp(b []byte, ts uint64) {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(ts))
+}
+
+// WritePacket writes the given packet data out to the file, as an enhanced
+// packet block of interface ci.InterfaceIndex.
+func (w *NgWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	return w.WritePacketWithOptions(ci, data, NgPacketOptions{})
+}
+
+// WritePacketWithOptions writes the given packet data out to the file,
+// attaching the given options.
+func (w *NgWriter) WritePacketWithOptions(ci gopacket.CaptureInfo, data []byte, options NgPacketOptions) error {
+	if ci.CaptureLength != len(data) {
+		return fmt.Errorf("capture length %d does not match data length %d", ci.CaptureLength, len(data))
+	}
+	if ci.CaptureLength > ci.Length {
+		return fmt.Errorf("invalid capture info %+v:  capture length > length", ci)
+	}
+	if ci.InterfaceIndex < 0 || ci.InterfaceIndex >= len(w.ifaces) {
+		return fmt.Errorf("interface %d does not exist", ci.InterfaceIndex)
+	}
+	intf := &w.ifaces[ci.InterfaceIndex]
+	t := ci.Timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+	var fixed [20]byte
+	binary.LittleEndian.PutUint32(fixed[0:4], uint32(ci.InterfaceIndex))
+	putTimestamp(fixed[4:12], intf.rawTimestamp(t))
+	binary.LittleEndian.PutUint32(fixed[12:16], uint32(ci.CaptureLength))
+	binary.LittleEndian.PutUint32(fixed[16:20], uint32(ci.Length))
+	var opts ngOptionWriter
+	opts.addComments(options.Comments)
+	if options.Flags != 0 {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], options.Flags)
+		opts.add(ngOptionCodeEpbFlags, b[:])
+	}
+	if options.DropCount != 0 {
+		opts.addUint64(ngOptionCodeEpbDropCnt, options.DropCount)
+	}
+	opts.end()
+	return w.writeBlock(ngBlockTypeEnhancedPacket, fixed[:], data, opts)
+}
+
+// WriteNameResolution writes a name resolution block containing the given
+// records.  Each record must have an IPv4 or IPv6 address and at least one
+// name.
+func (w *NgWriter) WriteNameResolution(names []NgResolvedName) error {
+	var records ngOptionWriter
+	for _, n := range names {
+		if len(n.Names) == 0 {
+			return fmt.Errorf("no names given for %v", n.Addr)
+		}
+		var value []byte
+		var typ uint16
+		if ip4 := n.Addr.To4(); ip4 != nil {
+			typ, value = ngNameRecordIPv4, append(value, ip4...)
+		} else if ip6 := n.Addr.To16(); ip6 != nil {
+			typ, value = ngNameRecordIPv6, append(value, ip6...)
+		} else {
+			return errors.New("invalid address in name resolution record")
+		}
+		for _, name := range n.Names {
+			value = append(value, name...)
+			value = append(value, 0)
+		}
+		records.add(typ, value)
+	}
+	records.add(ngNameRecordEnd, nil)
+	return w.writeBlock(ngBlockTypeNameResolution, nil, nil, records)
+}
+
+// WriteInterfaceStatistics writes an interface statistics block for the
+// given interface.  Negative counters and zero times are omitted.
+func (w *NgWriter) WriteInterfaceStatistics(id int, stats NgInterfaceStatistics) error {
+	if id < 0 || id >= len(w.ifaces) {
+		return fmt.Errorf("interface %d does not exist", id)
+	}
+	intf := &w.ifaces[id]
+	t := stats.LastUpdate
+	if t.IsZero() {
+		t = time.Now()
+	}
+	var fixed [12]byte
+	binary.LittleEndian.PutUint32(fixed[0:4], uint32(id))
+	putTimestamp(fixed[4:12], intf.rawTimestamp(t))
+	var opts ngOptionWriter
+	opts.addComments(stats.Comments)
+	var b [8]byte
+	for _, tm := range []struct {
+		code uint16
+		t    time.Time
+	}{{ngOptionCodeIsbStart, stats.StartTime}, {ngOptionCodeIsbEnd, stats.EndTime}} {
+		if !tm.t.IsZero() {
+			putTimestamp(b[:], intf.rawTimestamp(tm.t))
+			opts.add(tm.code, b[:])
+		}
+	}
+	for _, c := range []struct {
+		code  uint16
+		value int64
+	}{
+		{ngOptionCodeIsbIfRecv, stats.PacketsReceived},
+		{ngOptionCodeIsbIfDrop, stats.PacketsDropped},
+		{ngOptionCodeIsbAccept, stats.PacketsAccepted},
+		{ngOptionCodeIsbOSDrop, stats.OSDropped},
+		{ngOptionCodeIsbUsrDeliv, stats.UserDelivered},
+	} {
+		if c.value >= 0 {
+			opts.addUint64(c.code, uint64(c.value))
+		}
+	}
+	opts.end()
+	return w.writeBlock(ngBlockTypeInterfaceStatistics, fixed[:], nil, opts)
+}
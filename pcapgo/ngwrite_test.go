@@ -0,0 +1,177 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestNgWriteHeader(t *testing.T) {
+	var buf bytes.Buffer
+	intf := NgInterface{LinkType: 0x56, SnapLength: 0x1234, TimestampResolution: NgResolutionMicro, FCSLength: -1}
+	if _, err := NewNgWriterInterface(&buf, intf, NgWriterOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x0a, 0x0d, 0x0d, 0x0a, 0x1c, 0x00, 0x00, 0x00, // SHB, length
+		0x4d, 0x3c, 0x2b, 0x1a, 0x01, 0x00, 0x00, 0x00, // magic, maj, min
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, // section length
+		0x1c, 0x00, 0x00, 0x00, // length
+		0x01, 0x00, 0x00, 0x00, 0x14, 0x00, 0x00, 0x00, // IDB, length
+		0x56, 0x00, 0x00, 0x00, 0x34, 0x12, 0x00, 0x00, // linktype, reserved, snaplen
+		0x14, 0x00, 0x00, 0x00, // length
+	}
+	if got := buf.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("buf mismatch:\nwant: %+v\ngot:  %+v", want, got)
+	}
+}
+
+func TestNgWritePacket(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewNgWriter(&buf, layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	ci := gopacket.CaptureInfo{
+		Timestamp:     time.Unix(0x01020304, 0xAA),
+		Length:        0xABCD,
+		CaptureLength: 5,
+	}
+	if err := w.WritePacket(ci, []byte{9, 8, 7, 6, 5}); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{
+		0x06, 0x00, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, // EPB, length
+		0x00, 0x00, 0x00, 0x00, // interface
+		0xb3, 0x12, 0x3c, 0x00, 0xaa, 0x28, 0xc9, 0x52, // timestamp
+		0x05, 0x00, 0x00, 0x00, 0xcd, 0xab, 0x00, 0x00, // cap len, full len
+		0x09, 0x08, 0x07, 0x06, 0x05, 0x00, 0x00, 0x00, // data, padding
+		0x28, 0x00, 0x00, 0x00, // length
+	}
+	if got := buf.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("buf mismatch:\nwant: %+v\ngot:  %+v", want, got)
+	}
+
+	ci.InterfaceIndex = 1
+	if err := w.WritePacket(ci, []byte{9, 8, 7, 6, 5}); err == nil {
+		t.Error("writing packet for unknown interface should fail")
+	}
+}
+
+// closeTo returns true if a and b differ by less than the 2^-20 s timestamp
+// resolution used in TestNgWriteRead.
+func closeTo(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d > -time.Microsecond && d < time.Microsecond
+}
+
+func TestNgWriteRead(t *testing.T) {
+	var buf bytes.Buffer
+	section := NgWriterOptions{SectionInfo: NgSectionInfo{
+		Hardware:    "hw",
+		OS:          "os",
+		Application: "app",
+		Comments:    []string{"section comment"},
+	}}
+	intf := NgInterface{
+		Name:                "eth0",
+		Comments:            []string{"interface comment"},
+		Description:         "test interface",
+		Filter:              "tcp port 80",
+		OS:                  "linux",
+		LinkType:            layers.LinkTypeEthernet,
+		SnapLength:          65535,
+		TimestampResolution: NgResolution(0x80 | 20),
+		TimestampOffset:     100,
+		Speed:               1e9,
+		FCSLength:           4,
+	}
+	w, err := NewNgWriterInterface(&buf, intf, section)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []NgResolvedName{
+		{Addr: net.IP{192, 168, 0, 1}, Names: []string{"router", "gateway"}},
+		{Addr: net.ParseIP("2001:db8::1"), Names: []string{"v6host"}},
+	}
+	if err := w.WriteNameResolution(names); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2018, 1, 2, 3, 4, 5, 6000, time.UTC)
+	packetOptions := NgPacketOptions{Comments: []string{"a", "bc"}, Flags: 1, DropCount: 7}
+	if err := w.WritePacketWithOptions(gopacket.CaptureInfo{Timestamp: ts, CaptureLength: 3, Length: 10}, []byte{1, 2, 3}, packetOptions); err != nil {
+		t.Fatal(err)
+	}
+	stats := NgInterfaceStatistics{
+		LastUpdate:      ts,
+		StartTime:       ts.Add(-time.Second),
+		EndTime:         ts,
+		PacketsReceived: 10,
+		PacketsDropped:  2,
+		PacketsAccepted: -1,
+		OSDropped:       -1,
+		UserDelivered:   -1,
+	}
+	if err := w.WriteInterfaceStatistics(0, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewNgReader(bytes.NewReader(buf.Bytes()), DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.SectionInfo(); !reflect.DeepEqual(got, section.SectionInfo) {
+		t.Errorf("section info mismatch:\nwant: %+v\ngot:  %+v", section.SectionInfo, got)
+	}
+	data, ci, opts, err := r.ReadPacketDataWithOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{1, 2, 3}) || ci.CaptureLength != 3 || ci.Length != 10 {
+		t.Errorf("packet mismatch: %v %+v", data, ci)
+	}
+	if !closeTo(ci.Timestamp, ts) {
+		t.Errorf("timestamp mismatch: want %v, got %v", ts, ci.Timestamp)
+	}
+	if !reflect.DeepEqual(opts, packetOptions) {
+		t.Errorf("packet options mismatch:\nwant: %+v\ngot:  %+v", packetOptions, opts)
+	}
+	if got := r.ResolvedNames(); len(got) != 2 || !got[0].Addr.Equal(names[0].Addr) || !got[1].Addr.Equal(names[1].Addr) ||
+		!reflect.DeepEqual(got[0].Names, names[0].Names) || !reflect.DeepEqual(got[1].Names, names[1].Names) {
+		t.Errorf("names mismatch:\nwant: %+v\ngot:  %+v", names, got)
+	}
+	if _, _, err := r.ReadPacketData(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	got, err := r.Interface(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !closeTo(got.Statistics.LastUpdate, stats.LastUpdate) || !closeTo(got.Statistics.StartTime, stats.StartTime) ||
+		!closeTo(got.Statistics.EndTime, stats.EndTime) {
+		t.Errorf("statistics time mismatch:\nwant: %+v\ngot:  %+v", stats, got.Statistics)
+	}
+	got.Statistics.LastUpdate, got.Statistics.StartTime, got.Statistics.EndTime = time.Time{}, time.Time{}, time.Time{}
+	stats.LastUpdate, stats.StartTime, stats.EndTime = time.Time{}, time.Time{}, time.Time{}
+	if !reflect.DeepEqual(got.Statistics, stats) {
+		t.Errorf("statistics mismatch:\nwant: %+v\ngot:  %+v", stats, got.Statistics)
+	}
+	got.Statistics = NgInterfaceStatistics{}
+	got.unitsPerSecond = 0
+	if !reflect.DeepEqual(got, intf) {
+		t.Errorf("interface mismatch:\nwant: %+v\ngot:  %+v", intf, got)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package pcapgo
+
+import (
+	"errors"
+	"math/bits"
+	"net"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Block types, see
+// https://github.com/pcapng/pcapng/blob/master/draft-tuexen-opsawg-pcapng.xml
+// for the definition of each.
+const (
+	ngBlockTypeInterfaceDescriptor = 0x00000001
+	ngBlockTypePacket              = 0x00000002 // obsolete, but still read
+	ngBlockTypeSimplePacket        = 0x00000003
+	ngBlockTypeNameResolution      = 0x00000004
+	ngBlockTypeInterfaceStatistics = 0x00000005
+	ngBlockTypeEnhancedPacket      = 0x00000006
+	ngBlockTypeSectionHeader       = 0x0A0D0D0A
+)
+
+const ngByteOrderMagic uint32 = 0x1A2B3C4D
+
+// The only section version we know how to read and write.
+const (
+	ngVersionMajor = 1
+	ngVersionMinor = 0
+)
+
+// ngMaxBlockSize is the largest block we are willing to read.  This is the
+// same limit wireshark uses and protects us from allocating absurd amounts of
+// memory for corrupted files.
+const ngMaxBlockSize = 16 * 1024 * 1024
+
+// Option codes.  Codes 0 and 1 are shared by all blocks, the others depend on
+// the block they appear in.
+const (
+	ngOptionCodeEndOfOptions = 0
+	ngOptionCodeComment      = 1
+)
+
+const (
+	ngOptionCodeHardware    = 2
+	ngOptionCodeOS          = 3
+	ngOptionCodeUserApp     = 4
+	ngOptionCodeIfName      = 2
+	ngOptionCodeIfDesc      = 3
+	ngOptionCodeIfSpeed     = 8
+	ngOptionCodeIfTsresol   = 9
+	ngOptionCodeIfFilter    = 11
+	ngOptionCodeIfOS        = 12
+	ngOptionCodeIfFcslen    = 13
+	ngOptionCodeIfTsoffset  = 14
+	ngOptionCodeEpbFlags    = 2
+	ngOptionCodeEpbDropCnt  = 4
+	ngOptionCodeIsbStart    = 2
+	ngOptionCodeIsbEnd      = 3
+	ngOptionCodeIsbIfRecv   = 4
+	ngOptionCodeIsbIfDrop   = 5
+	ngOptionCodeIsbAccept   = 6
+	ngOptionCodeIsbOSDrop   = 7
+	ngOptionCodeIsbUsrDeliv = 8
+)
+
+// Record types of the name resolution block.
+const (
+	ngNameRecordEnd  = 0
+	ngNameRecordIPv4 = 1
+	ngNameRecordIPv6 = 2
+)
+
+// NgResolution represents a pcapng timestamp resolution (the if_tsresol
+// option).  If the most significant bit is clear, the remaining bits are the
+// negative power of 10 of the timestamp unit, otherwise they are the negative
+// power of 2.
+type NgResolution uint8
+
+// Binary returns true if the resolution is a negative power of 2.
+func (r NgResolution) Binary() bool {
+	return r&0x80 != 0
+}
+
+// Exponent returns the negative exponent of the resolution.
+func (r NgResolution) Exponent() uint8 {
+	return uint8(r) & 0x7f
+}
+
+// unitsPerSecond returns the number of timestamp units in one second.
+func (r NgResolution) unitsPerSecond() (uint64, error) {
+	e := r.Exponent()
+	if r.Binary() {
+		if e > 63 {
+			return 0, errors.New("timestamp resolution too large")
+		}
+		return 1 << e, nil
+	}
+	if e > 19 {
+		return 0, errors.New("timestamp resolution too large")
+	}
+	ups := uint64(1)
+	for i := uint8(0); i < e; i++ {
+		ups *= 10
+	}
+	return ups, nil
+}
+
+// Commonly used timestamp resolutions.
+const (
+	NgResolutionMicro NgResolution = 6
+	NgResolutionNano  NgResolution = 9
+)
+
+// NgInterfaceStatistics holds the statistics of an interface, as reported by
+// an interface statistics block.  Counters that were not present in the
+// block are set to -1.
+type NgInterfaceStatistics struct {
+	// LastUpdate is the time the statistics were last updated.
+	LastUpdate time.Time
+	// StartTime and EndTime delimit the time span these statistics cover.
+	StartTime time.Time
+	EndTime   time.Time
+	// Comments are the comments attached to the statistics block.
+	Comments []string
+	// PacketsReceived is the number of packets received by the interface.
+	PacketsReceived int64
+	// PacketsDropped is the number of packets dropped by the interface.
+	PacketsDropped int64
+	// PacketsAccepted is the number of packets accepted by the filter.
+	PacketsAccepted int64
+	// OSDropped is the number of packets dropped by the operating system.
+	OSDropped int64
+	// UserDelivered is the number of packets delivered to the user.
+	UserDelivered int64
+}
+
+// NgInterface holds all the information of a pcapng interface.
+type NgInterface struct {
+	// Name is the name of the interface.
+	Name string
+	// Comments are the comments attached to the interface.
+	Comments []string
+	// Description is the description of the interface.
+	Description string
+	// Filter is the filter used during packet capture.
+	Filter string
+	// OS is the operating system the capture was made on.
+	OS string
+	// LinkType is the link type of the interface.
+	LinkType layers.LinkType
+	// SnapLength is the maximum packet length captured by this interface.
+	// 0 means unlimited.
+	SnapLength uint32
+	// TimestampResolution is the resolution of the packet timestamps of
+	// this interface.
+	TimestampResolution NgResolution
+	// TimestampOffset is an offset in seconds that is added to the packet
+	// timestamps of this interface.
+	TimestampOffset int64
+	// Speed is the interface speed in bits per second, or 0 if unknown.
+	Speed uint64
+	// FCSLength is the length of the frame check sequence in bits, or -1
+	// if unknown.
+	FCSLength int
+	// Statistics holds the interface statistics, updated every time an
+	// interface statistics block is read.
+	Statistics NgInterfaceStatistics
+
+	unitsPerSecond uint64
+}
+
+// timestamp converts a raw pcapng timestamp of this interface to a time.
+func (intf *NgInterface) timestamp(ts uint64) time.Time {
+	secs := ts / intf.unitsPerSecond
+	frac := ts % intf.unitsPerSecond
+	// frac < unitsPerSecond, so this can't overflow.
+	hi, lo := bits.Mul64(frac, uint64(time.Second))
+	nanos, _ := bits.Div64(hi, lo, intf.unitsPerSecond)
+	return time.Unix(int64(secs)+intf.TimestampOffset, int64(nanos)).UTC()
+}
+
+// rawTimestamp is the inverse of timestamp.
+func (intf *NgInterface) rawTimestamp(t time.Time) uint64 {
+	secs := uint64(t.Unix() - intf.TimestampOffset)
+	hi, lo := bits.Mul64(uint64(t.Nanosecond()), intf.unitsPerSecond)
+	frac, _ := bits.Div64(hi, lo, uint64(time.Second))
+	return secs*intf.unitsPerSecond + frac
+}
+
+// NgSectionInfo contains additional information of a pcapng section.
+type NgSectionInfo struct {
+	// Hardware is the hardware this file was generated on.
+	Hardware string
+	// OS is the operating system this file was generated on.
+	OS string
+	// Application is the user space application this file was generated
+	// with.
+	Application string
+	// Comments are the comments attached to the section header.
+	Comments []string
+}
+
+// NgResolvedName is a single record of a name resolution block, mapping an
+// IPv4 or IPv6 address to one or more names.
+type NgResolvedName struct {
+	Addr  net.IP
+	Names []string
+}
+
+// NgPacketOptions holds the per-packet options of an enhanced packet block.
+type NgPacketOptions struct {
+	// Comments are the comments attached to the packet.
+	Comments []string
+	// Flags is the value of the epb_flags option (direction, reception
+	// type, FCS length and link-layer errors), or 0 if not present.
+	Flags uint32
+	// DropCount is the number of packets lost between this packet and the
+	// preceding one, or 0 if not present.
+	DropCount uint64
+}
@@ -5,7 +5,8 @@
 // tree.
 
 // Package pcapgo provides some native PCAP support, not requiring
-// C libpcap to be installed.
+// C libpcap to be installed.  Both the classic libpcap file format (Reader,
+// Writer) and the pcapng format (NgReader, NgWriter) are supported.
 package pcapgo
 
 import (
@@ -0,0 +1,306 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package sflowagent implements a simple sFlow version 5 agent.
+//
+// An Agent samples the packets it is given at a 1-in-N rate, keeps the
+// counters of the interface they were seen on, and reports both to a
+// collector in datagrams serialized with layers.SFlowDatagram.  Packets can
+// come from any gopacket.PacketDataSource, live or from a capture file, and
+// are expected to be Ethernet frames:
+//
+//	agent, err := sflowagent.DialUDP("collector:6343", sflowagent.DefaultAgentOptions)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer agent.Close()
+//	if err := agent.Run(handle); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// The agent runs on the clock of the packets: its uptime, the interval
+// between counter samples, and the age of pending samples are all measured
+// with their timestamps, so that captures replay as they were seen.
+package sflowagent
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// AgentOptions controls the behavior of an Agent.
+type AgentOptions struct {
+	// AgentAddress and SubAgentID identify the agent to the collector.
+	AgentAddress net.IP
+	SubAgentID   uint32
+	// SamplingRate is N, the agent sampling one packet out of N on average.
+	SamplingRate uint32
+	// HeaderSize is the maximum number of bytes of the sampled packets
+	// reported.
+	HeaderSize int
+	// CounterInterval is the interval at which interface counters are
+	// reported.
+	CounterInterval time.Duration
+	// MaxDatagramSize is the maximum size of the datagrams, which should
+	// leave room for the IP and UDP headers within the path MTU.
+	MaxDatagramSize int
+	// IfIndex and IfSpeed describe the interface the packets are seen on.
+	IfIndex uint32
+	IfSpeed uint64
+}
+
+// DefaultAgentOptions provides default options for an Agent, following the
+// common defaults of sFlow agents.
+var DefaultAgentOptions = AgentOptions{
+	AgentAddress:    net.IPv4zero,
+	SamplingRate:    400,
+	HeaderSize:      128,
+	CounterInterval: 20 * time.Second,
+	MaxDatagramSize: 1400,
+	IfIndex:         1,
+}
+
+// maxDelay is the time after which pending samples are sent, even if the
+// datagram holding them isn't full.
+const maxDelay = time.Second
+
+// Agent samples packets and reports them to a collector.  It is safe for
+// concurrent use.
+type Agent struct {
+	AgentOptions
+	w io.Writer
+	// skip returns the number of packets to skip before the next sample,
+	// replaced by tests.
+	skip func() uint32
+
+	mu              sync.Mutex
+	start           time.Time // timestamp of the first packet
+	last            time.Time // timestamp of the last packet
+	countersSent    time.Time
+	sequence        uint32 // datagram sequence number
+	flowSequence    uint32
+	counterSequence uint32
+	toSkip          uint32
+	counters        layers.SFlowGenericInterfaceCounters
+	pending         layers.SFlowDatagram
+	pendingSize     int
+	pendingSince    time.Time
+	buf             gopacket.SerializeBuffer
+}
+
+// NewAgent returns a new Agent writing its datagrams to w.
+func NewAgent(w io.Writer, options AgentOptions) *Agent {
+	a := &Agent{AgentOptions: options, w: w, buf: gopacket.NewSerializeBuffer()}
+	rate := int(options.SamplingRate)
+	if rate <= 1 {
+		a.skip = func() uint32 { return 0 }
+	} else {
+		// Skip counts uniformly distributed around the sampling rate, so
+		// that sampling doesn't synchronize with periodic traffic.
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		a.skip = func() uint32 { return uint32(r.Intn(2*rate - 1)) }
+	}
+	a.counters.IfIndex = options.IfIndex
+	a.counters.IfType = 6 // ethernetCsmacd
+	a.counters.IfSpeed = options.IfSpeed
+	a.counters.IfStatus = 3 // admin and operational status up
+	return a
+}
+
+// DialUDP returns a new Agent sending its datagrams to the collector at the
+// given UDP address.  Closing it closes the connection.
+func DialUDP(addr string, options AgentOptions) (*Agent, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewAgent(conn, options), nil
+}
+
+// Run samples the packets read from src until it returns an error, returning
+// nil on io.EOF.  Samples still pending then are sent by Flush or Close.
+func (a *Agent) Run(src gopacket.PacketDataSource) error {
+	for {
+		data, ci, err := src.ReadPacketData()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := a.Sample(data, ci); err != nil {
+			return err
+		}
+	}
+}
+
+// Sample accounts the packet with the given data and capture info to the
+// interface counters, and samples it if its turn has come.
+func (a *Agent) Sample(data []byte, ci gopacket.CaptureInfo) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.start.IsZero() {
+		a.start, a.countersSent = ci.Timestamp, ci.Timestamp
+		a.toSkip = a.skip()
+	}
+	if ci.Timestamp.After(a.last) {
+		a.last = ci.Timestamp
+	}
+	a.account(data, ci)
+	if a.toSkip > 0 {
+		a.toSkip--
+	} else {
+		a.toSkip = a.skip()
+		if err := a.addFlowSample(data, ci); err != nil {
+			return err
+		}
+	}
+	if a.CounterInterval > 0 && a.last.Sub(a.countersSent) >= a.CounterInterval {
+		if err := a.addCounterSample(); err != nil {
+			return err
+		}
+	}
+	if a.pendingSize > 0 && a.last.Sub(a.pendingSince) >= maxDelay {
+		return a.flush()
+	}
+	return nil
+}
+
+// account adds the packet to the input counters of the interface.
+func (a *Agent) account(data []byte, ci gopacket.CaptureInfo) {
+	c := &a.counters
+	c.IfInOctets += uint64(ci.Length)
+	switch {
+	case len(data) < 6:
+		c.IfInErrors++
+	case data[0]&data[1]&data[2]&data[3]&data[4]&data[5] == 0xff:
+		c.IfInBroadcastPkts++
+	case data[0]&1 != 0:
+		c.IfInMulticastPkts++
+	default:
+		c.IfInUcastPkts++
+	}
+}
+
+// reserve makes room in the pending datagram for a sample of the given length
+// once serialized, sending the datagram first if the sample doesn't fit in
+// it.
+func (a *Agent) reserve(length int) error {
+	if a.pendingSize > 0 && a.pendingSize+length > a.MaxDatagramSize {
+		if err := a.flush(); err != nil {
+			return err
+		}
+	}
+	if a.pendingSize == 0 {
+		a.pendingSize = 28
+		if a.AgentAddress.To4() == nil {
+			a.pendingSize += 12
+		}
+		a.pendingSince = a.last
+	}
+	a.pendingSize += length
+	return nil
+}
+
+func (a *Agent) addFlowSample(data []byte, ci gopacket.CaptureInfo) error {
+	header := data
+	if len(header) > a.HeaderSize {
+		header = header[:a.HeaderSize]
+	}
+	// The sample keeps its own copy of the header, since data may be reused
+	// by the source.
+	header = append([]byte(nil), header...)
+	if err := a.reserve(40 + 24 + len(header) + (4-len(header)%4)%4); err != nil {
+		return err
+	}
+	a.flowSequence++
+	a.pending.FlowSamples = append(a.pending.FlowSamples, layers.SFlowFlowSample{
+		SequenceNumber: a.flowSequence,
+		SourceIDIndex:  layers.SFlowSourceValue(a.IfIndex),
+		SamplingRate:   a.SamplingRate,
+		SamplePool:     a.pool(),
+		InputInterface: a.IfIndex,
+		Records: []layers.SFlowRecord{&layers.SFlowRawPacketFlowRecord{
+			HeaderProtocol: layers.SFlowProtoEthernet,
+			FrameLength:    uint32(ci.Length),
+			Header:         gopacket.NewPacket(header, layers.LayerTypeEthernet, gopacket.Lazy),
+		}},
+	})
+	return nil
+}
+
+// pool returns the number of packets seen, the total of the ones sampled
+// and skipped.
+func (a *Agent) pool() uint32 {
+	c := &a.counters
+	return c.IfInUcastPkts + c.IfInMulticastPkts + c.IfInBroadcastPkts + c.IfInErrors
+}
+
+func (a *Agent) addCounterSample() error {
+	if err := a.reserve(20 + 96); err != nil {
+		return err
+	}
+	a.countersSent = a.last
+	a.counterSequence++
+	counters := a.counters
+	a.pending.CounterSamples = append(a.pending.CounterSamples, layers.SFlowCounterSample{
+		SequenceNumber: a.counterSequence,
+		SourceIDIndex:  layers.SFlowSourceValue(a.IfIndex),
+		Records:        []layers.SFlowRecord{&counters},
+	})
+	return nil
+}
+
+// Flush sends the current interface counters, along with the pending
+// samples.
+func (a *Agent) Flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.start.IsZero() {
+		return nil
+	}
+	if err := a.addCounterSample(); err != nil {
+		return err
+	}
+	return a.flush()
+}
+
+func (a *Agent) flush() error {
+	if a.pendingSize == 0 {
+		return nil
+	}
+	d := &a.pending
+	d.AgentAddress = a.AgentAddress
+	d.SubAgentID = a.SubAgentID
+	a.sequence++
+	d.SequenceNumber = a.sequence
+	d.AgentUptime = uint32(a.last.Sub(a.start) / time.Millisecond)
+	err := gopacket.SerializeLayers(a.buf, gopacket.SerializeOptions{FixLengths: true}, d)
+	a.pending = layers.SFlowDatagram{}
+	a.pendingSize = 0
+	if err != nil {
+		return err
+	}
+	_, err = a.w.Write(a.buf.Bytes())
+	return err
+}
+
+// Close sends the current interface counters and the pending samples, then
+// closes the writer of the agent if it is an io.Closer.
+func (a *Agent) Close() error {
+	err := a.Flush()
+	if c, ok := a.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package sflowagent
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// datagrams records the datagrams written to it.
+type datagrams [][]byte
+
+func (d *datagrams) Write(b []byte) (int, error) {
+	*d = append(*d, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// testCapture returns a capture of n frames 100ms apart, alternately unicast,
+// multicast and broadcast, each i*10 bytes long on the wire.
+func testCapture(t *testing.T, n int, start time.Time) ([][]byte, *pcapgo.Reader) {
+	var buf bytes.Buffer
+	w := pcapgo.NewWriter(&buf)
+	if err := w.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	var frames [][]byte
+	for i := 0; i < n; i++ {
+		frame := make([]byte, 60)
+		for j := range frame {
+			frame[j] = byte(i + j)
+		}
+		switch i % 3 {
+		case 0:
+			frame[0] = 0x02
+		case 1:
+			frame[0] = 0x01
+		case 2:
+			copy(frame, layers.EthernetBroadcast)
+		}
+		ci := gopacket.CaptureInfo{Timestamp: start.Add(time.Duration(i) * 100 * time.Millisecond), CaptureLength: len(frame), Length: 60 + i*10}
+		if err := w.WritePacket(ci, frame); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	r, err := pcapgo.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frames, r
+}
+
+func TestAgent(t *testing.T) {
+	var d datagrams
+	options := DefaultAgentOptions
+	options.AgentAddress = net.IP{10, 0, 0, 1}
+	options.SamplingRate = 2
+	options.HeaderSize = 18
+	options.CounterInterval = 500 * time.Millisecond
+	options.MaxDatagramSize = 200
+	options.IfIndex = 3
+	a := NewAgent(&d, options)
+	a.skip = func() uint32 { return 1 }
+
+	start := time.Unix(1000, 0)
+	frames, r := testCapture(t, 20, start)
+	if err := a.Run(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var flows []layers.SFlowFlowSample
+	var counters []layers.SFlowGenericInterfaceCounters
+	for i, b := range d {
+		if len(b) > options.MaxDatagramSize {
+			t.Errorf("datagram %d: %d bytes long, want at most %d", i, len(b), options.MaxDatagramSize)
+		}
+		var s layers.SFlowDatagram
+		if err := s.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+			t.Fatalf("datagram %d: %v", i, err)
+		}
+		if s.SequenceNumber != uint32(i+1) || !s.AgentAddress.Equal(options.AgentAddress) {
+			t.Errorf("datagram %d: got sequence %d, agent %v, want %d, %v", i, s.SequenceNumber, s.AgentAddress, i+1, options.AgentAddress)
+		}
+		flows = append(flows, s.FlowSamples...)
+		for _, c := range s.CounterSamples {
+			counters = append(counters, c.Records[0].(layers.SFlowGenericInterfaceCounters))
+		}
+	}
+	if len(d) < 2 {
+		t.Errorf("got %d datagrams, want several", len(d))
+	}
+
+	// Every other packet is sampled, starting with the second one.
+	if len(flows) != len(frames)/2 {
+		t.Fatalf("got %d flow samples, want %d", len(flows), len(frames)/2)
+	}
+	for i, s := range flows {
+		n := 2*i + 1
+		raw := s.Records[0].(layers.SFlowRawPacketFlowRecord)
+		if s.SequenceNumber != uint32(i+1) || s.SamplePool != uint32(n+1) || s.SamplingRate != 2 || s.InputInterface != 3 {
+			t.Errorf("flow sample %d: got sequence %d, pool %d, rate %d, input %d", i, s.SequenceNumber, s.SamplePool, s.SamplingRate, s.InputInterface)
+		}
+		if raw.FrameLength != uint32(60+n*10) || raw.HeaderLength != 18 || !bytes.Equal(raw.Header.Data()[:18], frames[n][:18]) {
+			t.Errorf("flow sample %d: got frame length %d, header %v, want %d, %v", i, raw.FrameLength, raw.Header.Data()[:raw.HeaderLength], 60+n*10, frames[n][:18])
+		}
+	}
+
+	// Counters are sent every 500ms over the 1.9s of the capture, and on
+	// Close.
+	if len(counters) != 3+1 {
+		t.Fatalf("got %d counter samples, want 4", len(counters))
+	}
+	c := counters[len(counters)-1]
+	if c.IfIndex != 3 || c.IfInUcastPkts != 7 || c.IfInMulticastPkts != 7 || c.IfInBroadcastPkts != 6 || c.IfInOctets != 20*60+190*10 {
+		t.Errorf("got final counters %+v", c)
+	}
+}
@@ -7,7 +7,8 @@
 // Package tcpassembly provides TCP stream re-assembly.
 //
 // The tcpassembly package implements uni-directional TCP reassembly, for use in
-// packet-sniffing applications.  The caller reads packets off the wire, then
+// packet-sniffing applications.  Both directions of a TCP connection may be
+// handled together by creating the StreamPool with NewConnectionPool.  The caller reads packets off the wire, then
 // presents them to an Assembler in the form of gopacket layers.TCP packets
 // (github.com/google/gopacket, github.com/google/gopacket/layers).
 //
@@ -24,7 +25,9 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -82,6 +85,9 @@ type Reassembly struct {
 	End bool
 	// Seen is the timestamp this set of bytes was pulled off the wire.
 	Seen time.Time
+	// State is the state of the TCP connection after the packet holding
+	// this set of bytes, if the Assembler tracks connection states.
+	State TCPState
 }
 
 const pageBytes = 1900
@@ -96,15 +102,18 @@ type page struct {
 	index      int
 	prev, next *page
 	buf        [pageBytes]byte
+	// segStart and segEnd delimit the TCP segment the page holds part of,
+	// which may be spread over several pages.
+	segStart, segEnd Sequence
 }
 
 // pageCache is a concurrency-unsafe store of page objects we use to avoid
-// memory allocation as much as we can.  It grows but never shrinks.
+// memory allocation as much as we can.  It grows as needed, and shrinks back
+// when its free pages aren't needed anymore.
 type pageCache struct {
 	free         []*page
 	pcSize       int
 	size, used   int
-	pages        [][]page
 	pageRequests int64
 }
 
@@ -120,12 +129,11 @@ func newPageCache() *pageCache {
 }
 
 // grow exponentially increases the size of our page cache as much as necessary.
+// Pages are allocated one by one, so that shrink can release them.
 func (c *pageCache) grow() {
-	pages := make([]page, c.pcSize)
-	c.pages = append(c.pages, pages)
 	c.size += c.pcSize
-	for i, _ := range pages {
-		c.free = append(c.free, &pages[i])
+	for i := 0; i < c.pcSize; i++ {
+		c.free = append(c.free, new(page))
 	}
 	if *memLog {
 		log.Println("PageCache: created", c.pcSize, "new pages")
@@ -133,6 +141,31 @@ func (c *pageCache) grow() {
 	c.pcSize *= 2
 }
 
+// shrink releases the free pages beyond as many as are used, keeping at
+// least initialAllocSize pages, so that the memory taken by a traffic spike
+// is given back once the spike is over.
+func (c *pageCache) shrink() {
+	keep := c.used
+	if keep < initialAllocSize {
+		keep = initialAllocSize
+	}
+	if len(c.free) <= keep {
+		return
+	}
+	released := len(c.free) - keep
+	free := make([]*page, keep, keep*2)
+	copy(free, c.free)
+	c.free = free
+	c.size -= released
+	c.pcSize = initialAllocSize
+	for c.pcSize < c.size {
+		c.pcSize *= 2
+	}
+	if *memLog {
+		log.Println("PageCache: released", released, "pages")
+	}
+}
+
 // next returns a clean, ready-to-use page object.
 func (c *pageCache) next(ts time.Time) (p *page) {
 	if *memLog {
@@ -219,7 +252,9 @@ func (p *StreamPool) connections() []*connection {
 //
 // If it pushes all bytes (or there were no sets of bytes to begin with)
 // AND the connection has not received any bytes since the passed-in time,
-// the connection will be closed.
+// the connection will be closed.  With a connection pool, a Connection whose
+// only half seen is closed and hasn't received any bytes since the passed-in
+// time is completed too.
 //
 // Returns the number of connections flushed, and of those, the number closed
 // because of the flush.
@@ -253,6 +288,8 @@ func (a *Assembler) FlushOlderThan(t time.Time) (flushed, closed int) {
 		}
 		conn.mu.Unlock()
 	}
+	a.connPool.completeHalfConnections(t, false)
+	a.pc.shrink()
 	return flushes, closes
 }
 
@@ -269,6 +306,8 @@ func (a *Assembler) FlushAll() (closed int) {
 		}
 		conn.mu.Unlock()
 	}
+	a.connPool.completeHalfConnections(time.Time{}, true)
+	a.pc.shrink()
 	return
 }
 
@@ -278,6 +317,10 @@ func (k *key) String() string {
 	return fmt.Sprintf("%s:%s", k[0], k[1])
 }
 
+func (k key) reverse() key {
+	return key{k[0].Reverse(), k[1].Reverse()}
+}
+
 // StreamPool stores all streams created by Assemblers, allowing multiple
 // assemblers to work together on stream processing while enforcing the fact
 // that a single stream receives its data serially.  It is safe
@@ -294,10 +337,16 @@ func (k *key) String() string {
 // Assembler, though, it does have to do some locking to make sure that the
 // connection objects it stores are accessible to multiple Assemblers.
 type StreamPool struct {
+	// buffered is the number of bytes buffered by all connections.  It is
+	// accessed atomically, so it comes first for alignment.
+	buffered int64
+	StreamPoolOptions
 	conns              map[key]*connection
 	users              int
 	mu                 sync.RWMutex
 	factory            StreamFactory
+	connFactory        ConnectionFactory
+	bidis              map[key]*bidiConnection
 	free               []*connection
 	all                [][]connection
 	nextAlloc          int
@@ -318,15 +367,60 @@ func (p *StreamPool) grow() {
 
 // NewStreamPool creates a new connection pool.  Streams will
 // be created as necessary using the passed-in StreamFactory.
+//
+// This sets the pool options to DefaultStreamPoolOptions.
 func NewStreamPool(factory StreamFactory) *StreamPool {
 	return &StreamPool{
-		conns:     make(map[key]*connection, initialAllocSize),
-		free:      make([]*connection, 0, initialAllocSize),
-		factory:   factory,
-		nextAlloc: initialAllocSize,
+		conns:             make(map[key]*connection, initialAllocSize),
+		free:              make([]*connection, 0, initialAllocSize),
+		factory:           factory,
+		nextAlloc:         initialAllocSize,
+		StreamPoolOptions: DefaultStreamPoolOptions,
 	}
 }
 
+// DefaultStreamPoolOptions provides default options for a stream pool.
+// These options are used by default when calling NewStreamPool, so if
+// modified before a NewStreamPool call they'll affect the resulting
+// StreamPool.
+var DefaultStreamPoolOptions = StreamPoolOptions{
+	MaxBufferedBytes: 0, // unlimited
+	FlushPolicy:      FlushOldest,
+}
+
+// StreamPoolOptions controls the behavior of a stream pool, shared by all
+// the Assemblers using it.  They must be set before the pool is used.
+type StreamPoolOptions struct {
+	// MaxBufferedBytes is an upper limit on the total number of bytes
+	// buffered while waiting for out-of-order packets by all the connections
+	// of the pool, whichever Assembler handles them.  Once this limit is
+	// exceeded, the Assembler handling a packet flushes whole connections it
+	// buffers data for, in the order given by FlushPolicy, until back under
+	// the limit.  Connections buffered by other Assemblers are left to them,
+	// to flush on their next packet.  If <= 0, this is ignored.
+	MaxBufferedBytes int
+	// FlushPolicy selects the connections to flush first when exceeding
+	// MaxBufferedBytes.
+	FlushPolicy FlushPolicy
+}
+
+// FlushPolicy selects the connections flushed first to free memory.
+type FlushPolicy int
+
+const (
+	// FlushOldest flushes the connections which haven't seen packets for
+	// the longest time first.
+	FlushOldest FlushPolicy = iota
+	// FlushLargest flushes the connections buffering the most bytes first.
+	FlushLargest
+)
+
+// BufferedBytes returns the number of bytes currently buffered by the
+// connections of the pool while waiting for out-of-order packets.
+func (p *StreamPool) BufferedBytes() int {
+	return int(atomic.LoadInt64(&p.buffered))
+}
+
 const assemblerReturnValueInitialSize = 16
 
 // NewAssembler creates a new assembler.  Pass in the StreamPool
@@ -355,6 +449,7 @@ func NewAssembler(pool *StreamPool) *Assembler {
 var DefaultAssemblerOptions = AssemblerOptions{
 	MaxBufferedPagesPerConnection: 0, // unlimited
 	MaxBufferedPagesTotal:         0, // unlimited
+	OverlapPolicy:                 OverlapFirst,
 }
 
 type connection struct {
@@ -362,20 +457,30 @@ type connection struct {
 	pages             int
 	first, last       *page
 	nextSeq           Sequence
+	buffered          int // bytes in pages
 	created, lastSeen time.Time
 	stream            Stream
 	closed            bool
+	bidi              *bidiConnection
+	dir               Direction
+	state             *connState
+	pc                *pageCache // of the Assembler buffering the pages
 	mu                sync.Mutex
 }
 
 func (c *connection) reset(k key, s Stream, ts time.Time) {
 	c.key = k
 	c.pages = 0
+	c.buffered = 0
 	c.first, c.last = nil, nil
 	c.nextSeq = invalidSequence
 	c.created = ts
 	c.stream = s
 	c.closed = false
+	c.bidi = nil
+	c.state = nil
+	c.dir = ClientToServer
+	c.pc = nil
 }
 
 // AssemblerOptions controls the behavior of each assembler.  Modify the
@@ -391,6 +496,24 @@ type AssemblerOptions struct {
 	// particular connection, the smallest sequence number will be flushed, along
 	// with any contiguous data.  If <= 0, this is ignored.
 	MaxBufferedPagesPerConnection int
+	// TrackState makes the assembler follow the state of each TCP connection
+	// through its handshake and teardown, passing it on to Streams in
+	// Reassembly.State, and reporting the packets violating it to the
+	// Streams implementing InvalidStateHandler.
+	TrackState bool
+	// RejectInvalidState makes the assembler drop the packets violating the
+	// state of their connection, such as payload before the handshake or
+	// after a RST.  It implies TrackState.
+	RejectInvalidState bool
+	// OverlapPolicy selects which data is kept when buffered segments
+	// overlap with different contents.  Such overlaps are reported to the
+	// Streams implementing OverlapHandler.
+	OverlapPolicy OverlapPolicy
+	// TrackMetrics makes the assembler compute the metrics of each TCP
+	// connection, such as round trip times and retransmissions, passing
+	// them on to the Streams implementing MetricsHandler.  It implies
+	// TrackState.
+	TrackMetrics bool
 }
 
 // Assembler handles reassembling TCP streams.  It is not safe for
@@ -424,6 +547,7 @@ type AssemblerOptions struct {
 // then we recommend you use a seperate StreamPool per Assembler, thus
 // avoiding all lock contention.  Only when different Assemblers could receive
 // packets for the same Stream should a StreamPool be shared between them.
+// ShardedAssembler does this hashing and runs the Assemblers for you.
 //
 // Avoids Memory Copying
 //
@@ -448,10 +572,10 @@ type AssemblerOptions struct {
 // is done there, then very little allocation is done ever, mostly to handle
 // large increases in bandwidth or numbers of connections.
 //
-// TODO:  The page caches used by an Assembler will grow to the size necessary
-// to handle a workload, and currently will never shrink.  This means that
-// traffic spikes can result in large memory usage which isn't garbage
-// collected when typical traffic levels return.
+// The page caches used by an Assembler grow to the size necessary to handle a
+// workload, and are shrunk back by FlushOlderThan and FlushAll, so that the
+// memory taken by traffic spikes is garbage collected when typical traffic
+// levels return.
 type Assembler struct {
 	AssemblerOptions
 	ret      []Reassembly
@@ -478,13 +602,18 @@ func (p *StreamPool) newConnection(k key, s Stream, ts time.Time) (c *connection
 // getConnection returns a connection.  If end is true and a connection
 // does not already exist, returns nil.  This allows us to check for a
 // connection without actually creating one if it doesn't already exist.
-func (p *StreamPool) getConnection(k key, end bool, ts time.Time) *connection {
+// fromServer tells whether the packet creating the connection was sent by
+// the server, and is only used by connection pools.
+func (p *StreamPool) getConnection(k key, end bool, ts time.Time, fromServer bool) *connection {
 	p.mu.RLock()
 	conn := p.conns[k]
 	p.mu.RUnlock()
 	if end || conn != nil {
 		return conn
 	}
+	if p.connFactory != nil {
+		return p.newHalfConnection(k, ts, fromServer)
+	}
 	s := p.factory.New(k[0], k[1])
 	p.mu.Lock()
 	conn = p.newConnection(k, s, ts)
@@ -517,16 +646,43 @@ func (a *Assembler) Assemble(netFlow gopacket.Flow, t *layers.TCP) {
 //    zero or one calls to Reassembled on a single stream
 //    zero or one calls to ReassemblyComplete on the same stream
 func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP, timestamp time.Time) {
+	key := key{netFlow, t.TransportFlow()}
+	tracking := a.TrackState || a.RejectInvalidState || a.TrackMetrics
 	// Ignore empty TCP packets
 	if !t.SYN && !t.FIN && !t.RST && len(t.LayerPayload()) == 0 {
+		if tracking {
+			// Acknowledgements still matter to the connection state, even
+			// when they are all we see of their half.
+			conn := a.connPool.getConnection(key, true, timestamp, false)
+			if conn == nil {
+				conn = a.connPool.getConnection(key.reverse(), true, timestamp, false)
+			}
+			if conn != nil {
+				conn.mu.Lock()
+				if !conn.closed {
+					a.checkState(conn, key, t, timestamp)
+				}
+				conn.mu.Unlock()
+			}
+		}
 		if *debugLog {
 			log.Println("ignoring useless packet")
 		}
 		return
 	}
 
+	if a.connPool.connFactory != nil && t.ACK {
+		// Pass on the data of the other direction this packet comes after.
+		if rev := a.connPool.getConnection(key.reverse(), true, timestamp, false); rev != nil {
+			rev.mu.Lock()
+			if !rev.closed {
+				a.flushAcked(rev, Sequence(t.Ack))
+			}
+			rev.mu.Unlock()
+		}
+	}
+
 	a.ret = a.ret[:0]
-	key := key{netFlow, t.TransportFlow()}
 	var conn *connection
 	// This for loop handles a race condition where a connection will close, lock
 	// the connection pool, and remove itself, but before it locked the connection
@@ -534,7 +690,7 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 	// times for the VAST majority of cases.
 	for {
 		conn = a.connPool.getConnection(
-			key, !t.SYN && len(t.LayerPayload()) == 0, timestamp)
+			key, !t.SYN && len(t.LayerPayload()) == 0, timestamp, t.SYN && t.ACK)
 		if conn == nil {
 			if *debugLog {
 				log.Printf("%v got empty packet on otherwise empty connection", key)
@@ -550,6 +706,17 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 	if conn.lastSeen.Before(timestamp) {
 		conn.lastSeen = timestamp
 	}
+	var state TCPState
+	if tracking {
+		var ok bool
+		if state, ok = a.checkState(conn, key, t, timestamp); !ok {
+			if *debugLog {
+				log.Printf("%v rejecting packet violating connection state", key)
+			}
+			conn.mu.Unlock()
+			return
+		}
+	}
 	seq, bytes := Sequence(t.Seq), t.Payload
 	if conn.nextSeq == invalidSequence {
 		if t.SYN {
@@ -561,19 +728,26 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 				Skip:  0,
 				Start: true,
 				Seen:  timestamp,
+				State: state,
 			})
 			conn.nextSeq = seq.Add(len(bytes) + 1)
 		} else {
 			if *debugLog {
 				log.Printf("%v waiting for start, storing into connection", key)
 			}
-			a.insertIntoConn(t, conn, timestamp)
+			a.insertIntoConn(t, conn, timestamp, state)
 		}
 	} else if diff := conn.nextSeq.Difference(seq); diff > 0 {
 		if *debugLog {
 			log.Printf("%v gap in sequence numbers (%v, %v) diff %v, storing into connection", key, conn.nextSeq, seq, diff)
 		}
-		a.insertIntoConn(t, conn, timestamp)
+		a.insertIntoConn(t, conn, timestamp, state)
+	} else if conn.first != nil && seq.Add(len(bytes)).Difference(conn.first.seq) < 0 {
+		if *debugLog {
+			log.Printf("%v contiguous data (%v, %v) overlaps buffered data, storing into connection", key, seq, seq.Add(len(bytes)))
+		}
+		a.insertIntoConn(t, conn, timestamp, state)
+		a.addContiguous(conn)
 	} else {
 		bytes, conn.nextSeq = byteSpan(conn.nextSeq, seq, bytes)
 		if *debugLog {
@@ -584,12 +758,74 @@ func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP,
 			Skip:  0,
 			End:   t.RST || t.FIN,
 			Seen:  timestamp,
+			State: state,
 		})
 	}
 	if len(a.ret) > 0 {
 		a.sendToConnection(conn)
 	}
 	conn.mu.Unlock()
+	if max := a.connPool.MaxBufferedBytes; max > 0 && a.connPool.BufferedBytes() > max {
+		a.enforceBudget()
+	}
+}
+
+// flushCandidate is a connection which may be flushed to free memory, with
+// the values sorted on by flushCandidates.
+type flushCandidate struct {
+	conn     *connection
+	lastSeen time.Time
+	buffered int
+}
+
+// flushCandidates sorts connections in the order they should be flushed.
+type flushCandidates struct {
+	policy FlushPolicy
+	c      []flushCandidate
+}
+
+func (f flushCandidates) Len() int      { return len(f.c) }
+func (f flushCandidates) Swap(i, j int) { f.c[i], f.c[j] = f.c[j], f.c[i] }
+func (f flushCandidates) Less(i, j int) bool {
+	if f.policy == FlushLargest {
+		return f.c[i].buffered > f.c[j].buffered
+	}
+	return f.c[i].lastSeen.Before(f.c[j].lastSeen)
+}
+
+// addBuffered records that conn buffers n more bytes.
+func (a *Assembler) addBuffered(conn *connection, n int) {
+	conn.buffered += n
+	atomic.AddInt64(&a.connPool.buffered, int64(n))
+}
+
+// enforceBudget flushes connections of the pool in the order given by its
+// FlushPolicy, until they fit in its MaxBufferedBytes.  Only the connections
+// whose pages come from a's page cache are flushed, as the page caches of
+// other Assemblers can't be used concurrently.
+func (a *Assembler) enforceBudget() {
+	candidates := flushCandidates{policy: a.connPool.FlushPolicy}
+	for _, conn := range a.connPool.connections() {
+		conn.mu.Lock()
+		if !conn.closed && conn.first != nil && conn.pc == a.pc {
+			candidates.c = append(candidates.c, flushCandidate{conn, conn.lastSeen, conn.buffered})
+		}
+		conn.mu.Unlock()
+	}
+	sort.Sort(candidates)
+	for _, c := range candidates.c {
+		if a.connPool.BufferedBytes() <= a.connPool.MaxBufferedBytes {
+			return
+		}
+		if *debugLog {
+			log.Printf("%v over pool budget, flushing %v bytes", c.conn.key, c.buffered)
+		}
+		c.conn.mu.Lock()
+		for !c.conn.closed && c.conn.first != nil {
+			a.skipFlush(c.conn)
+		}
+		c.conn.mu.Unlock()
+	}
 }
 
 func byteSpan(expected, received Sequence, bytes []byte) (toSend []byte, next Sequence) {
@@ -646,17 +882,28 @@ func (p *StreamPool) remove(conn *connection) {
 	p.mu.Lock()
 	delete(p.conns, conn.key)
 	p.free = append(p.free, conn)
+	b := conn.bidi
+	complete := b != nil && p.halfClosed(b, conn.dir, conn.lastSeen)
 	p.mu.Unlock()
+	if complete {
+		b.conn.ConnectionComplete()
+	}
 }
 
 func (a *Assembler) closeConnection(conn *connection) {
 	if *debugLog {
 		log.Printf("%v closing", conn.key)
 	}
+	if h, ok := conn.stream.(MetricsHandler); ok && conn.state != nil {
+		if m, ok := conn.state.snapshot(conn.lastSeen); ok {
+			h.ConnectionMetrics(&m)
+		}
+	}
 	conn.stream.ReassemblyComplete()
 	conn.closed = true
 	a.connPool.remove(conn)
 	for p := conn.first; p != nil; p = p.next {
+		a.addBuffered(conn, -len(p.Bytes))
 		a.pc.replace(p)
 	}
 }
@@ -695,14 +942,17 @@ func (conn *connection) pushBetween(prev, next, first, last *page) {
 	}
 }
 
-func (a *Assembler) insertIntoConn(t *layers.TCP, conn *connection, ts time.Time) {
+func (a *Assembler) insertIntoConn(t *layers.TCP, conn *connection, ts time.Time, state TCPState) {
 	if conn.first != nil && conn.first.seq == conn.nextSeq {
 		panic("wtf")
 	}
-	p, p2, numPages := a.pagesFromTcp(t, ts)
+	p, p2, numPages := a.pagesFromTcp(t, ts, state)
 	prev, current := conn.traverseConn(Sequence(t.Seq))
 	conn.pushBetween(prev, current, p, p2)
+	conn.pc = a.pc
 	conn.pages += numPages
+	a.addBuffered(conn, len(t.Payload))
+	a.resolveOverlaps(conn, p, p2, ts)
 	if (a.MaxBufferedPagesPerConnection > 0 && conn.pages >= a.MaxBufferedPagesPerConnection) ||
 		(a.MaxBufferedPagesTotal > 0 && a.pc.used >= a.MaxBufferedPagesTotal) {
 		if *debugLog {
@@ -717,16 +967,19 @@ func (a *Assembler) insertIntoConn(t *layers.TCP, conn *connection, ts time.Time
 // correctly.
 //
 // It returns the first and last page in its doubly-linked list of new pages.
-func (a *Assembler) pagesFromTcp(t *layers.TCP, ts time.Time) (p, p2 *page, numPages int) {
+func (a *Assembler) pagesFromTcp(t *layers.TCP, ts time.Time, state TCPState) (p, p2 *page, numPages int) {
 	first := a.pc.next(ts)
 	current := first
 	numPages++
 	seq, bytes := Sequence(t.Seq), t.Payload
+	segEnd := seq.Add(len(bytes))
 	for {
 		length := min(len(bytes), pageBytes)
 		current.Bytes = current.buf[:length]
 		copy(current.Bytes, bytes)
 		current.seq = seq
+		current.segStart, current.segEnd = Sequence(t.Seq), segEnd
+		current.State = state
 		bytes = bytes[length:]
 		if len(bytes) == 0 {
 			break
@@ -749,6 +1002,7 @@ func (a *Assembler) addNextFromConn(conn *connection) {
 	} else if diff := conn.nextSeq.Difference(conn.first.seq); diff > 0 {
 		conn.first.Skip = int(diff)
 	}
+	a.addBuffered(conn, -len(conn.first.Bytes))
 	conn.first.Bytes, conn.nextSeq = byteSpan(conn.nextSeq, conn.first.seq, conn.first.Bytes)
 	if *debugLog {
 		log.Printf("%v   adding from conn (%v, %v)", conn.key, conn.first.seq, conn.nextSeq)
@@ -7,10 +7,13 @@
 package tcpassembly
 
 import (
+	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"net"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -28,12 +31,27 @@ type testSequence struct {
 	want []Reassembly
 }
 
+// testFactory is the StreamFactory of the tests.  Its streams, named after
+// the source of their network flow, pass their reassemblies on to it, and
+// describe all they are told in its events.
 type testFactory struct {
+	mu         sync.Mutex // streams may run concurrently, as in a ShardedAssembler
 	reassembly []Reassembly
+	events     []string
+	// data holds the reassembled bytes of each stream.
+	data     map[string][]byte
+	overlaps []string
+	metrics  []Metrics
+}
+
+type testStream struct {
+	f    *testFactory
+	name string
 }
 
 func (t *testFactory) New(a, b gopacket.Flow) Stream {
-	return t
+	src, _ := a.Endpoints()
+	return &testStream{t, src.String()}
 }
 func (t *testFactory) Reassembled(r []Reassembly) {
 	t.reassembly = r
@@ -44,6 +62,76 @@ func (t *testFactory) Reassembled(r []Reassembly) {
 func (t *testFactory) ReassemblyComplete() {
 }
 
+func (s *testStream) Reassembled(rs []Reassembly) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	s.f.Reassembled(rs)
+	if s.f.data == nil {
+		s.f.data = make(map[string][]byte)
+	}
+	for _, r := range rs {
+		s.f.data[s.name] = append(s.f.data[s.name], r.Bytes...)
+		e := fmt.Sprintf("%s %q", s.name, r.Bytes)
+		if r.Skip != 0 {
+			e += fmt.Sprintf(" skip=%d", r.Skip)
+		}
+		if r.State != TCPStateUntracked {
+			e += " " + r.State.String()
+		}
+		s.f.events = append(s.f.events, e)
+	}
+}
+func (s *testStream) ReassemblyComplete() {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	s.f.events = append(s.f.events, s.name+" complete")
+}
+func (s *testStream) InvalidState(err *StateError) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	s.f.events = append(s.f.events, fmt.Sprintf("%s %v", s.name, err))
+}
+func (s *testStream) ConflictingOverlap(o *Overlap) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	s.f.overlaps = append(s.f.overlaps, fmt.Sprintf("%d kept %q discarded %q", o.Seq, o.Kept, o.Discarded))
+}
+func (s *testStream) ConnectionMetrics(m *Metrics) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	s.f.metrics = append(s.f.metrics, *m)
+}
+
+// testConnectionFactory is the ConnectionFactory of a testFactory.  Its
+// connections are named after the address and port of their client, and
+// their streams after their connection and direction.
+type testConnectionFactory struct {
+	f *testFactory
+}
+
+type testConnection struct {
+	f    *testFactory
+	name string
+}
+
+func (c testConnectionFactory) New(netFlow, tcpFlow gopacket.Flow) Connection {
+	src, _ := netFlow.Endpoints()
+	name := src.String()
+	// The TCP layers built by tests, rather than decoded, have no ports.
+	if port, _ := tcpFlow.Endpoints(); len(port.Raw()) > 0 {
+		name += ":" + port.String()
+	}
+	return &testConnection{c.f, name}
+}
+func (c *testConnection) Stream(dir Direction) Stream {
+	return &testStream{c.f, fmt.Sprintf("%s %v", c.name, dir)}
+}
+func (c *testConnection) ConnectionComplete() {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.f.events = append(c.f.events, c.name+" complete")
+}
+
 func test(t *testing.T, s []testSequence) {
 	fact := &testFactory{}
 	p := NewStreamPool(fact)
@@ -560,3 +648,90 @@ func BenchmarkMultiStreamConn(b *testing.B) {
 		}
 	}
 }
+
+func TestPageCacheShrink(t *testing.T) {
+	c := newPageCache()
+	var pages []*page
+	for i := 0; i < 5000; i++ {
+		pages = append(pages, c.next(time.Time{}))
+	}
+	if c.size != 7168 {
+		t.Fatalf("page cache size: got %d, want 7168", c.size)
+	}
+	for _, p := range pages[100:] {
+		c.replace(p)
+	}
+	c.shrink()
+	if c.size != 1124 || len(c.free) != 1024 {
+		t.Errorf("shrunk page cache: got size %d with %d free, want 1124 with 1024 free", c.size, len(c.free))
+	}
+	for _, p := range pages[:100] {
+		c.replace(p)
+	}
+	c.shrink()
+	if c.size != initialAllocSize || len(c.free) != initialAllocSize {
+		t.Errorf("shrunk page cache: got size %d with %d free, want %d", c.size, len(c.free), initialAllocSize)
+	}
+	for i := 0; i < 2000; i++ {
+		c.next(time.Time{})
+	}
+	if c.used != 2000 || c.size < 2000 {
+		t.Errorf("regrown page cache: got size %d with %d used", c.size, c.used)
+	}
+}
+
+// skipped returns the names of the streams which skipped bytes, flushed
+// before they were complete.
+func (f *testFactory) skipped() (names []string) {
+	for _, e := range f.events {
+		if strings.Contains(e, " skip=") {
+			names = append(names, strings.Fields(e)[0])
+		}
+	}
+	return
+}
+
+func TestPoolMemoryBudget(t *testing.T) {
+	for _, test := range []struct {
+		policy FlushPolicy
+		want   string
+	}{
+		{FlushOldest, "2.2.2.2"},
+		{FlushLargest, "3.3.3.3"},
+	} {
+		f := &testFactory{}
+		p := NewStreamPool(f)
+		p.MaxBufferedBytes = 10
+		p.FlushPolicy = test.policy
+		// Two assemblers share the budget of the pool.
+		a1, a2 := NewAssembler(p), NewAssembler(p)
+		flow := func(a byte) gopacket.Flow {
+			return gopacket.NewFlow(layers.EndpointIPv4, []byte{a, a, a, a}, []byte{9, 9, 9, 9})
+		}
+		buffer := func(a *Assembler, flow gopacket.Flow, payload []byte, ts time.Time) {
+			a.AssembleWithTimestamp(flow, &layers.TCP{SYN: true, Seq: 1000}, ts)
+			a.AssembleWithTimestamp(flow, &layers.TCP{Seq: 1010, BaseLayer: layers.BaseLayer{Payload: payload}}, ts)
+		}
+		buffer(a1, flow(1), []byte{1, 2, 3, 4}, time.Unix(1, 0))
+		buffer(a2, flow(2), []byte{1, 2, 3}, time.Unix(2, 0))
+		if n := p.BufferedBytes(); n != 7 || len(f.skipped()) != 0 {
+			t.Fatalf("%v: %d bytes buffered, %v flushed before exceeding the budget", test.policy, n, f.skipped())
+		}
+		// The connection of a1 is the oldest, but only a2's are flushed
+		// by a2.
+		buffer(a2, flow(3), []byte{1, 2, 3, 4, 5}, time.Unix(3, 0))
+		if flushed := f.skipped(); len(flushed) != 1 || flushed[0] != test.want {
+			t.Errorf("%v: flushed %v, want %v", test.policy, flushed, test.want)
+		}
+		if n := p.BufferedBytes(); n > p.MaxBufferedBytes {
+			t.Errorf("%v: %d bytes buffered, over the budget", test.policy, n)
+		}
+		if a1.pc.used != 1 || a2.pc.used != 1 {
+			t.Errorf("%v: %d and %d pages used, want 1 each", test.policy, a1.pc.used, a2.pc.used)
+		}
+		a1.FlushAll()
+		if n := p.BufferedBytes(); n != 0 {
+			t.Errorf("%v: %d bytes buffered after flushing everything", test.policy, n)
+		}
+	}
+}
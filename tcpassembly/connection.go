@@ -0,0 +1,201 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpassembly
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Direction tells which half of a TCP connection some data was sent on.
+type Direction int
+
+const (
+	// ClientToServer is the direction of the data sent by the host which
+	// opened the connection, or by the first host seen if the handshake was
+	// missed.
+	ClientToServer Direction = 0
+	// ServerToClient is the direction of the data sent by the other host.
+	ServerToClient Direction = 1
+)
+
+// String returns a human-readable direction.
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
+// Reverse returns the opposite direction.
+func (d Direction) Reverse() Direction {
+	return 1 - d
+}
+
+// Connection is implemented by the caller to handle both halves of a TCP
+// connection.  Callers create a ConnectionFactory, then a StreamPool created
+// with NewConnectionPool uses it to create a new Connection for every TCP
+// connection.
+//
+// assembly will, in order:
+//  1. Create the connection via ConnectionFactory.New
+//  2. Call Stream once for each direction, and handle the Streams it
+//     returns like the ones returned by StreamFactory.New
+//  3. Call ConnectionComplete one time, once ReassemblyComplete was called
+//     on both Streams, after which the connection is dereferenced by
+//     assembly.
+//
+// Data is passed to the Streams in the order it was exchanged: before
+// passing data acknowledging some bytes of the other direction to a Stream,
+// assembly passes those bytes to the other Stream, skipping over the missing
+// packets if need be.  Thus requests are seen before their responses even
+// when packets are reordered or lost.
+type Connection interface {
+	// Stream returns the Stream receiving the data sent in the given
+	// direction.  If no data is ever seen in one direction, its Stream is
+	// requested and completed when the connection times out.
+	Stream(dir Direction) Stream
+	// ConnectionComplete is called when both directions of the connection
+	// are complete.
+	ConnectionComplete()
+}
+
+// ConnectionFactory is used by assembly to create a new Connection for each
+// new TCP connection.
+type ConnectionFactory interface {
+	// New should return a new connection for the given TCP key.  The flows
+	// go from the client to the server.
+	New(netFlow, tcpFlow gopacket.Flow) Connection
+}
+
+// NewConnectionPool creates a new connection pool, handing both directions
+// of each TCP connection to a single Connection created as necessary using
+// the passed-in ConnectionFactory.
+func NewConnectionPool(factory ConnectionFactory) *StreamPool {
+	p := NewStreamPool(nil)
+	p.connFactory = factory
+	p.bidis = make(map[key]*bidiConnection)
+	return p
+}
+
+// bidiConnection ties together the connection objects of both halves of a
+// TCP connection.  It is guarded by the StreamPool lock.
+type bidiConnection struct {
+	conn Connection
+	keys [2]key // indexed by Direction
+	// created and done tell whether the connection object of each half
+	// has been created, and closed.
+	created, done [2]bool
+	// lastSeen is the last time a packet was seen by a closed half.
+	lastSeen time.Time
+}
+
+func (b *bidiConnection) direction(k key) Direction {
+	if k == b.keys[ClientToServer] {
+		return ClientToServer
+	}
+	return ServerToClient
+}
+
+// newHalfConnection returns the connection object of the half of a TCP
+// connection with the given key, creating the Connection when seeing its
+// first half.  It returns nil if the half was already closed.
+func (p *StreamPool) newHalfConnection(k key, ts time.Time, fromServer bool) *connection {
+	p.mu.RLock()
+	b := p.bidis[k]
+	p.mu.RUnlock()
+	client := k
+	if fromServer {
+		client = k.reverse()
+	}
+	var c Connection
+	if b == nil {
+		c = p.connFactory.New(client[0], client[1])
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn := p.conns[k]; conn != nil {
+		return conn
+	}
+	if b = p.bidis[k]; b == nil {
+		b = &bidiConnection{conn: c, keys: [2]key{client, client.reverse()}}
+		p.bidis[b.keys[ClientToServer]] = b
+		p.bidis[b.keys[ServerToClient]] = b
+	}
+	dir := b.direction(k)
+	if b.created[dir] {
+		return nil
+	}
+	b.created[dir] = true
+	conn := p.newConnection(k, b.conn.Stream(dir), ts)
+	conn.bidi, conn.dir = b, dir
+	p.conns[k] = conn
+	return conn
+}
+
+// halfClosed records that the given half of b is closed, and returns
+// whether b is complete.  It must be called with the StreamPool lock held.
+func (p *StreamPool) halfClosed(b *bidiConnection, dir Direction, lastSeen time.Time) bool {
+	b.done[dir] = true
+	if b.lastSeen.Before(lastSeen) {
+		b.lastSeen = lastSeen
+	}
+	if !b.done[dir.Reverse()] {
+		return false
+	}
+	delete(p.bidis, b.keys[ClientToServer])
+	delete(p.bidis, b.keys[ServerToClient])
+	return true
+}
+
+// completeHalfConnections completes the connections with a closed half whose
+// other half was never seen, if all is set or if they haven't seen any
+// packet since t.
+func (p *StreamPool) completeHalfConnections(t time.Time, all bool) {
+	if p.connFactory == nil {
+		return
+	}
+	var complete []*bidiConnection
+	p.mu.Lock()
+	for k, b := range p.bidis {
+		dir := b.direction(k)
+		if b.done[dir] && !b.created[dir.Reverse()] && (all || b.lastSeen.Before(t)) {
+			b.created[dir.Reverse()] = true
+			delete(p.bidis, b.keys[ClientToServer])
+			delete(p.bidis, b.keys[ServerToClient])
+			complete = append(complete, b)
+		}
+	}
+	p.mu.Unlock()
+	for _, b := range complete {
+		dir := ClientToServer
+		if b.done[dir] {
+			dir = ServerToClient
+		}
+		b.conn.Stream(dir).ReassemblyComplete()
+		b.conn.ConnectionComplete()
+	}
+}
+
+// flushAcked passes on the data buffered by conn which was acknowledged by
+// its peer with ack.  Since the peer received it, the data we're missing
+// before it won't show up as a retransmission, so it is skipped.
+func (a *Assembler) flushAcked(conn *connection, ack Sequence) {
+	a.ret = a.ret[:0]
+	for conn.first != nil && conn.first.seq.Difference(ack) > 0 {
+		a.addNextFromConn(conn)
+		a.addContiguous(conn)
+	}
+	if len(a.ret) > 0 {
+		if *debugLog {
+			log.Printf("%v flushing data acknowledged by peer up to %v", conn.key, ack)
+		}
+		a.sendToConnection(conn)
+	}
+}
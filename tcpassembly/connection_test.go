@@ -0,0 +1,97 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpassembly
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// testPacket is a TCP packet sent by the client if fromClient is set, by
+// the server otherwise.
+type testPacket struct {
+	fromClient bool
+	tcp        layers.TCP
+}
+
+func testConnectionPackets(f *testFactory, packets []testPacket, ts time.Time) *Assembler {
+	a := NewAssembler(NewConnectionPool(testConnectionFactory{f}))
+	for _, p := range packets {
+		net := netFlow
+		p.tcp.SrcPort, p.tcp.DstPort = 1000, 80
+		if !p.fromClient {
+			net = netFlow.Reverse()
+			p.tcp.SrcPort, p.tcp.DstPort = 80, 1000
+		}
+		a.AssembleWithTimestamp(net, &p.tcp, ts)
+	}
+	return a
+}
+
+func TestConnection(t *testing.T) {
+	f := &testFactory{}
+	testConnectionPackets(f, []testPacket{
+		{true, layers.TCP{SYN: true, Seq: 100}},
+		{false, layers.TCP{SYN: true, ACK: true, Seq: 500, Ack: 101}},
+		{true, layers.TCP{ACK: true, Seq: 101, Ack: 501, BaseLayer: layers.BaseLayer{Payload: []byte("abc")}}},
+		// "def" is lost, but the server acknowledges "ghi" in its response.
+		{true, layers.TCP{ACK: true, Seq: 107, Ack: 501, BaseLayer: layers.BaseLayer{Payload: []byte("ghi")}}},
+		{false, layers.TCP{ACK: true, Seq: 501, Ack: 110, BaseLayer: layers.BaseLayer{Payload: []byte("resp")}}},
+		{true, layers.TCP{FIN: true, ACK: true, Seq: 110, Ack: 505}},
+		{false, layers.TCP{FIN: true, ACK: true, Seq: 505, Ack: 111}},
+	}, time.Unix(1, 0))
+	// The connection is named after its client.
+	want := []string{
+		`1.2.3.4 client->server ""`,
+		`1.2.3.4 server->client ""`,
+		`1.2.3.4 client->server "abc"`,
+		`1.2.3.4 client->server "ghi" skip=3`,
+		`1.2.3.4 server->client "resp"`,
+		`1.2.3.4 client->server ""`,
+		`1.2.3.4 client->server complete`,
+		`1.2.3.4 server->client ""`,
+		`1.2.3.4 server->client complete`,
+		`1.2.3.4 complete`,
+	}
+	if !reflect.DeepEqual(f.events, want) {
+		t.Errorf("events:\ngot  %q\nwant %q", f.events, want)
+	}
+}
+
+func TestConnectionHalf(t *testing.T) {
+	f := &testFactory{}
+	start := time.Unix(1, 0)
+	a := testConnectionPackets(f, []testPacket{
+		{false, layers.TCP{SYN: true, ACK: true, Seq: 500, Ack: 101}},
+		{false, layers.TCP{ACK: true, Seq: 501, Ack: 101, BaseLayer: layers.BaseLayer{Payload: []byte("resp")}}},
+		{false, layers.TCP{RST: true, Seq: 505}},
+	}, start)
+	if n := len(f.events); n != 4 {
+		t.Fatalf("got %d events before flushing: %q", n, f.events)
+	}
+	a.FlushOlderThan(start)
+	if n := len(f.events); n != 4 {
+		t.Fatalf("connection completed too early: %q", f.events)
+	}
+	a.FlushOlderThan(start.Add(time.Second))
+	// The connection is named after its client, even though only the
+	// server was seen.
+	want := []string{
+		`1.2.3.4 server->client ""`,
+		`1.2.3.4 server->client "resp"`,
+		`1.2.3.4 server->client ""`,
+		`1.2.3.4 server->client complete`,
+		`1.2.3.4 client->server complete`,
+		`1.2.3.4 complete`,
+	}
+	if !reflect.DeepEqual(f.events, want) {
+		t.Errorf("events:\ngot  %q\nwant %q", f.events, want)
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpassembly
+
+import (
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Metrics are performance metrics of a TCP connection, computed by an
+// Assembler whose AssemblerOptions.TrackMetrics is set.
+type Metrics struct {
+	// HandshakeRTT is the time between the SYN of the client and its
+	// acknowledgement of the SYN-ACK of the server, if the handshake was
+	// seen.
+	HandshakeRTT time.Duration
+	// Directions holds the metrics of the segments sent in each direction,
+	// indexed by Direction.
+	Directions [2]DirectionMetrics
+}
+
+// DirectionMetrics are the metrics of the segments sent in one direction of
+// a TCP connection.
+type DirectionMetrics struct {
+	// Segments is the number of segments seen.
+	Segments int
+	// RTT summarizes the time between data segments and the first
+	// acknowledgement covering them.  Following Karn's algorithm,
+	// retransmitted segments aren't sampled.
+	RTT RTTStats
+	// Retransmissions and OutOfOrder count the data segments seen after a
+	// segment with a higher sequence number.  They are told apart by how
+	// long after that segment they show up: out-of-order segments show up
+	// within a round trip time.
+	Retransmissions, OutOfOrder int
+	// DuplicateAcks counts the acknowledgements repeating the previous one
+	// while data of the other direction was outstanding.
+	DuplicateAcks int
+	// MinWindow and MaxWindow are the extremes of the receive window
+	// advertised, scaled by the window scale option.
+	MinWindow, MaxWindow int
+	// ZeroWindows counts the times the advertised receive window dropped to
+	// zero, and ZeroWindowDuration is the total time it stayed there.
+	ZeroWindows        int
+	ZeroWindowDuration time.Duration
+}
+
+// RTTStats summarizes round trip time samples.
+type RTTStats struct {
+	Samples         int
+	Min, Max, Total time.Duration
+}
+
+// Mean returns the mean round trip time, or 0 without samples.
+func (s RTTStats) Mean() time.Duration {
+	if s.Samples == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Samples)
+}
+
+func (s *RTTStats) add(rtt time.Duration) {
+	if s.Samples == 0 || rtt < s.Min {
+		s.Min = rtt
+	}
+	if rtt > s.Max {
+		s.Max = rtt
+	}
+	s.Samples++
+	s.Total += rtt
+}
+
+// MetricsHandler may be implemented by Streams to be given the metrics of
+// their connection, when the Assembler computes them.  ConnectionMetrics is
+// called right before ReassemblyComplete.
+type MetricsHandler interface {
+	ConnectionMetrics(m *Metrics)
+}
+
+const (
+	tcpOptionWindowScale = 3
+	// maxPendingSegments bounds the number of unacknowledged segments kept
+	// per direction to sample round trip times.
+	maxPendingSegments = 64
+	// defaultReorderingTime tells out-of-order segments from
+	// retransmissions before having any round trip time.
+	defaultReorderingTime = 3 * time.Millisecond
+)
+
+// sentSegment is a data segment waiting for its acknowledgement.
+type sentSegment struct {
+	end  Sequence
+	sent time.Time
+}
+
+// directionTracker holds what is needed to compute the metrics of one
+// direction.
+type directionTracker struct {
+	highest    Sequence  // end of the highest segment seen
+	advanced   time.Time // last time highest moved forward
+	ack        Sequence  // last acknowledgement sent
+	window     int       // last window advertised, unscaled
+	windowSeen bool
+	scale      uint      // window scale option sent in the SYN
+	scaled     bool      // whether a window scale option was sent
+	zeroSince  time.Time // when the window dropped to zero, if it is
+	pending    []sentSegment
+}
+
+// metricsTracker computes the metrics of a connection.
+type metricsTracker struct {
+	Metrics
+	synSent time.Time
+	dirs    [2]directionTracker
+}
+
+func newMetricsTracker() *metricsTracker {
+	m := &metricsTracker{}
+	for i := range m.dirs {
+		m.dirs[i].highest = invalidSequence
+		m.dirs[i].ack = invalidSequence
+	}
+	return m
+}
+
+// update updates the metrics with packet t, sent in direction dir, which
+// moved the connection from state old to state next.
+func (m *metricsTracker) update(dir Direction, t *layers.TCP, ts time.Time, old, next TCPState) {
+	d, peer := &m.dirs[dir], &m.dirs[dir.Reverse()]
+	dm := &m.Directions[dir]
+	dm.Segments++
+	if t.SYN && !t.ACK && m.synSent.IsZero() {
+		m.synSent = ts
+	}
+	if old == TCPStateSynReceived && next == TCPStateEstablished && !m.synSent.IsZero() {
+		m.HandshakeRTT = ts.Sub(m.synSent)
+	}
+	if t.SYN {
+		for _, o := range t.Options {
+			if o.OptionType == tcpOptionWindowScale && len(o.OptionData) == 1 {
+				d.scale, d.scaled = uint(o.OptionData[0]), true
+			}
+		}
+	}
+
+	// Sequence space: retransmissions, reordering and segments to sample.
+	seq := Sequence(t.Seq)
+	length := len(t.Payload)
+	if t.SYN || t.FIN {
+		length++
+	}
+	if length > 0 {
+		end := seq.Add(length)
+		switch {
+		case d.highest == invalidSequence || d.highest.Difference(end) > 0:
+			if d.highest != invalidSequence && d.highest.Difference(seq) < 0 {
+				m.resent(d, dm, seq, ts)
+			}
+			d.highest, d.advanced = end, ts
+			if len(d.pending) == maxPendingSegments {
+				d.pending = d.pending[1:]
+			}
+			d.pending = append(d.pending, sentSegment{end, ts})
+		case len(t.Payload) > 0 || t.FIN:
+			m.resent(d, dm, seq, ts)
+		}
+	}
+
+	if t.RST {
+		return
+	}
+	// Acknowledgements: duplicates and round trip times.
+	if t.ACK {
+		ack := Sequence(t.Ack)
+		if len(t.Payload) == 0 && !t.SYN && !t.FIN && ack == d.ack && int(t.Window) == d.window &&
+			peer.highest != invalidSequence && ack.Difference(peer.highest) > 0 {
+			dm.DuplicateAcks++
+		}
+		n := 0
+		for ; n < len(peer.pending) && peer.pending[n].end.Difference(ack) >= 0; n++ {
+		}
+		if n > 0 {
+			m.Directions[dir.Reverse()].RTT.add(ts.Sub(peer.pending[n-1].sent))
+			peer.pending = peer.pending[n:]
+		}
+		d.ack = ack
+	}
+	// Receive window.
+	window := int(t.Window)
+	d.window = window
+	if !t.SYN && d.scaled && peer.scaled {
+		window <<= d.scale
+	}
+	if !d.windowSeen || window < dm.MinWindow {
+		dm.MinWindow = window
+	}
+	if window > dm.MaxWindow {
+		dm.MaxWindow = window
+	}
+	d.windowSeen = true
+	if window == 0 && d.zeroSince.IsZero() {
+		dm.ZeroWindows++
+		d.zeroSince = ts
+	} else if window > 0 && !d.zeroSince.IsZero() {
+		dm.ZeroWindowDuration += ts.Sub(d.zeroSince)
+		d.zeroSince = time.Time{}
+	}
+}
+
+// resent records a segment starting at seq, sent before the highest one.
+func (m *metricsTracker) resent(d *directionTracker, dm *DirectionMetrics, seq Sequence, ts time.Time) {
+	reordering := defaultReorderingTime
+	if rtt := dm.RTT.Mean(); rtt > 0 {
+		reordering = rtt
+	} else if m.HandshakeRTT > 0 {
+		reordering = m.HandshakeRTT
+	}
+	if ts.Sub(d.advanced) < reordering {
+		dm.OutOfOrder++
+	} else {
+		dm.Retransmissions++
+	}
+	// The acknowledgements of segments after seq are now ambiguous.
+	n := 0
+	for ; n < len(d.pending) && seq.Difference(d.pending[n].end) <= 0; n++ {
+	}
+	d.pending = d.pending[:n]
+}
+
+// snapshot returns the metrics of the connection, counting the windows still
+// at zero up to lastSeen.
+func (m *metricsTracker) snapshot(lastSeen time.Time) Metrics {
+	metrics := m.Metrics
+	for i := range m.dirs {
+		if z := m.dirs[i].zeroSince; !z.IsZero() && lastSeen.After(z) {
+			metrics.Directions[i].ZeroWindowDuration += lastSeen.Sub(z)
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpassembly
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestMetrics(t *testing.T) {
+	f := &testFactory{}
+	a := NewAssembler(NewStreamPool(f))
+	a.TrackMetrics = true
+	scale := func(shift byte) []layers.TCPOption {
+		return []layers.TCPOption{{OptionType: tcpOptionWindowScale, OptionLength: 3, OptionData: []byte{shift}}}
+	}
+	payload := func(s string) layers.BaseLayer {
+		return layers.BaseLayer{Payload: []byte(s)}
+	}
+	start := time.Unix(1, 0)
+	for _, p := range []struct {
+		ms int
+		testPacket
+	}{
+		{0, testPacket{true, layers.TCP{SYN: true, Seq: 100, Window: 1000, Options: scale(2)}}},
+		{10, testPacket{false, layers.TCP{SYN: true, ACK: true, Seq: 500, Ack: 101, Window: 500, Options: scale(1)}}},
+		{20, testPacket{true, layers.TCP{ACK: true, Seq: 101, Ack: 501, Window: 1000}}},
+		{30, testPacket{true, layers.TCP{ACK: true, Seq: 101, Ack: 501, Window: 1000, BaseLayer: payload("abc")}}},
+		{40, testPacket{false, layers.TCP{ACK: true, Seq: 501, Ack: 104, Window: 500}}},
+		{50, testPacket{true, layers.TCP{ACK: true, Seq: 104, Ack: 501, Window: 1000, BaseLayer: payload("def")}}},
+		{51, testPacket{true, layers.TCP{ACK: true, Seq: 107, Ack: 501, Window: 1000, BaseLayer: payload("ghi")}}},
+		// "def" is lost: the server repeats its acknowledgement, and the
+		// client retransmits it.
+		{60, testPacket{false, layers.TCP{ACK: true, Seq: 501, Ack: 104, Window: 500}}},
+		{200, testPacket{true, layers.TCP{ACK: true, Seq: 104, Ack: 501, Window: 1000, BaseLayer: payload("def")}}},
+		{210, testPacket{false, layers.TCP{ACK: true, Seq: 501, Ack: 110, Window: 500}}},
+		// The server stops receiving for 100ms.
+		{220, testPacket{false, layers.TCP{ACK: true, Seq: 501, Ack: 110, Window: 0}}},
+		{320, testPacket{false, layers.TCP{ACK: true, Seq: 501, Ack: 110, Window: 1000}}},
+		// "jkl" and "mno" are reordered.
+		{330, testPacket{true, layers.TCP{ACK: true, Seq: 113, Ack: 501, Window: 1000, BaseLayer: payload("mno")}}},
+		{331, testPacket{true, layers.TCP{ACK: true, Seq: 110, Ack: 501, Window: 1000, BaseLayer: payload("jkl")}}},
+		{340, testPacket{false, layers.TCP{ACK: true, Seq: 501, Ack: 116, Window: 1000}}},
+		{350, testPacket{true, layers.TCP{FIN: true, ACK: true, Seq: 116, Ack: 501, Window: 1000}}},
+		{360, testPacket{false, layers.TCP{FIN: true, ACK: true, Seq: 501, Ack: 117, Window: 1000}}},
+	} {
+		net := netFlow
+		p.tcp.SrcPort, p.tcp.DstPort = 1000, 80
+		if !p.fromClient {
+			net = netFlow.Reverse()
+			p.tcp.SrcPort, p.tcp.DstPort = 80, 1000
+		}
+		a.AssembleWithTimestamp(net, &p.tcp, start.Add(time.Duration(p.ms)*time.Millisecond))
+	}
+	if len(f.metrics) != 2 {
+		t.Fatalf("got metrics %d times, want 2", len(f.metrics))
+	}
+	ms := time.Millisecond
+	want := Metrics{
+		HandshakeRTT: 20 * ms,
+		Directions: [2]DirectionMetrics{
+			ClientToServer: {
+				Segments:        9,
+				RTT:             RTTStats{Samples: 3, Min: 10 * ms, Max: 10 * ms, Total: 30 * ms},
+				Retransmissions: 1,
+				OutOfOrder:      1,
+				MinWindow:       1000,
+				MaxWindow:       4000,
+			},
+			ServerToClient: {
+				Segments:           8,
+				RTT:                RTTStats{Samples: 1, Min: 10 * ms, Max: 10 * ms, Total: 10 * ms},
+				DuplicateAcks:      1,
+				MinWindow:          0,
+				MaxWindow:          2000,
+				ZeroWindows:        1,
+				ZeroWindowDuration: 100 * ms,
+			},
+		},
+	}
+	if got := f.metrics[1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("metrics:\ngot  %+v\nwant %+v", got, want)
+	}
+	if got := f.metrics[1].Directions[ClientToServer].RTT.Mean(); got != 10*ms {
+		t.Errorf("client RTT mean: got %v, want %v", got, 10*ms)
+	}
+}
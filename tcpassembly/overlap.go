@@ -0,0 +1,167 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpassembly
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+)
+
+// OverlapPolicy selects which copy of the data the Assembler keeps when a
+// TCP segment overlaps buffered, out of order data with different contents,
+// as a retransmission which doesn't match the original segment does.  Such
+// overlaps are a classic way to evade a monitor: the stream it reassembles
+// depends on which copy it keeps, and a TCP stack keeps the one its own
+// rules pick, which differ between stacks.  Reassembling with the policy of
+// the monitored host's stack gives the stream that host reads.
+//
+// Each policy is a rule on the sequence ranges of the two segments
+// involved: the one just received, and the buffered one it overlaps.  It
+// decides whether the new segment's bytes replace the buffered ones in the
+// overlapping range, whatever the size of the segments.  The policies are
+// numbered like those ip4defrag applies to fragments, so that a host is
+// modeled with the same value at both layers.
+//
+// Data already passed on to a Stream is never subject to the policy: the
+// part of a later segment covering it is dropped, like a receiver drops data
+// it has already acknowledged, and no Overlap is reported for it.
+type OverlapPolicy int
+
+const (
+	// OverlapLinux keeps the new data if its segment starts at or before
+	// the buffered one.
+	OverlapLinux OverlapPolicy = iota
+	// OverlapFirst always keeps the buffered data.
+	OverlapFirst
+	// OverlapLast always keeps the new data.
+	OverlapLast
+	// OverlapBSD keeps the new data if its segment starts before the
+	// buffered one.
+	OverlapBSD
+	// OverlapWindows keeps the new data if its segment starts before the
+	// buffered one, and ends at or after its end.
+	OverlapWindows
+	// OverlapSolaris keeps the new data if its segment covers more than the
+	// buffered one, starting at or before it and ending at or after it.
+	OverlapSolaris
+)
+
+func (p OverlapPolicy) String() string {
+	switch p {
+	case OverlapLinux:
+		return "Linux"
+	case OverlapFirst:
+		return "First"
+	case OverlapLast:
+		return "Last"
+	case OverlapBSD:
+		return "BSD"
+	case OverlapWindows:
+		return "Windows"
+	case OverlapSolaris:
+		return "Solaris"
+	default:
+		return fmt.Sprintf("OverlapPolicy(%d)", int(p))
+	}
+}
+
+// newWins returns whether the data of the segment just received, spanning the
+// sequence range [start, end), replaces the data of the buffered segment at
+// [oldStart, oldEnd).  Ranges are relative to a common sequence number.
+func (p OverlapPolicy) newWins(start, end, oldStart, oldEnd int) bool {
+	switch p {
+	case OverlapFirst:
+		return false
+	case OverlapLast:
+		return true
+	case OverlapBSD:
+		return start < oldStart
+	case OverlapWindows:
+		return start < oldStart && end >= oldEnd
+	case OverlapSolaris:
+		return start <= oldStart && end >= oldEnd && (start < oldStart || end > oldEnd)
+	default:
+		return start <= oldStart
+	}
+}
+
+// Overlap describes TCP segments overlapping with different contents.
+type Overlap struct {
+	// Seq is the sequence number of the first overlapping byte.
+	Seq Sequence
+	// Kept and Discarded are the conflicting contents of the overlapping
+	// range, as kept following the OverlapPolicy, and as discarded.
+	Kept, Discarded []byte
+	// Seen is the timestamp the last of the segments was pulled off the
+	// wire.
+	Seen time.Time
+}
+
+// OverlapHandler may be implemented by Streams to be told about the TCP
+// segments overlapping with different contents, which may be a sign of an
+// evasion or injection attempt.  ConflictingOverlap is called before the
+// overlap is resolved, which overwrites the discarded bytes, so anything
+// needed afterwards must be copied out of the Overlap passed in.
+type OverlapHandler interface {
+	ConflictingOverlap(o *Overlap)
+}
+
+// resolveOverlaps resolves the overlaps between the new pages first-...-last
+// of conn and the pages it already buffers, making the overlapping bytes
+// agree following the overlap policy.
+func (a *Assembler) resolveOverlaps(conn *connection, first, last *page, ts time.Time) {
+	for np := first; ; np = np.next {
+		// Pages are sorted by sequence, and none is larger than pageBytes.
+		for op := first.prev; op != nil && op.seq.Difference(np.seq) < pageBytes; op = op.prev {
+			a.resolveOverlap(conn, op, np, ts)
+		}
+		end := np.seq.Add(len(np.Bytes))
+		for op := last.next; op != nil && end.Difference(op.seq) < 0; op = op.next {
+			a.resolveOverlap(conn, op, np, ts)
+		}
+		if np == last {
+			return
+		}
+	}
+}
+
+// resolveOverlap resolves the overlap of the new page np with the old page op,
+// if they overlap.
+func (a *Assembler) resolveOverlap(conn *connection, op, np *page, ts time.Time) {
+	// Work with offsets relative to the old page.
+	start := op.seq.Difference(np.seq)
+	end := start + len(np.Bytes)
+	from, to := start, end
+	if from < 0 {
+		from = 0
+	}
+	if to > len(op.Bytes) {
+		to = len(op.Bytes)
+	}
+	if from >= to {
+		return
+	}
+	ob, nb := op.Bytes[from:to], np.Bytes[from-start:to-start]
+	if bytes.Equal(ob, nb) {
+		return
+	}
+	// The policy applies to the segments the pages are part of.
+	kept, discarded := ob, nb
+	if a.OverlapPolicy.newWins(op.seq.Difference(np.segStart), op.seq.Difference(np.segEnd),
+		op.seq.Difference(op.segStart), op.seq.Difference(op.segEnd)) {
+		kept, discarded = nb, ob
+	}
+	if *debugLog {
+		log.Printf("%v conflicting overlap of %d bytes at %v", conn.key, to-from, op.seq.Add(from))
+	}
+	if h, ok := conn.stream.(OverlapHandler); ok {
+		h.ConflictingOverlap(&Overlap{Seq: op.seq.Add(from), Kept: kept, Discarded: discarded, Seen: ts})
+	}
+	copy(discarded, kept)
+}
@@ -0,0 +1,110 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpassembly
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestOverlapPolicies(t *testing.T) {
+	segment := func(seq uint32, data string) layers.TCP {
+		return layers.TCP{SrcPort: 1, DstPort: 2, Seq: seq, BaseLayer: layers.BaseLayer{Payload: []byte(data)}}
+	}
+	for _, test := range []struct {
+		name     string
+		segments []layers.TCP
+		report   string // the overlap reported with OverlapFirst
+		want     map[OverlapPolicy]string
+	}{
+		{
+			name:     "new after old",
+			segments: []layers.TCP{segment(1005, "abcdef"), segment(1007, "XYZW"), segment(1001, "0123")},
+			report:   `1007 kept "cdef" discarded "XYZW"`,
+			want: map[OverlapPolicy]string{
+				OverlapFirst:   "0123abcdef",
+				OverlapLast:    "0123abXYZW",
+				OverlapBSD:     "0123abcdef",
+				OverlapLinux:   "0123abcdef",
+				OverlapWindows: "0123abcdef",
+				OverlapSolaris: "0123abcdef",
+			},
+		},
+		{
+			name:     "contiguous new before old",
+			segments: []layers.TCP{segment(1005, "abcdef"), segment(1001, "0123XY")},
+			report:   `1005 kept "ab" discarded "XY"`,
+			want: map[OverlapPolicy]string{
+				OverlapFirst:   "0123abcdef",
+				OverlapLast:    "0123XYcdef",
+				OverlapBSD:     "0123XYcdef",
+				OverlapLinux:   "0123XYcdef",
+				OverlapWindows: "0123abcdef",
+				OverlapSolaris: "0123abcdef",
+			},
+		},
+		{
+			name:     "covering",
+			segments: []layers.TCP{segment(1005, "ab"), segment(1005, "XYZ"), segment(1001, "0123")},
+			report:   `1005 kept "ab" discarded "XY"`,
+			want: map[OverlapPolicy]string{
+				OverlapFirst:   "0123abZ",
+				OverlapLast:    "0123XYZ",
+				OverlapBSD:     "0123abZ",
+				OverlapLinux:   "0123XYZ",
+				OverlapWindows: "0123abZ",
+				OverlapSolaris: "0123XYZ",
+			},
+		},
+	} {
+		for policy, want := range test.want {
+			f := &testFactory{}
+			a := NewAssembler(NewStreamPool(f))
+			a.OverlapPolicy = policy
+			a.Assemble(netFlow, &layers.TCP{SrcPort: 1, DstPort: 2, SYN: true, Seq: 1000})
+			for i := range test.segments {
+				a.Assemble(netFlow, &test.segments[i])
+			}
+			if got := string(f.data["1.2.3.4"]); got != want {
+				t.Errorf("%s, %v: got %q, want %q", test.name, policy, got, want)
+			}
+			if len(f.overlaps) != 1 {
+				t.Errorf("%s, %v: got overlaps %q, want 1", test.name, policy, f.overlaps)
+			} else if policy == OverlapFirst && f.overlaps[0] != test.report {
+				t.Errorf("%s: got overlap %q, want %q", test.name, f.overlaps[0], test.report)
+			}
+		}
+	}
+}
+
+func TestOverlapPoliciesLargeSegments(t *testing.T) {
+	// Segments larger than a page, as captured with TSO or GRO, are split
+	// over several pages, but the policies apply to the whole segments.
+	old := bytes.Repeat([]byte{'a'}, 3000)
+	later := bytes.Repeat([]byte{'b'}, 2900)
+	for policy, want := range map[OverlapPolicy][]byte{
+		OverlapFirst:   old,
+		OverlapLast:    append(old[:100:100], later...),
+		OverlapBSD:     old,
+		OverlapLinux:   old,
+		OverlapWindows: old,
+		OverlapSolaris: old,
+	} {
+		f := &testFactory{}
+		a := NewAssembler(NewStreamPool(f))
+		a.OverlapPolicy = policy
+		a.Assemble(netFlow, &layers.TCP{SrcPort: 1, DstPort: 2, SYN: true, Seq: 1000})
+		a.Assemble(netFlow, &layers.TCP{SrcPort: 1, DstPort: 2, Seq: 1002, BaseLayer: layers.BaseLayer{Payload: old}})
+		a.Assemble(netFlow, &layers.TCP{SrcPort: 1, DstPort: 2, Seq: 1102, BaseLayer: layers.BaseLayer{Payload: later}})
+		a.Assemble(netFlow, &layers.TCP{SrcPort: 1, DstPort: 2, Seq: 1001, BaseLayer: layers.BaseLayer{Payload: []byte{'0'}}})
+		if got := f.data["1.2.3.4"]; !bytes.Equal(got, append([]byte{'0'}, want...)) {
+			t.Errorf("%v: got %d bytes, %d of them new", policy, len(got), bytes.Count(got, []byte{'b'}))
+		}
+	}
+}
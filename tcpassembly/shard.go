@@ -0,0 +1,160 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpassembly
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ShardedAssemblerOptions controls the behavior of a ShardedAssembler.
+type ShardedAssemblerOptions struct {
+	// Shards is the number of Assemblers run concurrently.  If <= 0, one is
+	// run per CPU.
+	Shards int
+	// QueueSize is the number of packets queued for each Assembler before
+	// AssembleWithTimestamp blocks.
+	QueueSize int
+	// AssemblerOptions are the options of each Assembler.
+	AssemblerOptions
+}
+
+// DefaultShardedAssemblerOptions provides default options for a
+// ShardedAssembler.
+var DefaultShardedAssemblerOptions = ShardedAssemblerOptions{
+	QueueSize:        1000,
+	AssemblerOptions: DefaultAssemblerOptions,
+}
+
+// ShardedAssembler reassembles TCP streams with several Assemblers running
+// concurrently, each in its own goroutine with its own StreamPool, as
+// recommended in the Assembler documentation.  Packets are dispatched to the
+// Assemblers by hashing their addresses and ports with Flow.FastHash, which
+// sends both directions of a connection to the same Assembler, so
+// NewConnectionPool may be used to create the StreamPools.
+//
+// Each Stream is only used by the goroutine of its Assembler, but Streams of
+// different connections may be used concurrently, so the state they share
+// must be protected.
+type ShardedAssembler struct {
+	shards []chan shardPacket
+	wg     sync.WaitGroup
+}
+
+// shardPacket is a packet queued for an Assembler, or a flush request if
+// flush is set.
+type shardPacket struct {
+	netFlow gopacket.Flow
+	tcp     layers.TCP
+	ts      time.Time
+	flush   *shardFlush
+}
+
+type shardFlush struct {
+	t    time.Time
+	all  bool
+	done chan<- [2]int // flushed and closed connections
+}
+
+// NewShardedAssembler creates a new ShardedAssembler and starts its
+// Assemblers, creating their StreamPools with newPool.
+func NewShardedAssembler(newPool func() *StreamPool, options ShardedAssemblerOptions) *ShardedAssembler {
+	n := options.Shards
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	s := &ShardedAssembler{shards: make([]chan shardPacket, n)}
+	for i := range s.shards {
+		a := NewAssembler(newPool())
+		a.AssemblerOptions = options.AssemblerOptions
+		s.shards[i] = make(chan shardPacket, options.QueueSize)
+		s.wg.Add(1)
+		go s.run(a, s.shards[i])
+	}
+	return s
+}
+
+func (s *ShardedAssembler) run(a *Assembler, packets <-chan shardPacket) {
+	defer s.wg.Done()
+	for p := range packets {
+		if f := p.flush; f != nil {
+			var flushed, closed int
+			if f.all {
+				closed = a.FlushAll()
+			} else {
+				flushed, closed = a.FlushOlderThan(f.t)
+			}
+			f.done <- [2]int{flushed, closed}
+			continue
+		}
+		a.AssembleWithTimestamp(p.netFlow, &p.tcp, p.ts)
+	}
+}
+
+// Assemble calls AssembleWithTimestamp with the current timestamp, useful for
+// packets being read directly off the wire.
+func (s *ShardedAssembler) Assemble(netFlow gopacket.Flow, t *layers.TCP) {
+	s.AssembleWithTimestamp(netFlow, t, time.Now())
+}
+
+// AssembleWithTimestamp queues the packet t, seen at timestamp, for the
+// Assembler handling its connection.  It blocks if that Assembler is too far
+// behind.  The packet is copied along with its list of options, so that t can
+// be reused, but not the bytes it refers to: its payload and the data of its
+// options must not be modified until the Assembler is done with them, and
+// DecodingLayerParser callers should decode each packet into new data.
+func (s *ShardedAssembler) AssembleWithTimestamp(netFlow gopacket.Flow, t *layers.TCP, timestamp time.Time) {
+	// Both flow hashes are symmetric, and so is any combination of them.
+	h := netFlow.FastHash()*1099511628211 + t.TransportFlow().FastHash()
+	p := shardPacket{netFlow: netFlow, tcp: *t, ts: timestamp}
+	p.tcp.Options = append([]layers.TCPOption(nil), t.Options...)
+	s.shards[h%uint64(len(s.shards))] <- p
+}
+
+// flush has every Assembler flush its connections once done with the
+// packets queued before, and sums up their results.
+func (s *ShardedAssembler) flush(t time.Time, all bool) (flushed, closed int) {
+	done := make(chan [2]int, len(s.shards))
+	for _, packets := range s.shards {
+		packets <- shardPacket{flush: &shardFlush{t: t, all: all, done: done}}
+	}
+	for range s.shards {
+		r := <-done
+		flushed += r[0]
+		closed += r[1]
+	}
+	return
+}
+
+// FlushOlderThan calls FlushOlderThan on every Assembler once it has handled
+// the packets queued before, and returns the total number of connections
+// flushed and closed.
+func (s *ShardedAssembler) FlushOlderThan(t time.Time) (flushed, closed int) {
+	return s.flush(t, false)
+}
+
+// FlushAll calls FlushAll on every Assembler once it has handled the packets
+// queued before, and returns the total number of connections closed.
+func (s *ShardedAssembler) FlushAll() (closed int) {
+	_, closed = s.flush(time.Time{}, true)
+	return
+}
+
+// Close flushes all connections like FlushAll, then stops the Assemblers.
+// The ShardedAssembler must not be used afterwards.
+func (s *ShardedAssembler) Close() (closed int) {
+	closed = s.FlushAll()
+	for _, packets := range s.shards {
+		close(packets)
+	}
+	s.wg.Wait()
+	return
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpassembly
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestShardedAssembler(t *testing.T) {
+	f := &testFactory{}
+	options := DefaultShardedAssemblerOptions
+	options.Shards = 4
+	options.TrackMetrics = true
+	s := NewShardedAssembler(func() *StreamPool { return NewConnectionPool(testConnectionFactory{f}) }, options)
+	start := time.Unix(1, 0)
+	const conns = 16
+	var want []string
+	mss := layers.TCPOption{OptionType: 2, OptionLength: 4, OptionData: []byte{0x05, 0xb4}}
+	// The same TCP layer is reused for all packets, as a DecodingLayerParser
+	// would.
+	var tcp layers.TCP
+	for i := 0; i < conns; i++ {
+		port := layers.TCPPort(1000 + i)
+		req, resp := fmt.Sprintf("req%d", i), fmt.Sprintf("resp%d", i)
+		for _, p := range []testPacket{
+			{true, layers.TCP{SYN: true, Seq: 100, Options: []layers.TCPOption{mss}}},
+			{false, layers.TCP{SYN: true, ACK: true, Seq: 500, Ack: 101, Options: []layers.TCPOption{mss}}},
+			{true, layers.TCP{ACK: true, Seq: 101, Ack: 501, BaseLayer: layers.BaseLayer{Payload: []byte(req)}}},
+			{false, layers.TCP{ACK: true, Seq: 501, Ack: 101 + uint32(len(req)), BaseLayer: layers.BaseLayer{Payload: []byte(resp)}}},
+		} {
+			net := netFlow
+			p.tcp.SrcPort, p.tcp.DstPort = port, 80
+			if !p.fromClient {
+				net = netFlow.Reverse()
+				p.tcp.SrcPort, p.tcp.DstPort = 80, port
+			}
+			// Decode the packet for its TransportFlow to be set.
+			buf := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, &p.tcp, gopacket.Payload(p.tcp.Payload)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tcp.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+				t.Fatal(err)
+			}
+			s.AssembleWithTimestamp(net, &tcp, start)
+		}
+		want = append(want, fmt.Sprintf("1.2.3.4:%d %q %q", port, req, resp))
+	}
+	if flushed, closed := s.FlushOlderThan(start); flushed != 0 || closed != 0 {
+		t.Errorf("flushed %d and closed %d connections too early", flushed, closed)
+	}
+	if flushed, closed := s.FlushOlderThan(start.Add(time.Second)); flushed != 2*conns || closed != 2*conns {
+		t.Errorf("flushed %d and closed %d connections, want %d", flushed, closed, 2*conns)
+	}
+	if closed := s.Close(); closed != 0 {
+		t.Errorf("closed %d more connections, want 0", closed)
+	}
+	// The completed connections are the events without a direction.
+	var got []string
+	for _, e := range f.events {
+		if name := strings.TrimSuffix(e, " complete"); !strings.Contains(name, " ") {
+			got = append(got, fmt.Sprintf("%s %q %q", name, f.data[name+" client->server"], f.data[name+" server->client"]))
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("connections:\ngot  %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpassembly
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TCPState is the state of a TCP connection, as seen by an Assembler whose
+// AssemblerOptions.TrackState is set.  Both halves of a connection share
+// its state.
+type TCPState int
+
+const (
+	// TCPStateUntracked is the state of connections whose state isn't
+	// tracked.
+	TCPStateUntracked TCPState = iota
+	// TCPStateSynSent means the client sent a SYN.
+	TCPStateSynSent
+	// TCPStateSynReceived means the server answered the SYN of the client.
+	TCPStateSynReceived
+	// TCPStateEstablished means the client acknowledged the SYN of the
+	// server, completing the handshake.
+	TCPStateEstablished
+	// TCPStateMidStream means the connection was picked up without seeing
+	// its handshake.
+	TCPStateMidStream
+	// TCPStateFinWait means one side of the connection sent a FIN.
+	TCPStateFinWait
+	// TCPStateClosed means both sides of the connection sent a FIN.
+	TCPStateClosed
+	// TCPStateReset means the connection was reset by a RST.
+	TCPStateReset
+)
+
+var tcpStateNames = []string{
+	TCPStateUntracked:   "UNTRACKED",
+	TCPStateSynSent:     "SYN_SENT",
+	TCPStateSynReceived: "SYN_RECEIVED",
+	TCPStateEstablished: "ESTABLISHED",
+	TCPStateMidStream:   "MID_STREAM",
+	TCPStateFinWait:     "FIN_WAIT",
+	TCPStateClosed:      "CLOSED",
+	TCPStateReset:       "RESET",
+}
+
+func (s TCPState) String() string {
+	if s < 0 || int(s) >= len(tcpStateNames) {
+		return fmt.Sprintf("TCPState(%d)", int(s))
+	}
+	return tcpStateNames[s]
+}
+
+// StateError describes a TCP packet violating the state of its connection.
+type StateError struct {
+	// State is the state of the connection when the packet was seen.
+	State TCPState
+	// Reason tells why the packet violates the state.
+	Reason string
+	// Seen is the timestamp the packet was pulled off the wire.
+	Seen time.Time
+}
+
+func (e *StateError) Error() string {
+	return fmt.Sprintf("tcpassembly: %s in state %v", e.Reason, e.State)
+}
+
+// InvalidStateHandler may be implemented by Streams to be told about the
+// packets violating the state of their connection, when the Assembler
+// tracks connection states.  InvalidState is called with the packet's
+// violation before passing its data on to the Stream, or dropping it if
+// AssemblerOptions.RejectInvalidState is set.
+//
+// Note that the data of connections picked up mid-stream is considered
+// invalid, since it shows up before any handshake.
+type InvalidStateHandler interface {
+	InvalidState(err *StateError)
+}
+
+// connState is the state of a TCP connection shared by the connection
+// objects of its two halves.
+type connState struct {
+	mu     sync.Mutex
+	state  TCPState
+	client key         // key of the half sent by the client
+	fins   [2]Sequence // sequence of the FIN sent by each side, indexed by Direction
+	// metrics is set when the connection metrics are computed.
+	metrics *metricsTracker
+}
+
+func newConnState() *connState {
+	return &connState{fins: [2]Sequence{invalidSequence, invalidSequence}}
+}
+
+// update updates the state with packet t sent on the half with key k at ts,
+// along with the metrics if measure is set.  It returns the state of the
+// connection before and after t, and the reason why t violates the former, if
+// it does.
+func (s *connState) update(k key, t *layers.TCP, ts time.Time, measure bool) (old, next TCPState, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if measure && s.metrics == nil {
+		s.metrics = newMetricsTracker()
+	}
+	data := len(t.Payload) > 0
+	switch {
+	case s.state != TCPStateUntracked:
+	case t.SYN && !t.ACK:
+		s.client, s.state = k, TCPStateSynSent
+	case t.SYN:
+		s.client, s.state = k.reverse(), TCPStateSynReceived
+	default:
+		s.client, s.state = k, TCPStateMidStream
+	}
+	old = s.state
+	side := ClientToServer
+	if k != s.client {
+		side = ServerToClient
+	}
+	if fin := s.fins[side]; data && fin != invalidSequence && fin.Difference(Sequence(t.Seq).Add(len(t.Payload))) > 0 {
+		reason = "payload after FIN"
+	}
+	switch s.state {
+	case TCPStateSynSent:
+		if t.SYN && t.ACK && side == ServerToClient {
+			s.state = TCPStateSynReceived
+		} else if data && !t.SYN {
+			reason = "payload before handshake"
+		}
+	case TCPStateSynReceived:
+		if t.ACK && !t.SYN && side == ClientToServer {
+			s.state = TCPStateEstablished
+		} else if data && !t.SYN {
+			reason = "payload before handshake"
+		}
+	case TCPStateMidStream:
+		if data {
+			reason = "payload before handshake"
+		}
+	case TCPStateEstablished, TCPStateFinWait, TCPStateClosed:
+		// The server retransmits its SYN-ACK when the client's ACK is lost.
+		if t.SYN && (side == ClientToServer || !t.ACK) {
+			reason = "SYN on established connection"
+		}
+	case TCPStateReset:
+		if data {
+			reason = "payload after RST"
+		}
+	}
+	if t.RST {
+		s.state = TCPStateReset
+	} else if t.FIN && s.state != TCPStateReset {
+		if s.fins[side] == invalidSequence {
+			s.fins[side] = Sequence(t.Seq).Add(len(t.Payload))
+		}
+		if s.fins[side.Reverse()] != invalidSequence {
+			s.state = TCPStateClosed
+		} else {
+			s.state = TCPStateFinWait
+		}
+	}
+	if s.metrics != nil {
+		s.metrics.update(side, t, ts, old, s.state)
+	}
+	return old, s.state, reason
+}
+
+// snapshot returns the metrics of the connection, if they are computed.
+func (s *connState) snapshot(lastSeen time.Time) (Metrics, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.metrics == nil {
+		return Metrics{}, false
+	}
+	return s.metrics.snapshot(lastSeen), true
+}
+
+// connState returns the state shared by both halves of the TCP connection of
+// conn, creating it if need be.
+func (p *StreamPool) connState(conn *connection) *connState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if conn.state == nil {
+		if rev := p.conns[conn.key.reverse()]; rev != nil && rev.state != nil {
+			conn.state = rev.state
+		} else {
+			conn.state = newConnState()
+		}
+	}
+	return conn.state
+}
+
+// checkState updates the state of the TCP connection of conn with packet t,
+// sent on the half with key k, and reports t to the stream if it violates
+// that state.  It returns the state of the connection after t, and false if t
+// must be dropped.
+func (a *Assembler) checkState(conn *connection, k key, t *layers.TCP, ts time.Time) (TCPState, bool) {
+	s := conn.state
+	if s == nil {
+		s = a.connPool.connState(conn)
+	}
+	state, next, reason := s.update(k, t, ts, a.TrackMetrics)
+	if reason == "" || k != conn.key {
+		return next, true
+	}
+	if *debugLog {
+		log.Printf("%v %s in state %v", k, reason, state)
+	}
+	if h, ok := conn.stream.(InvalidStateHandler); ok {
+		h.InvalidState(&StateError{State: state, Reason: reason, Seen: ts})
+	}
+	return next, !a.RejectInvalidState
+}
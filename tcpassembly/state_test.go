@@ -0,0 +1,100 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpassembly
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func testStatePackets(a *Assembler, packets []testPacket) {
+	for _, p := range packets {
+		net := netFlow
+		p.tcp.SrcPort, p.tcp.DstPort = 1000, 80
+		if !p.fromClient {
+			net = netFlow.Reverse()
+			p.tcp.SrcPort, p.tcp.DstPort = 80, 1000
+		}
+		a.AssembleWithTimestamp(net, &p.tcp, time.Unix(1, 0))
+	}
+}
+
+func TestStateHandshake(t *testing.T) {
+	f := &testFactory{}
+	a := NewAssembler(NewStreamPool(f))
+	a.TrackState = true
+	testStatePackets(a, []testPacket{
+		{true, layers.TCP{SYN: true, Seq: 100}},
+		{false, layers.TCP{SYN: true, ACK: true, Seq: 500, Ack: 101}},
+		{true, layers.TCP{ACK: true, Seq: 101, Ack: 501}},
+		{true, layers.TCP{ACK: true, Seq: 101, Ack: 501, BaseLayer: layers.BaseLayer{Payload: []byte("req")}}},
+		{false, layers.TCP{ACK: true, FIN: true, Seq: 501, Ack: 104, BaseLayer: layers.BaseLayer{Payload: []byte("resp")}}},
+		{true, layers.TCP{ACK: true, FIN: true, Seq: 104, Ack: 506}},
+	})
+	want := []string{
+		`1.2.3.4 "" SYN_SENT`,
+		`5.6.7.8 "" SYN_RECEIVED`,
+		`1.2.3.4 "req" ESTABLISHED`,
+		`5.6.7.8 "resp" FIN_WAIT`,
+		`5.6.7.8 complete`,
+		`1.2.3.4 "" CLOSED`,
+		`1.2.3.4 complete`,
+	}
+	if !reflect.DeepEqual(f.events, want) {
+		t.Errorf("events:\ngot  %q\nwant %q", f.events, want)
+	}
+}
+
+func TestStateReject(t *testing.T) {
+	f := &testFactory{}
+	a := NewAssembler(NewStreamPool(f))
+	a.RejectInvalidState = true
+	testStatePackets(a, []testPacket{
+		{true, layers.TCP{SYN: true, Seq: 100}},
+		{true, layers.TCP{ACK: true, Seq: 101, BaseLayer: layers.BaseLayer{Payload: []byte("early")}}},
+		{false, layers.TCP{SYN: true, ACK: true, Seq: 500, Ack: 101}},
+		{true, layers.TCP{ACK: true, Seq: 101, Ack: 501, BaseLayer: layers.BaseLayer{Payload: []byte("req")}}},
+		{false, layers.TCP{RST: true, Seq: 501}},
+		{false, layers.TCP{ACK: true, Seq: 501, Ack: 104, BaseLayer: layers.BaseLayer{Payload: []byte("injected")}}},
+	})
+	want := []string{
+		`1.2.3.4 "" SYN_SENT`,
+		`1.2.3.4 tcpassembly: payload before handshake in state SYN_SENT`,
+		`5.6.7.8 "" SYN_RECEIVED`,
+		`1.2.3.4 "req" ESTABLISHED`,
+		`5.6.7.8 "" RESET`,
+		`5.6.7.8 complete`,
+		`5.6.7.8 tcpassembly: payload after RST in state RESET`,
+	}
+	if !reflect.DeepEqual(f.events, want) {
+		t.Errorf("events:\ngot  %q\nwant %q", f.events, want)
+	}
+}
+
+func TestStateMidStream(t *testing.T) {
+	f := &testFactory{}
+	a := NewAssembler(NewStreamPool(f))
+	a.TrackState = true
+	testStatePackets(a, []testPacket{
+		{true, layers.TCP{ACK: true, Seq: 101, BaseLayer: layers.BaseLayer{Payload: []byte("req")}}},
+		{true, layers.TCP{ACK: true, Seq: 104, BaseLayer: layers.BaseLayer{Payload: []byte("more")}}},
+	})
+	a.FlushAll()
+	want := []string{
+		`1.2.3.4 tcpassembly: payload before handshake in state MID_STREAM`,
+		`1.2.3.4 tcpassembly: payload before handshake in state MID_STREAM`,
+		`1.2.3.4 "req" skip=-1 MID_STREAM`,
+		`1.2.3.4 "more" MID_STREAM`,
+		`1.2.3.4 complete`,
+	}
+	if !reflect.DeepEqual(f.events, want) {
+		t.Errorf("events:\ngot  %q\nwant %q", f.events, want)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpreader
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+// ParseFunc parses the data of a TCP stream read from r.  It must read r up
+// to its end, or close it, before returning; any bytes left are discarded
+// once it returns.
+type ParseFunc func(netFlow, tcpFlow gopacket.Flow, r *ReaderStream)
+
+// Protocol is an application protocol whose TCP streams can be parsed.
+type Protocol struct {
+	// Name is a human-readable name of the protocol.
+	Name string
+	// Ports are the well-known ports of the protocol.  Streams to or from
+	// them are assumed to use the protocol, unless Sniff rejects them.
+	Ports []layers.TCPPort
+	// Sniff, if set, returns whether the first bytes of a stream, as many as
+	// it started with, belong to the protocol.  It is only given data that
+	// must not be retained.
+	Sniff func(data []byte) bool
+	// Parse parses the streams of the protocol.
+	Parse ParseFunc
+}
+
+// Registry finds the Protocol of TCP streams among the ones registered.  It
+// is safe for concurrent use.
+type Registry struct {
+	mu        sync.RWMutex
+	protocols []*Protocol
+	ports     map[layers.TCPPort][]*Protocol
+}
+
+// NewRegistry returns a new empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{ports: make(map[layers.TCPPort][]*Protocol)}
+}
+
+// DefaultRegistry is the Registry used by StreamDispatcher when none is set,
+// to which Register adds protocols.
+var DefaultRegistry = NewRegistry()
+
+// Register adds p to DefaultRegistry.
+func Register(p *Protocol) {
+	DefaultRegistry.Register(p)
+}
+
+// Register adds p to the registry.  Protocols are tried in the order they
+// were registered.
+func (r *Registry) Register(p *Protocol) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.protocols = append(r.protocols, p)
+	for _, port := range p.Ports {
+		r.ports[port] = append(r.ports[port], p)
+	}
+}
+
+// Match returns the protocol of the stream with the given TCP flow starting
+// with data, or nil if none matches.  The protocols with a port of the flow
+// are tried first, and accepted unless their Sniff function rejects data.
+// Otherwise, the first protocol whose Sniff function accepts data is returned.
+func (r *Registry) Match(tcpFlow gopacket.Flow, data []byte) *Protocol {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	src, dst := tcpFlow.Endpoints()
+	for _, e := range []gopacket.Endpoint{dst, src} {
+		if raw := e.Raw(); len(raw) == 2 {
+			for _, p := range r.ports[layers.TCPPort(binary.BigEndian.Uint16(raw))] {
+				if p.Sniff == nil || p.Sniff(data) {
+					return p
+				}
+			}
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	for _, p := range r.protocols {
+		if p.Sniff != nil && p.Sniff(data) {
+			return p
+		}
+	}
+	return nil
+}
+
+// StreamDispatcher is a tcpassembly.StreamFactory handing each new stream to
+// the parser of its protocol.  It creates a ReaderStream for every stream,
+// waits for its first bytes, then finds its Protocol in the Registry and
+// runs its Parse function in a new goroutine.  The parser reads the stream
+// from its start, including the bytes used to find the protocol.
+type StreamDispatcher struct {
+	// Registry holds the protocols streams are dispatched to.  If nil,
+	// DefaultRegistry is used.
+	Registry *Registry
+	// Fallback parses the streams of unknown protocols.  If nil, their
+	// bytes are discarded.
+	Fallback ParseFunc
+	// ReaderStreamOptions are the options of the ReaderStreams created.
+	ReaderStreamOptions
+}
+
+// New implements tcpassembly.StreamFactory's New function.
+func (d *StreamDispatcher) New(netFlow, tcpFlow gopacket.Flow) tcpassembly.Stream {
+	r := NewReaderStream()
+	r.ReaderStreamOptions = d.ReaderStreamOptions
+	go d.dispatch(netFlow, tcpFlow, &r)
+	return &r
+}
+
+func (d *StreamDispatcher) dispatch(netFlow, tcpFlow gopacket.Flow, r *ReaderStream) {
+	registry := d.Registry
+	if registry == nil {
+		registry = DefaultRegistry
+	}
+	parse := d.Fallback
+	if p := registry.Match(tcpFlow, r.peek()); p != nil {
+		parse = p.Parse
+	}
+	if parse != nil {
+		parse(netFlow, tcpFlow, r)
+	}
+	DiscardBytesToEOF(r)
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package tcpreader
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/tcpassembly"
+)
+
+func TestStreamDispatcher(t *testing.T) {
+	parsed := make(chan string)
+	parser := func(name string) ParseFunc {
+		return func(netFlow, tcpFlow gopacket.Flow, r *ReaderStream) {
+			data, err := ioutil.ReadAll(r)
+			parsed <- fmt.Sprintf("%s %q %v", name, data, err)
+		}
+	}
+	prefix := func(p string) func([]byte) bool {
+		return func(data []byte) bool { return bytes.HasPrefix(data, []byte(p)) }
+	}
+	r := NewRegistry()
+	r.Register(&Protocol{Name: "http", Ports: []layers.TCPPort{80}, Sniff: prefix("GET "), Parse: parser("http")})
+	r.Register(&Protocol{Name: "hello", Sniff: prefix("HELO"), Parse: parser("hello")})
+	r.Register(&Protocol{Name: "any", Ports: []layers.TCPPort{7}, Parse: parser("any")})
+	d := &StreamDispatcher{Registry: r, Fallback: parser("fallback")}
+
+	for _, test := range []struct {
+		src, dst layers.TCPPort
+		data     []string
+		want     string
+	}{
+		{1000, 80, []string{"GET / HTTP/1.0\r\n", "\r\n"}, `http "GET / HTTP/1.0\r\n\r\n" <nil>`},
+		{1000, 25, []string{"HELO ", "example.com\r\n"}, `hello "HELO example.com\r\n" <nil>`},
+		{80, 1000, []string{"HELO"}, `hello "HELO" <nil>`},
+		{1000, 7, []string{"", "abc"}, `any "abc" <nil>`},
+		{1000, 80, []string{"xyz"}, `fallback "xyz" <nil>`},
+		{1000, 2000, nil, `fallback "" <nil>`},
+	} {
+		tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(test.src), layers.NewTCPPortEndpoint(test.dst))
+		s := d.New(netFlow, tcpFlow)
+		go func() {
+			for _, data := range test.data {
+				s.Reassembled([]tcpassembly.Reassembly{{Bytes: []byte(data)}})
+			}
+			s.ReassemblyComplete()
+		}()
+		if got := <-parsed; got != test.want {
+			t.Errorf("%v: got %s, want %s", tcpFlow, got, test.want)
+		}
+	}
+}
+
+func TestRegistryMatch(t *testing.T) {
+	r := NewRegistry()
+	p := &Protocol{Name: "p", Ports: []layers.TCPPort{80}}
+	r.Register(p)
+	tcpFlow, _ := gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(1000), layers.NewTCPPortEndpoint(2000))
+	if got := r.Match(tcpFlow, []byte("abc")); got != nil {
+		t.Errorf("unknown port matched %v", got.Name)
+	}
+	if got := r.Match(tcpFlow.Reverse(), nil); got != nil {
+		t.Errorf("empty stream matched %v", got.Name)
+	}
+	tcpFlow, _ = gopacket.FlowFromEndpoints(layers.NewTCPPortEndpoint(80), layers.NewTCPPortEndpoint(2000))
+	if got := r.Match(tcpFlow, nil); got != p {
+		t.Errorf("server port: got %v, want %v", got, p)
+	}
+}
@@ -42,6 +42,10 @@
 // for HTTP request parsing to do all the dirty-work of parsing requests from
 // the wire in real-time.  Pass this stream factory to an tcpassembly.StreamPool,
 // start up an tcpassembly.Assembler, and you're good to go!
+//
+// To handle several protocols, register them in a Registry, and use a
+// StreamDispatcher as the stream factory: it hands each stream to the parser
+// of its protocol, found by port or by the first bytes of the stream.
 package tcpreader
 
 import (
@@ -155,18 +159,8 @@ func (r *ReaderStream) stripEmpty() {
 	}
 }
 
-// DataLost is returned by the ReaderStream's Read function when it encounters
-// a Reassembly with Skip != 0.
-var DataLost error = errors.New("lost data")
-
-// Read implements io.Reader's Read function.
-// Given a byte slice, it will either copy a non-zero number of bytes into
-// that slice and return the number of bytes and a nil error, or it will
-// leave slice p as is and return 0, io.EOF.
-func (r *ReaderStream) Read(p []byte) (int, error) {
-	if !r.initiated {
-		panic("ReaderStream not created via NewReaderStream")
-	}
+// fill waits for bytes to read, unless the stream is closed.
+func (r *ReaderStream) fill() {
 	var ok bool
 	r.stripEmpty()
 	for !r.closed && len(r.current) == 0 {
@@ -181,6 +175,31 @@ func (r *ReaderStream) Read(p []byte) (int, error) {
 			r.closed = true
 		}
 	}
+}
+
+// peek returns the next bytes to read without consuming them, or nil at the
+// end of the stream.  They are only valid until the next Read.
+func (r *ReaderStream) peek() []byte {
+	r.fill()
+	if len(r.current) > 0 {
+		return r.current[0].Bytes
+	}
+	return nil
+}
+
+// DataLost is returned by the ReaderStream's Read function when it encounters
+// a Reassembly with Skip != 0.
+var DataLost error = errors.New("lost data")
+
+// Read implements io.Reader's Read function.
+// Given a byte slice, it will either copy a non-zero number of bytes into
+// that slice and return the number of bytes and a nil error, or it will
+// leave slice p as is and return 0, io.EOF.
+func (r *ReaderStream) Read(p []byte) (int, error) {
+	if !r.initiated {
+		panic("ReaderStream not created via NewReaderStream")
+	}
+	r.fill()
 	if len(r.current) > 0 {
 		current := &r.current[0]
 		if r.LossErrors && !r.lossReported && current.Skip != 0 {
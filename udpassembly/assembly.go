@@ -0,0 +1,252 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+// Package udpassembly provides UDP conversation tracking.
+//
+// The udpassembly package groups UDP datagrams into conversations, for use in
+// packet-sniffing applications handling protocols over UDP such as DNS, QUIC,
+// RTP or syslog.  It is the UDP counterpart of the tcpassembly package: the
+// caller reads packets off the wire, then presents them to an Assembler in the
+// form of gopacket layers.UDP packets (github.com/google/gopacket,
+// github.com/google/gopacket/layers).
+//
+// The Assembler uses a user-supplied ConversationFactory to create a
+// user-defined Conversation for each pair of endpoints exchanging datagrams,
+// whichever direction they're sent in, then passes it the datagrams with
+// their timestamp and direction.  Since UDP has no notion of connection
+// teardown, conversations end when they're idle: the caller must
+// periodically call FlushOlderThan to complete them.
+package udpassembly
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var debugLog = flag.Bool("udpassembly_debug_log", false, "If true, the github.com/google/gopacket/udpassembly library will log verbose debugging information (at least one line per packet)")
+
+// Direction tells which way a datagram was sent in a conversation.
+type Direction int
+
+const (
+	// ClientToServer is the direction of the datagrams sent by the host
+	// which sent the first datagram seen.
+	ClientToServer Direction = 0
+	// ServerToClient is the direction of the datagrams sent by the other
+	// host.
+	ServerToClient Direction = 1
+)
+
+// String returns a human-readable direction.
+func (d Direction) String() string {
+	if d == ClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
+// Reverse returns the opposite direction.
+func (d Direction) Reverse() Direction {
+	return 1 - d
+}
+
+// Datagram is a UDP datagram of a conversation.
+type Datagram struct {
+	// Direction is the direction the datagram was sent in.
+	Direction Direction
+	// Payload is the data of the datagram.  It belongs to the packet passed
+	// to the Assembler, so it must be copied to be kept if the caller reuses
+	// its packets, as DecodingLayerParser does.
+	Payload []byte
+	// Seen is the timestamp the datagram was pulled off the wire.
+	Seen time.Time
+}
+
+// Conversation is implemented by the caller to handle the datagrams exchanged
+// between two UDP endpoints.  Callers create a ConversationFactory, then the
+// Assembler uses it to create a new Conversation for every pair of
+// endpoints.
+//
+// assembly will, in order:
+//  1. Create the conversation via ConversationFactory.New
+//  2. Call Datagram once for every datagram exchanged, in the order they
+//     were passed to the Assembler
+//  3. Call ConversationComplete one time, once the conversation is idle,
+//     after which the conversation is dereferenced by assembly.
+type Conversation interface {
+	// Datagram is called with each datagram of the conversation.
+	Datagram(d *Datagram)
+	// ConversationComplete is called when the conversation is flushed for
+	// being idle.
+	ConversationComplete()
+}
+
+// ConversationFactory is used by assembly to create a new Conversation for
+// each new pair of UDP endpoints.
+type ConversationFactory interface {
+	// New should return a new conversation for the given UDP key.  The
+	// flows go from the client to the server.
+	New(netFlow, udpFlow gopacket.Flow) Conversation
+}
+
+type key [2]gopacket.Flow
+
+func (k *key) String() string {
+	return k[0].String() + ":" + k[1].String()
+}
+
+func (k key) reverse() key {
+	return key{k[0].Reverse(), k[1].Reverse()}
+}
+
+// conversation is the state of a Conversation.  Its lock serializes the
+// calls to the Conversation.
+type conversation struct {
+	key      key // key of the client to server direction
+	conv     Conversation
+	mu       sync.Mutex
+	lastSeen time.Time
+	closed   bool
+}
+
+// Assembler groups UDP datagrams into conversations.  It is safe for
+// concurrent use: each conversation is handled serially, but multiple
+// goroutines may pass datagrams of different conversations at once.
+type Assembler struct {
+	factory ConversationFactory
+	mu      sync.RWMutex
+	// conversations are indexed by the keys of both their directions.
+	conversations map[key]*conversation
+}
+
+// NewAssembler creates a new assembler, handing datagrams to Conversations
+// created as necessary using the passed-in ConversationFactory.
+func NewAssembler(factory ConversationFactory) *Assembler {
+	return &Assembler{
+		factory:       factory,
+		conversations: make(map[key]*conversation),
+	}
+}
+
+// Assemble calls AssembleWithTimestamp with the current timestamp, useful for
+// packets being read directly off the wire.
+func (a *Assembler) Assemble(netFlow gopacket.Flow, u *layers.UDP) {
+	a.AssembleWithTimestamp(netFlow, u, time.Now())
+}
+
+// AssembleWithTimestamp passes the datagram u, seen at timestamp, to the
+// Conversation of its endpoints, creating it if need be.
+//
+// The timestamp passed in must be the timestamp the packet was seen.  For
+// packets read off the wire, time.Now() should be fine.  For packets read from
+// PCAP files, CaptureInfo.Timestamp should be passed in.  This timestamp will
+// affect which conversations are flushed by a call to FlushOlderThan.
+func (a *Assembler) AssembleWithTimestamp(netFlow gopacket.Flow, u *layers.UDP, timestamp time.Time) {
+	k := key{netFlow, u.TransportFlow()}
+	var c *conversation
+	// Loop in case the conversation is flushed between its lookup and its
+	// locking, as the Assembler of tcpassembly does.
+	for {
+		c = a.getConversation(k)
+		c.mu.Lock()
+		if !c.closed {
+			break
+		}
+		c.mu.Unlock()
+	}
+	defer c.mu.Unlock()
+	if c.lastSeen.Before(timestamp) {
+		c.lastSeen = timestamp
+	}
+	dir := ClientToServer
+	if k != c.key {
+		dir = ServerToClient
+	}
+	if *debugLog {
+		log.Printf("%v %v datagram of %d bytes", &c.key, dir, len(u.Payload))
+	}
+	c.conv.Datagram(&Datagram{Direction: dir, Payload: u.Payload, Seen: timestamp})
+}
+
+// getConversation returns the conversation of the datagrams with key k,
+// creating it if need be.
+func (a *Assembler) getConversation(k key) *conversation {
+	a.mu.RLock()
+	c := a.conversations[k]
+	a.mu.RUnlock()
+	if c != nil {
+		return c
+	}
+	conv := a.factory.New(k[0], k[1])
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c = a.conversations[k]; c != nil {
+		return c
+	}
+	c = &conversation{key: k, conv: conv}
+	a.conversations[k] = c
+	a.conversations[k.reverse()] = c
+	return c
+}
+
+// conversationList returns every conversation of the assembler once.
+func (a *Assembler) conversationList() []*conversation {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	cs := make([]*conversation, 0, len(a.conversations)/2)
+	for k, c := range a.conversations {
+		if k == c.key {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+// complete completes conversation c, which must be locked.
+func (a *Assembler) complete(c *conversation) {
+	if *debugLog {
+		log.Printf("%v completing", &c.key)
+	}
+	c.closed = true
+	a.mu.Lock()
+	delete(a.conversations, c.key)
+	delete(a.conversations, c.key.reverse())
+	a.mu.Unlock()
+	c.conv.ConversationComplete()
+}
+
+// FlushOlderThan completes the conversations which haven't seen any datagram
+// since the passed-in time, and returns the number of conversations completed.
+func (a *Assembler) FlushOlderThan(t time.Time) (closed int) {
+	for _, c := range a.conversationList() {
+		c.mu.Lock()
+		if !c.closed && c.lastSeen.Before(t) {
+			a.complete(c)
+			closed++
+		}
+		c.mu.Unlock()
+	}
+	return
+}
+
+// FlushAll completes all conversations, and returns the number of
+// conversations completed.
+func (a *Assembler) FlushAll() (closed int) {
+	for _, c := range a.conversationList() {
+		c.mu.Lock()
+		if !c.closed {
+			a.complete(c)
+			closed++
+		}
+		c.mu.Unlock()
+	}
+	return
+}
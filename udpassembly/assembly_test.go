@@ -0,0 +1,93 @@
+// Copyright 2018 Google, Inc. All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license
+// that can be found in the LICENSE file in the root of the source
+// tree.
+
+package udpassembly
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var netFlow gopacket.Flow
+
+func init() {
+	netFlow, _ = gopacket.FlowFromEndpoints(
+		layers.NewIPEndpoint(net.IP{1, 2, 3, 4}),
+		layers.NewIPEndpoint(net.IP{5, 6, 7, 8}))
+}
+
+type testFactory struct {
+	events []string
+}
+
+type testConversation struct {
+	f    *testFactory
+	name string
+}
+
+func (f *testFactory) New(netFlow, udpFlow gopacket.Flow) Conversation {
+	return &testConversation{f, fmt.Sprintf("%v:%v", netFlow, udpFlow)}
+}
+func (c *testConversation) Datagram(d *Datagram) {
+	c.f.events = append(c.f.events, fmt.Sprintf("%s %v %q %d", c.name, d.Direction, d.Payload, d.Seen.Unix()))
+}
+func (c *testConversation) ConversationComplete() {
+	c.f.events = append(c.f.events, c.name+" complete")
+}
+
+// testUDP returns a decoded UDP datagram, whose TransportFlow is set.
+func testUDP(t *testing.T, src, dst layers.UDPPort, payload string) *layers.UDP {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true}
+	if err := gopacket.SerializeLayers(buf, opts, &layers.UDP{SrcPort: src, DstPort: dst}, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	u := &layers.UDP{}
+	if err := u.DecodeFromBytes(buf.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestAssembler(t *testing.T) {
+	f := &testFactory{}
+	a := NewAssembler(f)
+	a.AssembleWithTimestamp(netFlow, testUDP(t, 1000, 53, "query"), time.Unix(1, 0))
+	a.AssembleWithTimestamp(netFlow.Reverse(), testUDP(t, 53, 1000, "answer"), time.Unix(2, 0))
+	a.AssembleWithTimestamp(netFlow.Reverse(), testUDP(t, 514, 1001, "log"), time.Unix(3, 0))
+	a.AssembleWithTimestamp(netFlow, testUDP(t, 1000, 53, "query2"), time.Unix(4, 0))
+	if closed := a.FlushOlderThan(time.Unix(4, 0)); closed != 1 {
+		t.Errorf("FlushOlderThan closed %d conversations, want 1", closed)
+	}
+	// The conversation was completed, so this starts a new one.
+	a.AssembleWithTimestamp(netFlow, testUDP(t, 1001, 514, "log2"), time.Unix(5, 0))
+	if closed := a.FlushAll(); closed != 2 {
+		t.Errorf("FlushAll closed %d conversations, want 2", closed)
+	}
+	want := []string{
+		`1.2.3.4->5.6.7.8:1000->53 client->server "query" 1`,
+		`1.2.3.4->5.6.7.8:1000->53 server->client "answer" 2`,
+		`5.6.7.8->1.2.3.4:514->1001 client->server "log" 3`,
+		`1.2.3.4->5.6.7.8:1000->53 client->server "query2" 4`,
+		`5.6.7.8->1.2.3.4:514->1001 complete`,
+		`1.2.3.4->5.6.7.8:1001->514 client->server "log2" 5`,
+	}
+	got := f.events[:len(want)]
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events:\ngot  %q\nwant %q", got, want)
+	}
+	// FlushAll completes the remaining conversations in no particular order.
+	rest := f.events[len(want):]
+	if len(rest) != 2 || rest[0] == rest[1] {
+		t.Errorf("completions: got %q", rest)
+	}
+}
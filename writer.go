@@ -97,10 +97,24 @@ type SerializeBuffer interface {
 	Clear() error
 }
 
+// SerializeLayerTracker is implemented by the SerializeBuffers which keep
+// track of the layers serialized into them, like the default implementation.
+// SerializeLayers pushes each layer once serialized, so that the layers
+// wrapping it can tell what they wrap.
+type SerializeLayerTracker interface {
+	// Layers returns the types of the layers serialized into the buffer since
+	// it was last cleared, from the innermost one out.
+	Layers() []LayerType
+	// PushLayer records that a layer of the given type was serialized into
+	// the buffer.
+	PushLayer(LayerType)
+}
+
 type serializeBuffer struct {
 	data                []byte
 	start               int
 	prepended, appended int
+	layers              []LayerType
 }
 
 // NewSerializeBuffer creates a new instance of the default implementation of
@@ -169,9 +183,18 @@ func (w *serializeBuffer) AppendBytes(num int) ([]byte, error) {
 func (w *serializeBuffer) Clear() error {
 	w.start = w.prepended
 	w.data = w.data[:w.start]
+	w.layers = w.layers[:0]
 	return nil
 }
 
+func (w *serializeBuffer) Layers() []LayerType {
+	return w.layers
+}
+
+func (w *serializeBuffer) PushLayer(l LayerType) {
+	w.layers = append(w.layers, l)
+}
+
 // SerializeLayers clears the given write buffer, then writes all layers into it so
 // they correctly wrap each other.  Note that by clearing the buffer, it
 // invalidates all slices previously returned by w.Bytes()
@@ -185,12 +208,18 @@ func (w *serializeBuffer) Clear() error {
 //   secondPayload := buf.Bytes()  // contains byte representation of d(e(f)). firstPayload is now invalidated, since the SerializeLayers call Clears buf.
 func SerializeLayers(w SerializeBuffer, opts SerializeOptions, layers ...SerializableLayer) error {
 	w.Clear()
+	tracker, _ := w.(SerializeLayerTracker)
 	for i := len(layers) - 1; i >= 0; i-- {
 		layer := layers[i]
 		err := layer.SerializeTo(w, opts)
 		if err != nil {
 			return err
 		}
+		if l, ok := layer.(interface {
+			LayerType() LayerType
+		}); ok && tracker != nil {
+			tracker.PushLayer(l.LayerType())
+		}
 	}
 	return nil
 }
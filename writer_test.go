@@ -92,3 +92,18 @@ func ExampleSerializeBuffer() {
 	// 6: []
 	// 7: [9 9]
 }
+
+func TestSerializeLayersTracked(t *testing.T) {
+	b := NewSerializeBuffer()
+	if err := SerializeLayers(b, SerializeOptions{}, Payload{1}, Payload{2}); err != nil {
+		t.Fatal(err)
+	}
+	ls := b.(SerializeLayerTracker).Layers()
+	if len(ls) != 2 || ls[0] != LayerTypePayload || ls[1] != LayerTypePayload {
+		t.Errorf("got layers %v, want 2 payloads", ls)
+	}
+	b.Clear()
+	if ls := b.(SerializeLayerTracker).Layers(); len(ls) != 0 {
+		t.Errorf("got layers %v after Clear", ls)
+	}
+}